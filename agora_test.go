@@ -3,6 +3,7 @@ package agora
 import (
 	"bufio"
 	"bytes"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -27,12 +28,32 @@ import (
 // * long: if true, this test is skipped if the -short flag is set
 // * args: the command-line arguments to pass to the test file
 // * error: the expected error message (omit if no error is expected)
+//
+// The coverage of the source files can be recorded using the -agora.coverprofile
+// flag, which writes a profile in the same format as `go test -coverprofile`,
+// and the -agora.coverhtml flag, which writes an HTML report.
 
 const (
 	srcDir = "./testdata/src"
 )
 
+var (
+	coverProfile = flag.String("agora.coverprofile", "", "write the coverage profile of the agora source files to this file")
+	coverHTML    = flag.String("agora.coverhtml", "", "write the HTML coverage report of the agora source files to this file")
+
+	// The coverage recorder, shared by all source files
+	coverage *runtime.Coverage
+)
+
 func TestSourceFiles(t *testing.T) {
+	// Output files are relative to the initial working directory
+	profNm, htmlNm := absPath(*coverProfile), absPath(*coverHTML)
+	if profNm != "" || htmlNm != "" {
+		coverage = runtime.NewCoverage()
+		defer func() {
+			coverage = nil
+		}()
+	}
 	// Change working directory to where the source files are
 	os.Chdir(srcDir)
 	fis, err := ioutil.ReadDir(".")
@@ -44,15 +65,49 @@ func TestSourceFiles(t *testing.T) {
 			testFile(t, fi)
 		}
 	}
+	if profNm != "" {
+		writeCoverage(t, profNm, func(w io.Writer) error {
+			return coverage.WriteProfile(w, new(runtime.FileResolver))
+		})
+	}
+	if htmlNm != "" {
+		writeCoverage(t, htmlNm, func(w io.Writer) error {
+			return coverage.WriteHTML(w, new(runtime.FileResolver))
+		})
+	}
+	if coverage != nil {
+		fmt.Printf("agora coverage: %.1f%% of instructions\n", coverage.Percent())
+	}
+}
+
+func absPath(nm string) string {
+	if nm == "" {
+		return ""
+	}
+	abs, err := filepath.Abs(nm)
+	if err != nil {
+		panic(err)
+	}
+	return abs
+}
+
+func writeCoverage(t *testing.T, nm string, fn func(io.Writer) error) {
+	f, err := os.Create(nm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := fn(f); err != nil {
+		t.Errorf("failed to write coverage to %s: %s", nm, err)
+	}
 }
 
 func testFile(t *testing.T, fi os.FileInfo) {
-	f, e := os.Open(fi.Name())
+	b, e := ioutil.ReadFile(fi.Name())
 	if e != nil {
 		panic(e)
 	}
-	defer f.Close()
-	s := bufio.NewScanner(f)
+	s := bufio.NewScanner(bytes.NewReader(b))
 	m := readFrontMatter(s)
 	if len(m) == 0 {
 		if testing.Verbose() {
@@ -60,15 +115,6 @@ func testFile(t *testing.T, fi os.FileInfo) {
 		}
 		return
 	}
-	// Keep the rest of the file in a reader
-	buf := bytes.NewBuffer(nil)
-	for s.Scan() {
-		buf.WriteString(s.Text())
-		buf.WriteString("\n")
-	}
-	if s.Err() != nil {
-		panic(s.Err())
-	}
 	// And actually run and test the file
 	if _, ok := m["long"]; ok {
 		if testing.Short() {
@@ -81,7 +127,9 @@ func testFile(t *testing.T, fi os.FileInfo) {
 	if testing.Verbose() {
 		fmt.Printf("testing file %s...\n", fi.Name())
 	}
-	runAndAssertFile(t, strings.TrimSuffix(fi.Name(), filepath.Ext(fi.Name())), bytes.NewReader(buf.Bytes()), m)
+	// The whole file is compiled (the front matter is a comment), so that the
+	// line numbers match the source file.
+	runAndAssertFile(t, strings.TrimSuffix(fi.Name(), filepath.Ext(fi.Name())), bytes.NewReader(b), m)
 }
 
 type testResolver struct {
@@ -106,6 +154,7 @@ func runAndAssertFile(t *testing.T, id string, r io.Reader, m map[string]string)
 		new(runtime.FileResolver),
 	}, new(compiler.Compiler))
 	ctx.Stdout = buf
+	ctx.Coverage = coverage
 	ctx.RegisterNativeModule(new(stdlib.FilepathMod))
 	ctx.RegisterNativeModule(new(stdlib.FmtMod))
 	ctx.RegisterNativeModule(new(stdlib.MathMod))
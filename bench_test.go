@@ -0,0 +1,124 @@
+package agora
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/agora/compiler"
+	"github.com/PuerkitoBio/agora/runtime"
+)
+
+// These benchmarks measure the virtual machine on compute-heavy code. Each
+// source returns a function, which is called with the benchmark's argument
+// on every iteration, so that the compilation and the module's execution are
+// not part of the measure.
+var benchcases = map[string]string{
+	"fib": `
+func Fib(n) {
+  if n < 2 {
+    return 1
+  }
+  return Fib(n-1) + Fib(n-2)
+}
+return Fib`,
+	"call": `
+func add(x, y) {
+  return x + y
+}
+return func(n) {
+  sum := 0
+  for i := 0; i < n; i++ {
+    sum = add(sum, i)
+  }
+  return sum
+}`,
+	"loop": `
+return func(n) {
+  sum := 0
+  for i := 0; i < n; i++ {
+    if i % 3 == 0 {
+      sum += i * 2
+    } else {
+      sum -= 1
+    }
+  }
+  return sum
+}`,
+	"records": `
+return func(n) {
+  sum := 0
+  for i := 0; i < n; i++ {
+    p := {x: i, y: 2, name: "p"}
+    p.z = p.x * p.y
+    sum += p.z
+  }
+  return sum
+}`,
+	"range": `
+return func(n) {
+  sum := 0
+  for i := range n {
+    for j := range 10 {
+      sum += j
+    }
+  }
+  return sum
+}`,
+	"fields": `
+return func(n) {
+  o := {x: 0, y: 1}
+  o.inc = func(d) {
+    this.x += d
+    return this.x
+  }
+  for i := 0; i < n; i++ {
+    o.y = o.x + o.y
+    o.inc(1)
+  }
+  return o.x
+}`,
+}
+
+func benchmarkSource(b *testing.B, nm string, arg int) {
+	ctx := runtime.NewCtx(&testResolver{
+		strings.NewReader(benchcases[nm]),
+		new(runtime.FileResolver),
+	}, new(compiler.Compiler))
+	mod, err := ctx.Load(nm)
+	if err != nil {
+		b.Fatal(err)
+	}
+	v, err := mod.Run()
+	if err != nil {
+		b.Fatal(err)
+	}
+	fn := v.(runtime.Func)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fn.Call(nil, runtime.Number(arg))
+	}
+}
+
+func BenchmarkFib(b *testing.B) {
+	benchmarkSource(b, "fib", 20)
+}
+
+func BenchmarkCall(b *testing.B) {
+	benchmarkSource(b, "call", 10000)
+}
+
+func BenchmarkLoop(b *testing.B) {
+	benchmarkSource(b, "loop", 10000)
+}
+
+func BenchmarkRecords(b *testing.B) {
+	benchmarkSource(b, "records", 10000)
+}
+
+func BenchmarkRange(b *testing.B) {
+	benchmarkSource(b, "range", 1000)
+}
+
+func BenchmarkFields(b *testing.B) {
+	benchmarkSource(b, "fields", 10000)
+}
@@ -0,0 +1,174 @@
+package bytecode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The binary signature that must be present at the start of each bundle file.
+const (
+	_BUNDLE_SIGNATURE int32 = 0x000A602B
+)
+
+var (
+	// Error returned when the entry point of a bundle is not one of its modules.
+	ErrBundleEntry = errors.New("the bundle entry point is not one of its modules")
+
+	// Error returned when a bundle holds many modules with the same identifier.
+	ErrBundleDuplicate = errors.New("the bundle holds many modules with the same identifier")
+)
+
+// A Bundle is an in-memory representation of a bundle file, that packs the
+// bytecode of the modules of a program, as defined in /doc/bytecode.md.
+type Bundle struct {
+	Entry string // the identifier of the module that starts the program
+	Mods  []*BundleMod
+}
+
+// A BundleMod is a module of a bundle, with its identifier in the bundle.
+type BundleMod struct {
+	ID   string
+	File *File
+}
+
+// Mod returns the bytecode file of the module identified by id in the bundle,
+// or nil if there is no such module.
+func (b *Bundle) Mod(id string) *File {
+	for _, m := range b.Mods {
+		if m.ID == id {
+			return m.File
+		}
+	}
+	return nil
+}
+
+// Check that the identifiers of the modules are unique, and that the entry
+// point is one of them.
+func (b *Bundle) check() error {
+	ids := make(map[string]bool, len(b.Mods))
+	for _, m := range b.Mods {
+		if ids[m.ID] {
+			return ErrBundleDuplicate
+		}
+		ids[m.ID] = true
+	}
+	if !ids[b.Entry] {
+		return ErrBundleEntry
+	}
+	return nil
+}
+
+// IsBundle checks if the provided reader reads from a bundle file. It checks if
+// the agora bundle signature is present at the start of the data.
+func IsBundle(rs io.ReadSeeker) bool {
+	var i int32
+	defer rs.Seek(0, 0)
+	if err := binary.Read(rs, binary.LittleEndian, &i); err != nil {
+		return false
+	}
+	return i == _BUNDLE_SIGNATURE
+}
+
+// EncodeBundle encodes the provided in-memory Bundle structure into the bundle
+// format, written to the encoder's writer. Each module is encoded in the
+// bytecode format, including its signature if it is signed.
+func (enc *Encoder) EncodeBundle(b *Bundle) error {
+	// Reset error
+	enc.err = b.check()
+	// 1- Signature and version
+	enc.write(_BUNDLE_SIGNATURE)
+	enc.write(encodeVersionByte(_MAJOR_VERSION, _MINOR_VERSION))
+	// 2- Entry point and number of modules
+	enc.write(b.Entry)
+	enc.write(int64(len(b.Mods)))
+	// 3- Each module, as its identifier and its bytecode
+	for _, m := range b.Mods {
+		buf := bytes.NewBuffer(nil)
+		enc.guard(func() {
+			enc.err = NewEncoder(buf).Encode(m.File)
+		})
+		enc.write(m.ID)
+		enc.write(int64(buf.Len()))
+		enc.write(buf.Bytes())
+	}
+	return enc.err
+}
+
+// DecodeBundle reads the bundle-encoded source into an in-memory data structure,
+// and returns the Bundle structure containing the decoded modules, or an error.
+func (dec *Decoder) DecodeBundle() (*Bundle, error) {
+	// 1- Read and assert the signature and version
+	sig := dec.readSignature()
+	if dec.err != nil || sig != _BUNDLE_SIGNATURE {
+		return nil, ErrInvalidData
+	}
+	dec.assertVersion(dec.readByte())
+	// 2- Read the entry point and the modules
+	b := &Bundle{Entry: dec.readString()}
+	n := dec.readInt64()
+	for i := int64(0); i < n && dec.err == nil; i++ {
+		m := &BundleMod{ID: dec.readString()}
+		l := dec.readInt64()
+		dec.guard(func() {
+			if l <= 0 {
+				dec.err = ErrInvalidData
+			}
+		})
+		dec.guard(func() {
+			// The bytecode is decoded from a limited reader, so that a signature
+			// must end at the end of the module.
+			m.File, dec.err = NewDecoder(io.LimitReader(dec.r, l)).Decode()
+		})
+		b.Mods = append(b.Mods, m)
+	}
+	dec.assertEnd()
+	dec.guard(func() {
+		dec.err = b.check()
+	})
+	if dec.err == io.EOF || dec.err == io.ErrUnexpectedEOF {
+		// The bundle is truncated
+		return nil, ErrInvalidData
+	}
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	return b, nil
+}
+
+// Imports returns the identifiers of the modules imported by the bytecode file,
+// in order of appearance, via calls to the `import` built-in function with a
+// literal string argument (as compiled by the agora compiler, the instructions
+// GETG import, LOADK and CALL in sequence). The other imports are ignored, as
+// the identifier is only known at runtime.
+func Imports(f *File) []string {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, fn := range f.Fns {
+		isK := func(ix int, s string) (string, bool) {
+			if ix >= len(fn.Ks) || fn.Ks[ix].Type != KtString {
+				return "", false
+			}
+			v, ok := fn.Ks[ix].Val.(string)
+			return v, ok && (s == "" || v == s)
+		}
+		for j := 2; j < len(fn.Is); j++ {
+			g, k, c := fn.Is[j-2], fn.Is[j-1], fn.Is[j]
+			if g.Opcode() != OP_GETG || k.Opcode() != OP_LOADK || c.Opcode() != OP_CALL {
+				continue
+			}
+			if k.A() != g.A()+1 || c.A() != g.A() || c.B() != 1 {
+				continue
+			}
+			if _, ok := isK(g.Bx(), "import"); !ok {
+				continue
+			}
+			if id, ok := isK(k.Bx(), ""); ok && !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
@@ -0,0 +1,108 @@
+package bytecode
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"reflect"
+	"testing"
+)
+
+// Return a bytecode file named nm that imports the modules ids, as compiled by
+// the agora compiler.
+func importFile(nm string, ids ...string) *File {
+	f := NewFile(nm)
+	fn := &Fn{
+		Header: H{Name: nm, StackSz: 2},
+		Ks:     []*K{{KtString, "import"}},
+	}
+	for _, id := range ids {
+		fn.Ks = append(fn.Ks, &K{KtString, id})
+		fn.Is = append(fn.Is,
+			NewInstrBx(OP_GETG, 0, 0),
+			NewInstrBx(OP_LOADK, 1, len(fn.Ks)-1),
+			NewInstr(OP_CALL, 0, 1, 0))
+	}
+	fn.Is = append(fn.Is, NewInstr(OP_RET, 0, 0, 0))
+	f.Fns = []*Fn{fn}
+	return f
+}
+
+func TestBundle(t *testing.T) {
+	_, priv := signKey(1)
+	signed := importFile("lib/b")
+	if err := Sign(signed, priv); err != nil {
+		t.Fatal(err)
+	}
+	b := &Bundle{
+		Entry: "main",
+		Mods: []*BundleMod{
+			{ID: "main", File: importFile("main", "fmt", "./lib/b")},
+			{ID: "lib/b", File: signed},
+		},
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := NewEncoder(buf).EncodeBundle(b); err != nil {
+		t.Fatal(err)
+	}
+	if !IsBundle(bytes.NewReader(buf.Bytes())) || IsBytecode(bytes.NewReader(buf.Bytes())) {
+		t.Errorf("expected a bundle, not bytecode")
+	}
+	db, err := NewDecoder(bytes.NewReader(buf.Bytes())).DecodeBundle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Entry != b.Entry || len(db.Mods) != len(b.Mods) {
+		t.Fatalf("expected entry %s with %d modules, got %s with %d", b.Entry, len(b.Mods), db.Entry, len(db.Mods))
+	}
+	for i, m := range b.Mods {
+		if db.Mods[i].ID != m.ID || !equal(db.Mods[i].File, m.File) {
+			t.Errorf("[%d] - expected module %s to be decoded", i, m.ID)
+		}
+	}
+	if err := NewKeyring(priv.Public().(ed25519.PublicKey)).Verify(db.Mod("lib/b")); err != nil {
+		t.Errorf("expected the signature to be preserved, got %s", err)
+	}
+	if db.Mod("x") != nil {
+		t.Errorf("expected no module x")
+	}
+
+	// Invalid bundles
+	data := buf.Bytes()
+	cases := []struct {
+		b   []byte
+		err error
+	}{
+		0: {b: data[:len(data)-1], err: ErrInvalidData},
+		1: {b: append(data[:len(data):len(data)], 0), err: ErrInvalidData},
+		2: {b: data[:3], err: ErrInvalidData},
+		3: {b: nil, err: ErrInvalidData},
+	}
+	for i, c := range cases {
+		if _, err := NewDecoder(bytes.NewReader(c.b)).DecodeBundle(); err != c.err {
+			t.Errorf("[%d] - expected error %v, got %v", i, c.err, err)
+		}
+	}
+	b.Entry = "x"
+	if err := NewEncoder(buf).EncodeBundle(b); err != ErrBundleEntry {
+		t.Errorf("expected error %v, got %v", ErrBundleEntry, err)
+	}
+	b.Entry, b.Mods[1].ID = "main", "main"
+	if err := NewEncoder(buf).EncodeBundle(b); err != ErrBundleDuplicate {
+		t.Errorf("expected error %v, got %v", ErrBundleDuplicate, err)
+	}
+}
+
+func TestImports(t *testing.T) {
+	f := importFile("main", "fmt", "./lib/b", "fmt")
+	// Not an import: the argument is a register, not a constant
+	f.Fns[0].Is = append([]Instr{
+		NewInstrBx(OP_GETG, 0, 0),
+		NewInstr(OP_MOVE, 1, 0, 0),
+		NewInstr(OP_CALL, 0, 1, 0),
+	}, f.Fns[0].Is...)
+	f.Fns = append(f.Fns, importFile("f", "c").Fns[0])
+	exp := []string{"fmt", "./lib/b", "c"}
+	if got := Imports(f); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v, got %v", exp, got)
+	}
+}
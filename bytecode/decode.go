@@ -1,9 +1,12 @@
 package bytecode
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"encoding/binary"
 	"errors"
 	"io"
+	"math"
 )
 
 var (
@@ -11,6 +14,24 @@ var (
 	ErrInvalidData = errors.New("input data is not valid bytecode")
 )
 
+const (
+	// The maximum number of items of a section, or of bytes of a string.
+	maxCount = math.MaxInt32
+
+	// The maximum number of items allocated before they are read, so that a
+	// count larger than the input fails on the missing data, not on the
+	// allocation.
+	maxPrealloc = 1 << 10
+)
+
+// Return the number of items to allocate for a section of n items.
+func prealloc(n int64) int {
+	if n > maxPrealloc {
+		return maxPrealloc
+	}
+	return int(n)
+}
+
 // A Decoder reads a bytecode-encoded source into a structured representation in memory.
 type Decoder struct {
 	r   io.Reader
@@ -26,10 +47,10 @@ func NewDecoder(r io.Reader) *Decoder {
 // It checks if the agora bytecode signature is present at the start of the data.
 func IsBytecode(rs io.ReadSeeker) bool {
 	var i int32
+	defer rs.Seek(0, 0)
 	if err := binary.Read(rs, binary.LittleEndian, &i); err != nil {
 		return false
 	}
-	defer rs.Seek(0, 0)
 	return i == _SIGNATURE
 }
 
@@ -49,7 +70,7 @@ func (dec *Decoder) Decode() (*File, error) {
 	f := new(File)
 	f.MajorVersion, f.MinorVersion = decodeVersionByte(ver)
 	for {
-		fn, ok := dec.readFunc()
+		fn, ok := dec.readFunc(f)
 		if !ok {
 			break
 		}
@@ -105,8 +126,48 @@ func (dec *Decoder) assertOpcode(ins Instr) {
 	})
 }
 
-func (dec *Decoder) readFunc() (*Fn, bool) {
-	nm := dec.readString()
+func (dec *Decoder) assertEnd() {
+	dec.guard(func() {
+		var b [1]byte
+		if n, _ := dec.r.Read(b[:]); n > 0 {
+			dec.err = ErrInvalidData
+		}
+	})
+}
+
+func (dec *Decoder) assertCount(n int64) {
+	dec.guard(func() {
+		if n < 0 || n > maxCount {
+			dec.err = ErrInvalidData
+		}
+	})
+}
+
+func (dec *Decoder) assertLines(fn *Fn) {
+	dec.guard(func() {
+		if len(fn.Ns) > 0 && len(fn.Ns) != len(fn.Is) {
+			dec.err = ErrInvalidLineTable
+		}
+	})
+}
+
+func (dec *Decoder) readFunc(f *File) (*Fn, bool) {
+	l := dec.readInt64()
+	if dec.err != nil {
+		return nil, false
+	}
+	if l == sigMarker {
+		// The signature section, that must be at the end of the file
+		f.Signature = &Signature{KeyID: dec.readString()}
+		f.Signature.Sig = make([]byte, ed25519.SignatureSize)
+		dec.read(f.Signature.Sig)
+		dec.assertEnd()
+		return nil, false
+	}
+	nm := dec.readStringN(l)
+	if dec.err == io.EOF || dec.err == io.ErrUnexpectedEOF {
+		dec.err = ErrInvalidData
+	}
 	if dec.err != nil {
 		return nil, false
 	}
@@ -121,32 +182,59 @@ func (dec *Decoder) readFunc() (*Fn, bool) {
 	fn.Header.LineEnd = dec.readInt64()
 
 	// K section
-	ks := dec.readInt64()
+	ks := dec.readCount()
 	if ks > 0 {
-		fn.Ks = make([]*K, ks)
-		for i := int64(0); i < ks; i++ {
-			fn.Ks[i] = dec.readK()
+		fn.Ks = make([]*K, 0, prealloc(ks))
+		for i := int64(0); i < ks && dec.err == nil; i++ {
+			fn.Ks = append(fn.Ks, dec.readK())
 		}
 	}
 
 	// L section
-	ls := dec.readInt64()
+	ls := dec.readCount()
 	if ls > 0 {
-		fn.Ls = make([]int64, ls)
-		for i := int64(0); i < ls; i++ {
-			fn.Ls[i] = dec.readInt64()
+		fn.Ls = make([]int64, 0, prealloc(ls))
+		for i := int64(0); i < ls && dec.err == nil; i++ {
+			fn.Ls = append(fn.Ls, dec.readInt64())
+		}
+	}
+
+	// U section
+	us := dec.readCount()
+	if us > 0 {
+		fn.Us = make([]U, 0, prealloc(us))
+		for i := int64(0); i < us && dec.err == nil; i++ {
+			var u U
+			u.Local = dec.readInt64() != 0
+			u.Ix = dec.readInt64()
+			fn.Us = append(fn.Us, u)
 		}
 	}
 
 	// I section
-	is := dec.readInt64()
+	is := dec.readCount()
 	if is > 0 {
-		fn.Is = make([]Instr, is)
-		for i := int64(0); i < is; i++ {
-			fn.Is[i] = Instr(dec.readUInt64())
-			dec.assertOpcode(fn.Is[i])
+		fn.Is = make([]Instr, 0, prealloc(is))
+		for i := int64(0); i < is && dec.err == nil; i++ {
+			ins := Instr(dec.readUInt64())
+			dec.assertOpcode(ins)
+			fn.Is = append(fn.Is, ins)
 		}
 	}
+
+	// N section
+	ns := dec.readCount()
+	if ns > 0 {
+		fn.Ns = make([]int64, 0, prealloc(ns))
+		for i := int64(0); i < ns && dec.err == nil; i++ {
+			fn.Ns = append(fn.Ns, dec.readInt64())
+		}
+	}
+	dec.assertLines(fn)
+	if dec.err == io.EOF || dec.err == io.ErrUnexpectedEOF {
+		// The function is truncated
+		dec.err = ErrInvalidData
+	}
 	return fn, true
 }
 
@@ -173,13 +261,32 @@ func (dec *Decoder) readByte() byte {
 }
 
 func (dec *Decoder) readString() string {
-	l := dec.readInt64()
-	if l <= 0 {
+	return dec.readStringN(dec.readInt64())
+}
+
+func (dec *Decoder) readStringN(l int64) string {
+	dec.assertCount(l)
+	if l <= 0 || dec.err != nil {
 		return ""
 	}
-	buf := make([]byte, l)
-	dec.read(buf)
-	return string(buf)
+	// The buffer grows with the data actually read, so that a length beyond
+	// the end of the input is not allocated
+	buf := bytes.NewBuffer(make([]byte, 0, prealloc(l)))
+	dec.guard(func() {
+		var n int64
+		n, dec.err = io.CopyN(buf, dec.r, l)
+		if dec.err == io.EOF && n > 0 {
+			dec.err = io.ErrUnexpectedEOF
+		}
+	})
+	return buf.String()
+}
+
+// Read the number of items of a section.
+func (dec *Decoder) readCount() int64 {
+	n := dec.readInt64()
+	dec.assertCount(n)
+	return n
 }
 
 func (dec *Decoder) readInt64() int64 {
@@ -37,8 +37,8 @@ var (
 			src: AppendAny(SigVer(defMaj, defMin), Int64ToByteSlice(4), 't', 'e', 's', 't',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
 				Int64ToByteSlice(2), Int64ToByteSlice(3), ExpZeroInt64, Int64ToByteSlice(5), Int64ToByteSlice(6),
-				// Ks - Ls - Is
-				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64),
+				// Ks - Ls - Us - Is - Ns
+				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64),
 			exp: &File{
 				MajorVersion: defMaj,
 				MinorVersion: defMin,
@@ -62,8 +62,8 @@ var (
 			src: AppendAny(ExpSig, encodeVersionByte(2, 3), Int64ToByteSlice(4), 't', 'e', 's', 't',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
 				Int64ToByteSlice(2), Int64ToByteSlice(3), ExpZeroInt64, Int64ToByteSlice(5), Int64ToByteSlice(6),
-				// Ks - Ls - Is
-				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64),
+				// Ks - Ls - Us - Is - Ns
+				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64),
 			err: ErrVersionMismatch,
 		},
 		3: {
@@ -73,8 +73,8 @@ var (
 			src: AppendAny(SigVer(defMaj, defMin), Int64ToByteSlice(4), 't', 'e', 's', 't',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
 				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64,
-				// Ks - Ls - Is
-				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64),
+				// Ks - Ls - Us - Is - Ns
+				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64),
 			exp: &File{
 				MajorVersion: defMaj,
 				MinorVersion: defMin,
@@ -86,8 +86,8 @@ var (
 			src: AppendAny(SigVer(defMaj, defMin), Int64ToByteSlice(4), 't', 'e', 's', 't',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
 				Int64ToByteSlice(2), Int64ToByteSlice(3), ExpZeroInt64, Int64ToByteSlice(5), Int64ToByteSlice(6),
-				// Ks - Ls - Is
-				Int64ToByteSlice(1), byte(KtInteger), Int64ToByteSlice(7), ExpZeroInt64, ExpZeroInt64),
+				// Ks - Ls - Us - Is - Ns
+				Int64ToByteSlice(1), byte(KtInteger), Int64ToByteSlice(7), ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64),
 			exp: &File{
 				MajorVersion: defMaj,
 				MinorVersion: defMin,
@@ -117,8 +117,8 @@ var (
 			src: AppendAny(SigVer(defMaj, defMin), Int64ToByteSlice(4), 't', 'e', 's', 't',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
 				Int64ToByteSlice(2), Int64ToByteSlice(3), ExpZeroInt64, Int64ToByteSlice(5), Int64ToByteSlice(6),
-				// Ks - Ls - Is
-				Int64ToByteSlice(1), 'z', Int64ToByteSlice(7), ExpZeroInt64, ExpZeroInt64),
+				// Ks - Ls - Us - Is - Ns
+				Int64ToByteSlice(1), 'z', Int64ToByteSlice(7), ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64),
 			err: ErrInvalidKType,
 		},
 		6: {
@@ -135,10 +135,12 @@ var (
 			src: AppendAny(SigVer(defMaj, defMin), Int64ToByteSlice(4), 't', 'e', 's', 't',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
 				Int64ToByteSlice(2), Int64ToByteSlice(3), ExpZeroInt64, Int64ToByteSlice(5), Int64ToByteSlice(6),
-				// Ks - Ls - Is
-				Int64ToByteSlice(1), byte(KtInteger), Int64ToByteSlice(7), ExpZeroInt64, Int64ToByteSlice(2),
+				// Ks - Ls - Us - Is - Ns
+				Int64ToByteSlice(1), byte(KtInteger), Int64ToByteSlice(7), ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(2),
 				// 2 Ops
-				0x0C, 0x00, 0x00, 0x00, 0x00, 0x00, byte(FLG_K), byte(OP_ADD), 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, byte(FLG_Sn), byte(OP_DUMP)),
+				0x03, 0x00, 0x20, 0x00, 0x00, 0x01, 0x00, byte(OP_ADD), 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, byte(OP_DUMP),
+				// Ns
+				ExpZeroInt64),
 			exp: &File{
 				MajorVersion: defMaj,
 				MinorVersion: defMin,
@@ -159,8 +161,8 @@ var (
 							},
 						},
 						Is: []Instr{
-							NewInstr(OP_ADD, FLG_K, 12),
-							NewInstr(OP_DUMP, FLG_Sn, 0),
+							NewInstr(OP_ADD, 1, 2, 3),
+							NewInstrBx(OP_DUMP, 0, 0),
 						},
 					},
 				}},
@@ -172,10 +174,12 @@ var (
 			src: AppendAny(SigVer(defMaj, defMin), Int64ToByteSlice(4), 't', 'e', 's', 't',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
 				Int64ToByteSlice(2), Int64ToByteSlice(3), ExpZeroInt64, Int64ToByteSlice(5), Int64ToByteSlice(6),
-				// Ks - Ls - Is
-				Int64ToByteSlice(1), byte(KtInteger), Int64ToByteSlice(7), ExpZeroInt64, Int64ToByteSlice(2),
+				// Ks - Ls - Us - Is - Ns
+				Int64ToByteSlice(1), byte(KtInteger), Int64ToByteSlice(7), ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(2),
 				// 2 ops
-				0x0C, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09, byte(op_max)),
+				0x0C, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09, byte(op_max),
+				// Ns
+				ExpZeroInt64),
 			err: ErrUnknownOpcode,
 		},
 		9: {
@@ -185,18 +189,22 @@ var (
 			src: AppendAny(SigVer(defMaj, defMin), Int64ToByteSlice(4), 't', 'e', 's', 't',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
 				Int64ToByteSlice(2), Int64ToByteSlice(3), ExpZeroInt64, Int64ToByteSlice(5), Int64ToByteSlice(6),
-				// Ks - Ls - Is
-				Int64ToByteSlice(1), byte(KtInteger), Int64ToByteSlice(7), ExpZeroInt64, Int64ToByteSlice(2),
+				// Ks - Ls - Us - Is - Ns
+				Int64ToByteSlice(1), byte(KtInteger), Int64ToByteSlice(7), ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(2),
 				// 2 ops
-				0x0C, 0x00, 0x00, 0x00, 0x00, 0x00, byte(FLG_K), byte(OP_ADD), 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, byte(FLG_Sn), byte(OP_DUMP),
+				0x03, 0x00, 0x20, 0x00, 0x00, 0x01, 0x00, byte(OP_ADD), 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, byte(OP_DUMP),
+				// Ns
+				ExpZeroInt64,
 				// 2nd Fn
 				Int64ToByteSlice(2), 'f', '2',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
 				Int64ToByteSlice(2), Int64ToByteSlice(3), Int64ToByteSlice(0), Int64ToByteSlice(5), Int64ToByteSlice(6),
-				// Ks - Ls - Is
-				Int64ToByteSlice(1), byte(KtString), Int64ToByteSlice(5), 'c', 'o', 'n', 's', 't', ExpZeroInt64, Int64ToByteSlice(1),
+				// Ks - Ls - Us - Is - Ns
+				Int64ToByteSlice(1), byte(KtString), Int64ToByteSlice(5), 'c', 'o', 'n', 's', 't', ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(1),
 				// 1 op
-				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00),
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				// Ns
+				ExpZeroInt64),
 			exp: &File{
 				MajorVersion: defMaj,
 				MinorVersion: defMin,
@@ -217,8 +225,8 @@ var (
 							},
 						},
 						Is: []Instr{
-							NewInstr(OP_ADD, FLG_K, 12),
-							NewInstr(OP_DUMP, FLG_Sn, 0),
+							NewInstr(OP_ADD, 1, 2, 3),
+							NewInstrBx(OP_DUMP, 0, 0),
 						},
 					},
 					&Fn{
@@ -237,11 +245,164 @@ var (
 							},
 						},
 						Is: []Instr{
-							NewInstr(OP_RET, FLG__, 0),
+							NewInstr(OP_RET, 0, 0, 0),
 						},
 					},
 				}},
 		},
+		10: {
+			// Function with line numbers
+			maj: defMaj,
+			min: defMin,
+			src: AppendAny(SigVer(defMaj, defMin), Int64ToByteSlice(4), 't', 'e', 's', 't',
+				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
+				Int64ToByteSlice(1), ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(3), Int64ToByteSlice(4),
+				// Ks - Ls - Us - Is - Ns
+				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(2),
+				// 2 ops
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, byte(OP_LOADN), 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, byte(OP_RET),
+				// Ns
+				Int64ToByteSlice(2), Int64ToByteSlice(3), Int64ToByteSlice(4)),
+			exp: &File{
+				MajorVersion: defMaj,
+				MinorVersion: defMin,
+				Name:         "test", Fns: []*Fn{
+					&Fn{
+						Header: H{
+							Name:      "test",
+							StackSz:   1,
+							LineStart: 3,
+							LineEnd:   4,
+						},
+						Is: []Instr{
+							NewInstr(OP_LOADN, 0, 0, 0),
+							NewInstr(OP_RET, 0, 0, 0),
+						},
+						Ns: []int64{3, 4},
+					},
+				}},
+		},
+		11: {
+			// Line numbers do not match instructions
+			maj: defMaj,
+			min: defMin,
+			src: AppendAny(SigVer(defMaj, defMin), Int64ToByteSlice(4), 't', 'e', 's', 't',
+				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
+				Int64ToByteSlice(1), ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(3), Int64ToByteSlice(4),
+				// Ks - Ls - Us - Is - Ns
+				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(1),
+				// 1 op
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, byte(OP_RET),
+				// Ns
+				Int64ToByteSlice(2), Int64ToByteSlice(3), Int64ToByteSlice(4)),
+			err: ErrInvalidLineTable,
+		},
+		12: {
+			// Function with locals and upvalues
+			maj: defMaj,
+			min: defMin,
+			src: AppendAny(SigVer(defMaj, defMin), Int64ToByteSlice(4), 't', 'e', 's', 't',
+				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
+				Int64ToByteSlice(1), ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64,
+				// Ks - Ls - Us - Is - Ns
+				Int64ToByteSlice(1), byte(KtString), Int64ToByteSlice(1), 'a', Int64ToByteSlice(1), ExpZeroInt64,
+				Int64ToByteSlice(2), Int64ToByteSlice(1), Int64ToByteSlice(3), ExpZeroInt64, Int64ToByteSlice(1), Int64ToByteSlice(1),
+				// 1 op
+				0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, byte(OP_GETU),
+				// Ns
+				ExpZeroInt64),
+			exp: &File{
+				MajorVersion: defMaj,
+				MinorVersion: defMin,
+				Name:         "test", Fns: []*Fn{
+					&Fn{
+						Header: H{
+							Name:    "test",
+							StackSz: 1,
+						},
+						Ks: []*K{
+							&K{
+								Type: KtString,
+								Val:  "a",
+							},
+						},
+						Ls: []int64{0},
+						Us: []U{{Local: true, Ix: 3}, {Local: false, Ix: 1}},
+						Is: []Instr{
+							NewInstr(OP_GETU, 0, 1, 0),
+						},
+					},
+				}},
+		},
+		13: {
+			// Oversized K count
+			maj: defMaj,
+			min: defMin,
+			src: AppendAny(SigVer(defMaj, defMin), Int64ToByteSlice(4), 't', 'e', 's', 't',
+				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
+				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64,
+				// Ks
+				Int64ToByteSlice(1<<50)),
+			err: ErrInvalidData,
+		},
+		14: {
+			// Negative U count
+			maj: defMaj,
+			min: defMin,
+			src: AppendAny(SigVer(defMaj, defMin), Int64ToByteSlice(4), 't', 'e', 's', 't',
+				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
+				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64,
+				// Ks - Ls - Us
+				ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(-2)),
+			err: ErrInvalidData,
+		},
+		15: {
+			// I count larger than the input
+			maj: defMaj,
+			min: defMin,
+			src: AppendAny(SigVer(defMaj, defMin), Int64ToByteSlice(4), 't', 'e', 's', 't',
+				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
+				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64,
+				// Ks - Ls - Us - Is
+				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(1<<30), UInt64ToByteSlice(uint64(OP_RET)<<56)),
+			err: ErrInvalidData,
+		},
+		16: {
+			// N count larger than the input
+			maj: defMaj,
+			min: defMin,
+			src: AppendAny(SigVer(defMaj, defMin), Int64ToByteSlice(4), 't', 'e', 's', 't',
+				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
+				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64,
+				// Ks - Ls - Us - Is - Ns
+				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(1<<20)),
+			err: ErrInvalidData,
+		},
+		17: {
+			// String length larger than the input
+			maj: defMaj,
+			min: defMin,
+			src: AppendAny(SigVer(defMaj, defMin), Int64ToByteSlice(4), 't', 'e', 's', 't',
+				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
+				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64,
+				// Ks
+				Int64ToByteSlice(1), byte(KtString), Int64ToByteSlice(1<<40), 'a'),
+			err: ErrInvalidData,
+		},
+		18: {
+			// Oversized name length
+			maj: defMaj,
+			min: defMin,
+			src: AppendAny(SigVer(defMaj, defMin), Int64ToByteSlice(1<<50), 't'),
+			err: ErrInvalidData,
+		},
+		19: {
+			// Truncated function header
+			maj: defMaj,
+			min: defMin,
+			src: AppendAny(SigVer(defMaj, defMin), Int64ToByteSlice(4), 't', 'e', 's', 't', ExpZeroInt64),
+			err: ErrInvalidData,
+		},
 	}
 
 	isolateDecCase = -1
@@ -341,6 +502,14 @@ func equal(f1, f2 *File) bool {
 				return false
 			}
 		}
+		if len(fn1.Us) != len(fn2.Us) {
+			return false
+		}
+		for j := 0; j < len(fn1.Us); j++ {
+			if fn1.Us[j] != fn2.Us[j] {
+				return false
+			}
+		}
 		if len(fn1.Is) != len(fn2.Is) {
 			return false
 		}
@@ -349,6 +518,14 @@ func equal(f1, f2 *File) bool {
 				return false
 			}
 		}
+		if len(fn1.Ns) != len(fn2.Ns) {
+			return false
+		}
+		for j := 0; j < len(fn1.Ns); j++ {
+			if fn1.Ns[j] != fn2.Ns[j] {
+				return false
+			}
+		}
 	}
 	return true
 }
@@ -1,6 +1,7 @@
 package bytecode
 
 import (
+	"crypto/ed25519"
 	"encoding/binary"
 	"errors"
 	"io"
@@ -12,6 +13,7 @@ var (
 	ErrUnexpectedKValType = errors.New("unexpected constant value type")
 	ErrInvalidKType       = errors.New("invalid constant type tag")
 	ErrUnknownOpcode      = errors.New("unknown instruction opcode")
+	ErrInvalidLineTable   = errors.New("line numbers do not match the instructions")
 )
 
 // An encoder takes an in-memory representation of agora code and encodes it into
@@ -64,12 +66,36 @@ func (enc *Encoder) Encode(f *File) (err error) {
 			enc.write(l)
 		}
 
-		// 7- The I section
+		// 7- The U section
+		enc.write(int64(len(fn.Us)))
+		for _, u := range fn.Us {
+			enc.write(u)
+		}
+
+		// 8- The I section
 		enc.write(int64(len(fn.Is)))
 		for _, ins := range fn.Is {
 			enc.assertOpcode(ins)
 			enc.write(uint64(ins))
 		}
+
+		// 9- The N section
+		enc.assertLines(fn)
+		enc.write(int64(len(fn.Ns)))
+		for _, n := range fn.Ns {
+			enc.write(n)
+		}
+	}
+	// 10- The signature section, if the file is signed
+	if sig := f.Signature; sig != nil {
+		enc.guard(func() {
+			if len(sig.Sig) != ed25519.SignatureSize {
+				enc.err = ErrInvalidSignature
+			}
+		})
+		enc.write(sigMarker)
+		enc.write(sig.KeyID)
+		enc.write(sig.Sig)
 	}
 	return enc.err
 }
@@ -89,6 +115,14 @@ func (enc *Encoder) assertOpcode(ins Instr) {
 	})
 }
 
+func (enc *Encoder) assertLines(fn *Fn) {
+	enc.guard(func() {
+		if len(fn.Ns) > 0 && len(fn.Ns) != len(fn.Is) {
+			enc.err = ErrInvalidLineTable
+		}
+	})
+}
+
 func (enc *Encoder) assertKType(kt KType) {
 	enc.guard(func() {
 		if _, ok := validKtypes[kt]; !ok {
@@ -108,6 +142,13 @@ func (enc *Encoder) assertVersion(f *File) {
 func (enc *Encoder) write(v interface{}) {
 	enc.guard(func() {
 		switch val := v.(type) {
+		case U:
+			if val.Local {
+				enc.write(int64(1))
+			} else {
+				enc.write(int64(0))
+			}
+			enc.write(val.Ix)
 		case *K:
 			enc.write(byte(val.Type))
 			switch kval := val.Val.(type) {
@@ -51,8 +51,8 @@ var (
 			exp: AppendAny(SigVer(_MAJOR_VERSION, _MINOR_VERSION), Int64ToByteSlice(4), 't', 'e', 's', 't',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
 				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64,
-				// Ks - Ls - Is
-				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64),
+				// Ks - Ls - Us - Is - Ns
+				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64),
 		},
 		4: {
 			maj: defMaj,
@@ -80,8 +80,8 @@ var (
 			exp: AppendAny(SigVer(_MAJOR_VERSION, _MINOR_VERSION), Int64ToByteSlice(4), 't', 'e', 's', 't',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
 				Int64ToByteSlice(2), Int64ToByteSlice(3), ExpZeroInt64, Int64ToByteSlice(5), Int64ToByteSlice(6),
-				// Ks - Ls - Is
-				Int64ToByteSlice(1), byte(KtInteger), Int64ToByteSlice(7), ExpZeroInt64, ExpZeroInt64),
+				// Ks - Ls - Us - Is - Ns
+				Int64ToByteSlice(1), byte(KtInteger), Int64ToByteSlice(7), ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64),
 		},
 		5: {
 			// Invalid KType
@@ -156,18 +156,20 @@ var (
 							},
 						},
 						Is: []Instr{
-							NewInstr(OP_ADD, FLG_K, 12),
-							NewInstr(OP_DUMP, FLG_Sn, 0),
+							NewInstr(OP_ADD, 1, 2, 3),
+							NewInstrBx(OP_DUMP, 0, 0),
 						},
 					},
 				}},
 			exp: AppendAny(SigVer(_MAJOR_VERSION, _MINOR_VERSION), Int64ToByteSlice(4), 't', 'e', 's', 't',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
 				Int64ToByteSlice(2), Int64ToByteSlice(3), Int64ToByteSlice(4), Int64ToByteSlice(5), Int64ToByteSlice(6),
-				// Ks - Ls - Is
-				Int64ToByteSlice(1), byte(KtInteger), Int64ToByteSlice(7), ExpZeroInt64, Int64ToByteSlice(2),
+				// Ks - Ls - Us - Is - Ns
+				Int64ToByteSlice(1), byte(KtInteger), Int64ToByteSlice(7), ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(2),
 				// 2 ops
-				0x0C, 0x00, 0x00, 0x00, 0x00, 0x00, byte(FLG_K), byte(OP_ADD), 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, byte(FLG_Sn), byte(OP_DUMP)),
+				0x03, 0x00, 0x20, 0x00, 0x00, 0x01, 0x00, byte(OP_ADD), 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, byte(OP_DUMP),
+				// Ns
+				ExpZeroInt64),
 		},
 		// Invalid opcode
 		8: {
@@ -191,7 +193,7 @@ var (
 							},
 						},
 						Is: []Instr{
-							NewInstr(Opcode(op_max+1), FLG_K, 12),
+							NewInstr(Opcode(op_max+1), 1, 2, 3),
 						},
 					},
 				}},
@@ -220,8 +222,8 @@ var (
 							},
 						},
 						Is: []Instr{
-							NewInstr(OP_ADD, FLG_K, 12),
-							NewInstr(OP_DUMP, FLG_Sn, 0),
+							NewInstr(OP_ADD, 1, 2, 3),
+							NewInstrBx(OP_DUMP, 0, 0),
 						},
 					},
 					&Fn{
@@ -240,25 +242,113 @@ var (
 							},
 						},
 						Is: []Instr{
-							NewInstr(OP_RET, FLG__, 0),
+							NewInstr(OP_RET, 0, 0, 0),
 						},
 					},
 				}},
 			exp: AppendAny(SigVer(_MAJOR_VERSION, _MINOR_VERSION), Int64ToByteSlice(4), 't', 'e', 's', 't',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
 				Int64ToByteSlice(2), Int64ToByteSlice(3), Int64ToByteSlice(4), Int64ToByteSlice(5), Int64ToByteSlice(6),
-				// Ks - Ls - Is
-				Int64ToByteSlice(1), byte(KtInteger), Int64ToByteSlice(7), ExpZeroInt64, Int64ToByteSlice(2),
+				// Ks - Ls - Us - Is - Ns
+				Int64ToByteSlice(1), byte(KtInteger), Int64ToByteSlice(7), ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(2),
 				// 2 ops
-				0x0C, 0x00, 0x00, 0x00, 0x00, 0x00, byte(FLG_K), byte(OP_ADD), 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, byte(FLG_Sn), byte(OP_DUMP),
+				0x03, 0x00, 0x20, 0x00, 0x00, 0x01, 0x00, byte(OP_ADD), 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, byte(OP_DUMP),
+				// Ns
+				ExpZeroInt64,
 				// Fn 2
 				Int64ToByteSlice(2), 'f', '2',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
 				Int64ToByteSlice(2), Int64ToByteSlice(3), ExpZeroInt64, Int64ToByteSlice(5), Int64ToByteSlice(6),
-				// Ks - Ls - Is
-				Int64ToByteSlice(1), byte(KtString), Int64ToByteSlice(5), 'c', 'o', 'n', 's', 't', ExpZeroInt64, Int64ToByteSlice(1),
+				// Ks - Ls - Us - Is - Ns
+				Int64ToByteSlice(1), byte(KtString), Int64ToByteSlice(5), 'c', 'o', 'n', 's', 't', ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(1),
 				// 1 op
-				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00),
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				// Ns
+				ExpZeroInt64),
+		},
+		10: {
+			// Function with line numbers
+			maj: defMaj,
+			min: defMin,
+			f: &File{
+				MajorVersion: defMaj,
+				MinorVersion: defMin,
+				Name:         "test", Fns: []*Fn{
+					&Fn{
+						Header: H{
+							StackSz:   1,
+							LineStart: 3,
+							LineEnd:   4,
+						},
+						Is: []Instr{
+							NewInstr(OP_LOADN, 0, 0, 0),
+							NewInstr(OP_RET, 0, 0, 0),
+						},
+						Ns: []int64{3, 4},
+					},
+				}},
+			exp: AppendAny(SigVer(_MAJOR_VERSION, _MINOR_VERSION), Int64ToByteSlice(4), 't', 'e', 's', 't',
+				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
+				Int64ToByteSlice(1), ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(3), Int64ToByteSlice(4),
+				// Ks - Ls - Us - Is - Ns
+				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(2),
+				// 2 ops
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, byte(OP_LOADN), 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, byte(OP_RET),
+				// Ns
+				Int64ToByteSlice(2), Int64ToByteSlice(3), Int64ToByteSlice(4)),
+		},
+		11: {
+			// Line numbers do not match instructions
+			maj: defMaj,
+			min: defMin,
+			f: &File{
+				MajorVersion: defMaj,
+				MinorVersion: defMin,
+				Name:         "test", Fns: []*Fn{
+					&Fn{
+						Is: []Instr{
+							NewInstr(OP_RET, 0, 0, 0),
+						},
+						Ns: []int64{3, 4},
+					},
+				}},
+			err: ErrInvalidLineTable,
+		},
+		12: {
+			// Function with locals and upvalues
+			maj: defMaj,
+			min: defMin,
+			f: &File{
+				MajorVersion: defMaj,
+				MinorVersion: defMin,
+				Name:         "test", Fns: []*Fn{
+					&Fn{
+						Header: H{
+							StackSz: 1,
+						},
+						Ks: []*K{
+							&K{
+								Type: KtString,
+								Val:  "a",
+							},
+						},
+						Ls: []int64{0},
+						Us: []U{{Local: true, Ix: 3}, {Local: false, Ix: 1}},
+						Is: []Instr{
+							NewInstr(OP_GETU, 0, 1, 0),
+						},
+					},
+				}},
+			exp: AppendAny(SigVer(_MAJOR_VERSION, _MINOR_VERSION), Int64ToByteSlice(4), 't', 'e', 's', 't',
+				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
+				Int64ToByteSlice(1), ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64,
+				// Ks - Ls - Us - Is - Ns
+				Int64ToByteSlice(1), byte(KtString), Int64ToByteSlice(1), 'a', Int64ToByteSlice(1), ExpZeroInt64,
+				Int64ToByteSlice(2), Int64ToByteSlice(1), Int64ToByteSlice(3), ExpZeroInt64, Int64ToByteSlice(1), Int64ToByteSlice(1),
+				// 1 op
+				0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, byte(OP_GETU),
+				// Ns
+				ExpZeroInt64),
 		},
 	}
 
@@ -9,7 +9,7 @@ const (
 var (
 	// Vars only to allow for testing, but are really constants
 	_MAJOR_VERSION = 0
-	_MINOR_VERSION = 2
+	_MINOR_VERSION = 7
 )
 
 // Version returns the major and minor version of the bytecode format.
@@ -52,6 +52,7 @@ type File struct {
 	MajorVersion int
 	MinorVersion int
 	Fns          []*Fn
+	Signature    *Signature // nil if the file is not signed
 }
 
 // NewFile returns a File structure initialized with the specified name and
@@ -69,19 +70,28 @@ type Fn struct {
 	Header H
 	Ks     []*K
 	Ls     []int64 // locals, as indexes into the K table
+	Us     []U     // upvalues, captured from the parent function
 	Is     []Instr
+	Ns     []int64 // source line numbers, one per instruction in Is, or empty
 }
 
 // An H is the function header representation.
 type H struct {
 	Name       string
-	StackSz    int64
+	StackSz    int64 // Number of registers, the locals followed by the temporaries
 	ExpArgs    int64
 	ParentFnIx int64 // Lexical scope parent function, as index into the Fn table
 	LineStart  int64
 	LineEnd    int64
 }
 
+// A U is the representation of a single upvalue, a variable of an enclosing
+// function captured by a closure.
+type U struct {
+	Local bool  // true if it captures a local of the parent function, false if an upvalue of the parent
+	Ix    int64 // index into the L section or the U section of the parent function
+}
+
 // A K is the representation of a single constant value.
 type K struct {
 	Type KType
@@ -2,93 +2,74 @@ package bytecode
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 )
 
-// A Flag indicates the meaning of the index (or value) part of an instruction.
-type Flag byte
-
+// The size, in bits, of each part of an instruction, and the limits of the
+// operands.
 const (
-	// The possible values of Flag
-	FLG__    Flag = iota // Ignored
-	FLG_K                // Constant table index
-	FLG_V                // Variable table index
-	FLG_F                // Function prototype index
-	FLG_A                // Arguments array
-	FLG_N                // Nil value
-	FLG_T                // `this` keyword
-	FLG_An               // Args count in a CALL or CFLD instruction
-	FLG_Jf               // Jump forward over n instructions
-	FLG_Jb               // Jump back over n instructions
-	FLG_Sn               // Dump n frames
-	FLG_Fn               // Set n fields
-	FLG_INVL Flag = 0xFF // Invalid flag
-)
+	SizeOp = 8
+	SizeA  = 16
+	SizeB  = 20
+	SizeC  = 20
+	SizeBx = SizeB + SizeC
 
-var (
-	// The lookup table of Flag values to literal flag names
-	FlagNames = [...]string{
-		FLG__:  "_",
-		FLG_K:  "K",
-		FLG_V:  "V",
-		FLG_F:  "F",
-		FLG_A:  "A",
-		FLG_N:  "N",
-		FLG_T:  "T",
-		FLG_An: "An",
-		FLG_Jf: "Jf",
-		FLG_Jb: "Jb",
-		FLG_Sn: "Sn",
-		FLG_Fn: "Fn",
-	}
+	MaxA   = 1<<SizeA - 1
+	MaxB   = 1<<SizeB - 1
+	MaxC   = 1<<SizeC - 1
+	MaxBx  = 1<<SizeBx - 1
+	MaxSBx = MaxBx >> 1 // sBx is stored in Bx with an excess-MaxSBx encoding
 
-	// The lookup table of literal flag names to Flag values
-	FlagLookup = map[string]Flag{
-		"_":  FLG__,
-		"K":  FLG_K,
-		"V":  FLG_V,
-		"F":  FLG_F,
-		"A":  FLG_A,
-		"N":  FLG_N,
-		"T":  FLG_T,
-		"An": FLG_An,
-		"Jf": FLG_Jf,
-		"Jb": FLG_Jb,
-		"Sn": FLG_Sn,
-		"Fn": FLG_Fn,
-	}
+	// BitRK is set on a B or C operand that refers to a constant instead of a
+	// register.
+	BitRK = 1 << (SizeC - 1)
+	// MaxRK is the maximum constant index (or register) that can be used as
+	// a B or C operand.
+	MaxRK = BitRK - 1
 )
 
-// NewFlag returns the Flag value identified by the provided literal name, or the
-// invalid Flag value if the name is unknown.
-func NewFlag(nm string) Flag {
-	t, ok := FlagLookup[nm]
-	if !ok {
-		return FLG_INVL
-	}
-	return t
-}
-
-// String returns the literal name corresponding to the current Flag value.
-func (f Flag) String() string {
-	if f < 0 || int(f) > len(FlagNames)-1 {
-		return ""
-	}
-	return FlagNames[f]
-}
-
 // An Instr is an agora instruction to be executed by the virtual machine at runtime.
 //
-// A bytecode instruction is a sequence of 64 bits arranged like this (a single letter=a byte):
-// `ofvvvvvv`
+// A bytecode instruction is a sequence of 64 bits arranged like this (a single letter=4 bits):
+// `ooaaaabbbbbccccc`
 // o: represents the opcode, on a single byte. See /bytecode/opcodes.go for the list of codes.
-// f: indicates what the next value represents (Flag)
-// v: represents the instruction's value (or index), on 6 bytes. Its meaning depends on the flag.
-//    Gives a maximum possible value of 2^48.
+// a: represents the A operand, on 16 bits, usually the destination register.
+// b: represents the B operand, on 20 bits.
+// c: represents the C operand, on 20 bits.
+//
+// Depending on the mode of the opcode, B and C may be combined in a single 40 bits operand,
+// either Bx (unsigned) or sBx (signed). The B and C operands are often RK operands: if the
+// BitRK bit is set, the remaining bits are a constant table index, otherwise they are a
+// register.
 type Instr uint64
 
-// NewInstr returns an instruction value constructed from the provided opcode, flag and ix.
-func NewInstr(op Opcode, flg Flag, ix uint64) Instr {
-	return Instr(uint64(op)<<56 | uint64(flg)<<48 | ix)
+// NewInstr returns an instruction value constructed from the provided opcode and A, B
+// and C operands.
+func NewInstr(op Opcode, a, b, c int) Instr {
+	return Instr(uint64(op)<<56 | uint64(a&MaxA)<<SizeBx | uint64(b&MaxB)<<SizeC | uint64(c&MaxC))
+}
+
+// NewInstrBx returns an instruction value constructed from the provided opcode and A
+// and Bx operands.
+func NewInstrBx(op Opcode, a, bx int) Instr {
+	return Instr(uint64(op)<<56 | uint64(a&MaxA)<<SizeBx | uint64(bx)&MaxBx)
+}
+
+// NewInstrSBx returns an instruction value constructed from the provided opcode and A
+// and sBx operands.
+func NewInstrSBx(op Opcode, a, sbx int) Instr {
+	return NewInstrBx(op, a, sbx+MaxSBx)
+}
+
+// RK returns the B or C operand that refers to the constant table index ix.
+func RK(ix int) int {
+	return ix | BitRK
+}
+
+// IsK returns true if the B or C operand refers to a constant.
+func IsK(x int) bool {
+	return x&BitRK != 0
 }
 
 // Opcode returns the opcode part of the instruction (the most significant byte).
@@ -96,19 +77,74 @@ func (i Instr) Opcode() Opcode {
 	return Opcode(i >> 56)
 }
 
-// Flag returns the flag part of the instruction (the second most significant byte).
-func (i Instr) Flag() Flag {
-	return Flag((i << 8) >> 56)
+// A returns the A operand of the instruction.
+func (i Instr) A() int {
+	return int(i>>SizeBx) & MaxA
 }
 
-// Index returns the index (or value) part of the instruction, that is, the 6 least
-// significant bytes.
-func (i Instr) Index() uint64 {
-	return uint64((i << 16) >> 16)
+// B returns the B operand of the instruction.
+func (i Instr) B() int {
+	return int(i>>SizeC) & MaxB
+}
+
+// C returns the C operand of the instruction.
+func (i Instr) C() int {
+	return int(i) & MaxC
+}
+
+// Bx returns the unsigned Bx operand of the instruction, that is, the B and C
+// operands taken together.
+func (i Instr) Bx() int {
+	return int(i) & MaxBx
+}
+
+// SBx returns the signed sBx operand of the instruction.
+func (i Instr) SBx() int {
+	return i.Bx() - MaxSBx
+}
+
+// Operands returns the literal representation of the operands of the instruction,
+// as used in the assembly source code.
+func (i Instr) Operands() string {
+	switch op := i.Opcode(); op.Mode() {
+	case ModeABx:
+		return fmt.Sprintf("%d %d", i.A(), i.Bx())
+	case ModeAsBx:
+		return fmt.Sprintf("%d %d", i.A(), i.SBx())
+	}
+	return fmt.Sprintf("%d %s %s", i.A(), FormatRK(i.B()), FormatRK(i.C()))
 }
 
 // String returns a literal representation of the instruction.
 func (i Instr) String() string {
-	op, f, ix := i.Opcode(), i.Flag(), i.Index()
-	return fmt.Sprintf("%-4s %-2s %3d", op, f, ix)
+	return fmt.Sprintf("%-5s %s", i.Opcode(), i.Operands())
+}
+
+// FormatRK returns the literal representation of a B or C operand: the register
+// number, or the constant table index prefixed with K.
+func FormatRK(x int) string {
+	if IsK(x) {
+		return "K" + strconv.Itoa(x&MaxRK)
+	}
+	return strconv.Itoa(x)
+}
+
+// ParseRK parses the literal representation of a B or C operand, as returned by
+// FormatRK.
+func ParseRK(s string) (int, error) {
+	k := strings.HasPrefix(s, "K")
+	if k {
+		s = s[1:]
+	}
+	x, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if x < 0 || x > MaxRK {
+		return 0, fmt.Errorf("operand out of range: %d", x)
+	}
+	if k {
+		x = RK(x)
+	}
+	return x, nil
 }
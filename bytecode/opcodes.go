@@ -5,106 +5,159 @@ import (
 )
 
 // The opcode takes one byte, leaving 256 possible codes.
+//
+// In the descriptions below, R(x) is the register x, K(x) is the constant x,
+// RK(x) is either the register x or, if x is a constant operand, the constant
+// x (see Instr), and U(x) is the upvalue x.
 type Opcode byte
 
 const (
 	// The possible opcodes
-	OP_RET  Opcode = iota // return
-	OP_PUSH               // push a value onto the stack
-	OP_POP                // pop a value from the stack
-	OP_ADD                // add two values from the stack, push the result
-	OP_SUB                // subtract two values from the stack, push the result
-	OP_MUL                // multiply two values from the stack, push the result
-	OP_DIV                // divide two values from the stack, push the result
-	OP_MOD                // compute the modulo of two values from the stack, push the result
-	OP_NOT                // boolean negation of one value from the stack, push the result
-	OP_UNM                // unary minus of one value from the stack, push the result
-	OP_EQ                 // check equality of two values from the stack, push the result
-	OP_NEQ                // check non-equality of two values from the stack, push the result
-	OP_LT                 // lower than on two values from the stack, push the result
-	OP_LTE                // lower than or equal on two values from the stack, push the result
-	OP_GT                 // greater than on two values from the stack, push the result
-	OP_GTE                // greater than or equal on two values from the stack, push the result
-	OP_TEST               // check the boolean value on top of the stack, if false jump n instructions
-	OP_JMP                // perform an unconditional jump (forward or backward, depending on the flag)
-	OP_NEW                // create and initialize a new object, push the result
-	OP_SFLD               // set the value of an object's field, using 3 values from the stack (object variable, key and value)
-	OP_GFLD               // get the value of an object's field, push the result, using 2 values from the stack (object variable and key)
-	OP_CFLD               // call a method on an object, push the result, using 2 values + n arguments from the stack (object variable and key)
-	OP_CALL               // call a function, push the result, using 1 value + n arguments from the stack
-	OP_YLD                // yield a value for coroutine cooperative multitasking
-	OP_RNGS               // range start
-	OP_RNGP               // range push
-	OP_RNGE               // range end
+	OP_RET   Opcode = iota // return RK(B)
+	OP_MOVE                // R(A) := R(B)
+	OP_LOADK               // R(A) := K(Bx)
+	OP_LOADN               // R(A) := nil
+	OP_LOADT               // R(A) := this
+	OP_LOADA               // R(A) := args
+	OP_LOADF               // R(A) := a new function value of the function prototype Bx
+	OP_GETU                // R(A) := U(B)
+	OP_SETU                // U(A) := RK(B)
+	OP_GETG                // R(A) := the global variable named K(Bx)
+	OP_ADD                 // R(A) := RK(B) + RK(C)
+	OP_SUB                 // R(A) := RK(B) - RK(C)
+	OP_MUL                 // R(A) := RK(B) * RK(C)
+	OP_DIV                 // R(A) := RK(B) / RK(C)
+	OP_MOD                 // R(A) := RK(B) % RK(C)
+	OP_NOT                 // R(A) := !RK(B)
+	OP_UNM                 // R(A) := -RK(B)
+	OP_EQ                  // R(A) := RK(B) == RK(C)
+	OP_NEQ                 // R(A) := RK(B) != RK(C)
+	OP_LT                  // R(A) := RK(B) < RK(C)
+	OP_LTE                 // R(A) := RK(B) <= RK(C)
+	OP_GT                  // R(A) := RK(B) > RK(C)
+	OP_GTE                 // R(A) := RK(B) >= RK(C)
+	OP_TEST                // if R(A) is false, jump sBx instructions
+	OP_JMP                 // jump sBx instructions (forward or backward)
+	OP_NEW                 // R(A) := a new empty object
+	OP_SFLD                // R(A)[RK(B)] := RK(C)
+	OP_GFLD                // R(A) := R(B)[RK(C)]
+	OP_CFLD                // R(A) := R(A)[RK(B)](R(A+1), ..., R(A+C)), with R(A) as `this`
+	OP_CALL                // R(A) := R(A)(R(A+1), ..., R(A+B))
+	OP_TCALL               // return R(A)(R(A+1), ..., R(A+B)), as a tail call
+	OP_TCFLD               // return R(A)[RK(B)](R(A+1), ..., R(A+C)), as a tail call with R(A) as `this`
+	OP_YLD                 // yield RK(B), R(A) := the value received on resume
+	OP_RNGS                // range start, using R(A), ..., R(A+B-1) as arguments
+	OP_RNGP                // R(A) := the next value of the range, or jump sBx instructions if it is done
+	OP_RNGE                // range end
 	op_dbgstart
-	OP_DUMP               // print the execution context, if the Ctx is in debug mode
+	OP_DUMP               // print Bx frames of the execution context, if the Ctx is in debug mode
 	op_max                // Indicates the maximum legal opcode
 	OP_INVL Opcode = 0xFF // Invalid opcode
 )
 
+// An OpMode indicates how the operands of an instruction are encoded.
+type OpMode byte
+
+const (
+	// The possible instruction modes
+	ModeABC  OpMode = iota // A, B and C operands
+	ModeABx                // A and unsigned Bx operands
+	ModeAsBx               // A and signed sBx operands
+)
+
 var (
 	// Lookup table of opcodes to literal name
 	OpNames = [...]string{
-		OP_RET:  "RET",
-		OP_PUSH: "PUSH",
-		OP_POP:  "POP",
-		OP_ADD:  "ADD",
-		OP_SUB:  "SUB",
-		OP_MUL:  "MUL",
-		OP_DIV:  "DIV",
-		OP_MOD:  "MOD",
-		OP_NOT:  "NOT",
-		OP_UNM:  "UNM",
-		OP_EQ:   "EQ",
-		OP_NEQ:  "NEQ",
-		OP_LT:   "LT",
-		OP_LTE:  "LTE",
-		OP_GT:   "GT",
-		OP_GTE:  "GTE",
-		OP_TEST: "TEST",
-		OP_JMP:  "JMP",
-		OP_NEW:  "NEW",
-		OP_SFLD: "SFLD",
-		OP_GFLD: "GFLD",
-		OP_CFLD: "CFLD",
-		OP_CALL: "CALL",
-		OP_YLD:  "YLD",
-		OP_RNGS: "RNGS",
-		OP_RNGP: "RNGP",
-		OP_RNGE: "RNGE",
-		OP_DUMP: "DUMP",
+		OP_RET:   "RET",
+		OP_MOVE:  "MOVE",
+		OP_LOADK: "LOADK",
+		OP_LOADN: "LOADN",
+		OP_LOADT: "LOADT",
+		OP_LOADA: "LOADA",
+		OP_LOADF: "LOADF",
+		OP_GETU:  "GETU",
+		OP_SETU:  "SETU",
+		OP_GETG:  "GETG",
+		OP_ADD:   "ADD",
+		OP_SUB:   "SUB",
+		OP_MUL:   "MUL",
+		OP_DIV:   "DIV",
+		OP_MOD:   "MOD",
+		OP_NOT:   "NOT",
+		OP_UNM:   "UNM",
+		OP_EQ:    "EQ",
+		OP_NEQ:   "NEQ",
+		OP_LT:    "LT",
+		OP_LTE:   "LTE",
+		OP_GT:    "GT",
+		OP_GTE:   "GTE",
+		OP_TEST:  "TEST",
+		OP_JMP:   "JMP",
+		OP_NEW:   "NEW",
+		OP_SFLD:  "SFLD",
+		OP_GFLD:  "GFLD",
+		OP_CFLD:  "CFLD",
+		OP_CALL:  "CALL",
+		OP_TCALL: "TCALL",
+		OP_TCFLD: "TCFLD",
+		OP_YLD:   "YLD",
+		OP_RNGS:  "RNGS",
+		OP_RNGP:  "RNGP",
+		OP_RNGE:  "RNGE",
+		OP_DUMP:  "DUMP",
 	}
 
 	// Loopup table of literal opcode names to Opcode value
 	OpLookup = map[string]Opcode{
-		"RET":  OP_RET,
-		"PUSH": OP_PUSH,
-		"POP":  OP_POP,
-		"ADD":  OP_ADD,
-		"SUB":  OP_SUB,
-		"MUL":  OP_MUL,
-		"DIV":  OP_DIV,
-		"MOD":  OP_MOD,
-		"NOT":  OP_NOT,
-		"UNM":  OP_UNM,
-		"EQ":   OP_EQ,
-		"NEQ":  OP_NEQ,
-		"LT":   OP_LT,
-		"LTE":  OP_LTE,
-		"GT":   OP_GT,
-		"GTE":  OP_GTE,
-		"TEST": OP_TEST,
-		"JMP":  OP_JMP,
-		"NEW":  OP_NEW,
-		"SFLD": OP_SFLD,
-		"GFLD": OP_GFLD,
-		"CFLD": OP_CFLD,
-		"CALL": OP_CALL,
-		"YLD":  OP_YLD,
-		"RNGS": OP_RNGS,
-		"RNGP": OP_RNGP,
-		"RNGE": OP_RNGE,
-		"DUMP": OP_DUMP,
+		"RET":   OP_RET,
+		"MOVE":  OP_MOVE,
+		"LOADK": OP_LOADK,
+		"LOADN": OP_LOADN,
+		"LOADT": OP_LOADT,
+		"LOADA": OP_LOADA,
+		"LOADF": OP_LOADF,
+		"GETU":  OP_GETU,
+		"SETU":  OP_SETU,
+		"GETG":  OP_GETG,
+		"ADD":   OP_ADD,
+		"SUB":   OP_SUB,
+		"MUL":   OP_MUL,
+		"DIV":   OP_DIV,
+		"MOD":   OP_MOD,
+		"NOT":   OP_NOT,
+		"UNM":   OP_UNM,
+		"EQ":    OP_EQ,
+		"NEQ":   OP_NEQ,
+		"LT":    OP_LT,
+		"LTE":   OP_LTE,
+		"GT":    OP_GT,
+		"GTE":   OP_GTE,
+		"TEST":  OP_TEST,
+		"JMP":   OP_JMP,
+		"NEW":   OP_NEW,
+		"SFLD":  OP_SFLD,
+		"GFLD":  OP_GFLD,
+		"CFLD":  OP_CFLD,
+		"CALL":  OP_CALL,
+		"TCALL": OP_TCALL,
+		"TCFLD": OP_TCFLD,
+		"YLD":   OP_YLD,
+		"RNGS":  OP_RNGS,
+		"RNGP":  OP_RNGP,
+		"RNGE":  OP_RNGE,
+		"DUMP":  OP_DUMP,
+	}
+
+	// Lookup table of opcodes to their instruction mode, the opcodes that
+	// are not listed use the ModeABC mode.
+	opModes = map[Opcode]OpMode{
+		OP_LOADK: ModeABx,
+		OP_LOADF: ModeABx,
+		OP_GETG:  ModeABx,
+		OP_DUMP:  ModeABx,
+		OP_TEST:  ModeAsBx,
+		OP_JMP:   ModeAsBx,
+		OP_RNGP:  ModeAsBx,
 	}
 )
 
@@ -126,3 +179,9 @@ func (o Opcode) String() string {
 	}
 	return strconv.Itoa(int(o))
 }
+
+// Mode returns the instruction mode of the opcode, that is, how its operands
+// are encoded.
+func (o Opcode) Mode() OpMode {
+	return opModes[o]
+}
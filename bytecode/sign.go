@@ -0,0 +1,110 @@
+package bytecode
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// The name length that marks the signature section, in place of a function.
+const sigMarker int64 = -1
+
+var (
+	// Error returned when the bytecode has no signature and one is required.
+	ErrUnsigned = errors.New("the bytecode is not signed")
+
+	// Error returned when the signature does not match the bytecode.
+	ErrInvalidSignature = errors.New("invalid bytecode signature")
+)
+
+// An UntrustedKeyError is returned when the bytecode is signed by a key that
+// is not trusted.
+type UntrustedKeyError string
+
+// Error interface implementation.
+func (e UntrustedKeyError) Error() string {
+	return fmt.Sprintf("the bytecode is signed by an untrusted key: %s", string(e))
+}
+
+// A Signature is the ed25519 signature of a bytecode file, by the key identified
+// by KeyID. The signed content is the encoding of the file without its signature.
+type Signature struct {
+	KeyID string
+	Sig   []byte
+}
+
+// KeyID returns the identifier of the public key, the hexadecimal encoding of
+// the first 8 bytes of its SHA-256 hash.
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Return the signed content of the file, its encoding without the signature.
+func signedContent(f *File) ([]byte, error) {
+	nf := *f
+	nf.Signature = nil
+	buf := bytes.NewBuffer(nil)
+	if err := NewEncoder(buf).Encode(&nf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Sign signs the bytecode file with the private key, and sets its Signature.
+func Sign(f *File, priv ed25519.PrivateKey) error {
+	b, err := signedContent(f)
+	if err != nil {
+		return err
+	}
+	f.Signature = &Signature{
+		KeyID: KeyID(priv.Public().(ed25519.PublicKey)),
+		Sig:   ed25519.Sign(priv, b),
+	}
+	return nil
+}
+
+// A Keyring holds the public keys trusted to sign bytecode, by key id. It is
+// immutable once created, and safe for concurrent use.
+type Keyring struct {
+	keys map[string]ed25519.PublicKey
+}
+
+// NewKeyring returns a keyring that trusts the specified public keys.
+func NewKeyring(keys ...ed25519.PublicKey) *Keyring {
+	k := &Keyring{keys: make(map[string]ed25519.PublicKey, len(keys))}
+	for _, pub := range keys {
+		k.keys[KeyID(pub)] = pub
+	}
+	return k
+}
+
+// Trusts returns true if the key identified by id is trusted.
+func (k *Keyring) Trusts(id string) bool {
+	_, ok := k.keys[id]
+	return ok
+}
+
+// Verify checks that the bytecode file is signed by a trusted key, and that the
+// signature is valid. It returns ErrUnsigned, an UntrustedKeyError or
+// ErrInvalidSignature if it is not, nil otherwise.
+func (k *Keyring) Verify(f *File) error {
+	if f.Signature == nil {
+		return ErrUnsigned
+	}
+	pub, ok := k.keys[f.Signature.KeyID]
+	if !ok {
+		return UntrustedKeyError(f.Signature.KeyID)
+	}
+	b, err := signedContent(f)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, b, f.Signature.Sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package bytecode
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+)
+
+// Return a new key pair, generated from the seed byte.
+func signKey(seed byte) (ed25519.PublicKey, ed25519.PrivateKey) {
+	priv := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+	return priv.Public().(ed25519.PublicKey), priv
+}
+
+// Return a bytecode file signed by priv, encoded then decoded.
+func signedFile(t *testing.T, priv ed25519.PrivateKey) *File {
+	f := &File{
+		Name:         "signed",
+		MajorVersion: _MAJOR_VERSION,
+		MinorVersion: _MINOR_VERSION,
+		Fns:          []*Fn{verifyFn(0, NewInstr(OP_RET, 0, RK(1), 0))},
+	}
+	// The top-level function is named after the file once decoded
+	f.Fns[0].Header.Name = f.Name
+	if err := Sign(f, priv); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := NewEncoder(buf).Encode(f); err != nil {
+		t.Fatal(err)
+	}
+	df, err := NewDecoder(buf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equal(f, df) || df.Signature == nil || df.Signature.KeyID != f.Signature.KeyID || !bytes.Equal(df.Signature.Sig, f.Signature.Sig) {
+		t.Fatal("expected the decoded file to be the signed file")
+	}
+	return df
+}
+
+func TestSign(t *testing.T) {
+	pub1, priv1 := signKey(1)
+	pub2, _ := signKey(2)
+	cases := []struct {
+		alter func(f *File)
+		keys  []ed25519.PublicKey
+		err   error
+	}{
+		0: {keys: []ed25519.PublicKey{pub1}},
+		1: {keys: []ed25519.PublicKey{pub2, pub1}},
+		2: {keys: []ed25519.PublicKey{pub2}, err: UntrustedKeyError(KeyID(pub1))},
+		3: {keys: nil, err: UntrustedKeyError(KeyID(pub1))},
+		4: {
+			// Not signed
+			alter: func(f *File) { f.Signature = nil },
+			keys:  []ed25519.PublicKey{pub1},
+			err:   ErrUnsigned,
+		},
+		5: {
+			// Tampered instruction
+			alter: func(f *File) { f.Fns[0].Is[0] = NewInstr(OP_RET, 0, RK(0), 0) },
+			keys:  []ed25519.PublicKey{pub1},
+			err:   ErrInvalidSignature,
+		},
+		6: {
+			// Tampered name
+			alter: func(f *File) { f.Name = "other" },
+			keys:  []ed25519.PublicKey{pub1},
+			err:   ErrInvalidSignature,
+		},
+		7: {
+			// Tampered signature
+			alter: func(f *File) { f.Signature.Sig[0]++ },
+			keys:  []ed25519.PublicKey{pub1},
+			err:   ErrInvalidSignature,
+		},
+	}
+	for i, c := range cases {
+		f := signedFile(t, priv1)
+		if c.alter != nil {
+			c.alter(f)
+		}
+		err := NewKeyring(c.keys...).Verify(f)
+		if err != c.err {
+			t.Errorf("[%d] - expected error %v, got %v", i, c.err, err)
+		}
+	}
+}
+
+func TestDecodeSignature(t *testing.T) {
+	_, priv := signKey(1)
+	f := signedFile(t, priv)
+	buf := bytes.NewBuffer(nil)
+	if err := NewEncoder(buf).Encode(f); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	// Trailing data after the signature
+	if _, err := NewDecoder(bytes.NewReader(append(b[:len(b):len(b)], 0))).Decode(); err != ErrInvalidData {
+		t.Errorf("expected error %v with trailing data, got %v", ErrInvalidData, err)
+	}
+	// Truncated signature
+	if _, err := NewDecoder(bytes.NewReader(b[:len(b)-1])).Decode(); err == nil {
+		t.Errorf("expected an error with a truncated signature, got none")
+	}
+	// Invalid signature size
+	f.Signature.Sig = f.Signature.Sig[:10]
+	if err := NewEncoder(buf).Encode(f); err != ErrInvalidSignature {
+		t.Errorf("expected error %v with an invalid signature size, got %v", ErrInvalidSignature, err)
+	}
+}
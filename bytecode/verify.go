@@ -0,0 +1,279 @@
+package bytecode
+
+import (
+	"fmt"
+)
+
+// A VerifyError describes an invariant of the bytecode that is violated, and
+// where it is violated.
+type VerifyError struct {
+	File string // the name of the bytecode file
+	Fn   int    // the index of the function
+	Name string // the name of the function
+	PC   int    // the index of the instruction, or -1 if it is not about an instruction
+	Msg  string
+}
+
+// Error interface implementation.
+func (e *VerifyError) Error() string {
+	if e.PC < 0 {
+		return fmt.Sprintf("invalid bytecode: %s: func %d (%s): %s", e.File, e.Fn, e.Name, e.Msg)
+	}
+	return fmt.Sprintf("invalid bytecode: %s: func %d (%s): instruction %d: %s", e.File, e.Fn, e.Name, e.PC, e.Msg)
+}
+
+// Verify checks that the bytecode File can be safely executed by the virtual
+// machine: the operands of the instructions refer to existing registers,
+// constants, upvalues and functions, the jumps land inside the function, the
+// functions do not fall off the end of their instructions, and the range
+// instructions are balanced on every path (using an abstract interpretation of
+// the depth of the range stack). It returns a *VerifyError for the first
+// violation found, or nil.
+func Verify(f *File) error {
+	for i := range f.Fns {
+		v := &verifier{f: f, ix: i, fn: f.Fns[i], pc: -1}
+		if !v.header() || !v.instrs() {
+			return v.err
+		}
+	}
+	return nil
+}
+
+// A verifier checks a single function of a bytecode file.
+type verifier struct {
+	f     *File
+	ix    int
+	fn    *Fn
+	nregs int // the number of registers, the locals followed by the temporaries
+	pc    int
+	err   error
+}
+
+// Record the error at the current instruction.
+func (v *verifier) fail(s string, args ...interface{}) bool {
+	v.err = &VerifyError{v.f.Name, v.ix, v.fn.Header.Name, v.pc, fmt.Sprintf(s, args...)}
+	return false
+}
+
+// Return the number of registers of the function.
+func registers(fn *Fn) int {
+	n := fn.Header.StackSz
+	if l := int64(len(fn.Ls)); n < l {
+		n = l
+	}
+	return int(n)
+}
+
+// Check the header, constants, locals, upvalues and lines of the function.
+func (v *verifier) header() bool {
+	h := v.fn.Header
+	if h.StackSz < 0 || h.StackSz > MaxA+1 || len(v.fn.Ls) > MaxA+1 {
+		return v.fail("stack size %d out of range", h.StackSz)
+	}
+	v.nregs = registers(v.fn)
+	if h.ExpArgs < 0 || h.ExpArgs > int64(v.nregs) {
+		return v.fail("expected arguments %d out of range (%d registers)", h.ExpArgs, v.nregs)
+	}
+	if v.ix > 0 && (h.ParentFnIx < 0 || h.ParentFnIx >= int64(v.ix)) {
+		return v.fail("parent function %d out of range, it must be defined before function %d", h.ParentFnIx, v.ix)
+	}
+	for j, k := range v.fn.Ks {
+		ok := false
+		if k != nil {
+			switch k.Type {
+			case KtInteger, KtBoolean:
+				_, ok = k.Val.(int64)
+			case KtFloat:
+				_, ok = k.Val.(float64)
+			case KtString:
+				_, ok = k.Val.(string)
+			}
+		}
+		if !ok {
+			return v.fail("invalid constant %d", j)
+		}
+	}
+	for j, l := range v.fn.Ls {
+		if l < 0 || l >= int64(len(v.fn.Ks)) || v.fn.Ks[l].Type != KtString {
+			return v.fail("local %d refers to %d, not a string constant", j, l)
+		}
+	}
+	if len(v.fn.Us) > 0 {
+		if v.ix == 0 {
+			return v.fail("the top-level function cannot have upvalues")
+		}
+		p := v.f.Fns[v.fn.Header.ParentFnIx]
+		for j, u := range v.fn.Us {
+			if u.Local && (u.Ix < 0 || u.Ix >= int64(registers(p))) {
+				return v.fail("upvalue %d refers to register %d, out of range in the parent function", j, u.Ix)
+			} else if !u.Local && (u.Ix < 0 || u.Ix >= int64(len(p.Us))) {
+				return v.fail("upvalue %d refers to upvalue %d, out of range in the parent function", j, u.Ix)
+			}
+		}
+	}
+	if len(v.fn.Ns) > 0 && len(v.fn.Ns) != len(v.fn.Is) {
+		return v.fail("%d line numbers for %d instructions", len(v.fn.Ns), len(v.fn.Is))
+	}
+	return true
+}
+
+// Check the operands of each instruction, and follow the execution paths to
+// check the depth of the range stack. The instructions that cannot be reached
+// are checked too, but they may have any range stack depth.
+func (v *verifier) instrs() bool {
+	for v.pc = range v.fn.Is {
+		if !v.operands(v.fn.Is[v.pc]) {
+			return false
+		}
+	}
+
+	n := len(v.fn.Is)
+	depth := make([]int, n)
+	for j := range depth {
+		depth[j] = -1
+	}
+	type state struct{ pc, depth int }
+	todo := []state{{0, 0}}
+	for len(todo) > 0 {
+		s := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if s.pc == n {
+			v.pc = n - 1
+			return v.fail("missing return, the execution reaches the end of the function")
+		}
+		if d := depth[s.pc]; d >= 0 {
+			if d != s.depth {
+				v.pc = s.pc
+				return v.fail("range stack depth %d, expected %d from a previous path", s.depth, d)
+			}
+			continue
+		}
+		depth[s.pc] = s.depth
+		v.pc = s.pc
+		i := v.fn.Is[s.pc]
+		next := s.depth
+		switch i.Opcode() {
+		case OP_RET, OP_TCALL, OP_TCFLD:
+			continue
+		case OP_JMP:
+			todo = append(todo, state{s.pc + 1 + i.SBx(), next})
+			continue
+		case OP_TEST:
+			todo = append(todo, state{s.pc + 1 + i.SBx(), next})
+		case OP_RNGS:
+			next++
+		case OP_RNGP:
+			if next == 0 {
+				return v.fail("range next without a range start")
+			}
+			todo = append(todo, state{s.pc + 1 + i.SBx(), next})
+		case OP_RNGE:
+			if next == 0 {
+				return v.fail("range end without a range start")
+			}
+			next--
+		}
+		todo = append(todo, state{s.pc + 1, next})
+	}
+	return true
+}
+
+// Check the operands of the instruction at the current index. The opcodes
+// accepted here must be supported by the interpreter, and by compiler.GoGen,
+// which relies on this verification instead of checking the operands.
+func (v *verifier) operands(i Instr) bool {
+	fn := v.fn
+	reg := func(x int) bool {
+		if x >= v.nregs {
+			return v.fail("%s: register %d out of range (%d registers)", i, x, v.nregs)
+		}
+		return true
+	}
+	regs := func(x, n int) bool {
+		if x+n > v.nregs {
+			return v.fail("%s: registers %d to %d out of range (%d registers)", i, x, x+n-1, v.nregs)
+		}
+		return true
+	}
+	k := func(x int) bool {
+		if x >= len(fn.Ks) {
+			return v.fail("%s: constant %d out of range (%d constants)", i, x, len(fn.Ks))
+		}
+		return true
+	}
+	rk := func(x int) bool {
+		if IsK(x) {
+			return k(x & MaxRK)
+		}
+		return reg(x)
+	}
+	upval := func(x int) bool {
+		if x >= len(fn.Us) {
+			return v.fail("%s: upvalue %d out of range (%d upvalues)", i, x, len(fn.Us))
+		}
+		return true
+	}
+	jump := func() bool {
+		if to := v.pc + 1 + i.SBx(); to < 0 || to >= len(fn.Is) {
+			return v.fail("%s: jump to instruction %d out of range (%d instructions)", i, to, len(fn.Is))
+		}
+		return true
+	}
+
+	a, b, c := i.A(), i.B(), i.C()
+	switch op := i.Opcode(); op {
+	case OP_RET:
+		return rk(b)
+	case OP_MOVE:
+		return reg(a) && reg(b)
+	case OP_LOADK:
+		return reg(a) && k(i.Bx())
+	case OP_LOADN, OP_LOADT, OP_LOADA, OP_NEW:
+		return reg(a)
+	case OP_LOADF:
+		bx := i.Bx()
+		if bx <= 0 || bx >= len(v.f.Fns) {
+			return v.fail("%s: function %d out of range (%d functions)", i, bx, len(v.f.Fns))
+		}
+		if p := v.f.Fns[bx].Header.ParentFnIx; p != int64(v.ix) {
+			return v.fail("%s: function %d is nested in function %d", i, bx, p)
+		}
+		return reg(a)
+	case OP_GETU:
+		return reg(a) && upval(b)
+	case OP_SETU:
+		return upval(a) && rk(b)
+	case OP_GETG:
+		bx := i.Bx()
+		if !k(bx) {
+			return false
+		}
+		if fn.Ks[bx].Type != KtString {
+			return v.fail("%s: global variable name %d is not a string constant", i, bx)
+		}
+		return reg(a)
+	case OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD, OP_EQ, OP_NEQ, OP_LT, OP_LTE, OP_GT, OP_GTE, OP_SFLD:
+		return reg(a) && rk(b) && rk(c)
+	case OP_NOT, OP_UNM, OP_YLD:
+		return reg(a) && rk(b)
+	case OP_TEST, OP_RNGP:
+		return reg(a) && jump()
+	case OP_JMP:
+		return jump()
+	case OP_GFLD:
+		return reg(a) && reg(b) && rk(c)
+	case OP_CFLD, OP_TCFLD:
+		return rk(b) && regs(a, c+1)
+	case OP_CALL, OP_TCALL:
+		return regs(a, b+1)
+	case OP_RNGS:
+		if b == 0 {
+			return v.fail("%s: range without a value", i)
+		}
+		return regs(a, b)
+	case OP_RNGE, OP_DUMP:
+		return true
+	default:
+		return v.fail("unknown opcode %d", op)
+	}
+}
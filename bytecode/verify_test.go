@@ -0,0 +1,173 @@
+package bytecode
+
+import (
+	"testing"
+)
+
+// Return a function with 2 registers, a string and an integer constant, and
+// the specified instructions.
+func verifyFn(parent int64, is ...Instr) *Fn {
+	return &Fn{
+		Header: H{Name: "f", StackSz: 2, ParentFnIx: parent},
+		Ks:     []*K{{KtString, "x"}, {KtInteger, int64(1)}},
+		Ls:     []int64{0},
+		Is:     is,
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ret := NewInstr(OP_RET, 0, 0, 0)
+	cases := []struct {
+		fns []*Fn
+		fn  int
+		pc  int
+		msg string
+	}{
+		0: {
+			// Valid
+			fns: []*Fn{
+				verifyFn(0, NewInstrBx(OP_LOADK, 0, 1), NewInstrBx(OP_LOADF, 1, 1), NewInstr(OP_CALL, 1, 0, 0), ret),
+				{Header: H{ParentFnIx: 0}, Us: []U{{true, 1}}, Is: []Instr{NewInstr(OP_RET, 0, RK(0), 0)}, Ks: []*K{{KtBoolean, int64(1)}}},
+			},
+		},
+		1: {
+			fns: []*Fn{verifyFn(0, NewInstr(OP_RET, 0, RK(5), 0))},
+			msg: "RET   0 K5 0: constant 5 out of range (2 constants)",
+		},
+		2: {
+			fns: []*Fn{verifyFn(0, NewInstr(OP_MOVE, 2, 0, 0), ret)},
+			msg: "MOVE  2 0 0: register 2 out of range (2 registers)",
+		},
+		3: {
+			fns: []*Fn{verifyFn(0, NewInstrSBx(OP_JMP, 0, 10), ret)},
+			msg: "JMP   0 10: jump to instruction 11 out of range (2 instructions)",
+		},
+		4: {
+			fns: []*Fn{verifyFn(0, NewInstrSBx(OP_JMP, 0, -2), ret)},
+			msg: "JMP   0 -2: jump to instruction -1 out of range (2 instructions)",
+		},
+		5: {
+			fns: []*Fn{verifyFn(0, NewInstr(OP_LOADN, 0, 0, 0))},
+			msg: "missing return, the execution reaches the end of the function",
+		},
+		6: {
+			fns: []*Fn{verifyFn(0)},
+			pc:  -1,
+			msg: "missing return, the execution reaches the end of the function",
+		},
+		7: {
+			fns: []*Fn{verifyFn(0, NewInstr(OP_RNGE, 0, 0, 0), ret)},
+			msg: "range end without a range start",
+		},
+		8: {
+			fns: []*Fn{verifyFn(0, NewInstrSBx(OP_RNGP, 0, 0), ret)},
+			msg: "range next without a range start",
+		},
+		9: {
+			fns: []*Fn{verifyFn(0,
+				NewInstrBx(OP_LOADK, 0, 1),
+				NewInstrSBx(OP_TEST, 0, 1),
+				NewInstr(OP_RNGS, 0, 1, 0),
+				ret)},
+			pc:  3,
+			msg: "range stack depth 0, expected 1 from a previous path",
+		},
+		10: {
+			fns: []*Fn{verifyFn(0, NewInstr(OP_RNGS, 0, 0, 0), ret)},
+			msg: "RNGS  0 0 0: range without a value",
+		},
+		11: {
+			fns: []*Fn{verifyFn(0, NewInstr(OP_CALL, 0, 2, 0), ret)},
+			msg: "CALL  0 2 0: registers 0 to 2 out of range (2 registers)",
+		},
+		12: {
+			fns: []*Fn{verifyFn(0, NewInstr(OP_CFLD, 1, RK(0), 1), ret)},
+			msg: "CFLD  1 K0 1: registers 1 to 2 out of range (2 registers)",
+		},
+		13: {
+			fns: []*Fn{verifyFn(0, NewInstrBx(OP_GETG, 0, 1), ret)},
+			msg: "GETG  0 1: global variable name 1 is not a string constant",
+		},
+		14: {
+			fns: []*Fn{verifyFn(0, NewInstr(OP_GETU, 0, 0, 0), ret)},
+			msg: "GETU  0 0 0: upvalue 0 out of range (0 upvalues)",
+		},
+		15: {
+			fns: []*Fn{verifyFn(0, NewInstrBx(OP_LOADF, 0, 1), ret)},
+			msg: "LOADF 0 1: function 1 out of range (1 functions)",
+		},
+		16: {
+			fns: []*Fn{verifyFn(0, NewInstrBx(OP_LOADF, 0, 2), ret), verifyFn(0, ret), verifyFn(1, ret)},
+			msg: "LOADF 0 2: function 2 is nested in function 1",
+		},
+		17: {
+			fns: []*Fn{verifyFn(0, Instr(0xFE)<<56, ret)},
+			msg: "unknown opcode 254",
+		},
+		18: {
+			fns: []*Fn{verifyFn(0, ret), verifyFn(1, ret)},
+			fn:  1,
+			pc:  -1,
+			msg: "parent function 1 out of range, it must be defined before function 1",
+		},
+		19: {
+			fns: []*Fn{verifyFn(0, ret), {Header: H{StackSz: 1}, Us: []U{{true, 2}}, Is: []Instr{ret}}},
+			fn:  1,
+			pc:  -1,
+			msg: "upvalue 0 refers to register 2, out of range in the parent function",
+		},
+		20: {
+			fns: []*Fn{verifyFn(0, ret), {Us: []U{{false, 0}}, Is: []Instr{ret}}},
+			fn:  1,
+			pc:  -1,
+			msg: "upvalue 0 refers to upvalue 0, out of range in the parent function",
+		},
+		21: {
+			fns: []*Fn{{Us: []U{{true, 0}}, Is: []Instr{ret}}},
+			pc:  -1,
+			msg: "the top-level function cannot have upvalues",
+		},
+		22: {
+			fns: []*Fn{{Ks: []*K{{KtInteger, int64(1)}}, Ls: []int64{0}, Is: []Instr{ret}}},
+			pc:  -1,
+			msg: "local 0 refers to 0, not a string constant",
+		},
+		23: {
+			fns: []*Fn{{Ks: []*K{{KtFloat, "1"}}, Is: []Instr{ret}}},
+			pc:  -1,
+			msg: "invalid constant 0",
+		},
+		24: {
+			fns: []*Fn{{Header: H{StackSz: 1, ExpArgs: 2}, Is: []Instr{ret}}},
+			pc:  -1,
+			msg: "expected arguments 2 out of range (1 registers)",
+		},
+		25: {
+			fns: []*Fn{{Header: H{StackSz: -1}, Is: []Instr{ret}}},
+			pc:  -1,
+			msg: "stack size -1 out of range",
+		},
+		26: {
+			fns: []*Fn{{Is: []Instr{ret}, Ns: []int64{1, 2}}},
+			pc:  -1,
+			msg: "2 line numbers for 1 instructions",
+		},
+	}
+	for i, c := range cases {
+		err := Verify(&File{Name: "test", Fns: c.fns})
+		if c.msg == "" {
+			if err != nil {
+				t.Errorf("[%d] - expected no error, got %s", i, err)
+			}
+			continue
+		}
+		ve, ok := err.(*VerifyError)
+		if !ok {
+			t.Errorf("[%d] - expected a *VerifyError, got %v", i, err)
+			continue
+		}
+		if ve.Fn != c.fn || ve.PC != c.pc || ve.Msg != c.msg {
+			t.Errorf("[%d] - expected func %d, instruction %d: %q, got %s", i, c.fn, c.pc, c.msg, err)
+		}
+	}
+}
@@ -6,16 +6,25 @@
 // - agora asm : compile an agora assembly code file.
 // - agora dasm : disassemble an agora bytecode into assembly source.
 // - agora ast : generate the abstract syntax tree for an agora source code file.
+// - agora gogen : compile an agora source code file to a Go native module.
+// - agora verify : verify the signature of an agora bytecode file.
+// - agora bundle : compile an agora program and the modules it imports to a single bundle file.
 //
 // See `agora -h` and `agora <cmd> -h` for available options.
 package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/PuerkitoBio/agora/bytecode"
 	"github.com/PuerkitoBio/agora/compiler"
@@ -116,37 +125,164 @@ func (d *dasm) Execute(args []string) error {
 
 // The run command struct
 type run struct {
-	FromAsm  bool   `short:"a" long:"from-asm" description:"run an assembly input"`
-	NoStdlib bool   `short:"S" long:"no-stdlib" description:"do not import the stdlib"`
-	Debug    bool   `short:"d" long:"debug" description:"output debug information"`
-	NoResult bool   `short:"R" long:"no-result" description:"do not print the result"`
-	Output   string `short:"o" long:"output" description:"output file"`
+	FromAsm  bool     `short:"a" long:"from-asm" description:"run an assembly input (modules without a .agora or .agoraa extension are compiled as assembly)"`
+	NoStdlib bool     `short:"S" long:"no-stdlib" description:"do not import the stdlib"`
+	Debug    bool     `short:"d" long:"debug" description:"output debug information"`
+	NoResult bool     `short:"R" long:"no-result" description:"do not print the result"`
+	Output   string   `short:"o" long:"output" description:"output file"`
+	Profile  string   `long:"profile" description:"write a pprof execution profile to this file"`
+	Sandbox  bool     `long:"sandbox" description:"run in a sandbox, with file operations and modules confined to the root directory (AGORA_PATH is not used, and -I is not allowed)"`
+	Root     string   `long:"root" default:"." description:"root directory of the sandbox"`
+	Allow    []string `long:"allow" description:"allow a native module or function in the sandbox (e.g. os or os.ReadFile), replaces the default allow-list"`
+	Include  []string `short:"I" long:"include" description:"look for modules in this directory, after the current directory and before AGORA_PATH (not allowed with --sandbox)"`
+	Decimal  bool     `long:"decimal" description:"use the exact, arbitrary-precision decimal arithmetic"`
+	Watch    bool     `short:"w" long:"watch" description:"run again when the source of a module changes"`
+	Cache    bool     `short:"c" long:"cache" description:"cache the compiled bytecode of the modules in __agoracache__ directories, next to the source files"`
+	CacheDir string   `long:"cache-dir" description:"cache the compiled bytecode of the modules in this directory (implies --cache)"`
+	Trust    []string `long:"trust" description:"load only the bytecode signed by this public key file (PEM), may be repeated"`
+
+	exit *runtime.ExitError // the termination requested by the program, if any
+}
+
+// The native modules and functions allowed by default in the sandbox.
+var sandboxAllow = []string{
+	"fmt",
+	"filepath",
+	"strings",
+	"math",
+	"time",
+	"os.TempDir",
+	"os.PathSeparator",
+	"os.PathListSeparator",
+	"os.DevNull",
+	"os.Exit",
+	"os.Getwd",
+	"os.ReadFile",
+	"os.WriteFile",
+	"os.Open",
+	"os.TryOpen",
+	"os.Mkdir",
+	"os.Remove",
+	"os.Rename",
+	"os.ReadDir",
 }
 
 func (r *run) Execute(args []string) error {
 	if len(args) < 1 {
 		return fmt.Errorf("expected an input file")
 	}
+	var root *runtime.DirFS
+	if r.Sandbox {
+		if len(r.Include) > 0 {
+			// The modules are loaded from the root only
+			return fmt.Errorf("the --include option cannot be used with --sandbox, the modules are loaded from the root directory")
+		}
+		var err error
+		if root, err = runtime.OpenDirFS(r.Root); err != nil {
+			return err
+		}
+		defer root.Close()
+	}
+	if !r.Watch {
+		_, err := r.run(args, root)
+		return r.checkExit(err)
+	}
+	for {
+		ctx, err := r.run(args, root)
+		if err = r.checkExit(err); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		} else if r.exit != nil {
+			return nil
+		}
+		// Wait for a change in the modules, and run again in a new context
+		for {
+			time.Sleep(watchInterval)
+			ids, err := ctx.Changed()
+			if err != nil {
+				return err
+			}
+			if len(ids) > 0 {
+				fmt.Fprintf(os.Stderr, "\n--- changed: %s\n", strings.Join(ids, ", "))
+				break
+			}
+		}
+	}
+}
+
+// Record the termination requested by the program if err is an ExitError, so
+// that main exits with its code once the deferred calls have run.
+func (r *run) checkExit(err error) error {
+	if code, ok := err.(runtime.ExitError); ok {
+		r.exit = &code
+		return nil
+	}
+	return err
+}
+
+// The interval to check for changed modules in watch mode.
+const watchInterval = 500 * time.Millisecond
+
+// Run the module once, in the sandbox confined to root if it is not nil, and
+// return the execution context.
+func (r *run) run(args []string, root *runtime.DirFS) (*runtime.Ctx, error) {
 	var c runtime.Compiler
 	if r.FromAsm {
 		c = new(compiler.Asm)
 	} else {
 		c = new(compiler.Compiler)
 	}
-	ctx := runtime.NewCtx(new(runtime.FileResolver), c)
+	ctx := runtime.NewCtx(runtime.ChainResolver{
+		new(runtime.FileResolver),
+		runtime.NewPathResolver(r.Include...),
+		runtime.NewEnvPathResolver(),
+	}, c)
+	ctx.RegisterCompiler(".agora", new(compiler.Compiler))
+	ctx.RegisterCompiler(".agoraa", new(compiler.Asm))
+	if root != nil {
+		allow := sandboxAllow
+		if len(r.Allow) > 0 {
+			allow = r.Allow
+		}
+		ctx.Sandbox = runtime.NewSandbox(root, allow...)
+		ctx.Resolver = runtime.FSResolver{FS: root}
+	}
+	id := args[0]
+	if isBundle(id) {
+		// Serve the modules from the bundle first, starting with its entry point
+		br, err := runtime.OpenBundleResolver(id)
+		if err != nil {
+			return ctx, err
+		}
+		ctx.Resolver = runtime.ChainResolver{br, ctx.Resolver}
+		id = br.Entry
+	}
 	if !r.NoStdlib {
-		// Register the standard lib's Fmt package
-		ctx.RegisterNativeModule(new(stdlib.FmtMod))
-		ctx.RegisterNativeModule(new(stdlib.FilepathMod))
-		ctx.RegisterNativeModule(new(stdlib.StringsMod))
-		ctx.RegisterNativeModule(new(stdlib.MathMod))
-		ctx.RegisterNativeModule(new(stdlib.OsMod))
-		ctx.RegisterNativeModule(new(stdlib.TimeMod))
+		// Register the standard lib's packages
+		for _, m := range stdlibModules() {
+			ctx.RegisterNativeModule(m)
+		}
+	}
+	if r.Cache || r.CacheDir != "" {
+		ctx.BytecodeCache = runtime.NewBytecodeCache(r.CacheDir)
+	}
+	if len(r.Trust) > 0 {
+		kr, err := readKeyring(r.Trust)
+		if err != nil {
+			return ctx, err
+		}
+		ctx.TrustedKeys = kr
+	}
+	if r.Decimal {
+		ctx.Arithmetic = runtime.DecimalArithmetic{}
+		ctx.Comparer = runtime.DecimalComparer{}
+	}
+	if r.Watch {
+		ctx.Watch = watchInterval
 	}
 	ctx.Debug = r.Debug
-	m, err := ctx.Load(args[0])
+	m, err := ctx.Load(id)
 	if err != nil {
-		return err
+		return ctx, err
 	}
 	// Prepare extra parameters to send to module
 	vals := make([]runtime.Val, len(args)-1)
@@ -158,16 +294,58 @@ func (r *run) Execute(args []string) error {
 	if r.Output != "" {
 		outf, err = os.Open(r.Output)
 		if err != nil {
-			return err
+			return ctx, err
 		}
 		defer outf.Close()
 		ctx.Stdout = outf
 	}
+	if r.Profile != "" {
+		ctx.Profiler = runtime.NewProfiler()
+		ctx.Profiler.Start()
+	}
 	res, err := m.Run(vals...)
+	if r.Profile != "" {
+		ctx.Profiler.Stop()
+		if perr := writeProfile(ctx.Profiler, r.Profile); perr != nil && err == nil {
+			err = perr
+		}
+	}
 	if err == nil && !r.NoResult {
 		fmt.Fprintf(outf, "\n= %s (%T)\n", res, res)
 	}
-	return err
+	return ctx, err
+}
+
+// Return the native modules of the standard lib.
+func stdlibModules() []runtime.NativeModule {
+	return []runtime.NativeModule{
+		new(stdlib.FmtMod),
+		new(stdlib.FilepathMod),
+		new(stdlib.StringsMod),
+		new(stdlib.MathMod),
+		new(stdlib.OsMod),
+		new(stdlib.TimeMod),
+	}
+}
+
+// Return true if the file nm is a bundle.
+func isBundle(nm string) bool {
+	f, err := os.Open(nm)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return bytecode.IsBundle(f)
+}
+
+// Write the pprof profile to the specified file.
+func writeProfile(p *runtime.Profiler, nm string) error {
+	f, err := os.Create(nm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return p.WritePprof(f)
 }
 
 // The ast command struct
@@ -216,6 +394,7 @@ func (a *ast) Execute(args []string) error {
 type build struct {
 	Output string `short:"o" long:"output" description:"output file"`
 	Asm    bool   `short:"a" long:"assembly" description:"build to assembly instead of bytecode"`
+	Sign   string `long:"sign" description:"sign the bytecode with this ed25519 private key file (PEM)"`
 }
 
 func (b *build) Execute(args []string) error {
@@ -232,6 +411,18 @@ func (b *build) Execute(args []string) error {
 	if err != nil {
 		return err
 	}
+	if b.Sign != "" {
+		if b.Asm {
+			return fmt.Errorf("cannot sign the assembly output")
+		}
+		key, err := readPrivateKey(b.Sign)
+		if err != nil {
+			return err
+		}
+		if err := bytecode.Sign(f, key); err != nil {
+			return err
+		}
+	}
 	out := stdout
 	if b.Output != "" {
 		outf, err := os.Create(b.Output)
@@ -254,6 +445,246 @@ func (b *build) Execute(args []string) error {
 	return nil
 }
 
+// The gogen command struct
+type gogen struct {
+	Output  string `short:"o" long:"output" description:"output file"`
+	Package string `short:"p" long:"package" default:"main" description:"package name of the generated code"`
+	Type    string `short:"t" long:"type" default:"Module" description:"type name of the generated module"`
+	ID      string `long:"id" description:"identifier of the module (defaults to the file name without extension)"`
+}
+
+func (g *gogen) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected an input file")
+	}
+	inf, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer inf.Close()
+	// Decode the bytecode, or compile the source code
+	var f *bytecode.File
+	if bytecode.IsBytecode(inf) {
+		f, err = bytecode.NewDecoder(inf).Decode()
+	} else {
+		f, err = new(compiler.Compiler).Compile(args[0], inf)
+	}
+	if err != nil {
+		return err
+	}
+	// Generate to a buffer first, so that no output file is created on error
+	buf := bytes.NewBuffer(nil)
+	gen := &compiler.GoGen{Package: g.Package, Type: g.Type, ID: g.ID}
+	if err := gen.ToGo(f, buf); err != nil {
+		return err
+	}
+	out := stdout
+	if g.Output != "" {
+		outf, err := os.Create(g.Output)
+		if err != nil {
+			return err
+		}
+		defer outf.Close()
+		out = outf
+	}
+	_, err = out.Write(buf.Bytes())
+	return err
+}
+
+// The verify command struct
+type verify struct {
+	Keys []string `short:"k" long:"key" description:"trusted ed25519 public key file (PEM), may be repeated"`
+}
+
+func (v *verify) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected an input file")
+	}
+	if len(v.Keys) == 0 {
+		return fmt.Errorf("expected at least one trusted key")
+	}
+	kr, err := readKeyring(v.Keys)
+	if err != nil {
+		return err
+	}
+	inf, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer inf.Close()
+	f, err := bytecode.NewDecoder(inf).Decode()
+	if err != nil {
+		return err
+	}
+	if err := kr.Verify(f); err != nil {
+		return err
+	}
+	if err := bytecode.Verify(f); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s: valid signature by key %s\n", args[0], f.Signature.KeyID)
+	return nil
+}
+
+// The bundle command struct
+type bundle struct {
+	Output  string   `short:"o" long:"output" description:"output file"`
+	Include []string `short:"I" long:"include" description:"look for imported modules in this directory, may be repeated"`
+	Sign    string   `long:"sign" description:"sign the bytecode of the modules with this ed25519 private key file (PEM)"`
+}
+
+func (b *bundle) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected an input file")
+	}
+	var key ed25519.PrivateKey
+	if b.Sign != "" {
+		var err error
+		if key, err = readPrivateKey(b.Sign); err != nil {
+			return err
+		}
+	}
+	// The modules are looked for like the run command does
+	res := runtime.ChainResolver{
+		new(runtime.FileResolver),
+		runtime.NewPathResolver(b.Include...),
+		runtime.NewEnvPathResolver(),
+	}
+	natives := make(map[string]bool)
+	for _, m := range stdlibModules() {
+		natives[m.ID()] = true
+	}
+	entry, err := res.Canonical(args[0], "")
+	if err != nil {
+		return err
+	}
+	bdl := &bytecode.Bundle{Entry: runtime.BundleID(filepath.Base(entry), "")}
+	// Follow the imports, the files map the bundle ids to the module files, and
+	// the ids map the files back to their bundle id, so that a module is not
+	// bundled twice under different ids.
+	files := map[string]string{bdl.Entry: entry}
+	ids := map[string]string{entry: bdl.Entry}
+	for todo := []string{bdl.Entry}; len(todo) > 0; todo = todo[1:] {
+		id := todo[0]
+		f, err := compileFile(id, files[id])
+		if err != nil {
+			return err
+		}
+		if key != nil {
+			if err := bytecode.Sign(f, key); err != nil {
+				return err
+			}
+		}
+		bdl.Mods = append(bdl.Mods, &bytecode.BundleMod{ID: id, File: f})
+		for _, imp := range bytecode.Imports(f) {
+			if natives[imp] {
+				continue
+			}
+			nm, err := res.Canonical(imp, files[id])
+			if err != nil {
+				return fmt.Errorf("%s: %s", files[id], err)
+			}
+			bid := runtime.BundleID(imp, id)
+			if prev, ok := files[bid]; ok && prev != nm {
+				return fmt.Errorf("module %s is both %s and %s", bid, prev, nm)
+			}
+			if prev, ok := ids[nm]; ok && prev != bid {
+				return fmt.Errorf("module %s is imported as both %s and %s", nm, prev, bid)
+			}
+			if _, ok := files[bid]; !ok {
+				files[bid], ids[nm] = nm, bid
+				todo = append(todo, bid)
+			}
+		}
+	}
+	out := stdout
+	if b.Output != "" {
+		outf, err := os.Create(b.Output)
+		if err != nil {
+			return err
+		}
+		defer outf.Close()
+		out = outf
+	}
+	return bytecode.NewEncoder(out).EncodeBundle(bdl)
+}
+
+// Compile the module file nm to bytecode, according to its format, and verify
+// it. The module is named id.
+func compileFile(id, nm string) (*bytecode.File, error) {
+	inf, err := os.Open(nm)
+	if err != nil {
+		return nil, err
+	}
+	defer inf.Close()
+	var f *bytecode.File
+	switch {
+	case bytecode.IsBytecode(inf):
+		f, err = bytecode.NewDecoder(inf).Decode()
+	case filepath.Ext(nm) == ".agoraa":
+		f, err = new(compiler.Asm).Compile(id, inf)
+	default:
+		f, err = new(compiler.Compiler).Compile(id, inf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, bytecode.Verify(f)
+}
+
+// Read the PEM block of the key file nm.
+func readPEM(nm string) ([]byte, error) {
+	b, err := ioutil.ReadFile(nm)
+	if err != nil {
+		return nil, err
+	}
+	blk, _ := pem.Decode(b)
+	if blk == nil {
+		return nil, fmt.Errorf("%s: no PEM data", nm)
+	}
+	return blk.Bytes, nil
+}
+
+// Read the ed25519 private key from the PKCS #8 PEM file nm (e.g. as generated
+// by `openssl genpkey -algorithm ed25519`).
+func readPrivateKey(nm string) (ed25519.PrivateKey, error) {
+	b, err := readPEM(nm)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", nm, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 private key", nm)
+	}
+	return priv, nil
+}
+
+// Read the keyring of the ed25519 public keys from the PKIX PEM files (e.g. as
+// generated by `openssl pkey -pubout`).
+func readKeyring(nms []string) (*bytecode.Keyring, error) {
+	var keys []ed25519.PublicKey
+	for _, nm := range nms {
+		b, err := readPEM(nm)
+		if err != nil {
+			return nil, err
+		}
+		key, err := x509.ParsePKIXPublicKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", nm, err)
+		}
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an ed25519 public key", nm)
+		}
+		keys = append(keys, pub)
+	}
+	return bytecode.NewKeyring(keys...), nil
+}
+
 type version struct{}
 
 func (v *version) Execute(args []string) error {
@@ -264,14 +695,21 @@ func (v *version) Execute(args []string) error {
 
 func main() {
 	a, d, r, s, b, v := new(asm), new(dasm), new(run), new(ast), new(build), new(version)
+	g, vf, bd := new(gogen), new(verify), new(bundle)
 	p := flags.NewParser(nil, flags.Default)
 	p.AddCommand("asm", "assembler", "compile assembly to bytecode", a)
 	p.AddCommand("dasm", "disassembler", "disassemble bytecode to assembly", d)
 	p.AddCommand("run", "run", "execute a source program", r)
 	p.AddCommand("ast", "abstract syntax tree", "print the AST of a source program", s)
 	p.AddCommand("build", "compiler", "compile a source program", b)
+	p.AddCommand("gogen", "Go code generator", "compile a source program or bytecode to a Go native module", g)
+	p.AddCommand("verify", "signature verifier", "verify the signature of a bytecode file", vf)
+	p.AddCommand("bundle", "bundler", "compile a program and the modules it imports to a bundle", bd)
 	p.AddCommand("version", "print the current version", "print the current version", v)
 	// In case of errors, usage text is automatically displayed. In case of
 	// success, the Execute() method of the matching command is called.
 	p.Parse()
+	if r.exit != nil {
+		os.Exit(int(*r.exit))
+	}
 }
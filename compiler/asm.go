@@ -13,6 +13,7 @@ import (
 var (
 	// Predefined errors
 	ErrInvalidInstruction = errors.New("invalid instruction")
+	ErrInvalidUpvalue     = errors.New("invalid upvalue")
 	ErrNoInput            = errors.New("no input provided")
 )
 
@@ -94,30 +95,67 @@ func (a *Asm) readKs(fn *bytecode.Fn) {
 }
 
 func (a *Asm) readLs(fn *bytecode.Fn) {
-	// While the L section is not reached
-	for l, ok := a.getLine(false); ok && l != "[i]"; l, ok = a.getLine(false) {
+	var l string
+	var ok bool
+	// While the optional U section or the I section is not reached
+	for l, ok = a.getLine(false); ok && l != "[u]" && l != "[i]"; l, ok = a.getLine(false) {
 		var i int64
 		i, a.err = strconv.ParseInt(l, 10, 64)
 		fn.Ls = append(fn.Ls, i)
 	}
+	if ok && l == "[u]" {
+		a.readUs(fn)
+	} else {
+		a.readIs(fn)
+	}
+}
+
+func (a *Asm) readUs(fn *bytecode.Fn) {
+	// While the I section is not reached
+	for l, ok := a.getLine(false); ok && l != "[i]"; l, ok = a.getLine(false) {
+		// Split in two parts, the kind (L or U) and the index
+		parts := strings.SplitN(l, " ", 2)
+		if len(parts) != 2 || (parts[0] != "L" && parts[0] != "U") {
+			if a.err == nil {
+				a.err = ErrInvalidUpvalue
+			}
+			continue
+		}
+		var u bytecode.U
+		u.Local = parts[0] == "L"
+		u.Ix, a.err = strconv.ParseInt(parts[1], 10, 64)
+		fn.Us = append(fn.Us, u)
+	}
 	a.readIs(fn)
 }
 
 func (a *Asm) readIs(fn *bytecode.Fn) {
 	var l string
 	var ok bool
-	// While a new F section is not reached
-	for l, ok = a.getLine(false); ok && l != "[f]"; l, ok = a.getLine(false) {
-		// Split in three parts
-		parts := strings.SplitN(l, " ", 3)
+	// While a new F section or the optional N section is not reached
+	for l, ok = a.getLine(false); ok && l != "[f]" && l != "[n]"; l, ok = a.getLine(false) {
+		// Split in the opcode and its operands
+		parts := strings.Fields(l)
 		if a.assertIParts(parts) {
-			var ix uint64
-			o := bytecode.NewOpcode(parts[0])
-			f := bytecode.NewFlag(parts[1])
-			ix, a.err = strconv.ParseUint(parts[2], 10, 64)
-			fn.Is = append(fn.Is, bytecode.NewInstr(o, f, ix))
+			fn.Is = append(fn.Is, a.parseInstr(parts))
 		}
 	}
+	if ok && l == "[n]" {
+		a.readNs(fn)
+	} else if ok {
+		a.readFn()
+	}
+}
+
+func (a *Asm) readNs(fn *bytecode.Fn) {
+	var l string
+	var ok bool
+	// While a new F section is not reached
+	for l, ok = a.getLine(false); ok && l != "[f]"; l, ok = a.getLine(false) {
+		var n int64
+		n, a.err = strconv.ParseInt(l, 10, 64)
+		fn.Ns = append(fn.Ns, n)
+	}
 	if ok {
 		a.readFn()
 	}
@@ -127,13 +165,43 @@ func (a *Asm) assertIParts(p []string) bool {
 	if a.err != nil || a.ended {
 		return false
 	}
-	if len(p) != 3 {
+	// The opcode and A, B and C operands, or the opcode and A and Bx operands
+	n := 4
+	if len(p) > 0 && bytecode.NewOpcode(p[0]).Mode() != bytecode.ModeABC {
+		n = 3
+	}
+	if len(p) != n {
 		a.err = ErrInvalidInstruction
 		return false
 	}
 	return true
 }
 
+func (a *Asm) parseInstr(p []string) bytecode.Instr {
+	var x, y, z int
+	o := bytecode.NewOpcode(p[0])
+	x, a.err = strconv.Atoi(p[1])
+	switch o.Mode() {
+	case bytecode.ModeABx:
+		if a.err == nil {
+			y, a.err = strconv.Atoi(p[2])
+		}
+		return bytecode.NewInstrBx(o, x, y)
+	case bytecode.ModeAsBx:
+		if a.err == nil {
+			y, a.err = strconv.Atoi(p[2])
+		}
+		return bytecode.NewInstrSBx(o, x, y)
+	}
+	if a.err == nil {
+		y, a.err = bytecode.ParseRK(p[2])
+	}
+	if a.err == nil {
+		z, a.err = bytecode.ParseRK(p[3])
+	}
+	return bytecode.NewInstr(o, x, y, z)
+}
+
 func (a *Asm) getInt64() int64 {
 	if v, ok := a.getLine(false); ok {
 		var i int64
@@ -33,8 +33,8 @@ var (
 			exp: AppendAny(SigVer(bytecode.Version()), Int64ToByteSlice(4), 't', 'e', 's', 't',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
 				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64,
-				// Ks - Ls - Is
-				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64),
+				// Ks - Ls - Us - Is - Ns
+				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64),
 		},
 		2: {
 			// Full valid func
@@ -42,7 +42,7 @@ var (
 			src: `
 [f]
 test
-1
+2
 0
 0
 0
@@ -51,24 +51,25 @@ test
 sa
 i5
 [l]
+0
 [i]
-PUSH K 1 // Push constant value 5 on the stack
-POP V 0  // Pop the value from the stack into variable identified by constant 0 (a)
-PUSH V 0 // Push value of variable identified by constant 0 on the stack (a)
-DUMP S 1
-RET _ 0
+LOADK 0 1   // Load constant value 5 into register 0 (a)
+ADD 1 0 K1  // Add register 0 (a) and constant value 5 into register 1
+DUMP 0 1
+RET 0 1 0   // Return register 1
 `,
 			exp: AppendAny(SigVer(bytecode.Version()), Int64ToByteSlice(4), 't', 'e', 's', 't',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
-				Int64ToByteSlice(1), ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(2),
-				// Ks - Ls - Is
-				Int64ToByteSlice(2), 's', Int64ToByteSlice(1), 'a', 'i', Int64ToByteSlice(5), ExpZeroInt64, Int64ToByteSlice(5),
-				// 5 ops
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("PUSH"), bytecode.NewFlag("K"), 1))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("POP"), bytecode.NewFlag("V"), 0))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("PUSH"), bytecode.NewFlag("V"), 0))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("DUMP"), bytecode.NewFlag("S"), 1))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("RET"), bytecode.NewFlag("_"), 0))),
+				Int64ToByteSlice(2), ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(2),
+				// Ks - Ls - Us - Is - Ns
+				Int64ToByteSlice(2), 's', Int64ToByteSlice(1), 'a', 'i', Int64ToByteSlice(5), Int64ToByteSlice(1), ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(4),
+				// 4 ops
+				UInt64ToByteSlice(uint64(bytecode.NewInstrBx(bytecode.NewOpcode("LOADK"), 0, 1))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("ADD"), 1, 0, bytecode.RK(1)))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstrBx(bytecode.NewOpcode("DUMP"), 0, 1))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("RET"), 0, 1, 0))),
+				// Ns
+				ExpZeroInt64,
 			),
 		},
 		3: {
@@ -87,11 +88,10 @@ sa
 i5
 [l]
 [i]
-PUSH K 1 // Push constant value 5 on the stack
-POP V 0  // Pop the value from the stack into variable identified by constant 0 (a)
-PRUT V 0 
-DUMP S 1
-RET _ 0
+LOADK 0 1
+PRUT 1 0 K1
+DUMP 0 1
+RET 0 1 0
 `,
 			err: bytecode.ErrUnknownOpcode,
 		},
@@ -111,11 +111,10 @@ sa
 i5
 [l]
 [i]
-PUSH K 1 // Push constant value 5 on the stack
-POP V 0  // Pop the value from the stack into variable identified by constant 0 (a)
-ADD X
-DUMP S 1
-RET _ 0
+LOADK 0 1
+ADD 1
+DUMP 0 1
+RET 0 1 0
 `,
 			err: ErrInvalidInstruction,
 		},
@@ -131,7 +130,7 @@ RET _ 0
 //
 [f]
 test
-3
+4
 0
 0
 0
@@ -141,18 +140,18 @@ sAdd
 i4
 s198
 [l]
+0
 [i]
-PUSH F 1
-POP V 0
-PUSH K 1
-PUSH K 2
-PUSH V 0
-CALL A 2
-DUMP S 1
-RET _ 0
+LOADF 0 1
+MOVE 1 0 0
+LOADK 2 1
+LOADK 3 2
+CALL 1 2 0
+DUMP 0 1
+RET 0 1 0
 [f]
 Add
-2
+3
 2
 0
 0
@@ -161,39 +160,116 @@ Add
 sx
 sy
 [l]
+0
+1
 [i]
-PUSH V 0
-PUSH V 1
-ADD _ 0
-RET _ 0
+ADD 2 0 1
+RET 0 2 0
 `,
 			exp: AppendAny(SigVer(bytecode.Version()), Int64ToByteSlice(4), 't', 'e', 's', 't',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
-				Int64ToByteSlice(3), ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(3),
-				// Ks - Ls - Is
-				Int64ToByteSlice(3), 's', Int64ToByteSlice(3), 'A', 'd', 'd', 'i', Int64ToByteSlice(4), 's', Int64ToByteSlice(3), '1', '9', '8', ExpZeroInt64, Int64ToByteSlice(8),
-				// 8 ops
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("PUSH"), bytecode.NewFlag("F"), 1))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("POP"), bytecode.NewFlag("V"), 0))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("PUSH"), bytecode.NewFlag("K"), 1))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("PUSH"), bytecode.NewFlag("K"), 2))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("PUSH"), bytecode.NewFlag("V"), 0))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("CALL"), bytecode.NewFlag("A"), 2))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("DUMP"), bytecode.NewFlag("S"), 1))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("RET"), bytecode.NewFlag("_"), 0))),
+				Int64ToByteSlice(4), ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(3),
+				// Ks - Ls - Us - Is - Ns
+				Int64ToByteSlice(3), 's', Int64ToByteSlice(3), 'A', 'd', 'd', 'i', Int64ToByteSlice(4), 's', Int64ToByteSlice(3), '1', '9', '8', Int64ToByteSlice(1), ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(7),
+				// 7 ops
+				UInt64ToByteSlice(uint64(bytecode.NewInstrBx(bytecode.NewOpcode("LOADF"), 0, 1))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("MOVE"), 1, 0, 0))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstrBx(bytecode.NewOpcode("LOADK"), 2, 1))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstrBx(bytecode.NewOpcode("LOADK"), 3, 2))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("CALL"), 1, 2, 0))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstrBx(bytecode.NewOpcode("DUMP"), 0, 1))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("RET"), 0, 1, 0))),
+				// Ns
+				ExpZeroInt64,
 				// 2nd fn
 				Int64ToByteSlice(3), 'A', 'd', 'd',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
-				Int64ToByteSlice(2), Int64ToByteSlice(2), ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(2),
-				// Ks - Ls - Is
-				Int64ToByteSlice(2), 's', Int64ToByteSlice(1), 'x', 's', Int64ToByteSlice(1), 'y', ExpZeroInt64, Int64ToByteSlice(4),
-				// 4 ops
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("PUSH"), bytecode.NewFlag("V"), 0))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("PUSH"), bytecode.NewFlag("V"), 1))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("ADD"), bytecode.NewFlag("_"), 0))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("RET"), bytecode.NewFlag("_"), 0))),
+				Int64ToByteSlice(3), Int64ToByteSlice(2), ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(2),
+				// Ks - Ls - Us - Is - Ns
+				Int64ToByteSlice(2), 's', Int64ToByteSlice(1), 'x', 's', Int64ToByteSlice(1), 'y', Int64ToByteSlice(2), ExpZeroInt64, Int64ToByteSlice(1), ExpZeroInt64, Int64ToByteSlice(2),
+				// 2 ops
+				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("ADD"), 2, 0, 1))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("RET"), 0, 2, 0))),
+				// Ns
+				ExpZeroInt64,
 			),
 		},
+		6: {
+			// Closure with an upvalue
+			id: "test",
+			src: `
+[f]
+test
+1
+0
+0
+0
+0
+[k]
+sx
+[l]
+0
+[i]
+LOADF 0 1
+RET 0 0 0
+[f]
+<anon>
+1
+0
+0
+0
+0
+[k]
+[l]
+[u]
+L 0
+[i]
+GETU 0 0 0
+RET 0 0 0
+`,
+			exp: AppendAny(SigVer(bytecode.Version()), Int64ToByteSlice(4), 't', 'e', 's', 't',
+				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
+				Int64ToByteSlice(1), ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64,
+				// Ks - Ls - Us - Is - Ns
+				Int64ToByteSlice(1), 's', Int64ToByteSlice(1), 'x', Int64ToByteSlice(1), ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(2),
+				// 2 ops
+				UInt64ToByteSlice(uint64(bytecode.NewInstrBx(bytecode.NewOpcode("LOADF"), 0, 1))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("RET"), 0, 0, 0))),
+				// Ns
+				ExpZeroInt64,
+				// 2nd fn
+				Int64ToByteSlice(6), '<', 'a', 'n', 'o', 'n', '>',
+				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
+				Int64ToByteSlice(1), ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64,
+				// Ks - Ls - Us - Is - Ns
+				ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(1), Int64ToByteSlice(1), ExpZeroInt64, Int64ToByteSlice(2),
+				// 2 ops
+				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("GETU"), 0, 0, 0))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("RET"), 0, 0, 0))),
+				// Ns
+				ExpZeroInt64,
+			),
+		},
+		7: {
+			// Invalid upvalue
+			id: "test",
+			src: `
+[f]
+test
+1
+0
+0
+0
+0
+[k]
+[l]
+[u]
+X 0
+[i]
+RET 0 0 0
+`,
+			err: ErrInvalidUpvalue,
+		},
 	}
 
 	isolateAsmCase = -1
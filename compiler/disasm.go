@@ -53,15 +53,31 @@ func (d *Disasm) ToAsm(f *bytecode.File, w io.Writer) error {
 		for _, l := range fn.Ls {
 			d.write(l, true)
 		}
-		// 5- Write the function's I section
+		// 5- Write the function's U section, if there are upvalues
+		if len(fn.Us) > 0 {
+			d.write("[u]", true)
+			for _, u := range fn.Us {
+				if u.Local {
+					d.write("L ", false)
+				} else {
+					d.write("U ", false)
+				}
+				d.write(u.Ix, true)
+			}
+		}
+		// 6- Write the function's I section
 		d.write("[i]", true)
 		for _, i := range fn.Is {
-			op, flg, ix := i.Opcode(), i.Flag(), i.Index()
-			d.write(op.String(), false)
-			d.write(" ", false)
-			d.write(flg.String(), false)
+			d.write(i.Opcode().String(), false)
 			d.write(" ", false)
-			d.write(ix, true)
+			d.write(i.Operands(), true)
+		}
+		// 7- Write the function's N section, if there is line information
+		if len(fn.Ns) > 0 {
+			d.write("[n]", true)
+			for _, n := range fn.Ns {
+				d.write(n, true)
+			}
 		}
 	}
 	return d.err
@@ -24,8 +24,8 @@ var (
 			src: AppendAny(SigVer(bytecode.Version()), Int64ToByteSlice(4), 't', 'e', 's', 't',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
 				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64,
-				// Ks - Ls - Is
-				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64),
+				// Ks - Ls - Us - Is - Ns
+				ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64),
 			exp: disasmComment + `
 [f]
 test
@@ -43,20 +43,21 @@ test
 			// Full valid func
 			src: AppendAny(SigVer(bytecode.Version()), Int64ToByteSlice(4), 't', 'e', 's', 't',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
-				Int64ToByteSlice(1), ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(2),
-				// Ks - Ls - Is
-				Int64ToByteSlice(2), 's', Int64ToByteSlice(1), 'a', 'i', Int64ToByteSlice(5), ExpZeroInt64, Int64ToByteSlice(5),
-				// 5 ops
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("PUSH"), bytecode.NewFlag("K"), 1))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("POP"), bytecode.NewFlag("V"), 0))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("PUSH"), bytecode.NewFlag("V"), 0))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("DUMP"), bytecode.NewFlag("Sn"), 1))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("RET"), bytecode.NewFlag("_"), 0))),
+				Int64ToByteSlice(2), ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(2),
+				// Ks - Ls - Us - Is - Ns
+				Int64ToByteSlice(2), 's', Int64ToByteSlice(1), 'a', 'i', Int64ToByteSlice(5), Int64ToByteSlice(1), ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(4),
+				// 4 ops
+				UInt64ToByteSlice(uint64(bytecode.NewInstrBx(bytecode.NewOpcode("LOADK"), 0, 1))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("ADD"), 1, 0, bytecode.RK(1)))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstrBx(bytecode.NewOpcode("DUMP"), 0, 1))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("RET"), 0, 1, 0))),
+				// Ns
+				ExpZeroInt64,
 			),
 			exp: disasmComment + `
 [f]
 test
-1
+2
 0
 0
 0
@@ -65,46 +66,47 @@ test
 sa
 i5
 [l]
+0
 [i]
-PUSH K 1
-POP V 0
-PUSH V 0
-DUMP Sn 1
-RET _ 0
+LOADK 0 1
+ADD 1 0 K1
+DUMP 0 1
+RET 0 1 0
 `,
 		},
 		3: {
 			// Many functions, valid
 			src: AppendAny(SigVer(bytecode.Version()), Int64ToByteSlice(4), 't', 'e', 's', 't',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
-				Int64ToByteSlice(3), ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(3),
-				// Ks - Ls - Is
-				Int64ToByteSlice(3), 's', Int64ToByteSlice(3), 'A', 'd', 'd', 'i', Int64ToByteSlice(4), 's', Int64ToByteSlice(3), '1', '9', '8', ExpZeroInt64, Int64ToByteSlice(8),
-				// 8 ops
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("PUSH"), bytecode.NewFlag("F"), 1))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("POP"), bytecode.NewFlag("V"), 0))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("PUSH"), bytecode.NewFlag("K"), 1))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("PUSH"), bytecode.NewFlag("K"), 2))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("PUSH"), bytecode.NewFlag("V"), 0))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("CALL"), bytecode.NewFlag("An"), 2))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("DUMP"), bytecode.NewFlag("Sn"), 1))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("RET"), bytecode.NewFlag("_"), 0))),
+				Int64ToByteSlice(4), ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(3),
+				// Ks - Ls - Us - Is - Ns
+				Int64ToByteSlice(3), 's', Int64ToByteSlice(3), 'A', 'd', 'd', 'i', Int64ToByteSlice(4), 's', Int64ToByteSlice(3), '1', '9', '8', Int64ToByteSlice(1), ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(7),
+				// 7 ops
+				UInt64ToByteSlice(uint64(bytecode.NewInstrBx(bytecode.NewOpcode("LOADF"), 0, 1))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("MOVE"), 1, 0, 0))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstrBx(bytecode.NewOpcode("LOADK"), 2, 1))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstrBx(bytecode.NewOpcode("LOADK"), 3, 2))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("CALL"), 1, 2, 0))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstrBx(bytecode.NewOpcode("DUMP"), 0, 1))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("RET"), 0, 1, 0))),
+				// Ns
+				ExpZeroInt64,
 				// 2nd fn
 				Int64ToByteSlice(3), 'A', 'd', 'd',
 				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
-				Int64ToByteSlice(2), Int64ToByteSlice(2), ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(2),
-				// Ks - Ls - Is
-				Int64ToByteSlice(2), 's', Int64ToByteSlice(1), 'x', 's', Int64ToByteSlice(1), 'y', ExpZeroInt64, Int64ToByteSlice(4),
-				// 4 ops
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("PUSH"), bytecode.NewFlag("V"), 0))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("PUSH"), bytecode.NewFlag("V"), 1))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("ADD"), bytecode.NewFlag("_"), 0))),
-				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("RET"), bytecode.NewFlag("_"), 0))),
+				Int64ToByteSlice(3), Int64ToByteSlice(2), ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(2),
+				// Ks - Ls - Us - Is - Ns
+				Int64ToByteSlice(2), 's', Int64ToByteSlice(1), 'x', 's', Int64ToByteSlice(1), 'y', Int64ToByteSlice(2), ExpZeroInt64, Int64ToByteSlice(1), ExpZeroInt64, Int64ToByteSlice(2),
+				// 2 ops
+				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("ADD"), 2, 0, 1))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("RET"), 0, 2, 0))),
+				// Ns
+				ExpZeroInt64,
 			),
 			exp: disasmComment + `
 [f]
 test
-3
+4
 0
 0
 0
@@ -114,18 +116,18 @@ sAdd
 i4
 s198
 [l]
+0
 [i]
-PUSH F 1
-POP V 0
-PUSH K 1
-PUSH K 2
-PUSH V 0
-CALL An 2
-DUMP Sn 1
-RET _ 0
+LOADF 0 1
+MOVE 1 0 0
+LOADK 2 1
+LOADK 3 2
+CALL 1 2 0
+DUMP 0 1
+RET 0 1 0
 [f]
 Add
-2
+3
 2
 0
 0
@@ -134,11 +136,42 @@ Add
 sx
 sy
 [l]
+0
+1
+[i]
+ADD 2 0 1
+RET 0 2 0
+`,
+		},
+		4: {
+			// Closure with upvalues
+			src: AppendAny(SigVer(bytecode.Version()), Int64ToByteSlice(4), 't', 'e', 's', 't',
+				// StackSz - ExpArgs - ParentFnIx - LineStart - LineEnd
+				Int64ToByteSlice(1), ExpZeroInt64, ExpZeroInt64, ExpZeroInt64, ExpZeroInt64,
+				// Ks - Ls - Us - Is - Ns
+				ExpZeroInt64, ExpZeroInt64, Int64ToByteSlice(2), Int64ToByteSlice(1), Int64ToByteSlice(3), ExpZeroInt64, Int64ToByteSlice(1), Int64ToByteSlice(2),
+				// 2 ops
+				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("GETU"), 0, 1, 0))),
+				UInt64ToByteSlice(uint64(bytecode.NewInstr(bytecode.NewOpcode("RET"), 0, 0, 0))),
+				// Ns
+				ExpZeroInt64,
+			),
+			exp: disasmComment + `
+[f]
+test
+1
+0
+0
+0
+0
+[k]
+[l]
+[u]
+L 3
+U 1
 [i]
-PUSH V 0
-PUSH V 1
-ADD _ 0
-RET _ 0
+GETU 0 1 0
+RET 0 0 0
 `,
 		},
 	}
@@ -40,11 +40,59 @@ var (
 	}
 )
 
+// The kind of a variable, as resolved by the emitter.
+type varKind int
+
+const (
+	varLocal  varKind = iota // a local variable, in a register
+	varUpval                 // an upvalue, captured from an enclosing function
+	varGlobal                // a global variable (a built-in), by name
+)
+
+var (
+	// The ids of the symbols that refer to variables. The built-ins are global variables.
+	varIds = map[string]bool{
+		"(name)": true, "import": true, "panic": true, "recover": true, "len": true,
+		"keys": true, "string": true, "number": true, "decimal": true, "bool": true,
+		"type": true, "status": true, "reset": true, "equal": true, "compare": true,
+		"sort": true,
+	}
+)
+
 type forData struct {
 	breaks []int
 	conts  []int
 }
 
+// A scope holds the variables of a function being emitted: its locals, as
+// slot indexes into its L table, and the variables of the enclosing functions
+// that it captures, as indexes into its U table. The locals are the first
+// registers of the function, followed by the temporary registers.
+type scope struct {
+	fn     *bytecode.Fn
+	locals map[string]int
+	upvals map[string]int
+	top    int // the first free temporary register
+}
+
+func newScope(fn *bytecode.Fn) *scope {
+	return &scope{
+		fn,
+		make(map[string]int),
+		make(map[string]int),
+		0,
+	}
+}
+
+// Define the local variable in the scope, if it is not already defined. Its
+// K index is set when it is first used.
+func (s *scope) define(nm string) {
+	if _, ok := s.locals[nm]; !ok {
+		s.locals[nm] = len(s.fn.Ls)
+		s.fn.Ls = append(s.fn.Ls, -1)
+	}
+}
+
 type kId struct {
 	v string
 	t bytecode.KType
@@ -62,9 +110,10 @@ const (
 type Emitter struct {
 	err     error
 	kMap    map[*bytecode.Fn]map[kId]int
-	stackSz map[*bytecode.Fn]int64
 	forNest map[*bytecode.Fn][]*forData
 	fnIx    []int64
+	scopes  []*scope
+	line    int64
 }
 
 // Emit takes a module identifier, the symbols generated by the parser (the headless *AST*),
@@ -75,17 +124,20 @@ func (e *Emitter) Emit(id string, syms []*parser.Symbol, scps *parser.Scope) (*b
 	// Reset the internal fields
 	e.err = nil
 	e.kMap = make(map[*bytecode.Fn]map[kId]int)
-	e.stackSz = make(map[*bytecode.Fn]int64)
 	e.forNest = make(map[*bytecode.Fn][]*forData)
+	e.line = 0
 
 	// Create the bytecode representation structure
 	f := bytecode.NewFile(id)
 	fn := new(bytecode.Fn)
 	fn.Header.Name = f.Name // Expected args and parent func are always 0 for top-level func
-	// TODO : Line start and end
 	f.Fns = append(f.Fns, fn)
 	e.fnIx = []int64{0}
+	e.scopes = []*scope{newScope(fn)}
+	e.declare(e.scopes[0], syms)
+	e.startTemps(fn)
 	e.emitBlock(f, fn, syms)
+	e.setLines(fn)
 	return f, e.err
 }
 
@@ -99,27 +151,35 @@ func (e *Emitter) emitFn(f *bytecode.File, sym *parser.Symbol) {
 	args := sym.First.([]*parser.Symbol)
 	fn.Header.ExpArgs = int64(len(args))
 	fn.Header.ParentFnIx = e.fnIx[len(e.fnIx)-1]
-	// TODO : Line Start, Line End
+	fn.Header.LineStart = e.line
 	f.Fns = append(f.Fns, fn)
 	e.fnIx = append(e.fnIx, int64(len(f.Fns)-1))
-	// Define the expected args in the K table - *MUST* be defined in spots 0..ExpArgs - 1
+	scp := newScope(fn)
+	e.scopes = append(e.scopes, scp)
+	// Define the expected args in the K table - *MUST* be defined in spots 0..ExpArgs - 1,
+	// and as the first locals, so that they are in slots 0..ExpArgs - 1
 	for _, arg := range args {
 		e.assert(arg.Ar == parser.ArName, errors.New("expected argument to have name arity"))
-		e.registerK(fn, arg.Val, true, true)
+		nm, _ := arg.Val.(string)
+		scp.define(nm)
+		fn.Ls[scp.locals[nm]] = int64(e.registerK(fn, nm, true))
 	}
 	stmts := sym.Second.([]*parser.Symbol)
+	e.declare(scp, stmts)
+	e.startTemps(fn)
 	e.emitBlock(f, fn, stmts)
+	e.setLines(fn)
 	// Cleanup map keys of this fn
 	e.fnIx = e.fnIx[:len(e.fnIx)-1]
+	e.scopes = e.scopes[:len(e.scopes)-1]
 	delete(e.kMap, fn)
-	delete(e.stackSz, fn)
 	delete(e.forNest, fn)
 }
 
 func (e *Emitter) emitAny(f *bytecode.File, fn *bytecode.Fn, sym *parser.Symbol, any interface{}) {
 	switch v := any.(type) {
 	case *parser.Symbol:
-		e.emitSymbol(f, fn, v, atFalse)
+		e.emitStmt(f, fn, v)
 	case []*parser.Symbol:
 		e.emitBlock(f, fn, v)
 	default:
@@ -129,177 +189,56 @@ func (e *Emitter) emitAny(f *bytecode.File, fn *bytecode.Fn, sym *parser.Symbol,
 
 func (e *Emitter) emitBlock(f *bytecode.File, fn *bytecode.Fn, syms []*parser.Symbol) {
 	for _, sym := range syms {
-		e.emitSymbol(f, fn, sym, atFalse)
+		e.emitStmt(f, fn, sym)
 	}
 }
 
-func (e *Emitter) emitShortcutIf(f *bytecode.File, fn *bytecode.Fn, parent *parser.Symbol, cond, truePart, falsePart interface{}) {
-	// Emit the condition
-	e.emitAny(f, fn, parent, cond)
-	// Next comes the TEST
-	tstIx := e.addTempInstr(fn)
-	// Then the true expression
-	e.emitAny(f, fn, parent, truePart)
-	// Then a jump over the false expression
-	jmpIx := e.addTempInstr(fn)
-	// Update the test instruction, here starts the false part
-	e.updateTestInstr(fn, tstIx)
-	// Emit the false expression
-	e.emitAny(f, fn, parent, falsePart)
-	// Update the jump instruction, to after the false part
-	e.updateJumpfInstr(fn, jmpIx)
+// Attribute the instructions to the line of the symbol, if it has a position.
+// It returns the function that restores the previous line.
+func (e *Emitter) setLine(sym *parser.Symbol) func() {
+	l := e.line
+	if pos := sym.Pos(); pos.IsValid() {
+		e.line = int64(pos.Line)
+	}
+	return func() { e.line = l }
 }
 
-func (e *Emitter) emitSymbol(f *bytecode.File, fn *bytecode.Fn, sym *parser.Symbol, asg asgType) {
+// Emit a statement. The temporary registers it uses are released once it is
+// emitted.
+func (e *Emitter) emitStmt(f *bytecode.File, fn *bytecode.Fn, sym *parser.Symbol) {
 	if e.err != nil {
 		return
 	}
+	defer e.setLine(sym)()
+	defer e.release(e.scope().top)
 	switch sym.Id {
-	case "nil":
-		e.assert(asg == atFalse, errors.New("invalid assignment to nil"))
-		e.addInstr(fn, bytecode.OP_PUSH, bytecode.FLG_N, 0)
-	case "(name)", "import", "panic", "recover", "len", "keys", "string", "number",
-		"bool", "type", "status", "reset": // TODO : Cleaner way to handle all builtins
-		// Register the symbol, may or may not be a local
-		e.assert(sym.Ar == parser.ArName || sym.Ar == parser.ArLiteral, errors.New("expected `"+sym.Id+"` to have name or literal arity"))
-		kix := e.registerK(fn, sym.Val, true, asg == atDefine)
-		if asg != atFalse {
-			e.addInstr(fn, bytecode.OP_POP, bytecode.FLG_V, kix)
-		} else if sym.Ar == parser.ArLiteral {
-			e.addInstr(fn, bytecode.OP_PUSH, bytecode.FLG_K, kix)
-		} else {
-			e.addInstr(fn, bytecode.OP_PUSH, bytecode.FLG_V, kix)
-		}
-	case "(literal)", "true", "false":
-		// Register the symbol
-		e.assert(asg == atFalse, errors.New("invalid assignment to a literal"))
-		e.assert(sym.Ar == parser.ArLiteral, errors.New("expected `"+sym.Id+"` to have literal arity"))
-		kix := e.registerK(fn, sym.Val, false, false)
-		e.addInstr(fn, bytecode.OP_PUSH, bytecode.FLG_K, kix)
-	case "this":
-		e.assert(asg == atFalse, errors.New("invalid assignment to the `this` keyword"))
-		e.addInstr(fn, bytecode.OP_PUSH, bytecode.FLG_T, 0)
-	case "args":
-		e.assert(asg == atFalse, errors.New("invalid assignment to the `args` keyword"))
-		e.addInstr(fn, bytecode.OP_PUSH, bytecode.FLG_A, 0)
-	case ".", "[":
+	case ":=", "=":
 		e.assert(sym.Ar == parser.ArBinary, errors.New("expected `"+sym.Id+"` to have binary arity"))
-		e.emitSymbol(f, fn, sym.Second.(*parser.Symbol), atFalse)
-		e.emitSymbol(f, fn, sym.First.(*parser.Symbol), atFalse)
-		if asg != atFalse {
-			e.addInstr(fn, bytecode.OP_SFLD, bytecode.FLG__, 0)
-		} else {
-			e.addInstr(fn, bytecode.OP_GFLD, bytecode.FLG__, 0)
-		}
-	case ":=":
-		e.assert(sym.Ar == parser.ArBinary, errors.New("expected `:=` to have binary arity"))
-		e.emitSymbol(f, fn, sym.Second.(*parser.Symbol), atFalse)
-		e.emitSymbol(f, fn, sym.First.(*parser.Symbol), atDefine)
-	case "!":
-		e.assert(sym.Ar == parser.ArUnary, errors.New("expected `!` to have unary arity"))
-		e.emitSymbol(f, fn, sym.First.(*parser.Symbol), atFalse)
-		e.addInstr(fn, unrSym2op[sym.Id], bytecode.FLG__, 0)
-	case "-":
-		if sym.Ar == parser.ArUnary {
-			e.emitSymbol(f, fn, sym.First.(*parser.Symbol), atFalse)
-			e.addInstr(fn, unrSym2op[sym.Id], bytecode.FLG__, 0)
-			break
-		}
-		fallthrough
-	case "+", "*", "/", "%", "<", ">", "<=", ">=", "==", "!=":
-		e.assert(sym.Ar == parser.ArBinary, errors.New("expected `"+sym.Id+"` to have binary arity"))
-		e.emitSymbol(f, fn, sym.First.(*parser.Symbol), atFalse)
-		e.emitSymbol(f, fn, sym.Second.(*parser.Symbol), atFalse)
-		e.addInstr(fn, binSym2op[sym.Id], bytecode.FLG__, 0)
-	case "&&", "||":
-		e.assert(sym.Ar == parser.ArBinary, errors.New("expected `"+sym.Id+"` to have binary arity"))
-		if sym.Id == "&&" {
-			// Equivalent to if <first> then <second> else <first>
-			e.emitShortcutIf(f, fn, sym, sym.First, sym.Second, sym.First)
-		} else {
-			// Equivalent to if <first> then <first> else <second>
-			e.emitShortcutIf(f, fn, sym, sym.First, sym.First, sym.Second)
-		}
-	case "=":
-		e.assert(sym.Ar == parser.ArBinary, errors.New("expected `=` to have binary arity"))
-		e.emitSymbol(f, fn, sym.Second.(*parser.Symbol), atFalse)
-		left := sym.First.(*parser.Symbol)
-		if left.Id == "." {
-			// Emit left, which will generate a SFLD
-			e.emitSymbol(f, fn, left, atTrue)
-		} else {
-			// Emit a standard POP instruction
-			e.emitSymbol(f, fn, left, atTrue)
-		}
+		e.emitStore(f, fn, sym.First.(*parser.Symbol), sym.Second.(*parser.Symbol), sym.Id == ":=")
 	case "+=", "-=", "*=", "/=", "%=":
 		e.assert(sym.Ar == parser.ArBinary, errors.New("expected `"+sym.Id+"` to have binary arity"))
-		e.emitSymbol(f, fn, sym.First.(*parser.Symbol), atFalse)
-		e.emitSymbol(f, fn, sym.Second.(*parser.Symbol), atFalse)
-		e.addInstr(fn, binAsgSym2op[sym.Id], bytecode.FLG__, 0)
-		e.emitSymbol(f, fn, sym.First.(*parser.Symbol), atTrue)
+		e.emitUpdate(f, fn, sym.First.(*parser.Symbol), binAsgSym2op[sym.Id], sym.Second.(*parser.Symbol))
 	case "++", "--":
 		e.assert(sym.Ar == parser.ArStatement, errors.New("expected `"+sym.Id+"` to have statement arity"))
-		e.emitSymbol(f, fn, sym.First.(*parser.Symbol), atFalse)
 		// Implicit `1` constant
-		ix := e.registerK(fn, "1", false, false)
-		e.addInstr(fn, bytecode.OP_PUSH, bytecode.FLG_K, ix)
-		e.addInstr(fn, unrSym2op[sym.Id], bytecode.FLG__, 0)
-		e.emitSymbol(f, fn, sym.First.(*parser.Symbol), atTrue)
+		one := &parser.Symbol{Id: "(literal)", Ar: parser.ArLiteral, Val: "1"}
+		e.emitUpdate(f, fn, sym.First.(*parser.Symbol), unrSym2op[sym.Id], one)
 	case "func":
-		funcIx := len(f.Fns) // New Fn will be added at this index
-		if sym.Name != "" {
-			// Function defined as a statement, register the name as a K,
-			// and push the function's value into this variable.
-			kix := e.registerK(fn, sym.Name, true, true)
-			e.addInstr(fn, bytecode.OP_PUSH, bytecode.FLG_F, uint64(funcIx))
-			e.addInstr(fn, bytecode.OP_POP, bytecode.FLG_V, kix)
-		}
-		e.emitFn(f, sym)
 		if sym.Name == "" {
-			// Func defined as an expression, must be pushed on the stack
-			e.addInstr(fn, bytecode.OP_PUSH, bytecode.FLG_F, uint64(funcIx))
-		}
-	case "(":
-		e.assert(sym.Ar == parser.ArBinary || sym.Ar == parser.ArTernary, errors.New("expected `(` to have binary or ternary arity"))
-		// Push parameters
-		var parms []*parser.Symbol
-		var op bytecode.Opcode
-		if sym.Ar == parser.ArBinary {
-			parms = sym.Second.([]*parser.Symbol)
-			op = bytecode.OP_CALL
-		} else {
-			parms = sym.Third.([]*parser.Symbol)
-			op = bytecode.OP_CFLD
-		}
-		for _, parm := range parms {
-			e.emitSymbol(f, fn, parm, atFalse)
-		}
-		// If ternary, push field (Second)
-		if sym.Ar == parser.ArTernary {
-			e.emitSymbol(f, fn, sym.Second.(*parser.Symbol), atFalse)
-		}
-		// Push function name (or parent object of the field if ternary)
-		e.emitSymbol(f, fn, sym.First.(*parser.Symbol), atFalse)
-		// Call
-		e.addInstr(fn, op, bytecode.FLG_An, uint64(len(parms)))
-	case "{":
-		e.assert(sym.Ar == parser.ArUnary, errors.New("expected `{` to have unary arity"))
-		ln := 0
-		if !e.isEmpty(sym.First) {
-			e.emitAny(f, fn, sym, sym.First)
-			if ar, ok := sym.First.([]*parser.Symbol); ok {
-				ln = len(ar)
-			}
+			// Func defined as an expression, its value is discarded
+			e.emitExpr(f, fn, sym, e.alloc(fn))
+			break
 		}
-		e.addInstr(fn, bytecode.OP_NEW, bytecode.FLG__, uint64(ln))
-	case "?":
-		// Similar to if, but yields a value
-		e.assert(sym.Ar == parser.ArTernary, errors.New("expected `?` to have ternary arity"))
-		e.emitShortcutIf(f, fn, sym, sym.First, sym.Second, sym.Third)
+		// Function defined as a statement, load the function's value into the
+		// local variable.
+		kind, ix := e.resolve(sym.Name)
+		e.assert(kind == varLocal, errors.New("expected `"+sym.Name+"` to be a local variable"))
+		e.addInstrBx(fn, bytecode.OP_LOADF, ix, len(f.Fns))
+		e.emitFn(f, sym)
 	case "if":
 		e.assert(sym.Ar == parser.ArStatement, errors.New("expected `if` to have statement arity"))
 		// First is the condition, always a *Symbol
-		e.emitSymbol(f, fn, sym.First.(*parser.Symbol), atFalse)
+		c := e.emitCond(f, fn, sym.First)
 		// Next comes the TEST, but we don't know yet how many instructions to jump
 		// insert a placeholder (invalid op) so that it fails explicitly should it ever make it to
 		// the VM.
@@ -307,17 +246,17 @@ func (e *Emitter) emitSymbol(f *bytecode.File, fn *bytecode.Fn, sym *parser.Symb
 		// Then comes the body
 		e.emitBlock(f, fn, sym.Second.([]*parser.Symbol))
 		// Update the test instruction, now that we know where to jump to
-		e.updateTestInstr(fn, tstIx)
+		e.updateTestInstr(fn, tstIx, c)
 		// Then comes the ELSE/ELSE IF, maybe
 		if sym.Third != nil {
 			// If so, insert a jump over the else part
 			jmpIx := e.addTempInstr(fn)
 			// And re-update the test instruction, since an instr was added
-			e.updateTestInstr(fn, tstIx)
+			e.updateTestInstr(fn, tstIx, c)
 			// Emit the else or else-if part
 			e.emitAny(f, fn, sym, sym.Third)
 			// Update the jump instruction now that we know how many instrs to jump over
-			e.updateJumpfInstr(fn, jmpIx)
+			e.updateJumpInstr(fn, jmpIx)
 		}
 	case "forr":
 		// For-range notation, distinct from regular for
@@ -326,22 +265,25 @@ func (e *Emitter) emitSymbol(f *bytecode.File, fn *bytecode.Fn, sym *parser.Symb
 		e.assert(assign.Id == "=" || assign.Id == ":=", errors.New("left hand side of `for...range` must be `=` or `:=`"))
 		rng := assign.Second.(*parser.Symbol)
 		e.assert(rng.Id == "range", errors.New("right hand side of `for...range` must be the `range` keyword"))
-		// Push `range` args onto the stack
+		// Load the `range` args in consecutive registers
 		args := rng.First.([]*parser.Symbol)
-		e.emitBlock(f, fn, args)
+		base := e.emitArgs(f, fn, args)
 		// Start the `range` coroutine
-		e.addInstr(fn, bytecode.OP_RNGS, bytecode.FLG_An, uint64(len(args)))
-		// For loop officially starts here
+		e.addInstr(fn, bytecode.OP_RNGS, base, len(args), 0)
+		e.release(base)
+		// The iteration var receives the values directly if it is a local variable,
+		// otherwise through a temporary register
+		left := assign.First.(*parser.Symbol)
+		r, ok := e.local(left)
+		if !ok {
+			r = e.alloc(fn)
+		}
+		// For loop officially starts here, get one value from the coro (until multiple
+		// vals are supported), or jump to the end of the loop
 		start := len(fn.Is)
-		// Push one value from the coro (until multiple vals are supported), + condition
-		e.addInstr(fn, bytecode.OP_RNGP, bytecode.FLG_An, 1)
-		// Test the end of loop
-		tstIx := e.addTempInstr(fn)
-		// Pop the top value from the stack into the iteration var
-		if assign.Id == "=" {
-			e.emitSymbol(f, fn, assign.First.(*parser.Symbol), atTrue)
-		} else {
-			e.emitSymbol(f, fn, assign.First.(*parser.Symbol), atDefine)
+		rngIx := e.addTempInstr(fn)
+		if !ok {
+			e.emitStoreRK(f, fn, left, r, assign.Id == ":=")
 		}
 		// Emit the body
 		e.startFor(fn)
@@ -349,17 +291,17 @@ func (e *Emitter) emitSymbol(f *bytecode.File, fn *bytecode.Fn, sym *parser.Symb
 		// Update the continue statements (must jump to the next statement)
 		e.updateForJmp(fn, false)
 		// Add the jump back to RNGP instruction
-		e.addInstr(fn, bytecode.OP_JMP, bytecode.FLG_Jb, uint64(len(fn.Is)-start))
+		e.addInstrSBx(fn, bytecode.OP_JMP, 0, start-len(fn.Is)-1)
 		// Break statements must jump to the next statement (RNGE)
 		e.updateForJmp(fn, true)
-		// Update the test instruction to jump to the next statement (RNGE)
-		e.updateTestInstr(fn, tstIx)
+		// Update the range instruction to jump to the next statement (RNGE)
+		fn.Is[rngIx] = bytecode.NewInstrSBx(bytecode.OP_RNGP, r, len(fn.Is)-rngIx-1)
 		e.endFor(fn)
 		// Emit the range end (clear coroutine) statement
-		e.addInstr(fn, bytecode.OP_RNGE, bytecode.FLG__, 0)
+		e.addInstr(fn, bytecode.OP_RNGE, 0, 0, 0)
 
 	case "for":
-		var tstIx int
+		var tstIx, c int
 		var parts []interface{}
 		var ok bool
 		start := len(fn.Is)
@@ -379,7 +321,7 @@ func (e *Emitter) emitSymbol(f *bytecode.File, fn *bytecode.Fn, sym *parser.Symb
 				cond = sym.First
 			}
 			// Emit the condition
-			e.emitAny(f, fn, sym, cond)
+			c = e.emitCond(f, fn, cond)
 			// Add a test instruction placeholder
 			tstIx = e.addTempInstr(fn)
 		}
@@ -393,10 +335,10 @@ func (e *Emitter) emitSymbol(f *bytecode.File, fn *bytecode.Fn, sym *parser.Symb
 			e.emitAny(f, fn, sym, parts[2])
 		}
 		// Add the jump-back to for condition instruction (or for body start if no condition)
-		e.addInstr(fn, bytecode.OP_JMP, bytecode.FLG_Jb, uint64(len(fn.Is)-start))
+		e.addInstrSBx(fn, bytecode.OP_JMP, 0, start-len(fn.Is)-1)
 		if !empty {
 			// Update the test instruction
-			e.updateTestInstr(fn, tstIx)
+			e.updateTestInstr(fn, tstIx, c)
 		}
 		// The break statements must jump to the next statement (after the whole for loop)
 		e.updateForJmp(fn, true)
@@ -407,32 +349,302 @@ func (e *Emitter) emitSymbol(f *bytecode.File, fn *bytecode.Fn, sym *parser.Symb
 		if sym.First != nil {
 			// If present, it must be a literal number
 			ix, err = strconv.ParseInt(sym.First.(*parser.Symbol).Val.(string), 10, 64)
-			e.assert(err == nil, errors.New("invalid number literal"))
+			e.assert(err == nil && ix <= bytecode.MaxBx, errors.New("invalid number literal"))
 		}
-		e.addInstr(fn, bytecode.OP_DUMP, bytecode.FLG_Sn, uint64(ix))
+		e.addInstrBx(fn, bytecode.OP_DUMP, 0, int(ix))
 	case "break":
 		e.assert(len(e.forNest[fn]) > 0, errors.New("invalid break statement outside any `for` loop"))
 		e.addForData(fn, true, e.addTempInstr(fn))
 	case "continue":
 		e.assert(len(e.forNest[fn]) > 0, errors.New("invalid continue statement outside any `for` loop"))
 		e.addForData(fn, false, e.addTempInstr(fn))
+	case "return":
+		// Returning the result of a call is a tail call, it returns from this function
+		if ret := sym.First.(*parser.Symbol); ret.Id == "(" {
+			e.emitCall(f, fn, ret, e.alloc(fn), true)
+			break
+		}
+		v := e.emitRK(f, fn, sym.First.(*parser.Symbol))
+		e.addInstr(fn, bytecode.OP_RET, 0, v, 0)
+	default:
+		// An expression used as a statement, its value is discarded
+		e.emitExpr(f, fn, sym, e.alloc(fn))
+	}
+}
+
+// Emit the instructions that compute the value of the expression into the
+// register dst.
+func (e *Emitter) emitExpr(f *bytecode.File, fn *bytecode.Fn, sym *parser.Symbol, dst int) {
+	if e.err != nil {
+		return
+	}
+	defer e.setLine(sym)()
+	if varIds[sym.Id] {
+		// Resolve the symbol, may be a local, an upvalue or a global (built-in)
+		e.assert(sym.Ar == parser.ArName || sym.Ar == parser.ArLiteral, errors.New("expected `"+sym.Id+"` to have name or literal arity"))
+		if sym.Ar == parser.ArLiteral {
+			// A field name
+			e.addInstrBx(fn, bytecode.OP_LOADK, dst, e.registerK(fn, sym.Val, true))
+			return
+		}
+		nm, _ := sym.Val.(string)
+		switch kind, ix := e.resolve(nm); kind {
+		case varLocal:
+			if ix != dst {
+				e.addInstr(fn, bytecode.OP_MOVE, dst, ix, 0)
+			}
+		case varUpval:
+			e.addInstr(fn, bytecode.OP_GETU, dst, ix, 0)
+		default:
+			e.addInstrBx(fn, bytecode.OP_GETG, dst, ix)
+		}
+		return
+	}
+	mark := e.scope().top
+	switch sym.Id {
+	case "nil":
+		e.addInstr(fn, bytecode.OP_LOADN, dst, 0, 0)
+	case "(literal)", "true", "false":
+		// Register the symbol
+		e.assert(sym.Ar == parser.ArLiteral, errors.New("expected `"+sym.Id+"` to have literal arity"))
+		e.addInstrBx(fn, bytecode.OP_LOADK, dst, e.registerK(fn, sym.Val, false))
+	case "this":
+		e.addInstr(fn, bytecode.OP_LOADT, dst, 0, 0)
+	case "args":
+		e.addInstr(fn, bytecode.OP_LOADA, dst, 0, 0)
+	case ".", "[":
+		e.assert(sym.Ar == parser.ArBinary, errors.New("expected `"+sym.Id+"` to have binary arity"))
+		k := e.emitRK(f, fn, sym.Second.(*parser.Symbol))
+		o := e.emitReg(f, fn, sym.First.(*parser.Symbol))
+		e.addInstr(fn, bytecode.OP_GFLD, dst, o, k)
+	case "!":
+		e.assert(sym.Ar == parser.ArUnary, errors.New("expected `!` to have unary arity"))
+		e.addInstr(fn, unrSym2op[sym.Id], dst, e.emitRK(f, fn, sym.First.(*parser.Symbol)), 0)
+	case "-":
+		if sym.Ar == parser.ArUnary {
+			e.addInstr(fn, unrSym2op[sym.Id], dst, e.emitRK(f, fn, sym.First.(*parser.Symbol)), 0)
+			break
+		}
+		fallthrough
+	case "+", "*", "/", "%", "<", ">", "<=", ">=", "==", "!=":
+		e.assert(sym.Ar == parser.ArBinary, errors.New("expected `"+sym.Id+"` to have binary arity"))
+		ops := e.emitOperands(f, fn, sym.First.(*parser.Symbol), sym.Second.(*parser.Symbol))
+		e.addInstr(fn, binSym2op[sym.Id], dst, ops[0], ops[1])
+	case "&&", "||", "?":
+		e.emitShortcutIf(f, fn, sym, dst)
+	case "func":
+		e.addInstrBx(fn, bytecode.OP_LOADF, dst, len(f.Fns))
+		e.emitFn(f, sym)
+	case "(":
+		e.emitCall(f, fn, sym, dst, false)
+	case "{":
+		e.assert(sym.Ar == parser.ArUnary, errors.New("expected `{` to have unary arity"))
+		// The object is built in a temporary register if the destination is a
+		// variable, since the fields may refer to it.
+		o := e.tempFor(fn, dst)
+		e.addInstr(fn, bytecode.OP_NEW, o, 0, 0)
+		if fields, ok := sym.First.([]*parser.Symbol); ok {
+			for _, v := range fields {
+				m := e.scope().top
+				val := e.emitRK(f, fn, v)
+				k := e.rkK(fn, e.registerK(fn, v.Key, true))
+				e.addInstr(fn, bytecode.OP_SFLD, o, k, val)
+				e.release(m)
+			}
+		}
+		e.move(fn, dst, o)
 	case "yield":
 		e.assert(len(e.fnIx) > 1, errors.New("cannot yield from the top-level module function"))
-		// Push the value to yield
-		e.emitSymbol(f, fn, sym.First.(*parser.Symbol), atFalse)
-		// Yield
-		e.addInstr(fn, bytecode.OP_YLD, bytecode.FLG__, 0)
-	case "return":
-		e.emitSymbol(f, fn, sym.First.(*parser.Symbol), atFalse)
-		e.addInstr(fn, bytecode.OP_RET, bytecode.FLG__, 0)
+		e.addInstr(fn, bytecode.OP_YLD, dst, e.emitRK(f, fn, sym.First.(*parser.Symbol)), 0)
 	default:
 		e.err = errors.New("unexpected symbol id: " + sym.Id)
 	}
-	// After treating the symbol, if it had a Key value, push the Key name
-	if sym.Key != nil {
-		// Can be on name, literal, func call, any operator, hard to assert...
-		kix := e.registerK(fn, sym.Key, true, false)
-		e.addInstr(fn, bytecode.OP_PUSH, bytecode.FLG_K, kix)
+	e.release(mark)
+}
+
+// Emit the instructions that compute the value of the expression, and return
+// the B or C operand that refers to it: the constant or the register of a
+// local variable if it is one, otherwise a temporary register.
+func (e *Emitter) emitRK(f *bytecode.File, fn *bytecode.Fn, sym *parser.Symbol) int {
+	switch {
+	case sym.Id == "(literal)" || sym.Id == "true" || sym.Id == "false":
+		return e.rkK(fn, e.registerK(fn, sym.Val, false))
+	case varIds[sym.Id] && sym.Ar == parser.ArLiteral:
+		return e.rkK(fn, e.registerK(fn, sym.Val, true))
+	}
+	return e.emitReg(f, fn, sym)
+}
+
+// Emit the instructions that compute the value of the expression, and return
+// the register that holds it: the register of a local variable if it is one,
+// otherwise a temporary register.
+func (e *Emitter) emitReg(f *bytecode.File, fn *bytecode.Fn, sym *parser.Symbol) int {
+	if r, ok := e.local(sym); ok {
+		return r
+	}
+	r := e.alloc(fn)
+	e.emitExpr(f, fn, sym, r)
+	return r
+}
+
+// Emit the operands of an instruction, in order. A local variable is copied in
+// a temporary register if a following operand may modify it, so that its value
+// is the one before the evaluation of the following operands.
+func (e *Emitter) emitOperands(f *bytecode.File, fn *bytecode.Fn, syms ...*parser.Symbol) []int {
+	ops := make([]int, len(syms))
+	for i, sym := range syms {
+		if r, ok := e.local(sym); ok && e.hasCall(syms[i+1:]) {
+			ops[i] = e.alloc(fn)
+			e.addInstr(fn, bytecode.OP_MOVE, ops[i], r, 0)
+			continue
+		}
+		ops[i] = e.emitRK(f, fn, sym)
+	}
+	return ops
+}
+
+// Emit the expressions in consecutive temporary registers, and return the first
+// register.
+func (e *Emitter) emitArgs(f *bytecode.File, fn *bytecode.Fn, syms []*parser.Symbol) int {
+	base := e.scope().top
+	for _, sym := range syms {
+		r := e.alloc(fn)
+		e.emitExpr(f, fn, sym, r)
+		e.release(r + 1)
+	}
+	return base
+}
+
+// Emit a function or method call. The function (or the object) and the arguments
+// must be in consecutive registers, the result is returned in the first one. A
+// tail call returns the result from the function instead.
+func (e *Emitter) emitCall(f *bytecode.File, fn *bytecode.Fn, sym *parser.Symbol, dst int, tail bool) {
+	call, cfld := bytecode.OP_CALL, bytecode.OP_CFLD
+	if tail {
+		call, cfld = bytecode.OP_TCALL, bytecode.OP_TCFLD
+	}
+	e.assert(sym.Ar == parser.ArBinary || sym.Ar == parser.ArTernary, errors.New("expected `(` to have binary or ternary arity"))
+	base := dst
+	if !e.isTemp(dst) || dst != e.scope().top-1 {
+		base = e.alloc(fn)
+	}
+	e.emitExpr(f, fn, sym.First.(*parser.Symbol), base)
+	if sym.Ar == parser.ArBinary {
+		parms := sym.Second.([]*parser.Symbol)
+		e.emitArgs(f, fn, parms)
+		e.addInstr(fn, call, base, len(parms), 0)
+	} else {
+		// The field is evaluated after the arguments, so that they immediately
+		// follow the object
+		parms := sym.Third.([]*parser.Symbol)
+		e.emitArgs(f, fn, parms)
+		k := e.emitRK(f, fn, sym.Second.(*parser.Symbol))
+		e.addInstr(fn, cfld, base, k, len(parms))
+	}
+	e.release(base + 1)
+	e.move(fn, dst, base)
+}
+
+// Emit the `&&`, `||` and ternary `?` operators, which only evaluate the operands
+// that are required.
+func (e *Emitter) emitShortcutIf(f *bytecode.File, fn *bytecode.Fn, sym *parser.Symbol, dst int) {
+	e.assert(sym.Ar == parser.ArBinary || sym.Ar == parser.ArTernary, errors.New("expected `"+sym.Id+"` to have binary or ternary arity"))
+	// The value is computed in a temporary register if the destination is a
+	// variable, since the operands may refer to it.
+	r := e.tempFor(fn, dst)
+	switch sym.Id {
+	case "&&":
+		// Equivalent to if <first> then <second> else <first>
+		e.emitExpr(f, fn, sym.First.(*parser.Symbol), r)
+		tstIx := e.addTempInstr(fn)
+		e.emitExpr(f, fn, sym.Second.(*parser.Symbol), r)
+		e.updateTestInstr(fn, tstIx, r)
+	case "||":
+		// Equivalent to if <first> then <first> else <second>
+		e.emitExpr(f, fn, sym.First.(*parser.Symbol), r)
+		tstIx := e.addTempInstr(fn)
+		jmpIx := e.addTempInstr(fn)
+		e.updateTestInstr(fn, tstIx, r)
+		e.emitExpr(f, fn, sym.Second.(*parser.Symbol), r)
+		e.updateJumpInstr(fn, jmpIx)
+	default:
+		// Similar to if, but yields a value
+		c := e.emitCond(f, fn, sym.First)
+		tstIx := e.addTempInstr(fn)
+		e.emitExpr(f, fn, sym.Second.(*parser.Symbol), r)
+		jmpIx := e.addTempInstr(fn)
+		e.updateTestInstr(fn, tstIx, c)
+		e.emitExpr(f, fn, sym.Third.(*parser.Symbol), r)
+		e.updateJumpInstr(fn, jmpIx)
+	}
+	e.move(fn, dst, r)
+}
+
+// Emit the condition of a test, and return the register that holds its value.
+func (e *Emitter) emitCond(f *bytecode.File, fn *bytecode.Fn, cond interface{}) int {
+	sym, ok := cond.(*parser.Symbol)
+	if !ok {
+		e.assert(false, errors.New("expected condition to be a symbol"))
+		return 0
+	}
+	return e.emitReg(f, fn, sym)
+}
+
+// Emit the assignment of the value of the expression rhs to the variable or
+// the field lhs. If define is true, lhs must be a local variable.
+func (e *Emitter) emitStore(f *bytecode.File, fn *bytecode.Fn, lhs, rhs *parser.Symbol, define bool) {
+	if lhs.Id == "." || lhs.Id == "[" {
+		// The value is evaluated first, then the key and the object
+		ops := e.emitOperands(f, fn, rhs, lhs.Second.(*parser.Symbol), lhs.First.(*parser.Symbol))
+		e.addInstr(fn, bytecode.OP_SFLD, e.toReg(fn, ops[2]), ops[1], ops[0])
+		return
+	}
+	if r, ok := e.local(lhs); ok {
+		// Compute the value directly in the local variable
+		e.emitExpr(f, fn, rhs, r)
+		return
+	}
+	e.emitStoreRK(f, fn, lhs, e.emitRK(f, fn, rhs), define)
+}
+
+// Emit the assignment of the operand v to the variable or the field lhs. If
+// define is true, lhs must be a local variable.
+func (e *Emitter) emitStoreRK(f *bytecode.File, fn *bytecode.Fn, lhs *parser.Symbol, v int, define bool) {
+	if lhs.Id == "." || lhs.Id == "[" {
+		k := e.emitRK(f, fn, lhs.Second.(*parser.Symbol))
+		o := e.emitReg(f, fn, lhs.First.(*parser.Symbol))
+		e.addInstr(fn, bytecode.OP_SFLD, o, k, v)
+		return
+	}
+	switch kind, ix := e.resolveLhs(lhs, define); kind {
+	case varLocal:
+		e.move(fn, ix, v)
+	case varUpval:
+		e.addInstr(fn, bytecode.OP_SETU, ix, v, 0)
+	}
+}
+
+// Emit an assignment operator (e.g. `+=`) or an increment/decrement statement:
+// the operation op is applied to lhs and rhs, and the result is stored in lhs.
+func (e *Emitter) emitUpdate(f *bytecode.File, fn *bytecode.Fn, lhs *parser.Symbol, op bytecode.Opcode, rhs *parser.Symbol) {
+	if lhs.Id == "." || lhs.Id == "[" {
+		// The key and the object are evaluated twice, once to get the field and
+		// once to set it
+		r := e.alloc(fn)
+		e.emitExpr(f, fn, lhs, r)
+		e.addInstr(fn, op, r, r, e.emitRK(f, fn, rhs))
+		e.emitStoreRK(f, fn, lhs, r, false)
+		return
+	}
+	switch kind, ix := e.resolveLhs(lhs, false); kind {
+	case varLocal:
+		ops := e.emitOperands(f, fn, lhs, rhs)
+		e.addInstr(fn, op, ix, ops[0], ops[1])
+	case varUpval:
+		r := e.alloc(fn)
+		e.addInstr(fn, bytecode.OP_GETU, r, ix, 0)
+		e.addInstr(fn, op, r, r, e.emitRK(f, fn, rhs))
+		e.addInstr(fn, bytecode.OP_SETU, ix, r, 0)
 	}
 }
 
@@ -453,7 +665,7 @@ func (e *Emitter) updateForJmp(fn *bytecode.Fn, br bool) {
 		sl = f.conts
 	}
 	for _, ix := range sl {
-		e.updateJumpfInstr(fn, ix)
+		e.updateJumpInstr(fn, ix)
 	}
 }
 
@@ -483,46 +695,176 @@ func (e *Emitter) isEmpty(v interface{}) bool {
 }
 
 func (e *Emitter) addTempInstr(fn *bytecode.Fn) int {
-	e.addInstr(fn, bytecode.OP_INVL, bytecode.FLG_INVL, 0)
+	e.appendInstr(fn, bytecode.NewInstr(bytecode.OP_INVL, 0, 0, 0))
 	return len(fn.Is) - 1
 }
 
-func (e *Emitter) updateTestInstr(fn *bytecode.Fn, ix int) {
-	fn.Is[ix] = bytecode.NewInstr(bytecode.OP_TEST, bytecode.FLG_Jf, uint64(len(fn.Is)-ix-1))
+func (e *Emitter) updateTestInstr(fn *bytecode.Fn, ix int, r int) {
+	fn.Is[ix] = bytecode.NewInstrSBx(bytecode.OP_TEST, r, len(fn.Is)-ix-1)
+}
+
+func (e *Emitter) updateJumpInstr(fn *bytecode.Fn, ix int) {
+	fn.Is[ix] = bytecode.NewInstrSBx(bytecode.OP_JMP, 0, len(fn.Is)-ix-1)
+}
+
+func (e *Emitter) addInstr(fn *bytecode.Fn, op bytecode.Opcode, a, b, c int) {
+	e.appendInstr(fn, bytecode.NewInstr(op, a, b, c))
 }
 
-func (e *Emitter) updateJumpfInstr(fn *bytecode.Fn, ix int) {
-	fn.Is[ix] = bytecode.NewInstr(bytecode.OP_JMP, bytecode.FLG_Jf, uint64(len(fn.Is)-ix-1))
+func (e *Emitter) addInstrBx(fn *bytecode.Fn, op bytecode.Opcode, a, bx int) {
+	e.appendInstr(fn, bytecode.NewInstrBx(op, a, bx))
 }
 
-func (e *Emitter) addInstr(fn *bytecode.Fn, op bytecode.Opcode, flg bytecode.Flag, ix uint64) {
+func (e *Emitter) addInstrSBx(fn *bytecode.Fn, op bytecode.Opcode, a, sbx int) {
+	e.appendInstr(fn, bytecode.NewInstrSBx(op, a, sbx))
+}
+
+func (e *Emitter) appendInstr(fn *bytecode.Fn, i bytecode.Instr) {
 	if e.err != nil {
 		return
 	}
-	switch op {
-	case bytecode.OP_PUSH:
-		e.stackSz[fn] += 1
-	case bytecode.OP_NEW:
-		e.stackSz[fn] += (1 - (2 * int64(ix)))
-	case bytecode.OP_POP, bytecode.OP_RET, bytecode.OP_UNM, bytecode.OP_NOT, bytecode.OP_TEST,
-		bytecode.OP_LT, bytecode.OP_LTE, bytecode.OP_GT, bytecode.OP_GTE, bytecode.OP_EQ,
-		bytecode.OP_ADD, bytecode.OP_SUB, bytecode.OP_MUL,
-		bytecode.OP_DIV, bytecode.OP_MOD, bytecode.OP_GFLD, bytecode.OP_NEQ:
-		e.stackSz[fn] -= 1
-	case bytecode.OP_SFLD:
-		e.stackSz[fn] -= 3
-	case bytecode.OP_CALL:
-		e.stackSz[fn] -= (int64(ix) + 1)
-	case bytecode.OP_CFLD:
-		e.stackSz[fn] -= (int64(ix) + 2)
-	}
-	if e.stackSz[fn] > fn.Header.StackSz {
-		fn.Header.StackSz = e.stackSz[fn]
-	}
-	fn.Is = append(fn.Is, bytecode.NewInstr(op, flg, ix))
-}
-
-func (e *Emitter) registerK(fn *bytecode.Fn, val interface{}, isName bool, local bool) uint64 {
+	fn.Is = append(fn.Is, i)
+	fn.Ns = append(fn.Ns, e.line)
+}
+
+// Copy the operand src (a register or a constant) in the register dst, if it
+// is not already there.
+func (e *Emitter) move(fn *bytecode.Fn, dst, src int) {
+	if bytecode.IsK(src) {
+		e.addInstrBx(fn, bytecode.OP_LOADK, dst, src&bytecode.MaxRK)
+	} else if src != dst {
+		e.addInstr(fn, bytecode.OP_MOVE, dst, src, 0)
+	}
+}
+
+// Return the register that holds the operand x, loading it in a temporary
+// register if it is a constant.
+func (e *Emitter) toReg(fn *bytecode.Fn, x int) int {
+	if !bytecode.IsK(x) {
+		return x
+	}
+	r := e.alloc(fn)
+	e.move(fn, r, x)
+	return r
+}
+
+// Return the operand that refers to the constant kix, loading it in a temporary
+// register if its index is too big for an operand.
+func (e *Emitter) rkK(fn *bytecode.Fn, kix int) int {
+	if kix <= bytecode.MaxRK {
+		return bytecode.RK(kix)
+	}
+	r := e.alloc(fn)
+	e.addInstrBx(fn, bytecode.OP_LOADK, r, kix)
+	return r
+}
+
+// The scope of the function being emitted.
+func (e *Emitter) scope() *scope {
+	return e.scopes[len(e.scopes)-1]
+}
+
+// Start allocating the temporary registers of the function, after its locals.
+func (e *Emitter) startTemps(fn *bytecode.Fn) {
+	e.scope().top = len(fn.Ls)
+	if int64(len(fn.Ls)) > fn.Header.StackSz {
+		fn.Header.StackSz = int64(len(fn.Ls))
+	}
+}
+
+// Allocate a temporary register.
+func (e *Emitter) alloc(fn *bytecode.Fn) int {
+	scp := e.scope()
+	r := scp.top
+	scp.top++
+	if int64(scp.top) > fn.Header.StackSz {
+		fn.Header.StackSz = int64(scp.top)
+	}
+	e.assert(r <= bytecode.MaxA, errors.New("too many registers required in function `"+fn.Header.Name+"`"))
+	return r
+}
+
+// Release the temporary registers starting at register r.
+func (e *Emitter) release(r int) {
+	e.scope().top = r
+}
+
+// Return true if the register r is a temporary register.
+func (e *Emitter) isTemp(r int) bool {
+	return r >= len(e.scope().fn.Ls)
+}
+
+// Return a register where an expression can be computed before being stored in
+// dst: dst itself if it is a temporary register, a new temporary register otherwise.
+func (e *Emitter) tempFor(fn *bytecode.Fn, dst int) int {
+	if e.isTemp(dst) {
+		return dst
+	}
+	return e.alloc(fn)
+}
+
+// Return the register of the local variable if sym is one.
+func (e *Emitter) local(sym *parser.Symbol) (int, bool) {
+	if !varIds[sym.Id] || sym.Ar != parser.ArName {
+		return 0, false
+	}
+	nm, _ := sym.Val.(string)
+	if kind, ix := e.resolve(nm); kind == varLocal {
+		return ix, true
+	}
+	return 0, false
+}
+
+// Return true if the symbols contain a function call or a yield, that may
+// modify the local variables. The nested functions are not visited, they are
+// not executed where they are defined.
+func (e *Emitter) hasCall(any interface{}) bool {
+	switch v := any.(type) {
+	case *parser.Symbol:
+		if v == nil || v.Id == "func" {
+			return false
+		}
+		if v.Id == "(" || v.Id == "yield" {
+			return true
+		}
+		return e.hasCall(v.First) || e.hasCall(v.Second) || e.hasCall(v.Third)
+	case []*parser.Symbol:
+		for _, sym := range v {
+			if e.hasCall(sym) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, sym := range v {
+			if e.hasCall(sym) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setLines sets the line start and end of the function header based on the
+// line numbers of its instructions. If no line information is available, the
+// N section is cleared.
+func (e *Emitter) setLines(fn *bytecode.Fn) {
+	var max int64
+	for _, n := range fn.Ns {
+		if n > max {
+			max = n
+		}
+		if n > 0 && (fn.Header.LineStart == 0 || n < fn.Header.LineStart) {
+			fn.Header.LineStart = n
+		}
+	}
+	if max == 0 {
+		fn.Ns = nil
+		return
+	}
+	fn.Header.LineEnd = max
+}
+
+func (e *Emitter) registerK(fn *bytecode.Fn, val interface{}, isName bool) int {
 	var kt bytecode.KType
 	s, ok := val.(string)
 	if ok {
@@ -566,13 +908,105 @@ func (e *Emitter) registerK(fn *bytecode.Fn, val interface{}, isName bool, local
 		m[kId{s, kt}] = i
 		fn.Ks = append(fn.Ks, &bytecode.K{Type: kt, Val: val})
 	}
-	// If this is a local definition, add the K index to this function's L table.
-	// It can't have duplicates by definition, because it would have been caught as an
-	// error in the parser stage.
-	if local {
-		fn.Ls = append(fn.Ls, int64(i))
+	return i
+}
+
+// Declare the local variables defined in the statements of the function, so that
+// they are resolved to their slots even if they are used before their definition,
+// e.g. by a nested function. The nested functions are not visited, they have their
+// own scope.
+func (e *Emitter) declare(scp *scope, any interface{}) {
+	switch v := any.(type) {
+	case *parser.Symbol:
+		if v == nil {
+			return
+		}
+		switch v.Id {
+		case "func":
+			if v.Name != "" {
+				scp.define(v.Name)
+			}
+			return
+		case ":=":
+			if nm, ok := v.First.(*parser.Symbol); ok {
+				if s, ok := nm.Val.(string); ok {
+					scp.define(s)
+				}
+			}
+		}
+		e.declare(scp, v.First)
+		e.declare(scp, v.Second)
+		e.declare(scp, v.Third)
+	case []*parser.Symbol:
+		for _, sym := range v {
+			e.declare(scp, sym)
+		}
+	case []interface{}:
+		for _, sym := range v {
+			e.declare(scp, sym)
+		}
+	}
+}
+
+// Resolve the variable name in the scope of the current function, and return the
+// kind and index to access it: a local slot, an upvalue, or the name of a global
+// variable (a built-in) as K index.
+func (e *Emitter) resolve(nm string) (varKind, int) {
+	if kind, ix, ok := e.resolveIn(len(e.scopes)-1, nm); ok {
+		return kind, ix
+	}
+	return varGlobal, e.registerK(e.scope().fn, nm, true)
+}
+
+// Resolve the variable name in the scope at depth d, capturing it as an upvalue
+// if it is defined in an enclosing function. It returns false if the name is not
+// defined in any scope.
+func (e *Emitter) resolveIn(d int, nm string) (varKind, int, bool) {
+	scp := e.scopes[d]
+	if ix, ok := scp.locals[nm]; ok {
+		// Set the name of the local on first use
+		if scp.fn.Ls[ix] < 0 {
+			scp.fn.Ls[ix] = int64(e.registerK(scp.fn, nm, true))
+		}
+		return varLocal, ix, true
+	}
+	if ix, ok := scp.upvals[nm]; ok {
+		return varUpval, ix, true
+	}
+	if d == 0 {
+		return 0, 0, false
+	}
+	kind, ix, ok := e.resolveIn(d-1, nm)
+	if !ok {
+		return 0, 0, false
+	}
+	scp.upvals[nm] = len(scp.fn.Us)
+	scp.fn.Us = append(scp.fn.Us, bytecode.U{Local: kind == varLocal, Ix: int64(ix)})
+	return varUpval, scp.upvals[nm], true
+}
+
+// Resolve the left hand side of an assignment, which must be a local variable
+// or an upvalue. If define is true, it must be a local variable.
+func (e *Emitter) resolveLhs(sym *parser.Symbol, define bool) (varKind, int) {
+	switch {
+	case sym.Id == "nil":
+		e.err = errors.New("invalid assignment to nil")
+	case sym.Id == "(literal)" || sym.Id == "true" || sym.Id == "false":
+		e.err = errors.New("invalid assignment to a literal")
+	case sym.Id == "this":
+		e.err = errors.New("invalid assignment to the `this` keyword")
+	case sym.Id == "args":
+		e.err = errors.New("invalid assignment to the `args` keyword")
+	case !varIds[sym.Id] || sym.Ar != parser.ArName:
+		e.err = errors.New("invalid assignment to `" + sym.Id + "`")
+	default:
+		nm, _ := sym.Val.(string)
+		kind, ix := e.resolve(nm)
+		e.assert(!define || kind == varLocal, errors.New("expected `"+nm+"` to be a local variable"))
+		e.assert(kind != varGlobal, errors.New("invalid assignment to the global variable `"+nm+"`"))
+		return kind, ix
 	}
-	return uint64(i)
+	return varGlobal, 0
 }
 
 func (e *Emitter) assert(cond bool, err error) {
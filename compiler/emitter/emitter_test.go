@@ -26,20 +26,20 @@ var (
 			exp: &bytecode.File{
 				Fns: []*bytecode.Fn{
 					&bytecode.Fn{
-						// := emits Second before First, so literal is K0
+						// := resolves First before emitting Second, so the name is K0
 						Ks: []*bytecode.K{
-							&bytecode.K{
-								Type: bytecode.KtInteger,
-								Val:  int64(5),
-							},
 							&bytecode.K{
 								Type: bytecode.KtString,
 								Val:  "a",
 							},
+							&bytecode.K{
+								Type: bytecode.KtInteger,
+								Val:  int64(5),
+							},
 						},
+						Ls: []int64{0},
 						Is: []bytecode.Instr{
-							bytecode.NewInstr(bytecode.OP_PUSH, bytecode.FLG_K, 0),
-							bytecode.NewInstr(bytecode.OP_POP, bytecode.FLG_V, 1),
+							bytecode.NewInstrBx(bytecode.OP_LOADK, 0, 1),
 						},
 					},
 				},
@@ -54,8 +54,8 @@ var (
 				Fns: []*bytecode.Fn{
 					&bytecode.Fn{
 						Is: []bytecode.Instr{
-							bytecode.NewInstr(bytecode.OP_PUSH, bytecode.FLG_N, 0),
-							bytecode.NewInstr(bytecode.OP_RET, bytecode.FLG__, 0),
+							bytecode.NewInstr(bytecode.OP_LOADN, 0, 0, 0),
+							bytecode.NewInstr(bytecode.OP_RET, 0, 0, 0),
 						},
 					},
 				},
@@ -71,19 +71,18 @@ var (
 				Fns: []*bytecode.Fn{
 					&bytecode.Fn{
 						Ks: []*bytecode.K{
-							&bytecode.K{
-								Type: bytecode.KtBoolean,
-								Val:  int64(1),
-							},
 							&bytecode.K{
 								Type: bytecode.KtString,
 								Val:  "a",
 							},
+							&bytecode.K{
+								Type: bytecode.KtBoolean,
+								Val:  int64(1),
+							},
 						},
+						Ls: []int64{0},
 						Is: []bytecode.Instr{
-							bytecode.NewInstr(bytecode.OP_PUSH, bytecode.FLG_K, 0),
-							bytecode.NewInstr(bytecode.OP_NOT, bytecode.FLG__, 0),
-							bytecode.NewInstr(bytecode.OP_POP, bytecode.FLG_V, 1),
+							bytecode.NewInstr(bytecode.OP_NOT, 0, bytecode.RK(1), 0),
 						},
 					},
 				},
@@ -99,19 +98,18 @@ var (
 				Fns: []*bytecode.Fn{
 					&bytecode.Fn{
 						Ks: []*bytecode.K{
-							&bytecode.K{
-								Type: bytecode.KtInteger,
-								Val:  int64(1),
-							},
 							&bytecode.K{
 								Type: bytecode.KtString,
 								Val:  "a",
 							},
+							&bytecode.K{
+								Type: bytecode.KtInteger,
+								Val:  int64(1),
+							},
 						},
+						Ls: []int64{0},
 						Is: []bytecode.Instr{
-							bytecode.NewInstr(bytecode.OP_PUSH, bytecode.FLG_K, 0),
-							bytecode.NewInstr(bytecode.OP_UNM, bytecode.FLG__, 0),
-							bytecode.NewInstr(bytecode.OP_POP, bytecode.FLG_V, 1),
+							bytecode.NewInstr(bytecode.OP_UNM, 0, bytecode.RK(1), 0),
 						},
 					},
 				},
@@ -127,6 +125,10 @@ var (
 				Fns: []*bytecode.Fn{
 					&bytecode.Fn{
 						Ks: []*bytecode.K{
+							&bytecode.K{
+								Type: bytecode.KtString,
+								Val:  "a",
+							},
 							&bytecode.K{
 								Type: bytecode.KtInteger,
 								Val:  int64(5),
@@ -135,16 +137,82 @@ var (
 								Type: bytecode.KtInteger,
 								Val:  int64(2),
 							},
+						},
+						Ls: []int64{0},
+						Is: []bytecode.Instr{
+							bytecode.NewInstr(bytecode.OP_ADD, 0, bytecode.RK(1), bytecode.RK(2)),
+						},
+					},
+				},
+			},
+		},
+		5: {
+			// Closure capturing a local of the enclosing function
+			src: []*parser.Symbol{
+				&parser.Symbol{Id: ":=", Ar: parser.ArBinary, First: &parser.Symbol{Id: "(name)", Val: "a"}, Second: &parser.Symbol{Id: "(literal)", Val: "1", Ar: parser.ArLiteral}},
+				&parser.Symbol{Id: ":=", Ar: parser.ArBinary, First: &parser.Symbol{Id: "(name)", Val: "f"},
+					Second: &parser.Symbol{Id: "func", Ar: parser.ArFunction, First: []*parser.Symbol{}, Second: []*parser.Symbol{
+						&parser.Symbol{Id: "return", Ar: parser.ArStatement, First: &parser.Symbol{Id: "(name)", Val: "a", Ar: parser.ArName}},
+					}}},
+			},
+			exp: &bytecode.File{
+				Fns: []*bytecode.Fn{
+					&bytecode.Fn{
+						Ks: []*bytecode.K{
 							&bytecode.K{
 								Type: bytecode.KtString,
 								Val:  "a",
 							},
+							&bytecode.K{
+								Type: bytecode.KtInteger,
+								Val:  int64(1),
+							},
+							&bytecode.K{
+								Type: bytecode.KtString,
+								Val:  "f",
+							},
 						},
+						Ls: []int64{0, 2},
+						Is: []bytecode.Instr{
+							bytecode.NewInstrBx(bytecode.OP_LOADK, 0, 1),
+							bytecode.NewInstrBx(bytecode.OP_LOADF, 1, 1),
+						},
+					},
+					&bytecode.Fn{
+						Us: []bytecode.U{{Local: true, Ix: 0}},
 						Is: []bytecode.Instr{
-							bytecode.NewInstr(bytecode.OP_PUSH, bytecode.FLG_K, 0),
-							bytecode.NewInstr(bytecode.OP_PUSH, bytecode.FLG_K, 1),
-							bytecode.NewInstr(bytecode.OP_ADD, bytecode.FLG__, 0),
-							bytecode.NewInstr(bytecode.OP_POP, bytecode.FLG_V, 2),
+							bytecode.NewInstr(bytecode.OP_GETU, 0, 0, 0),
+							bytecode.NewInstr(bytecode.OP_RET, 0, 0, 0),
+						},
+					},
+				},
+			},
+		},
+		6: {
+			// Tail call
+			src: []*parser.Symbol{
+				&parser.Symbol{Id: "return", Ar: parser.ArStatement, First: &parser.Symbol{Id: "(", Ar: parser.ArBinary,
+					First: &parser.Symbol{Id: "(name)", Val: "len", Ar: parser.ArName}, Second: []*parser.Symbol{
+						&parser.Symbol{Id: "(literal)", Val: "1", Ar: parser.ArLiteral},
+					}}},
+			},
+			exp: &bytecode.File{
+				Fns: []*bytecode.Fn{
+					&bytecode.Fn{
+						Ks: []*bytecode.K{
+							&bytecode.K{
+								Type: bytecode.KtString,
+								Val:  "len",
+							},
+							&bytecode.K{
+								Type: bytecode.KtInteger,
+								Val:  int64(1),
+							},
+						},
+						Is: []bytecode.Instr{
+							bytecode.NewInstrBx(bytecode.OP_GETG, 0, 0),
+							bytecode.NewInstrBx(bytecode.OP_LOADK, 1, 1),
+							bytecode.NewInstr(bytecode.OP_TCALL, 0, 1, 0),
 						},
 					},
 				},
@@ -212,7 +280,7 @@ func equal(c int, f1, f2 *bytecode.File) bool {
 	}
 	for i := 0; i < len(f1.Fns); i++ {
 		fn1, fn2 := f1.Fns[i], f2.Fns[i]
-		// Ignore function header, care only about instructions and Ks
+		// Ignore function header, care only about instructions, Ks, Ls and Us
 		if len(fn1.Ks) != len(fn2.Ks) {
 			if testing.Verbose() {
 				fmt.Printf("[%d] - error: f1.func[%d] has %d Ks, f2.func[%d] has %d\n", c, i, len(fn1.Ks), i, len(fn2.Ks))
@@ -234,6 +302,34 @@ func equal(c int, f1, f2 *bytecode.File) bool {
 				return false
 			}
 		}
+		if len(fn1.Ls) != len(fn2.Ls) {
+			if testing.Verbose() {
+				fmt.Printf("[%d] - error: f1.func[%d] has %d Ls, f2.func[%d] has %d\n", c, i, len(fn1.Ls), i, len(fn2.Ls))
+			}
+			return false
+		}
+		for j := 0; j < len(fn1.Ls); j++ {
+			if fn1.Ls[j] != fn2.Ls[j] {
+				if testing.Verbose() {
+					fmt.Printf("[%d] - error: f1.func[%d].Ls[%d] is %d, f2.func[%d].Ls[%d] is %d\n", c, i, j, fn1.Ls[j], i, j, fn2.Ls[j])
+				}
+				return false
+			}
+		}
+		if len(fn1.Us) != len(fn2.Us) {
+			if testing.Verbose() {
+				fmt.Printf("[%d] - error: f1.func[%d] has %d Us, f2.func[%d] has %d\n", c, i, len(fn1.Us), i, len(fn2.Us))
+			}
+			return false
+		}
+		for j := 0; j < len(fn1.Us); j++ {
+			if fn1.Us[j] != fn2.Us[j] {
+				if testing.Verbose() {
+					fmt.Printf("[%d] - error: f1.func[%d].Us[%d] is %v, f2.func[%d].Us[%d] is %v\n", c, i, j, fn1.Us[j], i, j, fn2.Us[j])
+				}
+				return false
+			}
+		}
 		if len(fn1.Is) != len(fn2.Is) {
 			if testing.Verbose() {
 				fmt.Printf("[%d] - error: f1.func[%d] has %d Is, f2.func[%d] has %d\n", c, i, len(fn1.Is), i, len(fn2.Is))
@@ -0,0 +1,404 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/PuerkitoBio/agora/bytecode"
+)
+
+// A GoGen translates a bytecode representation into the Go source code of a native
+// module (a runtime.NativeModule), compiled ahead-of-time. The functions of the
+// module are translated to Go functions that call into the runtime API directly,
+// without the interpreter loop. The coroutines (the functions that yield), and
+// the functions nested in a coroutine, are run by the interpreter from the
+// bytecode embedded in the generated code.
+//
+// The generated code ignores the debug statements, and the functions are not
+// counted by the Profiler and the Coverage of the execution context.
+type GoGen struct {
+	// Package is the name of the package of the generated code, "main" if empty.
+	Package string
+	// Type is the name of the type of the module, "Module" if empty.
+	Type string
+	// ID is the identifier of the module, the base name of the bytecode file
+	// without its extension if empty.
+	ID string
+
+	f      *bytecode.File
+	buf    *bytes.Buffer
+	interp []bool // the functions run by the interpreter, by index
+	err    error
+}
+
+// ToGo takes the in-memory bytecode File structure and translates it to Go source
+// code, writing the results to the provided writer. The bytecode is verified
+// first (see bytecode.Verify), so the translation relies on valid operands,
+// jumps, constants and nesting of the functions. It fails on an opcode accepted
+// by Verify that it does not translate. If an error is encountered, it is
+// returned, otherwise it returns nil.
+func (g *GoGen) ToGo(f *bytecode.File, w io.Writer) error {
+	if len(f.Fns) == 0 {
+		return fmt.Errorf("empty module: %s", f.Name)
+	}
+	g.f = f
+	g.buf = bytes.NewBuffer(nil)
+	g.err = nil
+	pkg, typ, id := g.Package, g.Type, g.ID
+	if pkg == "" {
+		pkg = "main"
+	}
+	if typ == "" {
+		typ = "Module"
+	}
+	if id == "" {
+		id = strings.TrimSuffix(filepath.Base(f.Name), filepath.Ext(f.Name))
+	}
+	for _, nm := range []string{pkg, typ} {
+		if !token.IsIdentifier(nm) {
+			return fmt.Errorf("invalid Go identifier: %s", nm)
+		}
+	}
+	if err := bytecode.Verify(f); err != nil {
+		return err
+	}
+
+	// 1- Find the functions run by the interpreter: the coroutines and their
+	// nested functions. The enclosing function is always defined before its
+	// nested functions.
+	g.interp = make([]bool, len(f.Fns))
+	for i, fn := range f.Fns {
+		if i > 0 {
+			g.interp[i] = g.interp[fn.Header.ParentFnIx]
+		}
+		for _, ins := range fn.Is {
+			if ins.Opcode() == bytecode.OP_YLD {
+				g.interp[i] = true
+			}
+		}
+	}
+	var bc []byte
+	bcNm := string(unicode.ToLower(rune(typ[0]))) + typ[1:] + "Bytecode"
+	for _, b := range g.interp {
+		if b {
+			out := bytes.NewBuffer(nil)
+			if err := bytecode.NewEncoder(out).Encode(f); err != nil {
+				return err
+			}
+			bc = out.Bytes()
+			break
+		}
+	}
+
+	// 2- Write the module type and its NativeModule implementation
+	g.printf("// Code generated by agora gogen from %s. DO NOT EDIT.\n\n", filepath.Base(f.Name))
+	g.printf("package %s\n\n", pkg)
+	g.printf("import \"github.com/PuerkitoBio/agora/runtime\"\n\n")
+	g.printf("// %s is the agora module %q, compiled to Go.\n", typ, id)
+	g.printf("type %s struct {\n", typ)
+	g.printf("ctx *runtime.Ctx\n")
+	if bc != nil {
+		g.printf("bc *runtime.BytecodeFuncs\n")
+	}
+	g.printf("v runtime.Val\n}\n\n")
+	g.printf("// ID returns the identifier of the module.\n")
+	g.printf("func (m *%s) ID() string {\nreturn %q\n}\n\n", typ, id)
+	g.printf("// SetCtx sets the execution context of the module.\n")
+	g.printf("func (m *%s) SetCtx(c *runtime.Ctx) {\nm.ctx = c\n}\n\n", typ)
+	g.printf("// Run executes the module and returns its return value, or an error.\n")
+	g.printf("func (m *%s) Run(args ...runtime.Val) (v runtime.Val, err error) {\n", typ)
+	g.printf("defer runtime.PanicToError(&err)\n")
+	g.printf("// Do not re-run a module if it has already been imported. Use the cached value.\n")
+	g.printf("if m.v == nil {\n")
+	if bc != nil {
+		g.printf("if m.bc == nil {\n")
+		g.printf("if m.bc, err = runtime.NewBytecodeFuncs(m.ctx, %q, %s); err != nil {\nreturn nil, err\n}\n}\n", id, bcNm)
+	}
+	if g.interp[0] {
+		g.printf("m.v = m.bc.Func(0).Call(nil, args...)\n")
+	} else {
+		g.printf("m.v = runtime.NewGoFunc(m.ctx, %q, m.fn0).Call(nil, args...)\n", f.Fns[0].Header.Name)
+	}
+	g.printf("}\nreturn m.v, nil\n}\n")
+
+	// 3- Write the top-level function, with its nested functions
+	if !g.interp[0] {
+		g.printf("\nfunc (m *%s) fn0", typ)
+		g.fn(0)
+		g.printf("\n")
+	}
+
+	// 4- Write the bytecode, if some functions are run by the interpreter
+	if bc != nil {
+		g.printf("\n// The bytecode of the module, for the functions run by the interpreter.\n")
+		g.printf("var %s = []byte(%q)\n", bcNm, bc)
+	}
+	if g.err != nil {
+		return g.err
+	}
+	b, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// Write the signature and the body of the function at index ix.
+func (g *GoGen) fn(ix int) {
+	fn := g.f.Fns[ix]
+	g.printf("(this runtime.Val, args ...runtime.Val) runtime.Val {\n")
+
+	// Find the reachable instructions, and the targets of their jumps that get
+	// a label. The unreachable instructions are not translated.
+	n := len(fn.Is)
+	reach := make([]bool, n+1)
+	labels := make(map[int]bool)
+	usesArgs, usesRange := false, false
+	for todo := []int{0}; len(todo) > 0; {
+		pc := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if reach[pc] {
+			continue
+		}
+		reach[pc] = true
+		if pc == n {
+			continue
+		}
+		ins := fn.Is[pc]
+		switch ins.Opcode() {
+		case bytecode.OP_RET, bytecode.OP_TCALL, bytecode.OP_TCFLD:
+			continue
+		case bytecode.OP_JMP:
+			labels[pc+1+ins.SBx()] = true
+			todo = append(todo, pc+1+ins.SBx())
+			continue
+		case bytecode.OP_TEST, bytecode.OP_RNGP:
+			labels[pc+1+ins.SBx()] = true
+			todo = append(todo, pc+1+ins.SBx())
+		case bytecode.OP_LOADA:
+			usesArgs = true
+		case bytecode.OP_RNGS:
+			usesRange = true
+		}
+		todo = append(todo, pc+1)
+	}
+
+	// The registers, the local variables by slot followed by the temporaries, and
+	// the expected arguments in the first slots.
+	sz := fn.Header.StackSz
+	if l := int64(len(fn.Ls)); sz < l {
+		sz = l
+	}
+	if sz > 0 {
+		g.printf("var r%d [%d]runtime.Val\n", ix, sz)
+		g.printf("for i := range r%d {\nr%[1]d[i] = runtime.Nil\n}\n", ix)
+	}
+	for j := int64(0); j < fn.Header.ExpArgs && j < sz; j++ {
+		g.printf("if len(args) > %d {\nr%d[%[1]d] = args[%[1]d]\n}\n", j, ix)
+	}
+	if usesArgs {
+		g.printf("a%d := runtime.NewArgs(args)\n", ix)
+	}
+	if usesRange {
+		g.printf("var rs%d []func() (runtime.Val, bool)\n", ix)
+	}
+
+	// The instructions
+	for pc, ins := range fn.Is {
+		if labels[pc] {
+			g.printf("L%d:\n", pc)
+		}
+		if reach[pc] {
+			g.instr(ix, pc, ins)
+		}
+	}
+	// Return nil if the end of the function is reached
+	if labels[n] {
+		g.printf("L%d:\n", n)
+	}
+	if reach[n] {
+		g.printf("return runtime.Nil\n")
+	}
+	g.printf("}")
+}
+
+// Write the Go statement of the instruction at index pc of the function at
+// index ix.
+func (g *GoGen) instr(ix, pc int, i bytecode.Instr) {
+	r := func(x int) string {
+		return fmt.Sprintf("r%d[%d]", ix, x)
+	}
+	rk := func(x int) string {
+		if bytecode.IsK(x) {
+			return g.k(ix, x&bytecode.MaxRK)
+		}
+		return r(x)
+	}
+	regs := func(from, n int) string {
+		var s []string
+		for j := from; j < from+n; j++ {
+			s = append(s, r(j))
+		}
+		return strings.Join(s, ", ")
+	}
+	call := func(a, n int) string {
+		if n == 0 {
+			return fmt.Sprintf("runtime.CallFunc(%s)", r(a))
+		}
+		return fmt.Sprintf("runtime.CallFunc(%s, %s)", r(a), regs(a+1, n))
+	}
+	callMethod := func(a, k, n int) string {
+		if n == 0 {
+			return fmt.Sprintf("runtime.CallMethod(%s, %s)", r(a), rk(k))
+		}
+		return fmt.Sprintf("runtime.CallMethod(%s, %s, %s)", r(a), rk(k), regs(a+1, n))
+	}
+	arith := map[bytecode.Opcode]string{
+		bytecode.OP_ADD: "Add",
+		bytecode.OP_SUB: "Sub",
+		bytecode.OP_MUL: "Mul",
+		bytecode.OP_DIV: "Div",
+		bytecode.OP_MOD: "Mod",
+	}
+	cmp := map[bytecode.Opcode]string{
+		bytecode.OP_EQ:  "==",
+		bytecode.OP_NEQ: "!=",
+		bytecode.OP_LT:  "<",
+		bytecode.OP_LTE: "<=",
+		bytecode.OP_GT:  ">",
+		bytecode.OP_GTE: ">=",
+	}
+	to := pc + 1 + i.SBx()
+
+	switch op := i.Opcode(); op {
+	case bytecode.OP_RET:
+		g.printf("return %s\n", rk(i.B()))
+	case bytecode.OP_MOVE:
+		g.printf("%s = %s\n", r(i.A()), r(i.B()))
+	case bytecode.OP_LOADK:
+		g.printf("%s = %s\n", r(i.A()), g.k(ix, i.Bx()))
+	case bytecode.OP_LOADN:
+		g.printf("%s = runtime.Nil\n", r(i.A()))
+	case bytecode.OP_LOADT:
+		g.printf("%s = this\n", r(i.A()))
+	case bytecode.OP_LOADA:
+		g.printf("%s = a%d\n", r(i.A()), ix)
+	case bytecode.OP_LOADF:
+		g.loadf(ix, i.A(), i.Bx())
+	case bytecode.OP_GETU:
+		g.printf("%s = %s\n", r(i.A()), g.upval(ix, i.B()))
+	case bytecode.OP_SETU:
+		g.printf("%s = %s\n", g.upval(ix, i.A()), rk(i.B()))
+	case bytecode.OP_GETG:
+		g.printf("%s = m.ctx.Builtin(%s)\n", r(i.A()), strconv.Quote(g.f.Fns[ix].Ks[i.Bx()].Val.(string)))
+	case bytecode.OP_ADD, bytecode.OP_SUB, bytecode.OP_MUL, bytecode.OP_DIV, bytecode.OP_MOD:
+		g.printf("%s = m.ctx.Arithmetic.%s(%s, %s)\n", r(i.A()), arith[op], rk(i.B()), rk(i.C()))
+	case bytecode.OP_NOT:
+		g.printf("%s = runtime.Bool(!%s.Bool())\n", r(i.A()), rk(i.B()))
+	case bytecode.OP_UNM:
+		g.printf("%s = m.ctx.Arithmetic.Unm(%s)\n", r(i.A()), rk(i.B()))
+	case bytecode.OP_EQ, bytecode.OP_NEQ, bytecode.OP_LT, bytecode.OP_LTE, bytecode.OP_GT, bytecode.OP_GTE:
+		g.printf("%s = runtime.Bool(m.ctx.Comparer.Cmp(%s, %s) %s 0)\n", r(i.A()), rk(i.B()), rk(i.C()), cmp[op])
+	case bytecode.OP_TEST:
+		g.printf("if !%s.Bool() {\ngoto L%d\n}\n", r(i.A()), to)
+	case bytecode.OP_JMP:
+		g.printf("goto L%d\n", to)
+	case bytecode.OP_NEW:
+		g.printf("%s = runtime.NewObject()\n", r(i.A()))
+	case bytecode.OP_SFLD:
+		g.printf("runtime.SetField(%s, %s, %s)\n", r(i.A()), rk(i.B()), rk(i.C()))
+	case bytecode.OP_GFLD:
+		g.printf("%s = runtime.GetField(%s, %s)\n", r(i.A()), r(i.B()), rk(i.C()))
+	case bytecode.OP_CFLD:
+		g.printf("%s = %s\n", r(i.A()), callMethod(i.A(), i.B(), i.C()))
+	case bytecode.OP_CALL:
+		g.printf("%s = %s\n", r(i.A()), call(i.A(), i.B()))
+	case bytecode.OP_TCALL:
+		g.printf("return %s\n", call(i.A(), i.B()))
+	case bytecode.OP_TCFLD:
+		g.printf("return %s\n", callMethod(i.A(), i.B(), i.C()))
+	case bytecode.OP_RNGS:
+		g.printf("rs%d = append(rs%[1]d, runtime.NewRange(%s))\n", ix, regs(i.A(), i.B()))
+	case bytecode.OP_RNGP:
+		g.printf("if v, ok := rs%d[len(rs%[1]d)-1](); ok {\n%s = v\n} else {\ngoto L%d\n}\n", ix, r(i.A()), to)
+	case bytecode.OP_RNGE:
+		g.printf("rs%d = rs%[1]d[:len(rs%[1]d)-1]\n", ix)
+	case bytecode.OP_DUMP:
+		g.printf("// DUMP %d: debug statements are ignored\n", i.Bx())
+	default:
+		// Verify accepts an opcode that is not translated to Go
+		g.fail(fmt.Errorf("unsupported opcode %s in function %d", op, ix))
+	}
+}
+
+// Write the instruction that loads a new function value of the function at
+// index fnIx in the register a of the function at index ix.
+func (g *GoGen) loadf(ix, a, fnIx int) {
+	if g.interp[fnIx] {
+		// Bind the function to the cells of its upvalues
+		g.printf("r%d[%d] = m.bc.Func(%d", ix, a, fnIx)
+		for j := range g.f.Fns[fnIx].Us {
+			g.printf(", &%s", g.upval(fnIx, j))
+		}
+		g.printf(")\n")
+		return
+	}
+	g.printf("r%d[%d] = runtime.NewGoFunc(m.ctx, %q, func", ix, a, g.f.Fns[fnIx].Header.Name)
+	g.fn(fnIx)
+	g.printf(")\n")
+}
+
+// Return the expression of the upvalue u of the function at index ix: the
+// register of the enclosing function that holds the captured variable, which
+// the nested Go function literals capture.
+func (g *GoGen) upval(ix, u int) string {
+	fn := g.f.Fns[ix]
+	uv, p := fn.Us[u], int(fn.Header.ParentFnIx)
+	if uv.Local {
+		return fmt.Sprintf("r%d[%d]", p, uv.Ix)
+	}
+	return g.upval(p, int(uv.Ix))
+}
+
+// Return the Go expression of the constant at index x of the function at index ix.
+func (g *GoGen) k(ix, x int) string {
+	switch k := g.f.Fns[ix].Ks[x]; k.Type {
+	case bytecode.KtBoolean:
+		return fmt.Sprintf("runtime.Bool(%t)", k.Val.(int64) != 0)
+	case bytecode.KtInteger:
+		return fmt.Sprintf("runtime.Number(%d)", k.Val.(int64))
+	case bytecode.KtFloat:
+		f := k.Val.(float64)
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			g.fail(fmt.Errorf("invalid float constant %v in function %d", f, ix))
+			return "runtime.Nil"
+		}
+		return fmt.Sprintf("runtime.Number(%s)", strconv.FormatFloat(f, 'g', -1, 64))
+	case bytecode.KtString:
+		return fmt.Sprintf("runtime.String(%s)", strconv.Quote(k.Val.(string)))
+	default:
+		g.fail(bytecode.ErrInvalidKType)
+		return "runtime.Nil"
+	}
+}
+
+// Write the formatted string to the buffer of the generated code.
+func (g *GoGen) printf(s string, args ...interface{}) {
+	fmt.Fprintf(g.buf, s, args...)
+}
+
+// Record the first error encountered.
+func (g *GoGen) fail(err error) {
+	if g.err == nil {
+		g.err = err
+	}
+}
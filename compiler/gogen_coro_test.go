@@ -0,0 +1,96 @@
+// Code generated by agora gogen from coro.agora. DO NOT EDIT.
+
+package compiler
+
+import "github.com/PuerkitoBio/agora/runtime"
+
+// coroModule is the agora module "coro", compiled to Go.
+type coroModule struct {
+	ctx *runtime.Ctx
+	bc  *runtime.BytecodeFuncs
+	v   runtime.Val
+}
+
+// ID returns the identifier of the module.
+func (m *coroModule) ID() string {
+	return "coro"
+}
+
+// SetCtx sets the execution context of the module.
+func (m *coroModule) SetCtx(c *runtime.Ctx) {
+	m.ctx = c
+}
+
+// Run executes the module and returns its return value, or an error.
+func (m *coroModule) Run(args ...runtime.Val) (v runtime.Val, err error) {
+	defer runtime.PanicToError(&err)
+	// Do not re-run a module if it has already been imported. Use the cached value.
+	if m.v == nil {
+		if m.bc == nil {
+			if m.bc, err = runtime.NewBytecodeFuncs(m.ctx, "coro", coroModuleBytecode); err != nil {
+				return nil, err
+			}
+		}
+		m.v = runtime.NewGoFunc(m.ctx, "testdata/gogen/coro.agora", m.fn0).Call(nil, args...)
+	}
+	return m.v, nil
+}
+
+func (m *coroModule) fn0(this runtime.Val, args ...runtime.Val) runtime.Val {
+	var r0 [11]runtime.Val
+	for i := range r0 {
+		r0[i] = runtime.Nil
+	}
+	var rs0 []func() (runtime.Val, bool)
+	r0[5] = m.ctx.Builtin("import")
+	r0[6] = runtime.String("fmt")
+	r0[5] = runtime.CallFunc(r0[5], r0[6])
+	r0[0] = r0[5]
+	r0[1] = runtime.Number(100)
+	r0[2] = m.bc.Func(1, &r0[1])
+	r0[3] = runtime.Number(0)
+	r0[5] = r0[2]
+	r0[6] = runtime.Number(3)
+	rs0 = append(rs0, runtime.NewRange(r0[5], r0[6]))
+L10:
+	if v, ok := rs0[len(rs0)-1](); ok {
+		r0[4] = v
+	} else {
+		goto L13
+	}
+	r0[3] = m.ctx.Arithmetic.Add(r0[3], r0[4])
+	goto L10
+L13:
+	rs0 = rs0[:len(rs0)-1]
+	r0[5] = r0[0]
+	r0[6] = r0[2]
+	r0[7] = runtime.Number(1)
+	r0[6] = runtime.CallFunc(r0[6], r0[7])
+	r0[7] = m.ctx.Builtin("status")
+	r0[8] = r0[2]
+	r0[7] = runtime.CallFunc(r0[7], r0[8])
+	r0[8] = r0[2]
+	r0[9] = runtime.Number(1)
+	r0[8] = runtime.CallFunc(r0[8], r0[9])
+	r0[9] = m.ctx.Builtin("status")
+	r0[10] = r0[2]
+	r0[9] = runtime.CallFunc(r0[9], r0[10])
+	r0[10] = r0[3]
+	r0[5] = runtime.CallMethod(r0[5], runtime.String("Println"), r0[6], r0[7], r0[8], r0[9], r0[10])
+	r0[1] = runtime.Number(0)
+	r0[5] = r0[0]
+	r0[6] = r0[2]
+	r0[7] = runtime.Number(2)
+	r0[6] = runtime.CallFunc(r0[6], r0[7])
+	r0[7] = r0[2]
+	r0[8] = runtime.Number(2)
+	r0[7] = runtime.CallFunc(r0[7], r0[8])
+	r0[8] = r0[2]
+	r0[9] = runtime.Number(2)
+	r0[8] = runtime.CallFunc(r0[8], r0[9])
+	r0[5] = runtime.CallMethod(r0[5], runtime.String("Println"), r0[6], r0[7], r0[8])
+	return r0[3]
+}
+
+// The bytecode of the module, for the functions run by the interpreter.
+var coroModuleBytecode = []byte("*`\n\x00\a\x19\x00\x00\x00\x00\x00\x00\x00testdata/gogen/coro.agora\v\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x00\x00\x00\x00\x00\x00\x15\x00\x00\x00\x00\x00\x00\x00\r\x00\x00\x00\x00\x00\x00\x00s\x03\x00\x00\x00\x00\x00\x00\x00fmts\x06\x00\x00\x00\x00\x00\x00\x00imports\x04\x00\x00\x00\x00\x00\x00\x00baseid\x00\x00\x00\x00\x00\x00\x00s\x03\x00\x00\x00\x00\x00\x00\x00gens\x01\x00\x00\x00\x00\x00\x00\x00ti\x00\x00\x00\x00\x00\x00\x00\x00i\x03\x00\x00\x00\x00\x00\x00\x00s\x01\x00\x00\x00\x00\x00\x00\x00vi\x01\x00\x00\x00\x00\x00\x00\x00s\x06\x00\x00\x00\x00\x00\x00\x00statuss\a\x00\x00\x00\x00\x00\x00\x00Printlni\x02\x00\x00\x00\x00\x00\x00\x00\x05\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x00\x00\x00\x00\x00\x00\x04\x00\x00\x00\x00\x00\x00\x00\x05\x00\x00\x00\x00\x00\x00\x00\b\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00*\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x05\x00\t\x00\x00\x00\x00\x00\x06\x00\x02\x00\x00\x10\x00\x00\x05\x00\x1d\x00\x00P\x00\x00\x00\x00\x01\x03\x00\x00\x00\x00\x01\x00\x02\x01\x00\x00\x00\x00\x02\x00\x06\x06\x00\x00\x00\x00\x03\x00\x02\x00\x00 \x00\x00\x05\x00\x01\a\x00\x00\x00\x00\x06\x00\x02\x00\x00 \x00\x00\x05\x00!\x01\x00\x00\x00\x80\x04\x00\"\x04\x000\x00\x00\x03\x00\n\xfc\xff\xff\xff\x7f\x00\x00\x18\x00\x00\x00\x00\x00\x00\x00#\x00\x00\x00\x00\x00\x05\x00\x01\x00\x00 \x00\x00\x06\x00\x01\t\x00\x00\x00\x00\a\x00\x02\x00\x00\x10\x00\x00\x06\x00\x1d\n\x00\x00\x00\x00\a\x00\t\x00\x00 \x00\x00\b\x00\x01\x00\x00\x10\x00\x00\a\x00\x1d\x00\x00 \x00\x00\b\x00\x01\t\x00\x00\x00\x00\t\x00\x02\x00\x00\x10\x00\x00\b\x00\x1d\n\x00\x00\x00\x00\t\x00\t\x00\x00 \x00\x00\n\x00\x01\x00\x00\x10\x00\x00\t\x00\x1d\x00\x000\x00\x00\n\x00\x01\x05\x00\xb0\x00\x80\x05\x00\x1c\x06\x00\x00\x00\x00\x01\x00\x02\x00\x00\x00\x00\x00\x05\x00\x01\x00\x00 \x00\x00\x06\x00\x01\f\x00\x00\x00\x00\a\x00\x02\x00\x00\x10\x00\x00\x06\x00\x1d\x00\x00 \x00\x00\a\x00\x01\f\x00\x00\x00\x00\b\x00\x02\x00\x00\x10\x00\x00\a\x00\x1d\x00\x00 \x00\x00\b\x00\x01\f\x00\x00\x00\x00\t\x00\x02\x00\x00\x10\x00\x00\b\x00\x1d\x03\x00\xb0\x00\x80\x05\x00\x1c\x00\x000\x00\x00\x00\x00\x00*\x00\x00\x00\x00\x00\x00\x00\x02\x00\x00\x00\x00\x00\x00\x00\x02\x00\x00\x00\x00\x00\x00\x00\x02\x00\x00\x00\x00\x00\x00\x00\x02\x00\x00\x00\x00\x00\x00\x00\x04\x00\x00\x00\x00\x00\x00\x00\x05\x00\x00\x00\x00\x00\x00\x00\x0e\x00\x00\x00\x00\x00\x00\x00\x0f\x00\x00\x00\x00\x00\x00\x00\x0f\x00\x00\x00\x00\x00\x00\x00\x0f\x00\x00\x00\x00\x00\x00\x00\x0f\x00\x00\x00\x00\x00\x00\x00\x10\x00\x00\x00\x00\x00\x00\x00\x0f\x00\x00\x00\x00\x00\x00\x00\x0f\x00\x00\x00\x00\x00\x00\x00\x12\x00\x00\x00\x00\x00\x00\x00\x12\x00\x00\x00\x00\x00\x00\x00\x12\x00\x00\x00\x00\x00\x00\x00\x12\x00\x00\x00\x00\x00\x00\x00\x12\x00\x00\x00\x00\x00\x00\x00\x12\x00\x00\x00\x00\x00\x00\x00\x12\x00\x00\x00\x00\x00\x00\x00\x12\x00\x00\x00\x00\x00\x00\x00\x12\x00\x00\x00\x00\x00\x00\x00\x12\x00\x00\x00\x00\x00\x00\x00\x12\x00\x00\x00\x00\x00\x00\x00\x12\x00\x00\x00\x00\x00\x00\x00\x12\x00\x00\x00\x00\x00\x00\x00\x12\x00\x00\x00\x00\x00\x00\x00\x12\x00\x00\x00\x00\x00\x00\x00\x13\x00\x00\x00\x00\x00\x00\x00\x14\x00\x00\x00\x00\x00\x00\x00\x14\x00\x00\x00\x00\x00\x00\x00\x14\x00\x00\x00\x00\x00\x00\x00\x14\x00\x00\x00\x00\x00\x00\x00\x14\x00\x00\x00\x00\x00\x00\x00\x14\x00\x00\x00\x00\x00\x00\x00\x14\x00\x00\x00\x00\x00\x00\x00\x14\x00\x00\x00\x00\x00\x00\x00\x14\x00\x00\x00\x00\x00\x00\x00\x14\x00\x00\x00\x00\x00\x00\x00\x14\x00\x00\x00\x00\x00\x00\x00\x15\x00\x00\x00\x00\x00\x00\x00\x03\x00\x00\x00\x00\x00\x00\x00gen\a\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x05\x00\x00\x00\x00\x00\x00\x00\f\x00\x00\x00\x00\x00\x00\x00\x05\x00\x00\x00\x00\x00\x00\x00s\x01\x00\x00\x00\x00\x00\x00\x00ns\x03\x00\x00\x00\x00\x00\x00\x00adds\x01\x00\x00\x00\x00\x00\x00\x00ii\x00\x00\x00\x00\x00\x00\x00\x00i\x01\x00\x00\x00\x00\x00\x00\x00\x03\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x02\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\f\x00\x00\x00\x00\x00\x00\x00\x02\x00\x00\x00\x00\x01\x00\x06\x03\x00\x00\x00\x00\x02\x00\x02\x00\x00 \x00\x00\x03\x00\x13\x05\x00\x00\x00\x80\x03\x00\x17\x00\x00\x10\x00\x00\x05\x00\x01\x00\x00 \x00\x00\x06\x00\x01\x00\x00\x10\x00\x00\x05\x00\x1d\x00\x00P\x00\x00\x04\x00 \x04\x00(\x00\x00\x02\x00\n\xf7\xff\xff\xff\x7f\x00\x00\x18\x00\x00@\x00\x80\x03\x00\x10\x00\x000\x00\x00\x00\x00\x00\f\x00\x00\x00\x00\x00\x00\x00\x06\x00\x00\x00\x00\x00\x00\x00\t\x00\x00\x00\x00\x00\x00\x00\t\x00\x00\x00\x00\x00\x00\x00\t\x00\x00\x00\x00\x00\x00\x00\n\x00\x00\x00\x00\x00\x00\x00\n\x00\x00\x00\x00\x00\x00\x00\n\x00\x00\x00\x00\x00\x00\x00\n\x00\x00\x00\x00\x00\x00\x00\t\x00\x00\x00\x00\x00\x00\x00\t\x00\x00\x00\x00\x00\x00\x00\f\x00\x00\x00\x00\x00\x00\x00\f\x00\x00\x00\x00\x00\x00\x00\x03\x00\x00\x00\x00\x00\x00\x00add\x03\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x06\x00\x00\x00\x00\x00\x00\x00\a\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00s\x01\x00\x00\x00\x00\x00\x00\x00x\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x03\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\a\x02\x00\x00\x00\x00\x01\x00\n\x00\x00\x10\x00\x00\x00\x00\x00\x03\x00\x00\x00\x00\x00\x00\x00\a\x00\x00\x00\x00\x00\x00\x00\a\x00\x00\x00\x00\x00\x00\x00\a\x00\x00\x00\x00\x00\x00\x00")
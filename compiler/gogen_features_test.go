@@ -0,0 +1,290 @@
+// Code generated by agora gogen from features.agora. DO NOT EDIT.
+
+package compiler
+
+import "github.com/PuerkitoBio/agora/runtime"
+
+// featuresModule is the agora module "features", compiled to Go.
+type featuresModule struct {
+	ctx *runtime.Ctx
+	v   runtime.Val
+}
+
+// ID returns the identifier of the module.
+func (m *featuresModule) ID() string {
+	return "features"
+}
+
+// SetCtx sets the execution context of the module.
+func (m *featuresModule) SetCtx(c *runtime.Ctx) {
+	m.ctx = c
+}
+
+// Run executes the module and returns its return value, or an error.
+func (m *featuresModule) Run(args ...runtime.Val) (v runtime.Val, err error) {
+	defer runtime.PanicToError(&err)
+	// Do not re-run a module if it has already been imported. Use the cached value.
+	if m.v == nil {
+		m.v = runtime.NewGoFunc(m.ctx, "testdata/gogen/features.agora", m.fn0).Call(nil, args...)
+	}
+	return m.v, nil
+}
+
+func (m *featuresModule) fn0(this runtime.Val, args ...runtime.Val) runtime.Val {
+	var r0 [22]runtime.Val
+	for i := range r0 {
+		r0[i] = runtime.Nil
+	}
+	a0 := runtime.NewArgs(args)
+	var rs0 []func() (runtime.Val, bool)
+	r0[14] = m.ctx.Builtin("import")
+	r0[15] = runtime.String("fmt")
+	r0[14] = runtime.CallFunc(r0[14], r0[15])
+	r0[0] = r0[14]
+	r0[14] = runtime.NewObject()
+	runtime.SetField(r0[14], runtime.String("name"), runtime.String("o"))
+	runtime.SetField(r0[14], runtime.String("n"), runtime.Number(1.5))
+	r0[1] = r0[14]
+	r0[14] = runtime.NewGoFunc(m.ctx, "", func(this runtime.Val, args ...runtime.Val) runtime.Val {
+		var r1 [5]runtime.Val
+		for i := range r1 {
+			r1[i] = runtime.Nil
+		}
+		if len(args) > 0 {
+			r1[0] = args[0]
+		}
+		r1[2] = m.ctx.Arithmetic.Add(r1[0], runtime.String(" "))
+		r1[4] = this
+		r1[3] = runtime.GetField(r1[4], runtime.String("name"))
+		r1[1] = m.ctx.Arithmetic.Add(r1[2], r1[3])
+		return r1[1]
+	})
+	runtime.SetField(r0[1], runtime.String("greet"), r0[14])
+	r0[16] = runtime.GetField(r0[1], runtime.String("n"))
+	r0[15] = m.ctx.Arithmetic.Unm(r0[16])
+	r0[14] = m.ctx.Arithmetic.Mul(r0[15], runtime.Number(2))
+	runtime.SetField(r0[1], runtime.String("x y"), r0[14])
+	r0[14] = r0[0]
+	r0[15] = r0[1]
+	r0[16] = runtime.String("hi")
+	r0[15] = runtime.CallMethod(r0[15], runtime.String("greet"), r0[16])
+	r0[16] = runtime.GetField(r0[1], runtime.String("x y"))
+	r0[18] = runtime.GetField(r0[1], runtime.String("n"))
+	r0[17] = m.ctx.Arithmetic.Mod(r0[18], runtime.Number(1))
+	r0[19] = runtime.GetField(r0[1], runtime.String("missing"))
+	r0[18] = runtime.Bool(!r0[19].Bool())
+	r0[20] = runtime.GetField(r0[1], runtime.String("missing"))
+	r0[21] = runtime.Nil
+	r0[19] = runtime.Bool(m.ctx.Comparer.Cmp(r0[20], r0[21]) == 0)
+	r0[14] = runtime.CallMethod(r0[14], runtime.String("Println"), r0[15], r0[16], r0[17], r0[18], r0[19])
+	r0[2] = runtime.NewGoFunc(m.ctx, "sum", func(this runtime.Val, args ...runtime.Val) runtime.Val {
+		var r2 [6]runtime.Val
+		for i := range r2 {
+			r2[i] = runtime.Nil
+		}
+		a2 := runtime.NewArgs(args)
+		r2[0] = runtime.Number(0)
+		r2[1] = runtime.Number(0)
+	L2:
+		r2[3] = r2[1]
+		r2[4] = m.ctx.Builtin("len")
+		r2[5] = a2
+		r2[4] = runtime.CallFunc(r2[4], r2[5])
+		r2[2] = runtime.Bool(m.ctx.Comparer.Cmp(r2[3], r2[4]) < 0)
+		if !r2[2].Bool() {
+			goto L13
+		}
+		r2[4] = a2
+		r2[3] = runtime.GetField(r2[4], r2[1])
+		r2[0] = m.ctx.Arithmetic.Add(r2[0], r2[3])
+		r2[1] = m.ctx.Arithmetic.Add(r2[1], runtime.Number(1))
+		goto L2
+	L13:
+		return r2[0]
+	})
+	r0[14] = r0[0]
+	r0[15] = r0[2]
+	r0[15] = runtime.CallFunc(r0[15])
+	r0[16] = r0[2]
+	r0[17] = runtime.Number(1)
+	r0[18] = runtime.Number(2)
+	r0[19] = runtime.Number(3)
+	r0[16] = runtime.CallFunc(r0[16], r0[17], r0[18], r0[19])
+	r0[17] = m.ctx.Builtin("len")
+	r0[18] = a0
+	r0[17] = runtime.CallFunc(r0[17], r0[18])
+	r0[14] = runtime.CallMethod(r0[14], runtime.String("Println"), r0[15], r0[16], r0[17])
+	r0[3] = runtime.NewGoFunc(m.ctx, "counter", func(this runtime.Val, args ...runtime.Val) runtime.Val {
+		var r3 [3]runtime.Val
+		for i := range r3 {
+			r3[i] = runtime.Nil
+		}
+		if len(args) > 0 {
+			r3[0] = args[0]
+		}
+		r3[1] = r3[0]
+		r3[2] = runtime.NewGoFunc(m.ctx, "", func(this runtime.Val, args ...runtime.Val) runtime.Val {
+			var r4 [2]runtime.Val
+			for i := range r4 {
+				r4[i] = runtime.Nil
+			}
+			if len(args) > 0 {
+				r4[0] = args[0]
+			}
+			r4[1] = runtime.NewGoFunc(m.ctx, "", func(this runtime.Val, args ...runtime.Val) runtime.Val {
+				var r5 [2]runtime.Val
+				for i := range r5 {
+					r5[i] = runtime.Nil
+				}
+				r5[0] = r3[1]
+				r5[1] = r4[0]
+				r5[0] = m.ctx.Arithmetic.Add(r5[0], r5[1])
+				r3[1] = r5[0]
+				r5[0] = r3[1]
+				return r5[0]
+			})
+			return r4[1]
+		})
+		return r3[2]
+	})
+	r0[14] = r0[3]
+	r0[15] = runtime.Number(10)
+	r0[14] = runtime.CallFunc(r0[14], r0[15])
+	r0[4] = r0[14]
+	r0[14] = r0[4]
+	r0[15] = runtime.Number(2)
+	r0[14] = runtime.CallFunc(r0[14], r0[15])
+	r0[5] = r0[14]
+	r0[14] = r0[4]
+	r0[15] = m.ctx.Arithmetic.Unm(runtime.Number(1))
+	r0[14] = runtime.CallFunc(r0[14], r0[15])
+	r0[6] = r0[14]
+	r0[14] = r0[0]
+	r0[15] = r0[5]
+	r0[15] = runtime.CallFunc(r0[15])
+	r0[16] = r0[5]
+	r0[16] = runtime.CallFunc(r0[16])
+	r0[17] = r0[6]
+	r0[17] = runtime.CallFunc(r0[17])
+	r0[18] = r0[5]
+	r0[18] = runtime.CallFunc(r0[18])
+	r0[14] = runtime.CallMethod(r0[14], runtime.String("Println"), r0[15], r0[16], r0[17], r0[18])
+	r0[7] = runtime.String("")
+	r0[14] = runtime.Number(10)
+	rs0 = append(rs0, runtime.NewRange(r0[14]))
+L66:
+	if v, ok := rs0[len(rs0)-1](); ok {
+		r0[8] = v
+	} else {
+		goto L79
+	}
+	r0[14] = runtime.Bool(m.ctx.Comparer.Cmp(r0[8], runtime.Number(2)) == 0)
+	if !r0[14].Bool() {
+		goto L70
+	}
+	goto L78
+L70:
+	r0[14] = runtime.Bool(m.ctx.Comparer.Cmp(r0[8], runtime.Number(5)) > 0)
+	if !r0[14].Bool() {
+		goto L73
+	}
+	goto L79
+L73:
+	r0[14] = r0[7]
+	r0[15] = m.ctx.Builtin("string")
+	r0[16] = r0[8]
+	r0[15] = runtime.CallFunc(r0[15], r0[16])
+	r0[7] = m.ctx.Arithmetic.Add(r0[14], r0[15])
+L78:
+	goto L66
+L79:
+	rs0 = rs0[:len(rs0)-1]
+	r0[14] = runtime.String("a,b,c")
+	r0[15] = runtime.String(",")
+	rs0 = append(rs0, runtime.NewRange(r0[14], r0[15]))
+L83:
+	if v, ok := rs0[len(rs0)-1](); ok {
+		r0[9] = v
+	} else {
+		goto L86
+	}
+	r0[7] = m.ctx.Arithmetic.Add(r0[7], r0[9])
+	goto L83
+L86:
+	rs0 = rs0[:len(rs0)-1]
+	r0[14] = runtime.Number(6)
+	r0[15] = runtime.Number(0)
+	r0[16] = m.ctx.Arithmetic.Unm(runtime.Number(2))
+	rs0 = append(rs0, runtime.NewRange(r0[14], r0[15], r0[16]))
+L91:
+	if v, ok := rs0[len(rs0)-1](); ok {
+		r0[10] = v
+	} else {
+		goto L99
+	}
+	r0[14] = r0[7]
+	r0[16] = m.ctx.Builtin("string")
+	r0[17] = r0[10]
+	r0[16] = runtime.CallFunc(r0[16], r0[17])
+	r0[15] = m.ctx.Arithmetic.Add(runtime.String("/"), r0[16])
+	r0[7] = m.ctx.Arithmetic.Add(r0[14], r0[15])
+	goto L91
+L99:
+	rs0 = rs0[:len(rs0)-1]
+	r0[11] = runtime.Number(0)
+	r0[14] = runtime.NewObject()
+	runtime.SetField(r0[14], runtime.String("a"), runtime.Number(1))
+	runtime.SetField(r0[14], runtime.String("b"), runtime.Number(2))
+	rs0 = append(rs0, runtime.NewRange(r0[14]))
+L105:
+	if v, ok := rs0[len(rs0)-1](); ok {
+		r0[12] = v
+	} else {
+		goto L109
+	}
+	r0[14] = runtime.GetField(r0[12], runtime.String("v"))
+	r0[11] = m.ctx.Arithmetic.Add(r0[11], r0[14])
+	goto L105
+L109:
+	rs0 = rs0[:len(rs0)-1]
+	r0[14] = r0[0]
+	r0[15] = r0[7]
+	r0[16] = r0[11]
+	r0[14] = runtime.CallMethod(r0[14], runtime.String("Println"), r0[15], r0[16])
+	r0[13] = runtime.NewGoFunc(m.ctx, "loop", func(this runtime.Val, args ...runtime.Val) runtime.Val {
+		var r6 [5]runtime.Val
+		for i := range r6 {
+			r6[i] = runtime.Nil
+		}
+		if len(args) > 0 {
+			r6[0] = args[0]
+		}
+		if len(args) > 1 {
+			r6[1] = args[1]
+		}
+		r6[2] = runtime.Bool(m.ctx.Comparer.Cmp(r6[0], runtime.Number(0)) == 0)
+		if !r6[2].Bool() {
+			goto L3
+		}
+		return r6[1]
+	L3:
+		r6[2] = r0[13]
+		r6[3] = m.ctx.Arithmetic.Sub(r6[0], runtime.Number(1))
+		r6[4] = m.ctx.Arithmetic.Add(r6[1], r6[0])
+		return runtime.CallFunc(r6[2], r6[3], r6[4])
+	})
+	r0[14] = r0[0]
+	r0[15] = r0[13]
+	r0[16] = runtime.Number(1000)
+	r0[17] = runtime.Number(0)
+	r0[15] = runtime.CallFunc(r0[15], r0[16], r0[17])
+	r0[16] = r0[1]
+	r0[17] = runtime.String("tail")
+	r0[16] = runtime.CallMethod(r0[16], runtime.String("greet"), r0[17])
+	r0[17] = runtime.Bool(m.ctx.Comparer.Cmp(runtime.String("esc\t\"q\"\n"), runtime.String("")) != 0)
+	r0[14] = runtime.CallMethod(r0[14], runtime.String("Println"), r0[15], r0[16], r0[17])
+	r0[14] = r0[13]
+	r0[15] = runtime.Number(10)
+	r0[16] = runtime.Number(0)
+	return runtime.CallFunc(r0[14], r0[15], r0[16])
+}
@@ -0,0 +1,103 @@
+// Code generated by agora gogen from fib.agora. DO NOT EDIT.
+
+package compiler
+
+import "github.com/PuerkitoBio/agora/runtime"
+
+// fibModule is the agora module "fib", compiled to Go.
+type fibModule struct {
+	ctx *runtime.Ctx
+	v   runtime.Val
+}
+
+// ID returns the identifier of the module.
+func (m *fibModule) ID() string {
+	return "fib"
+}
+
+// SetCtx sets the execution context of the module.
+func (m *fibModule) SetCtx(c *runtime.Ctx) {
+	m.ctx = c
+}
+
+// Run executes the module and returns its return value, or an error.
+func (m *fibModule) Run(args ...runtime.Val) (v runtime.Val, err error) {
+	defer runtime.PanicToError(&err)
+	// Do not re-run a module if it has already been imported. Use the cached value.
+	if m.v == nil {
+		m.v = runtime.NewGoFunc(m.ctx, "testdata/gogen/fib.agora", m.fn0).Call(nil, args...)
+	}
+	return m.v, nil
+}
+
+func (m *fibModule) fn0(this runtime.Val, args ...runtime.Val) runtime.Val {
+	var r0 [8]runtime.Val
+	for i := range r0 {
+		r0[i] = runtime.Nil
+	}
+	r0[3] = m.ctx.Builtin("import")
+	r0[4] = runtime.String("fmt")
+	r0[3] = runtime.CallFunc(r0[3], r0[4])
+	r0[0] = r0[3]
+	r0[1] = runtime.NewGoFunc(m.ctx, "fib", func(this runtime.Val, args ...runtime.Val) runtime.Val {
+		var r1 [5]runtime.Val
+		for i := range r1 {
+			r1[i] = runtime.Nil
+		}
+		if len(args) > 0 {
+			r1[0] = args[0]
+		}
+		r1[1] = runtime.Bool(m.ctx.Comparer.Cmp(r1[0], runtime.Number(2)) < 0)
+		if !r1[1].Bool() {
+			goto L3
+		}
+		return r1[0]
+	L3:
+		r1[2] = r0[1]
+		r1[3] = m.ctx.Arithmetic.Sub(r1[0], runtime.Number(1))
+		r1[2] = runtime.CallFunc(r1[2], r1[3])
+		r1[3] = r0[1]
+		r1[4] = m.ctx.Arithmetic.Sub(r1[0], runtime.Number(2))
+		r1[3] = runtime.CallFunc(r1[3], r1[4])
+		r1[1] = m.ctx.Arithmetic.Add(r1[2], r1[3])
+		return r1[1]
+	})
+	r0[2] = runtime.NewGoFunc(m.ctx, "iter", func(this runtime.Val, args ...runtime.Val) runtime.Val {
+		var r2 [6]runtime.Val
+		for i := range r2 {
+			r2[i] = runtime.Nil
+		}
+		if len(args) > 0 {
+			r2[0] = args[0]
+		}
+		r2[1] = runtime.Number(0)
+		r2[2] = runtime.Number(1)
+		r2[3] = runtime.Number(0)
+	L3:
+		r2[5] = runtime.Bool(m.ctx.Comparer.Cmp(r2[3], r2[0]) < 0)
+		if !r2[5].Bool() {
+			goto L10
+		}
+		r2[4] = m.ctx.Arithmetic.Add(r2[1], r2[2])
+		r2[1] = r2[2]
+		r2[2] = r2[4]
+		r2[3] = m.ctx.Arithmetic.Add(r2[3], runtime.Number(1))
+		goto L3
+	L10:
+		return r2[1]
+	})
+	r0[3] = r0[0]
+	r0[4] = r0[1]
+	r0[5] = runtime.Number(20)
+	r0[4] = runtime.CallFunc(r0[4], r0[5])
+	r0[5] = r0[2]
+	r0[6] = runtime.Number(20)
+	r0[5] = runtime.CallFunc(r0[5], r0[6])
+	r0[6] = r0[2]
+	r0[7] = runtime.Number(80)
+	r0[6] = runtime.CallFunc(r0[6], r0[7])
+	r0[3] = runtime.CallMethod(r0[3], runtime.String("Println"), r0[4], r0[5], r0[6])
+	r0[3] = r0[1]
+	r0[4] = runtime.Number(15)
+	return runtime.CallFunc(r0[3], r0[4])
+}
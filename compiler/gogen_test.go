@@ -0,0 +1,125 @@
+package compiler
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/agora/bytecode"
+	"github.com/PuerkitoBio/agora/runtime"
+	"github.com/PuerkitoBio/agora/runtime/stdlib"
+)
+
+var (
+	updateGoGen = flag.Bool("gogen.update", false, "rewrite the Go modules generated from testdata/gogen")
+
+	// The modules of testdata/gogen, generated in the gogen_<name>_test.go files.
+	gogencases = []struct {
+		nm     string
+		mod    runtime.NativeModule
+		interp bool // some functions are run by the interpreter
+	}{
+		0: {nm: "fib", mod: new(fibModule)},
+		1: {nm: "features", mod: new(featuresModule)},
+		2: {nm: "coro", mod: new(coroModule), interp: true},
+	}
+)
+
+func TestGoGen(t *testing.T) {
+	for i, c := range gogencases {
+		src := filepath.Join("testdata", "gogen", c.nm+".agora")
+		b, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := new(Compiler).Compile(src, bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := bytes.NewBuffer(nil)
+		gen := &GoGen{Package: "compiler", Type: c.nm + "Module"}
+		if err := gen.ToGo(f, buf); err != nil {
+			t.Errorf("[%d] - expected no error, got %s", i, err)
+			continue
+		}
+		if got := strings.Contains(buf.String(), "runtime.NewBytecodeFuncs"); got != c.interp {
+			t.Errorf("[%d] - expected interpreted functions to be %v, got %v", i, c.interp, got)
+		}
+		golden := "gogen_" + c.nm + "_test.go"
+		if *updateGoGen {
+			if err := ioutil.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		exp, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), exp) {
+			t.Errorf("[%d] - %s is out of date, run the tests with -gogen.update", i, golden)
+		}
+	}
+}
+
+func TestGoGenRun(t *testing.T) {
+	run := func(id string, mod runtime.NativeModule) (string, runtime.Val, error) {
+		ctx := runtime.NewCtx(new(runtime.FileResolver), new(Compiler))
+		buf := bytes.NewBuffer(nil)
+		ctx.Stdout = buf
+		ctx.RegisterNativeModule(new(stdlib.FmtMod))
+		if mod != nil {
+			ctx.RegisterNativeModule(mod)
+		}
+		m, err := ctx.Load(id)
+		if err != nil {
+			return "", nil, err
+		}
+		v, err := m.Run()
+		return buf.String(), v, err
+	}
+	for i, c := range gogencases {
+		expOut, expV, err := run(filepath.Join("testdata", "gogen", c.nm), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, v, err := run(c.nm, c.mod)
+		if err != nil {
+			t.Errorf("[%d] - expected no error, got %s", i, err)
+			continue
+		}
+		if out != expOut {
+			t.Errorf("[%d] - expected output %q, got %q", i, expOut, out)
+		}
+		if v != expV {
+			t.Errorf("[%d] - expected result %v, got %v", i, expV, v)
+		}
+	}
+}
+
+func TestGoGenErrors(t *testing.T) {
+	f := &bytecode.File{
+		Name: "test",
+		Fns: []*bytecode.Fn{
+			{Is: []bytecode.Instr{bytecode.NewInstrSBx(bytecode.OP_JMP, 0, 5)}},
+		},
+	}
+	cases := []struct {
+		gen *GoGen
+		f   *bytecode.File
+		err string
+	}{
+		0: {gen: new(GoGen), f: &bytecode.File{Name: "test"}, err: "empty module: test"},
+		1: {gen: &GoGen{Type: "my-module"}, f: f, err: "invalid Go identifier: my-module"},
+		2: {gen: new(GoGen), f: f, err: "invalid bytecode: test: func 0 (): instruction 0: JMP   0 5: jump to instruction 6 out of range (1 instructions)"},
+	}
+	for i, c := range cases {
+		err := c.gen.ToGo(c.f, ioutil.Discard)
+		if err == nil || err.Error() != c.err {
+			t.Errorf("[%d] - expected error %q, got %v", i, c.err, err)
+		}
+	}
+}
@@ -232,11 +232,15 @@ func (p *Parser) defineGrammar() {
 	p.builtin("len")
 	p.builtin("keys")
 	p.builtin("number")
+	p.builtin("decimal")
 	p.builtin("string")
 	p.builtin("bool")
 	p.builtin("type")
 	p.builtin("status")
 	p.builtin("reset")
+	p.builtin("equal")
+	p.builtin("compare")
+	p.builtin("sort")
 
 	// func can be both an expression prefix:
 	//   fnAdd := func(x, y) {return x+y}
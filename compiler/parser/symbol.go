@@ -126,6 +126,11 @@ func (s *Symbol) nud() *Symbol {
 	return s.nudfn(s)
 }
 
+// Pos returns the position of the Symbol in the source code.
+func (s *Symbol) Pos() token.Position {
+	return s.pos
+}
+
 // String returns a literal string representation of the Symbol.
 func (s *Symbol) String() string {
 	return s.indentString(0)
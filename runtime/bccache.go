@@ -0,0 +1,135 @@
+package runtime
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/PuerkitoBio/agora/bytecode"
+)
+
+// The name of the directory that holds the cached bytecode of the modules, next
+// to their source files.
+const BytecodeCacheDirName = "__agoracache__"
+
+// A BytecodeCache stores the compiled bytecode of the modules on disk, so that
+// a module is not compiled again on the next run if its source did not change.
+// It is enabled by setting the BytecodeCache field of the execution context.
+//
+// If Dir is empty, the bytecode is written to the __agoracache__ directory next
+// to the source file of the module, for the modules that are resolved to a file
+// (a reader with a Name method, e.g. *os.File). Otherwise, the bytecode of all
+// modules is written to Dir, in a file named after the hash of the module ID.
+//
+// A cached file is named after the version of the bytecode format, and holds the
+// SHA-256 hash of the module ID, format, compiler type and source code before the
+// encoded bytecode. It is used only if the hash matches, otherwise the module is
+// compiled and the file replaced. Errors reading or writing the cache are ignored, the
+// module is compiled as if there was no cache.
+//
+// Modules that are already bytecode are not cached.
+type BytecodeCache struct {
+	Dir string
+}
+
+// NewBytecodeCache returns a BytecodeCache that writes to the specified
+// directory, or next to the source files if it is empty.
+func NewBytecodeCache(dir string) *BytecodeCache {
+	return &BytecodeCache{dir}
+}
+
+// Return the bytecode of the module identified by id, whose source code in the
+// specified format is read from r, from the cache if it is up-to-date, otherwise
+// compiled with comp and stored in the cache.
+func (bc *BytecodeCache) get(id, format string, r io.Reader, comp Compiler) (*bytecode.File, error) {
+	nm := bc.fileName(id, r)
+	if nm == "" {
+		return comp.Compile(id, r)
+	}
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%T\x00", id, format, comp)
+	h.Write(src)
+	sum := h.Sum(nil)
+
+	if f := bc.read(nm, sum); f != nil {
+		return f, nil
+	}
+	f, err := comp.Compile(id, bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	bc.write(nm, sum, f)
+	return f, nil
+}
+
+// Return the name of the cache file for the module identified by id and resolved
+// to r, or an empty string if the module cannot be cached.
+func (bc *BytecodeCache) fileName(id string, r io.Reader) string {
+	maj, min := bytecode.Version()
+	if bc.Dir != "" {
+		sum := sha256.Sum256([]byte(id))
+		return filepath.Join(bc.Dir, fmt.Sprintf("%s.v%d.%d.agorac", hex.EncodeToString(sum[:16]), maj, min))
+	}
+	nr, ok := r.(interface {
+		Name() string
+	})
+	if !ok {
+		return ""
+	}
+	dir, base := filepath.Split(nr.Name())
+	return filepath.Join(dir, BytecodeCacheDirName, fmt.Sprintf("%s.v%d.%d.agorac", base, maj, min))
+}
+
+// Return the decoded bytecode of the cache file, or nil if it does not exist, is
+// invalid, or was not compiled from the source with the specified hash.
+func (bc *BytecodeCache) read(nm string, sum []byte) *bytecode.File {
+	b, err := ioutil.ReadFile(nm)
+	if err != nil || len(b) < len(sum) || !bytes.Equal(b[:len(sum)], sum) {
+		return nil
+	}
+	f, err := bytecode.NewDecoder(bytes.NewReader(b[len(sum):])).Decode()
+	if err != nil {
+		return nil
+	}
+	return f
+}
+
+// Write the bytecode to the cache file, preceded by the hash of its source. The
+// file is replaced atomically, so that concurrent runs never read a partial file.
+func (bc *BytecodeCache) write(nm string, sum []byte, f *bytecode.File) {
+	buf := new(bytes.Buffer)
+	buf.Write(sum)
+	if err := bytecode.NewEncoder(buf).Encode(f); err != nil {
+		return
+	}
+	dir := filepath.Dir(nm)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), nm)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+}
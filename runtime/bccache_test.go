@@ -0,0 +1,113 @@
+package runtime_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/PuerkitoBio/agora/runtime"
+)
+
+func TestBytecodeCacheNextToSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agora-bccache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(nm, src string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, nm), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("main.agora", `return import("./lib") + 1`)
+	write("lib.agora", `return 1`)
+
+	comp := new(countCompiler)
+	run := func(exp int64) {
+		ctx := runtime.NewCtx(new(runtime.FileResolver), comp)
+		ctx.BytecodeCache = runtime.NewBytecodeCache("")
+		if v, err := mustLoad(t, ctx, filepath.Join(dir, "main")).Run(); err != nil || v.Int() != exp {
+			t.Errorf("expected %d, got %v (%v)", exp, v, err)
+		}
+	}
+	cases := []struct {
+		lib  string
+		exp  int64
+		comp int
+	}{
+		0: {exp: 2, comp: 2},
+		1: {exp: 2, comp: 0},
+		2: {lib: `return 2`, exp: 3, comp: 1},
+		3: {exp: 3, comp: 0},
+	}
+	for i, c := range cases {
+		if c.lib != "" {
+			write("lib.agora", c.lib)
+		}
+		n := comp.n
+		run(c.exp)
+		if comp.n-n != c.comp {
+			t.Errorf("[%d] - expected %d compilations, got %d", i, c.comp, comp.n-n)
+		}
+	}
+	fis, err := ioutil.ReadDir(filepath.Join(dir, runtime.BytecodeCacheDirName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 2 {
+		t.Errorf("expected 2 cached files, got %d", len(fis))
+	}
+
+	// A corrupted cache file is ignored and replaced
+	for _, fi := range fis {
+		if err := ioutil.WriteFile(filepath.Join(dir, runtime.BytecodeCacheDirName, fi.Name()), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := comp.n
+	run(3)
+	run(3)
+	if comp.n-n != 2 {
+		t.Errorf("expected 2 compilations, got %d", comp.n-n)
+	}
+}
+
+func TestBytecodeCacheDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agora-bccache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	res := srcResolver{"main": `return import("lib") + 1`, "lib": `return 1`}
+	comp := new(countCompiler)
+	for i, exp := range []int{2, 0} {
+		ctx := runtime.NewCtx(res, comp)
+		ctx.BytecodeCache = runtime.NewBytecodeCache(dir)
+		n := comp.n
+		if v, err := mustLoad(t, ctx, "main").Run(); err != nil || v.Int() != 2 {
+			t.Errorf("[%d] - expected 2, got %v (%v)", i, v, err)
+		}
+		if comp.n-n != exp {
+			t.Errorf("[%d] - expected %d compilations, got %d", i, exp, comp.n-n)
+		}
+	}
+
+	// Another type of compiler does not use the cached bytecode
+	ctx := runtime.NewCtx(res, fixedCompiler("return 5"))
+	ctx.BytecodeCache = runtime.NewBytecodeCache(dir)
+	if v, err := mustLoad(t, ctx, "main").Run(); err != nil || v.Int() != 5 {
+		t.Errorf("expected 5, got %v (%v)", v, err)
+	}
+
+	// Without a directory, modules that are not files are not cached
+	for i := 0; i < 2; i++ {
+		ctx := runtime.NewCtx(res, comp)
+		ctx.BytecodeCache = runtime.NewBytecodeCache("")
+		n := comp.n
+		mustLoad(t, ctx, "main")
+		if comp.n-n != 1 {
+			t.Errorf("[%d] - expected 1 compilation, got %d", i, comp.n-n)
+		}
+	}
+}
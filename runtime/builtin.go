@@ -2,6 +2,7 @@ package runtime
 
 import (
 	"fmt"
+	"sort"
 )
 
 type builtinMod struct {
@@ -23,11 +24,15 @@ func (b *builtinMod) Run(_ ...Val) (v Val, err error) {
 		b.ob.Set(String("len"), NewNativeFunc(b.ctx, "len", b._len))
 		b.ob.Set(String("keys"), NewNativeFunc(b.ctx, "keys", b._keys))
 		b.ob.Set(String("number"), NewNativeFunc(b.ctx, "number", b._number))
+		b.ob.Set(String("decimal"), NewNativeFunc(b.ctx, "decimal", b._decimal))
 		b.ob.Set(String("string"), NewNativeFunc(b.ctx, "string", b._string))
 		b.ob.Set(String("bool"), NewNativeFunc(b.ctx, "bool", b._bool))
 		b.ob.Set(String("type"), NewNativeFunc(b.ctx, "type", b._type))
 		b.ob.Set(String("status"), NewNativeFunc(b.ctx, "status", b._status))
 		b.ob.Set(String("reset"), NewNativeFunc(b.ctx, "reset", b._reset))
+		b.ob.Set(String("equal"), NewNativeFunc(b.ctx, "equal", b._equal))
+		b.ob.Set(String("compare"), NewNativeFunc(b.ctx, "compare", b._compare))
+		b.ob.Set(String("sort"), NewNativeFunc(b.ctx, "sort", b._sort))
 	}
 	return b.ob, nil
 }
@@ -38,7 +43,8 @@ func (b *builtinMod) SetCtx(c *Ctx) {
 
 func (b *builtinMod) _import(args ...Val) Val {
 	ExpectAtLeastNArgs(1, args)
-	m, err := b.ctx.Load(args[0].String())
+	// Relative module identifiers are resolved from the importing module
+	m, err := b.ctx.load(args[0].String(), b.ctx.importer())
 	if err != nil {
 		panic(err)
 	}
@@ -66,6 +72,9 @@ func (b *builtinMod) _recover(args ...Val) (ret Val) {
 	defer func() {
 		if err := recover(); err != nil {
 			switch v := err.(type) {
+			case ExitError:
+				// Termination requests are not recoverable
+				panic(v)
 			case Val:
 				ret = v
 			case error:
@@ -113,6 +122,11 @@ func (b *builtinMod) _number(args ...Val) Val {
 	return Number(args[0].Float())
 }
 
+func (b *builtinMod) _decimal(args ...Val) Val {
+	ExpectAtLeastNArgs(1, args)
+	return decimalVal(ToRat(args[0]))
+}
+
 func (b *builtinMod) _string(args ...Val) Val {
 	ExpectAtLeastNArgs(1, args)
 	return String(args[0].String())
@@ -152,3 +166,50 @@ func (b *builtinMod) _reset(args ...Val) Val {
 	}
 	return Nil
 }
+
+func (b *builtinMod) _equal(args ...Val) Val {
+	ExpectAtLeastNArgs(2, args)
+	return Bool(newOrderer(b.ctx.Comparer).equal(args[0], args[1]))
+}
+
+func (b *builtinMod) _compare(args ...Val) Val {
+	ExpectAtLeastNArgs(2, args)
+	return Number(newOrderer(b.ctx.Comparer).compare(args[0], args[1]))
+}
+
+func (b *builtinMod) _sort(args ...Val) Val {
+	ExpectAtLeastNArgs(1, args)
+	ob, ok := args[0].(Object)
+	if !ok {
+		panic(NewTypeError(Type(args[0]), "", "sort"))
+	}
+	// Only array-like objects can be sorted
+	keys := ob.Keys().(Object)
+	if l := keys.Len().Int(); l > 0 && !isArrayLike(ob, keys, l) {
+		panic(NewTypeError("non-array object", "", "sort"))
+	}
+	vals := make([]Val, keys.Len().Int())
+	for i := range vals {
+		vals[i] = ob.Get(Number(i))
+	}
+	var less func(i, j int) bool
+	if len(args) > 1 && args[1] != Nil {
+		fn, ok := args[1].(Func)
+		if !ok {
+			panic(NewTypeError(Type(args[1]), "", "sort"))
+		}
+		less = func(i, j int) bool {
+			return fn.Call(Nil, vals[i], vals[j]).Float() < 0
+		}
+	} else {
+		o := newOrderer(b.ctx.Comparer)
+		less = func(i, j int) bool {
+			return o.compare(vals[i], vals[j]) < 0
+		}
+	}
+	sort.SliceStable(vals, less)
+	for i, v := range vals {
+		ob.Set(Number(i), v)
+	}
+	return ob
+}
@@ -2,6 +2,7 @@ package runtime
 
 import (
 	"io"
+	"math"
 	"strings"
 	"testing"
 )
@@ -119,11 +120,11 @@ lines`),
 		},
 		5: {
 			src: &object{
-				map[Val]Val{
+				m: map[Val]Val{
 					Number(1):      String("val1"),
 					String("name"): Bool(false),
 					String("subobj"): &object{
-						map[Val]Val{
+						m: map[Val]Val{
 							String("key"): Number(10),
 						},
 					},
@@ -181,7 +182,7 @@ func TestPanic(t *testing.T) {
 		},
 		5: {
 			src: &object{
-				map[Val]Val{
+				m: map[Val]Val{
 					String("__bool"): NewNativeFunc(ctx, "", func(args ...Val) Val {
 						return Bool(false)
 					}),
@@ -215,7 +216,7 @@ func TestPanic(t *testing.T) {
 		},
 		12: {
 			src: &object{
-				map[Val]Val{
+				m: map[Val]Val{
 					String("__bool"): NewNativeFunc(ctx, "", func(args ...Val) Val {
 						return Bool(true)
 					}),
@@ -568,3 +569,133 @@ func TestConvType(t *testing.T) {
 		}
 	}
 }
+
+// Create an object with the specified key-value pairs.
+func obj(kv ...Val) Object {
+	o := NewObject()
+	for i := 0; i < len(kv); i += 2 {
+		o.Set(kv[i], kv[i+1])
+	}
+	return o
+}
+
+func TestEqualAndCompare(t *testing.T) {
+	bi := new(builtinMod)
+	ctx := NewCtx(nil, nil)
+	bi.SetCtx(ctx)
+
+	cyc1, cyc2 := obj(String("a"), Number(1)), obj(String("a"), Number(1))
+	cyc1.Set(String("self"), cyc1)
+	cyc2.Set(String("self"), cyc2)
+	fn1, fn2 := NewNativeFunc(ctx, "f1", nil), NewNativeFunc(ctx, "f2", nil)
+	cases := []struct {
+		a, b Val
+		exp  int
+	}{
+		0:  {a: Nil, b: Nil, exp: 0},
+		1:  {a: Number(1), b: Number(2), exp: -1},
+		2:  {a: String("b"), b: String("a"), exp: 1},
+		3:  {a: Number(1), b: String("1"), exp: -1},
+		4:  {a: obj(), b: obj(), exp: 0},
+		5:  {a: obj(String("a"), Number(1)), b: obj(String("a"), Number(1)), exp: 0},
+		6:  {a: obj(String("a"), Number(1)), b: obj(String("a"), Number(2)), exp: -1},
+		7:  {a: obj(String("a"), Number(1)), b: obj(String("b"), Number(1)), exp: -1},
+		8:  {a: obj(String("a"), Number(1), String("b"), Number(1)), b: obj(String("a"), Number(1)), exp: 1},
+		9:  {a: obj(String("x"), obj(Number(0), Bool(true))), b: obj(String("x"), obj(Number(0), Bool(true))), exp: 0},
+		10: {a: cyc1, b: cyc2, exp: 0},
+		11: {a: fn1, b: fn1, exp: 0},
+		12: {a: Bool(false), b: Nil, exp: 1},
+		13: {a: obj(), b: String(""), exp: -1},
+		14: {a: Number(math.NaN()), b: Number(math.NaN()), exp: 0},
+		15: {a: Number(math.NaN()), b: Number(math.Inf(-1)), exp: -1},
+		16: {a: Number(math.NaN()), b: Number(1), exp: -1},
+		17: {a: Number(math.NaN()), b: Bool(true), exp: 1},
+		18: {a: obj(String("a"), Number(math.NaN())), b: obj(String("a"), Number(math.NaN())), exp: 0},
+		19: {a: obj(String("a"), Number(math.NaN())), b: obj(String("a"), Number(0)), exp: -1},
+	}
+	for i, c := range cases {
+		if res := bi._compare(c.a, c.b).Int(); res != int64(c.exp) {
+			t.Errorf("[%d] - expected compare %d, got %d", i, c.exp, res)
+		}
+		if res := bi._compare(c.b, c.a).Int(); res != int64(-c.exp) {
+			t.Errorf("[%d] - expected reverse compare %d, got %d", i, -c.exp, res)
+		}
+		if res := bi._equal(c.a, c.b).Bool(); res != (c.exp == 0) {
+			t.Errorf("[%d] - expected equal %t, got %t", i, c.exp == 0, res)
+		}
+	}
+
+	// The exported functions use the standard comparer, the methods of the
+	// context its comparer
+	for i, c := range cases {
+		if res := Compare(c.a, c.b); res != c.exp {
+			t.Errorf("[%d] - expected Compare %d, got %d", i, c.exp, res)
+		}
+		if res := Equal(c.a, c.b); res != (c.exp == 0) {
+			t.Errorf("[%d] - expected Equal %t, got %t", i, c.exp == 0, res)
+		}
+	}
+	dctx := NewCtx(nil, nil)
+	dctx.Arithmetic, dctx.Comparer = DecimalArithmetic{}, DecimalComparer{}
+	d := dctx.Arithmetic.Add(Number(0.1), Number(0.2))
+	if res := dctx.Compare(d, Number(0.3)); res != 0 || !dctx.Equal(d, Number(0.3)) {
+		t.Errorf("expected %s equal to 0.3 with the decimal comparer, got %d", d, res)
+	}
+	if res := dctx.Compare(Number(math.NaN()), d); res != -1 {
+		t.Errorf("expected NaN lower with the decimal comparer, got %d", res)
+	}
+
+	// The standard comparer is consistent for distinct funcs and objects
+	cmp := defaultComparer{}
+	o1, o2 := obj(), obj()
+	pairs := [][2]Val{{fn1, fn2}, {o1, o2}}
+	for i, p := range pairs {
+		if c1, c2 := cmp.Cmp(p[0], p[1]), cmp.Cmp(p[1], p[0]); c1 == 0 || c1 != -c2 {
+			t.Errorf("[%d] - expected a consistent order, got %d and %d", i, c1, c2)
+		}
+	}
+}
+
+func TestSort(t *testing.T) {
+	bi := new(builtinMod)
+	ctx := NewCtx(nil, nil)
+	bi.SetCtx(ctx)
+
+	o := obj(Number(0), String("b"), Number(1), Number(3), Number(2), Nil, Number(3), String("a"),
+		Number(4), Number(-1), Number(5), obj(String("k"), Number(1)))
+	o.Set(Number(2), Bool(true))
+	bi._sort(o)
+	exp := []string{"true", "-1", "3", "", "a", "b"}
+	for i, e := range exp {
+		if v := o.Get(Number(i)); i != 3 && v.String() != e {
+			t.Errorf("[%d] - expected %s, got %s", i, e, v)
+		} else if i == 3 && Type(v) != "object" {
+			t.Errorf("[%d] - expected an object, got %s", i, v)
+		}
+	}
+
+	// With NaN, lower than all other numbers, wherever it is
+	for i, o := range []Object{
+		obj(Number(0), Number(2), Number(1), Number(math.NaN()), Number(2), Number(-1)),
+		obj(Number(0), Number(math.NaN()), Number(1), Number(2), Number(2), Number(-1)),
+	} {
+		bi._sort(o)
+		if v := o.Get(Number(0)).Float(); !math.IsNaN(v) {
+			t.Errorf("[%d] - expected NaN first, got %v", i, v)
+		}
+		if v1, v2 := o.Get(Number(1)).Float(), o.Get(Number(2)).Float(); v1 != -1 || v2 != 2 {
+			t.Errorf("[%d] - expected -1 and 2, got %v and %v", i, v1, v2)
+		}
+	}
+
+	// With a custom comparison, in reverse order
+	o = obj(Number(0), Number(1), Number(1), Number(3), Number(2), Number(2))
+	bi._sort(o, NewNativeFunc(ctx, "rev", func(args ...Val) Val {
+		return Number(args[1].Float() - args[0].Float())
+	}))
+	for i, e := range []float64{3, 2, 1} {
+		if v := o.Get(Number(i)).Float(); v != e {
+			t.Errorf("[%d] - expected %v, got %v", i, e, v)
+		}
+	}
+}
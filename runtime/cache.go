@@ -0,0 +1,125 @@
+package runtime
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// A ModuleCache is a goroutine-safe cache of compiled modules. It may be shared
+// by many execution contexts via their Cache field, so that a module is compiled
+// (or its bytecode decoded) only once, and its immutable compiled form shared.
+// The execution state of the modules, such as the values they return, is not
+// shared.
+//
+// An entry is identified by the module ID, the format of the module and the type
+// of the compiler used for this format (see Ctx.RegisterCompiler), and, if the
+// reader returned by the resolver has a Name method (e.g. *os.File), by the file
+// name. Compilers of the same type are expected to produce the same bytecode for
+// the same source. It is invalidated
+// when the file modification time or size changes, if the reader also has a
+// Stat method. Otherwise, or if Hash is true, the entry is invalidated when the
+// SHA-256 hash of the content changes, which requires reading the whole content
+// on each load.
+type ModuleCache struct {
+	Hash bool // Always use the content hash to invalidate entries
+
+	mu   sync.RWMutex
+	mods map[string]*cacheEntry
+}
+
+// A cache entry holds the compiled module and the version of the file it was
+// compiled from (modification time and size, or content hash).
+type cacheEntry struct {
+	version string
+	mod     *compiledModule
+}
+
+// NewModuleCache returns a new, empty compiled modules cache.
+func NewModuleCache() *ModuleCache {
+	return &ModuleCache{
+		mods: make(map[string]*cacheEntry),
+	}
+}
+
+// Len returns the number of compiled modules in the cache.
+func (mc *ModuleCache) Len() int {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	return len(mc.mods)
+}
+
+// Remove removes the compiled modules of the module identified by id from the
+// cache.
+func (mc *ModuleCache) Remove(id string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for k := range mc.mods {
+		if k == id || strings.HasPrefix(k, id+"\x00") {
+			delete(mc.mods, k)
+		}
+	}
+}
+
+// Return the up-to-date compiled module for the module identified by id and
+// resolved to the reader r, compiling it with the compile function and storing
+// it in the cache if required. The compiler identifies the format and compiler
+// used by compile. The modules compiled for a context that requires signed
+// bytecode are stored apart, as their signature has been verified.
+func (mc *ModuleCache) get(id string, r io.Reader, compiler string, compile func(string, io.Reader) (*compiledModule, error), signed bool) (*compiledModule, error) {
+	key, version, r, err := sourceVersion(id, r, mc.Hash)
+	if err != nil {
+		return nil, err
+	}
+	key += "\x00" + compiler
+	if signed {
+		key += "\x00signed"
+	}
+	mc.mu.RLock()
+	e := mc.mods[key]
+	mc.mu.RUnlock()
+	if e != nil && e.version == version {
+		return e.mod, nil
+	}
+	cm, err := compile(id, r)
+	if err != nil {
+		return nil, err
+	}
+	mc.mu.Lock()
+	mc.mods[key] = &cacheEntry{version, cm}
+	mc.mu.Unlock()
+	return cm, nil
+}
+
+// Return the key and version of the source of the module identified by id and
+// resolved to r: the file name and its modification time and size if r is a file,
+// otherwise (or if hash is true) the id and the hash of the content. It returns
+// the reader to use to compile the module, which may be a copy of r if the
+// content had to be read to compute its hash.
+func sourceVersion(id string, r io.Reader, hash bool) (string, string, io.Reader, error) {
+	if nr, ok := r.(interface {
+		Name() string
+	}); ok && !hash {
+		if sr, ok := r.(interface {
+			Stat() (fs.FileInfo, error)
+		}); ok {
+			fi, err := sr.Stat()
+			if err != nil {
+				return "", "", nil, err
+			}
+			return id + "\x00" + nr.Name(), fmt.Sprintf("%d-%d", fi.ModTime().UnixNano(), fi.Size()), r, nil
+		}
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", "", nil, err
+	}
+	sum := sha256.Sum256(b)
+	return id, hex.EncodeToString(sum[:]), bytes.NewReader(b), nil
+}
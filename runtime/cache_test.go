@@ -0,0 +1,157 @@
+package runtime_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/agora/bytecode"
+	"github.com/PuerkitoBio/agora/compiler"
+	"github.com/PuerkitoBio/agora/runtime"
+)
+
+// A compiler that counts the number of compilations.
+type countCompiler struct {
+	mu sync.Mutex
+	n  int
+	c  compiler.Compiler
+}
+
+func (c *countCompiler) Compile(id string, r io.Reader) (*bytecode.File, error) {
+	c.mu.Lock()
+	c.n++
+	c.mu.Unlock()
+	return c.c.Compile(id, r)
+}
+
+const cacheSrc = `x := {n: 0}
+x.Incr = func() {
+	this.n++
+	return this.n
+}
+return x
+`
+
+func TestModuleCacheHash(t *testing.T) {
+	res := srcResolver{"mod": cacheSrc}
+	comp := new(countCompiler)
+	cache := runtime.NewModuleCache()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx := runtime.NewCtx(res, comp)
+			ctx.Cache = cache
+			// The module's state is not shared
+			if v, err := ctx.Call("mod", "Incr"); err != nil || v != 1.0 {
+				t.Errorf("[%d] - expected 1, got %v (%v)", i, v, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	// Concurrent loads may compile the same module, but once cached, it is not
+	// compiled again.
+	n := comp.n
+	if n < 1 || cache.Len() != 1 {
+		t.Fatalf("expected the module to be compiled and cached, got %d compilations and %d entries", n, cache.Len())
+	}
+	ctx := runtime.NewCtx(res, comp)
+	ctx.Cache = cache
+	mustLoad(t, ctx, "mod")
+	if comp.n != n {
+		t.Errorf("expected no new compilation, got %d", comp.n-n)
+	}
+
+	// Changing the source invalidates the entry
+	res["mod"] = "return 2"
+	ctx = runtime.NewCtx(res, comp)
+	ctx.Cache = cache
+	if v, _ := mustLoad(t, ctx, "mod").Run(); v.Int() != 2 {
+		t.Errorf("expected 2, got %v", v)
+	}
+	if comp.n != n+1 {
+		t.Errorf("expected a new compilation, got %d", comp.n-n)
+	}
+	cache.Remove("mod")
+	if cache.Len() != 0 {
+		t.Errorf("expected the entry to be removed, got %d entries", cache.Len())
+	}
+}
+
+func TestModuleCacheModTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agora-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "mod.agora")
+	if err := ioutil.WriteFile(fn, []byte("return 1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	comp := new(countCompiler)
+	cache := runtime.NewModuleCache()
+	load := func(exp int64) {
+		ctx := runtime.NewCtx(new(runtime.FileResolver), comp)
+		ctx.Cache = cache
+		if v, _ := mustLoad(t, ctx, filepath.Join(dir, "mod")).Run(); v.Int() != exp {
+			t.Errorf("expected %d, got %v", exp, v)
+		}
+	}
+	load(1)
+	load(1)
+	if comp.n != 1 {
+		t.Errorf("expected 1 compilation, got %d", comp.n)
+	}
+	if err := ioutil.WriteFile(fn, []byte("return 2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mt := time.Now().Add(time.Second)
+	if err := os.Chtimes(fn, mt, mt); err != nil {
+		t.Fatal(err)
+	}
+	load(2)
+	if comp.n != 2 {
+		t.Errorf("expected 2 compilations, got %d", comp.n)
+	}
+}
+
+// A compiler that compiles a fixed source, whatever the source of the module.
+type fixedCompiler string
+
+func (c fixedCompiler) Compile(id string, r io.Reader) (*bytecode.File, error) {
+	return new(compiler.Compiler).Compile(id, strings.NewReader(string(c)))
+}
+
+func TestModuleCacheCompilers(t *testing.T) {
+	res := srcResolver{"mod": "return 1"}
+	cache := runtime.NewModuleCache()
+	cases := []struct {
+		comp   runtime.Compiler
+		format runtime.Compiler // registered for the format of the module
+		exp    int64
+	}{
+		0: {comp: new(compiler.Compiler), exp: 1},
+		1: {comp: fixedCompiler("return 2"), exp: 2},
+		2: {comp: fixedCompiler("return 2"), format: new(compiler.Compiler), exp: 1},
+		3: {comp: new(compiler.Compiler), exp: 1},
+	}
+	for i, c := range cases {
+		ctx := runtime.NewCtx(res, c.comp)
+		ctx.Cache = cache
+		if c.format != nil {
+			ctx.RegisterCompiler("", c.format)
+		}
+		if v, err := mustLoad(t, ctx, "mod").Run(); err != nil || v.Int() != c.exp {
+			t.Errorf("[%d] - expected %d, got %v (%v)", i, c.exp, v, err)
+		}
+	}
+	if cache.Len() != 2 {
+		t.Errorf("expected 2 entries, got %d", cache.Len())
+	}
+}
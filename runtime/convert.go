@@ -0,0 +1,626 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	goruntime "runtime"
+	"strings"
+)
+
+// The struct tag key used to control the name of a field in agora.
+const structTag = "agora"
+
+var (
+	valType      = reflect.TypeOf((*Val)(nil)).Elem()
+	errorType    = reflect.TypeOf((*error)(nil)).Elem()
+	ratPtrType   = reflect.TypeOf((*big.Rat)(nil))
+	intPtrType   = reflect.TypeOf((*big.Int)(nil))
+	floatPtrType = reflect.TypeOf((*big.Float)(nil))
+
+	// Error returned by FromVal if the target is not a non-nil pointer.
+	ErrInvalidTarget = errors.New("target must be a non-nil pointer")
+)
+
+// RangeError is returned by FromVal when a number is out of the range of the
+// Go numeric type it is converted to.
+type RangeError string
+
+// Error interface implementation.
+func (e RangeError) Error() string {
+	return string(e)
+}
+
+// Create a new RangeError.
+func NewRangeError(v Val, t reflect.Type) RangeError {
+	return RangeError(fmt.Sprintf("range error: %s out of the range of %s", v, t))
+}
+
+// ToVal converts the Go value v to an agora value, using reflection:
+//
+// * nil and nil pointers, maps, slices and funcs are converted to Nil.
+// * Values that already implement Val are returned as-is.
+// * Booleans are converted to Bool, integers and floats to Number, strings and
+// byte slices to String.
+// * *big.Rat, *big.Int and *big.Float are converted to Decimal, or to Number if
+// they are integers exactly represented by a float64.
+// * Slices and arrays are converted to array-like Objects, indexed from 0.
+// * Maps are converted to Objects, keys and values are converted too.
+// * Structs are converted to Objects, with one key per exported field. The name
+// of the key can be set with the `agora:"name"` struct tag, and the field is
+// skipped if the name is "-". Embedded structs' fields are promoted, except
+// for embedded pointers to unexported struct types, and for a struct type
+// embedded in itself, directly or not.
+// * Pointers are converted to the agora value of the value they point to, a
+// pointer seen more than once is converted to the same Object.
+// * Funcs are converted to native funcs. Arguments are converted using FromVal
+// to the types expected by the Go function, and its result is converted using
+// ToVal. If the last result is an error, it is raised as a panic if non-nil.
+// Multiple other results are returned as an array-like Object.
+//
+// It panics if the value cannot be converted, i.e. for channels and complex
+// numbers.
+func ToVal(ctx *Ctx, v interface{}) Val {
+	if v == nil {
+		return Nil
+	}
+	if val, ok := v.(Val); ok {
+		return val
+	}
+	c := &toValConv{ctx, make(map[toValKey]Val)}
+	return c.conv(reflect.ValueOf(v))
+}
+
+// A toValKey identifies an already converted pointer.
+type toValKey struct {
+	p uintptr
+	t reflect.Type
+}
+
+// A toValConv holds the state of a Go to agora conversion.
+type toValConv struct {
+	ctx  *Ctx
+	seen map[toValKey]Val
+}
+
+func (c *toValConv) conv(rv reflect.Value) Val {
+	if !rv.IsValid() {
+		return Nil
+	}
+	if rv.Type().Implements(valType) && (rv.Kind() != reflect.Ptr && rv.Kind() != reflect.Interface || !rv.IsNil()) {
+		return rv.Interface().(Val)
+	}
+	if v, ok := bigToVal(rv); ok {
+		return v
+	}
+	switch rv.Kind() {
+	case reflect.Bool:
+		return Bool(rv.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return Number(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return Number(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return Number(rv.Float())
+	case reflect.String:
+		return String(rv.String())
+	case reflect.Interface:
+		if rv.IsNil() {
+			return Nil
+		}
+		return c.conv(rv.Elem())
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return Nil
+		}
+		k := toValKey{rv.Pointer(), rv.Type()}
+		if v, ok := c.seen[k]; ok {
+			return v
+		}
+		if rv.Elem().Kind() == reflect.Struct {
+			// Register the object before converting the fields, to support cycles
+			ob := NewObject()
+			c.seen[k] = ob
+			c.setFields(ob, rv.Elem())
+			return ob
+		}
+		v := c.conv(rv.Elem())
+		c.seen[k] = v
+		return v
+	case reflect.Slice:
+		if rv.IsNil() {
+			return Nil
+		}
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return String(rv.Bytes())
+		}
+		fallthrough
+	case reflect.Array:
+		ob := NewObject()
+		for i, l := 0, rv.Len(); i < l; i++ {
+			ob.Set(Number(i), c.conv(rv.Index(i)))
+		}
+		return ob
+	case reflect.Map:
+		if rv.IsNil() {
+			return Nil
+		}
+		ob := NewObject()
+		for _, k := range rv.MapKeys() {
+			ob.Set(c.conv(k), c.conv(rv.MapIndex(k)))
+		}
+		return ob
+	case reflect.Struct:
+		ob := NewObject()
+		c.setFields(ob, rv)
+		return ob
+	case reflect.Func:
+		if rv.IsNil() {
+			return Nil
+		}
+		return c.convFunc(rv)
+	}
+	panic(NewTypeError(rv.Type().String(), "", "conversion to agora value"))
+}
+
+// Set the fields of the struct value rv on the object.
+func (c *toValConv) setFields(ob Object, rv reflect.Value) {
+	for _, f := range structFields(rv.Type()) {
+		fv, ok := fieldByIndex(rv, f.index, false)
+		if !ok {
+			continue
+		}
+		ob.Set(String(f.name), c.conv(fv))
+	}
+}
+
+// Convert a Go func to a native func.
+func (c *toValConv) convFunc(rv reflect.Value) Val {
+	t := rv.Type()
+	nm := t.String()
+	if f := goruntime.FuncForPC(rv.Pointer()); f != nil {
+		nm = f.Name()
+	}
+	ctx := c.ctx
+	return NewNativeFunc(ctx, nm, func(args ...Val) Val {
+		// Convert the arguments to the expected types
+		n := t.NumIn()
+		if t.IsVariadic() {
+			n--
+			ExpectAtLeastNArgs(n, args)
+		} else if len(args) < n {
+			// Missing arguments are nil, as with agora funcs
+			args = append(args, make([]Val, n-len(args))...)
+		}
+		in := make([]reflect.Value, 0, len(args))
+		for i, arg := range args {
+			var at reflect.Type
+			if i < n {
+				at = t.In(i)
+			} else if t.IsVariadic() {
+				at = t.In(n).Elem()
+			} else {
+				// Extra arguments are ignored
+				break
+			}
+			if arg == nil {
+				arg = Nil
+			}
+			av := reflect.New(at).Elem()
+			if err := fromVal(arg, av); err != nil {
+				panic(err)
+			}
+			in = append(in, av)
+		}
+		out := rv.Call(in)
+		// Raise the error, if any
+		if l := len(out); l > 0 && t.Out(l-1) == errorType {
+			if err := out[l-1]; !err.IsNil() {
+				panic(err.Interface())
+			}
+			out = out[:l-1]
+		}
+		switch len(out) {
+		case 0:
+			return Nil
+		case 1:
+			return ToVal(ctx, out[0].Interface())
+		}
+		ob := NewObject()
+		for i, o := range out {
+			ob.Set(Number(i), ToVal(ctx, o.Interface()))
+		}
+		return ob
+	})
+}
+
+// FromVal converts the agora value v and stores the result in the value pointed
+// to by target, which must be a non-nil pointer. It is the reverse of ToVal:
+//
+// * Nil sets the target to its zero value.
+// * If the target's type is implemented by the agora value, it is set as-is.
+// * Booleans, integers, floats and strings are set using the corresponding
+// conversion method of the value (e.g. Int() for integers). A RangeError is
+// returned if the number is out of the range of the integer or float type.
+// * Byte slices are set from the String() conversion of the value.
+// * *big.Rat, *big.Int (truncated) and *big.Float are set from the exact value
+// of the number (see ToRat).
+// * Slices and arrays are set from array-like Objects.
+// * Maps are set from Objects, keys and values are converted too.
+// * Structs are set from Objects, using the same field names as ToVal.
+// * Pointers are allocated and set from the converted value.
+// * Funcs are set to a Go func that calls the agora func with the converted
+// arguments, and converts its return value. If the Go func has an error as
+// last result, a panic in the agora func is returned as an error, otherwise
+// the panic is propagated.
+// * Empty interfaces are set to the natural Go representation of the value:
+// nil, float64 (*big.Rat for Decimal), string, bool, []interface{} for array-like Objects,
+// map[string]interface{} for other Objects, the Func itself for funcs and
+// Native() for custom values.
+//
+// It returns an error if the conversion is not possible.
+func FromVal(v Val, target interface{}) (err error) {
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return ErrInvalidTarget
+	}
+	defer PanicToError(&err)
+	if v == nil {
+		v = Nil
+	}
+	return fromVal(v, rv.Elem())
+}
+
+// Convert the agora value v and store it in the settable value rv.
+func fromVal(v Val, rv reflect.Value) error {
+	t := rv.Type()
+	if v == Nil {
+		rv.Set(reflect.Zero(t))
+		return nil
+	}
+	if t.Kind() == reflect.Interface && t.NumMethod() > 0 {
+		if reflect.TypeOf(v).Implements(t) {
+			rv.Set(reflect.ValueOf(v))
+			return nil
+		}
+		return NewTypeError(Type(v), "", "conversion to "+t.String())
+	}
+	if t.Kind() != reflect.Interface && reflect.TypeOf(v).AssignableTo(t) {
+		rv.Set(reflect.ValueOf(v))
+		return nil
+	}
+	if bv, ok := valToBig(v, t); ok {
+		rv.Set(bv)
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		rv.SetBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := v.Int()
+		if rv.OverflowInt(n) {
+			return NewRangeError(v, t)
+		}
+		rv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n := v.Int()
+		if n < 0 || rv.OverflowUint(uint64(n)) {
+			return NewRangeError(v, t)
+		}
+		rv.SetUint(uint64(n))
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if rv.OverflowFloat(f) {
+			return NewRangeError(v, t)
+		}
+		rv.SetFloat(f)
+	case reflect.String:
+		rv.SetString(v.String())
+	case reflect.Interface:
+		rv.Set(reflect.ValueOf(goValue(v)))
+	case reflect.Ptr:
+		pv := reflect.New(t.Elem())
+		if err := fromVal(v, pv.Elem()); err != nil {
+			return err
+		}
+		rv.Set(pv)
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			rv.SetBytes([]byte(v.String()))
+			return nil
+		}
+		ob, err := expectObject(v, t)
+		if err != nil {
+			return err
+		}
+		l := int(ob.Len().Int())
+		sl := reflect.MakeSlice(t, l, l)
+		for i := 0; i < l; i++ {
+			if err := fromVal(ob.Get(Number(i)), sl.Index(i)); err != nil {
+				return err
+			}
+		}
+		rv.Set(sl)
+	case reflect.Array:
+		ob, err := expectObject(v, t)
+		if err != nil {
+			return err
+		}
+		for i, l := 0, rv.Len(); i < l; i++ {
+			if err := fromVal(ob.Get(Number(i)), rv.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		ob, err := expectObject(v, t)
+		if err != nil {
+			return err
+		}
+		m := reflect.MakeMap(t)
+		keys := ob.Keys().(Object)
+		for i, l := int64(0), keys.Len().Int(); i < l; i++ {
+			k := keys.Get(Number(i))
+			kv, vv := reflect.New(t.Key()).Elem(), reflect.New(t.Elem()).Elem()
+			if err := fromVal(k, kv); err != nil {
+				return err
+			}
+			if err := fromVal(ob.Get(k), vv); err != nil {
+				return err
+			}
+			m.SetMapIndex(kv, vv)
+		}
+		rv.Set(m)
+	case reflect.Struct:
+		ob, err := expectObject(v, t)
+		if err != nil {
+			return err
+		}
+		for _, f := range structFields(t) {
+			fv := ob.Get(String(f.name))
+			if fv == Nil {
+				continue
+			}
+			dst, _ := fieldByIndex(rv, f.index, true)
+			if err := fromVal(fv, dst); err != nil {
+				return err
+			}
+		}
+	case reflect.Func:
+		fn, ok := v.(Func)
+		if !ok {
+			return NewTypeError(Type(v), "", "conversion to "+t.String())
+		}
+		f, err := makeGoFunc(fn, t)
+		if err != nil {
+			return err
+		}
+		rv.Set(f)
+	default:
+		return NewTypeError(Type(v), "", "conversion to "+t.String())
+	}
+	return nil
+}
+
+// Make sure v is an Object, to be converted to type t.
+func expectObject(v Val, t reflect.Type) (Object, error) {
+	if ob, ok := v.(Object); ok {
+		return ob, nil
+	}
+	return nil, NewTypeError(Type(v), "", "conversion to "+t.String())
+}
+
+// Create a Go func of type t that calls the agora func fn.
+func makeGoFunc(fn Func, t reflect.Type) (reflect.Value, error) {
+	var ctx *Ctx
+	switch f := fn.(type) {
+	case *agoraFuncVal:
+		ctx = f.ctx
+	case *NativeFunc:
+		ctx = f.ctx
+	}
+	nout := t.NumOut()
+	hasErr := nout > 0 && t.Out(nout-1) == errorType
+	if hasErr {
+		nout--
+	}
+	if nout > 1 {
+		return reflect.Value{}, fmt.Errorf("cannot convert func to %s: at most one non-error result is supported", t)
+	}
+	return reflect.MakeFunc(t, func(in []reflect.Value) (out []reflect.Value) {
+		out = make([]reflect.Value, t.NumOut())
+		for i := range out {
+			out[i] = reflect.Zero(t.Out(i))
+		}
+		if hasErr {
+			defer func() {
+				if p := recover(); p != nil {
+					if e, ok := p.(ExitError); ok {
+						// Termination requests are not turned into errors
+						panic(e)
+					}
+					err, ok := p.(error)
+					if !ok {
+						err = fmt.Errorf("%s", p)
+					}
+					out[len(out)-1] = reflect.ValueOf(&err).Elem()
+				}
+			}()
+		}
+		args := make([]Val, 0, len(in))
+		for i, a := range in {
+			if t.IsVariadic() && i == len(in)-1 {
+				for j := 0; j < a.Len(); j++ {
+					args = append(args, ToVal(ctx, a.Index(j).Interface()))
+				}
+				break
+			}
+			args = append(args, ToVal(ctx, a.Interface()))
+		}
+		res := fn.Call(nil, args...)
+		if nout == 1 {
+			rv := reflect.New(t.Out(0)).Elem()
+			if err := fromVal(res, rv); err != nil {
+				panic(err)
+			}
+			out[0] = rv
+		}
+		return out
+	}), nil
+}
+
+// Return the natural Go representation of the agora value.
+func goValue(v Val) interface{} {
+	switch Type(v) {
+	case "nil":
+		return nil
+	case "number", "string", "bool":
+		return v.Native()
+	case "func":
+		return v
+	case "object":
+		ob := v.(Object)
+		keys := ob.Keys().(Object)
+		l := keys.Len().Int()
+		if isArrayLike(ob, keys, l) {
+			sl := make([]interface{}, l)
+			for i := range sl {
+				sl[i] = goValue(ob.Get(Number(i)))
+			}
+			return sl
+		}
+		m := make(map[string]interface{}, l)
+		for i := int64(0); i < l; i++ {
+			k := keys.Get(Number(i))
+			m[k.String()] = goValue(ob.Get(k))
+		}
+		return m
+	}
+	return v.Native()
+}
+
+// Convert the math/big numbers to a Number or Decimal value, and return true,
+// or return false if rv is not a math/big number.
+func bigToVal(rv reflect.Value) (Val, bool) {
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || !rv.CanInterface() {
+		return nil, false
+	}
+	switch x := rv.Interface().(type) {
+	case *big.Rat:
+		return decimalVal(new(big.Rat).Set(x)), true
+	case *big.Int:
+		return decimalVal(new(big.Rat).SetInt(x)), true
+	case *big.Float:
+		if x.IsInf() {
+			f, _ := x.Float64()
+			return Number(f), true
+		}
+		r, _ := x.Rat(nil)
+		return decimalVal(r), true
+	}
+	return nil, false
+}
+
+// Convert the value to the math/big number type t, and return true, or return
+// false if t is not a math/big number type.
+func valToBig(v Val, t reflect.Type) (reflect.Value, bool) {
+	switch t {
+	case ratPtrType:
+		return reflect.ValueOf(ToRat(v)), true
+	case intPtrType:
+		r := ToRat(v)
+		return reflect.ValueOf(new(big.Int).Quo(r.Num(), r.Denom())), true
+	case floatPtrType:
+		return reflect.ValueOf(new(big.Float).SetRat(ToRat(v))), true
+	}
+	return reflect.Value{}, false
+}
+
+// Check if the object's keys are the numbers 0 to l-1. An empty object is
+// not considered array-like.
+func isArrayLike(ob Object, keys Object, l int64) bool {
+	if l == 0 {
+		return false
+	}
+	for i := int64(0); i < l; i++ {
+		k := keys.Get(Number(i))
+		if Type(k) != "number" {
+			return false
+		}
+		if n := k.Float(); n < 0 || n >= float64(l) || n != float64(int64(n)) {
+			return false
+		}
+	}
+	return true
+}
+
+// A structField is an exported field of a struct, possibly promoted from an
+// embedded struct.
+type structField struct {
+	name  string
+	index []int
+}
+
+// Get the agora fields of the struct type t.
+func structFields(t reflect.Type) []structField {
+	return embeddedFields(t, map[reflect.Type]bool{t: true})
+}
+
+// Get the agora fields of the struct type t, embedded in the struct types of
+// path (t included), whose fields are not promoted again.
+func embeddedFields(t reflect.Type, path map[reflect.Type]bool) []structField {
+	var fields []structField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get(structTag)
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			if path[ft] || (f.PkgPath != "" && f.Type.Kind() == reflect.Ptr) {
+				// A cycle, or a pointer that cannot be allocated
+				continue
+			}
+			// Promote the embedded struct's fields
+			path[ft] = true
+			for _, ef := range embeddedFields(ft, path) {
+				fields = append(fields, structField{ef.name, append([]int{i}, ef.index...)})
+			}
+			delete(path, ft)
+			continue
+		}
+		if f.PkgPath != "" {
+			// Unexported field
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, structField{name, []int{i}})
+	}
+	return fields
+}
+
+// Get the field identified by index in the struct value rv. If alloc is true,
+// nil embedded pointers are allocated, otherwise false is returned if the
+// field is not reachable.
+func fieldByIndex(rv reflect.Value, index []int, alloc bool) (reflect.Value, bool) {
+	for i, ix := range index {
+		if i > 0 && rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				if !alloc {
+					return reflect.Value{}, false
+				}
+				rv.Set(reflect.New(rv.Type().Elem()))
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(ix)
+	}
+	return rv, true
+}
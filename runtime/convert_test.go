@@ -0,0 +1,288 @@
+package runtime
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+type convInner struct {
+	Z int
+}
+
+type convStruct struct {
+	convInner
+	A       string
+	B       float64 `agora:"bee"`
+	C       []int   `agora:"-"`
+	D       map[string]bool
+	E       *convStruct
+	private int
+}
+
+type ConvCycle struct {
+	*ConvCycle
+	N int
+}
+
+type convEmbedPtr struct {
+	*convInner
+	A int
+}
+
+func TestToVal(t *testing.T) {
+	ctx := NewCtx(nil, nil)
+	cycle := &convStruct{A: "cycle"}
+	cycle.E = cycle
+	cases := []struct {
+		src interface{}
+		exp string
+	}{
+		0:  {src: nil, exp: "nil"},
+		1:  {src: true, exp: "true"},
+		2:  {src: 42, exp: "42"},
+		3:  {src: uint8(3), exp: "3"},
+		4:  {src: 1.5, exp: "1.5"},
+		5:  {src: "hi", exp: "hi"},
+		6:  {src: []byte("bytes"), exp: "bytes"},
+		7:  {src: []string{"a", "b"}, exp: "{0:a,1:b}"},
+		8:  {src: [1]int{7}, exp: "{0:7}"},
+		9:  {src: map[string]int{"k": 1}, exp: "{k:1}"},
+		10: {src: convStruct{convInner{1}, "a", 2, []int{3}, nil, nil, 4}, exp: "{A:a,Z:1,bee:2}"},
+		11: {src: (*int)(nil), exp: "nil"},
+		12: {src: Number(3), exp: "3"},
+	}
+	for i, c := range cases {
+		v := ToVal(ctx, c.src)
+		if got := sortedString(v); got != c.exp {
+			t.Errorf("[%d] - expected %s, got %s", i, c.exp, got)
+		}
+	}
+
+	// Pointer cycles are converted to the same object
+	ob := ToVal(ctx, cycle).(Object)
+	if ob.Get(String("E")) != ob {
+		t.Errorf("expected the cycle to be preserved")
+	}
+}
+
+func TestToValFunc(t *testing.T) {
+	ctx := NewCtx(nil, nil)
+	errNeg := errors.New("negative")
+	fn := ToVal(ctx, func(a, b int, more ...int) (int, error) {
+		if a < 0 {
+			return 0, errNeg
+		}
+		for _, m := range more {
+			b += m
+		}
+		return a + b, nil
+	}).(Func)
+	if v := fn.Call(nil, Number(1), Number(2)); v.Int() != 3 {
+		t.Errorf("expected 3, got %s", v)
+	}
+	if v := fn.Call(nil, Number(1), Number(2), Number(3), Number(4)); v.Int() != 10 {
+		t.Errorf("expected 10 with variadic args, got %s", v)
+	}
+	func() {
+		defer func() {
+			if e := recover(); e != errNeg {
+				t.Errorf("expected error %v to be raised, got %v", errNeg, e)
+			}
+		}()
+		fn.Call(nil, Number(-1), Number(2))
+	}()
+
+	multi := ToVal(ctx, func(s string) (string, int) { return s, len(s) }).(Func)
+	if v := multi.Call(nil, String("abc")); sortedString(v) != "{0:abc,1:3}" {
+		t.Errorf("expected multiple results as an array, got %s", v)
+	}
+}
+
+func TestFromVal(t *testing.T) {
+	ctx := NewCtx(nil, nil)
+	arr := NewObject()
+	arr.Set(Number(0), Number(1))
+	arr.Set(Number(1), String("two"))
+	st := NewObject()
+	st.Set(String("A"), String("a"))
+	st.Set(String("bee"), Number(2))
+	st.Set(String("Z"), Number(3))
+	st.Set(String("E"), func() Object {
+		o := NewObject()
+		o.Set(String("A"), String("a"))
+		return o
+	}())
+	st.Set(String("D"), func() Object {
+		o := NewObject()
+		o.Set(String("x"), Bool(true))
+		return o
+	}())
+
+	var (
+		b   bool
+		i   int
+		u   uint16
+		i8  int8
+		f   float32
+		s   string
+		bs  []byte
+		sl  []int
+		ar  [2]int
+		m   map[string]int
+		cs  convStruct
+		pi  *int
+		any interface{}
+		val Val
+		ob  Object
+	)
+	cases := []struct {
+		src Val
+		dst interface{}
+		exp interface{}
+		err bool
+	}{
+		0:  {src: Bool(true), dst: &b, exp: true},
+		1:  {src: Number(3.9), dst: &i, exp: 3},
+		2:  {src: Number(7), dst: &u, exp: uint16(7)},
+		3:  {src: Number(1.5), dst: &f, exp: float32(1.5)},
+		4:  {src: String("s"), dst: &s, exp: "s"},
+		5:  {src: String("bytes"), dst: &bs, exp: []byte("bytes")},
+		6:  {src: arr, dst: &sl, err: true},
+		7:  {src: Nil, dst: &i, exp: 0},
+		8:  {src: st, dst: &m, err: true},
+		9:  {src: Number(4), dst: &pi, exp: 4},
+		10: {src: arr, dst: &any, exp: []interface{}{float64(1), "two"}},
+		11: {src: Number(2), dst: &val, exp: Number(2)},
+		12: {src: st, dst: &ob, exp: st},
+		13: {src: String("x"), dst: &ob, err: true},
+		14: {src: func() Val { o := NewObject(); o.Set(Number(1), Number(5)); return o }(), dst: &ar, exp: [2]int{0, 5}},
+		15: {src: Number(-1), dst: &u, err: true},
+		16: {src: Number(70000), dst: &u, err: true},
+		17: {src: Number(-128), dst: &i8, exp: int8(-128)},
+		18: {src: Number(128), dst: &i8, err: true},
+		19: {src: Number(1e40), dst: &f, err: true},
+	}
+	for j, c := range cases {
+		err := FromVal(c.src, c.dst)
+		if (err != nil) != c.err {
+			t.Errorf("[%d] - expected error: %v, got %v", j, c.err, err)
+			continue
+		}
+		if c.err {
+			continue
+		}
+		got := reflect.ValueOf(c.dst).Elem().Interface()
+		if p, ok := got.(*int); ok {
+			got = *p
+		}
+		if !reflect.DeepEqual(got, c.exp) {
+			t.Errorf("[%d] - expected %v, got %v", j, c.exp, got)
+		}
+	}
+
+	// Struct
+	if err := FromVal(st, &cs); err != nil {
+		t.Fatal(err)
+	}
+	if cs.A != "a" || cs.B != 2 || cs.Z != 3 || !cs.D["x"] || cs.E == nil || cs.E.A != "a" {
+		t.Errorf("unexpected struct value %+v", cs)
+	}
+
+	// Out of range
+	if err := FromVal(Number(-1), &u); err != NewRangeError(Number(-1), reflect.TypeOf(u)) {
+		t.Errorf("expected a range error, got %v", err)
+	}
+
+	// Self-embedded struct
+	cyc := ConvCycle{&ConvCycle{N: 2}, 1}
+	if got := sortedString(ToVal(ctx, cyc)); got != "{N:1}" {
+		t.Errorf("expected {N:1}, got %s", got)
+	}
+	cyc = ConvCycle{}
+	if err := FromVal(ToVal(ctx, map[string]int{"N": 3}), &cyc); err != nil || cyc.N != 3 || cyc.ConvCycle != nil {
+		t.Errorf("expected N=3 and no error, got %+v and %v", cyc, err)
+	}
+
+	// Embedded pointer to an unexported struct
+	var ep convEmbedPtr
+	if err := FromVal(ToVal(ctx, map[string]int{"Z": 1, "A": 2}), &ep); err != nil || ep.A != 2 || ep.convInner != nil {
+		t.Errorf("expected A=2 and no error, got %+v and %v", ep, err)
+	}
+	if got := sortedString(ToVal(ctx, convEmbedPtr{&convInner{1}, 2})); got != "{A:2}" {
+		t.Errorf("expected {A:2}, got %s", got)
+	}
+
+	// Invalid target
+	if err := FromVal(Number(1), i); err != ErrInvalidTarget {
+		t.Errorf("expected %v, got %v", ErrInvalidTarget, err)
+	}
+
+	// Func
+	add := NewNativeFunc(ctx, "add", func(args ...Val) Val {
+		if args[0].Int() < 0 {
+			panic("negative")
+		}
+		return Number(args[0].Int() + args[1].Int())
+	})
+	var gofn func(int, int) (int, error)
+	if err := FromVal(add, &gofn); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := gofn(2, 3); r != 5 || err != nil {
+		t.Errorf("expected 5 and no error, got %d and %v", r, err)
+	}
+	if _, err := gofn(-2, 3); err == nil || err.Error() != "negative" {
+		t.Errorf("expected error 'negative', got %v", err)
+	}
+	var badfn func() (int, int)
+	if err := FromVal(add, &badfn); err == nil {
+		t.Errorf("expected error for a func with multiple results")
+	}
+
+	// A termination request is not turned into an error
+	exit := NewNativeFunc(ctx, "exit", func(args ...Val) Val {
+		panic(ExitError(3))
+	})
+	var exitfn func() error
+	if err := FromVal(exit, &exitfn); err != nil {
+		t.Fatal(err)
+	}
+	func() {
+		defer func() {
+			if p := recover(); p != ExitError(3) {
+				t.Errorf("expected panic %v, got %v", ExitError(3), p)
+			}
+		}()
+		err := exitfn()
+		t.Errorf("expected a panic, got error %v", err)
+	}()
+}
+
+// Return the string representation of the value, with object keys sorted.
+func sortedString(v Val) string {
+	ob, ok := v.(Object)
+	if !ok {
+		return v.String()
+	}
+	keys := ob.Keys().(Object)
+	vals := make(map[string]Val)
+	ks := make([]string, 0, keys.Len().Int())
+	for i := int64(0); i < keys.Len().Int(); i++ {
+		k := keys.Get(Number(i))
+		ks = append(ks, k.String())
+		vals[k.String()] = ob.Get(k)
+	}
+	sort.Strings(ks)
+	buf := bytes.NewBufferString("{")
+	for i, k := range ks {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(k + ":" + vals[k].String())
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
@@ -0,0 +1,311 @@
+package runtime
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/PuerkitoBio/agora/bytecode"
+)
+
+// A Coverage records which instructions of the agora modules loaded in an
+// execution context are executed. To record the coverage, set the Coverage
+// field of the execution context before loading the modules.
+//
+// The same Coverage may be used by many execution contexts, as long as they
+// do not run concurrently. The counts of modules with the same identifier are
+// merged, and the counts are kept by module identifier and function, so that
+// the memory used does not grow as contexts are created or modules reloaded.
+type Coverage struct {
+	mods  map[string]*covModule
+	order []string
+}
+
+// The coverage data of a module.
+type covModule struct {
+	id  string
+	fns []*covFn
+}
+
+// The coverage data of a function.
+type covFn struct {
+	def    *agoraFuncDef
+	counts []int64 // execution count by pc
+}
+
+// FileCoverage holds the coverage statistics of a module.
+type FileCoverage struct {
+	ID      string          // The module identifier
+	Instrs  int             // The number of instructions
+	Covered int             // The number of instructions executed at least once
+	Lines   []*LineCoverage // The per-line statistics, sorted by line
+}
+
+// LineCoverage holds the coverage statistics of a line of code.
+type LineCoverage struct {
+	Line    int64 // The line number
+	Instrs  int   // The number of instructions on this line
+	Covered int   // The number of instructions executed at least once
+	Count   int64 // The maximum execution count of the instructions
+}
+
+// NewCoverage returns a new, empty coverage recorder.
+func NewCoverage() *Coverage {
+	return &Coverage{
+		mods: make(map[string]*covModule),
+	}
+}
+
+// Register the module's functions. If a module with the same identifier and
+// the same shape is already registered, its counts are shared.
+func (c *Coverage) addModule(m *agoraModule) {
+	cm, ok := c.mods[m.id]
+	if ok && !cm.sameShape(m) {
+		// Different code for this module, restart from scratch
+		ok = false
+	}
+	if !ok {
+		cm = &covModule{id: m.id, fns: make([]*covFn, len(m.fns))}
+		for i, def := range m.fns {
+			cm.fns[i] = &covFn{def, make([]int64, len(def.code))}
+		}
+		if _, seen := c.mods[m.id]; !seen {
+			c.order = append(c.order, m.id)
+		}
+		c.mods[m.id] = cm
+	}
+}
+
+// Check if the module has the same functions and instructions count.
+func (cm *covModule) sameShape(m *agoraModule) bool {
+	if len(cm.fns) != len(m.fns) {
+		return false
+	}
+	for i, def := range m.fns {
+		if len(cm.fns[i].counts) != len(def.code) {
+			return false
+		}
+	}
+	return true
+}
+
+// Get the execution counters for the function, registering its module if needed.
+// It returns nil if the module registered with the same identifier has different
+// code, i.e. the function belongs to a version of a module since reloaded.
+func (c *Coverage) counts(def *agoraFuncDef) []int64 {
+	cm, ok := c.mods[def.mod.id]
+	if !ok {
+		c.addModule(def.mod)
+		cm = c.mods[def.mod.id]
+	}
+	if def.ix >= len(cm.fns) || len(cm.fns[def.ix].counts) != len(def.code) {
+		return nil
+	}
+	return cm.fns[def.ix].counts
+}
+
+// Files returns the coverage statistics of all modules, in loading order.
+func (c *Coverage) Files() []*FileCoverage {
+	res := make([]*FileCoverage, 0, len(c.order))
+	for _, id := range c.order {
+		cm := c.mods[id]
+		fc := &FileCoverage{ID: id}
+		lines := make(map[int64]*LineCoverage)
+		for _, fn := range cm.fns {
+			for pc, cnt := range fn.counts {
+				l := fn.def.line(pc)
+				lc, ok := lines[l]
+				if !ok {
+					lc = &LineCoverage{Line: l}
+					lines[l] = lc
+					fc.Lines = append(fc.Lines, lc)
+				}
+				fc.Instrs++
+				lc.Instrs++
+				if cnt > 0 {
+					fc.Covered++
+					lc.Covered++
+				}
+				if cnt > lc.Count {
+					lc.Count = cnt
+				}
+			}
+		}
+		sort.Sort(covLinesByNum(fc.Lines))
+		res = append(res, fc)
+	}
+	return res
+}
+
+type covLinesByNum []*LineCoverage
+
+func (s covLinesByNum) Len() int           { return len(s) }
+func (s covLinesByNum) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s covLinesByNum) Less(i, j int) bool { return s[i].Line < s[j].Line }
+
+// Percent returns the percentage of instructions executed at least once, in
+// all recorded modules.
+func (c *Coverage) Percent() float64 {
+	var n, cov int
+	for _, fc := range c.Files() {
+		n += fc.Instrs
+		cov += fc.Covered
+	}
+	if n == 0 {
+		return 0
+	}
+	return float64(cov) * 100 / float64(n)
+}
+
+// WriteProfile writes the coverage profile to w, in the text format used by
+// `go test -coverprofile`, in "count" mode. Each line of source code is a block,
+// with its number of instructions as statements count. Lines without line
+// information are not reported.
+//
+// The modules are reported by the path of their file, as the name of the file
+// opened by the resolver (e.g. an *os.File), or by their identifier if the
+// resolver is nil or does not open a named file.
+func (c *Coverage) WriteProfile(w io.Writer, r ModuleResolver) error {
+	if _, err := fmt.Fprintln(w, "mode: count"); err != nil {
+		return err
+	}
+	for _, fc := range c.Files() {
+		nm, err := covPath(r, fc.ID)
+		if err != nil {
+			return err
+		}
+		for _, lc := range fc.Lines {
+			if lc.Line <= 0 {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "%s:%d.1,%d.1 %d %d\n", nm, lc.Line, lc.Line+1, lc.Instrs, lc.Count); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Get the path of the file of the module, or its identifier if it has no
+// named file.
+func covPath(r ModuleResolver, id string) (string, error) {
+	if r == nil {
+		return id, nil
+	}
+	rd, err := r.Resolve(id)
+	if err != nil {
+		return "", err
+	}
+	if rc, ok := rd.(io.Closer); ok {
+		defer rc.Close()
+	}
+	if nr, ok := rd.(interface {
+		Name() string
+	}); ok {
+		return nr.Name(), nil
+	}
+	return id, nil
+}
+
+// WriteHTML writes an HTML coverage report to w. The source code of the modules
+// is obtained via the resolver, modules resolved as bytecode are reported
+// without source code.
+func (c *Coverage) WriteHTML(w io.Writer, r ModuleResolver) error {
+	var data struct {
+		Files []*covHTMLFile
+	}
+	for _, fc := range c.Files() {
+		hf := &covHTMLFile{ID: fc.ID}
+		if fc.Instrs > 0 {
+			hf.Percent = float64(fc.Covered) * 100 / float64(fc.Instrs)
+		}
+		src, err := covSource(r, fc.ID)
+		if err != nil {
+			return err
+		}
+		byLine := make(map[int64]*LineCoverage, len(fc.Lines))
+		for _, lc := range fc.Lines {
+			byLine[lc.Line] = lc
+		}
+		if src != nil {
+			for i, l := range strings.Split(string(src), "\n") {
+				hl := covHTMLLine{Num: i + 1, Text: l, Class: "none"}
+				if lc, ok := byLine[int64(i+1)]; ok {
+					hl.Count = lc.Count
+					switch {
+					case lc.Covered == 0:
+						hl.Class = "cov0"
+					case lc.Covered < lc.Instrs:
+						hl.Class = "part"
+					default:
+						hl.Class = "cov1"
+					}
+				}
+				hf.Lines = append(hf.Lines, hl)
+			}
+		}
+		data.Files = append(data.Files, hf)
+	}
+	return covTemplate.Execute(w, data)
+}
+
+// Get the source code of the module, or nil if it is bytecode.
+func covSource(r ModuleResolver, id string) ([]byte, error) {
+	rd, err := r.Resolve(id)
+	if err != nil {
+		return nil, err
+	}
+	if rc, ok := rd.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+	b, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	if bytecode.IsBytecode(bytes.NewReader(b)) {
+		return nil, nil
+	}
+	return b, nil
+}
+
+type covHTMLFile struct {
+	ID      string
+	Percent float64
+	Lines   []covHTMLLine
+}
+
+type covHTMLLine struct {
+	Num   int
+	Text  string
+	Class string
+	Count int64
+}
+
+var covTemplate = template.Must(template.New("coverage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>agora coverage</title>
+<style>
+body { background: black; color: rgb(80, 80, 80); font-family: Menlo, monospace; font-size: 14px; }
+h2 { color: rgb(180, 180, 180); font-size: 16px; }
+pre { margin: 0; }
+.num { color: rgb(80, 80, 80); display: inline-block; width: 4em; }
+.cov0 { color: rgb(192, 0, 0); }
+.part { color: rgb(192, 192, 0); }
+.cov1 { color: rgb(44, 212, 149); }
+</style>
+</head>
+<body>
+{{range .Files}}
+<h2>{{.ID}} ({{printf "%.1f" .Percent}}%)</h2>
+{{if .Lines}}<pre>{{range .Lines}}<span class="num">{{.Num}}</span><span class="{{.Class}}" title="{{.Count}}">{{.Text}}</span>
+{{end}}</pre>{{else}}<p>source not available</p>{{end}}
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,131 @@
+package runtime_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/agora/compiler"
+	"github.com/PuerkitoBio/agora/runtime"
+)
+
+const coverageSrc = `func never() {
+	return 1
+}
+a := 1
+if a > 2 {
+	a = 3
+}
+return a
+`
+
+func TestCoverage(t *testing.T) {
+	res := srcResolver{"cov": coverageSrc}
+	ctx := runtime.NewCtx(res, new(compiler.Compiler))
+	ctx.Coverage = runtime.NewCoverage()
+	m, err := ctx.Load("cov")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	fcs := ctx.Coverage.Files()
+	if len(fcs) != 1 || fcs[0].ID != "cov" {
+		t.Fatalf("expected coverage for module cov, got %v", fcs)
+	}
+	cases := []struct {
+		line    int64
+		covered bool
+	}{
+		0: {line: 1, covered: true}, // the func declaration, in the top-level function
+		1: {line: 2, covered: false},
+		2: {line: 4, covered: true},
+		3: {line: 5, covered: true},
+		4: {line: 6, covered: false},
+		5: {line: 8, covered: true},
+	}
+	lines := make(map[int64]*runtime.LineCoverage)
+	for _, lc := range fcs[0].Lines {
+		lines[lc.Line] = lc
+	}
+	for i, c := range cases {
+		lc, ok := lines[c.line]
+		if !ok {
+			t.Errorf("[%d] - expected coverage for line %d", i, c.line)
+			continue
+		}
+		if got := lc.Covered > 0; got != c.covered {
+			t.Errorf("[%d] - expected line %d covered to be %v, got %v", i, c.line, c.covered, got)
+		}
+	}
+	if p := ctx.Coverage.Percent(); p <= 0 || p >= 100 {
+		t.Errorf("expected partial coverage, got %f%%", p)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := ctx.Coverage.WriteProfile(buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	prof := buf.String()
+	for _, exp := range []string{"mode: count\n", "cov:2.1,3.1 1 0\n", "cov:4.1,5.1 "} {
+		if !strings.Contains(prof, exp) {
+			t.Errorf("expected profile to contain %q, got %q", exp, prof)
+		}
+	}
+
+	buf.Reset()
+	if err := ctx.Coverage.WriteHTML(buf, res); err != nil {
+		t.Fatal(err)
+	}
+	html := buf.String()
+	for _, exp := range []string{`<h2>cov (`, `class="cov0" title="0">	return 1</span>`, `class="cov1"`} {
+		if !strings.Contains(html, exp) {
+			t.Errorf("expected HTML report to contain %q", exp)
+		}
+	}
+}
+
+func TestCoverageFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agora-cover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	nm := filepath.Join(dir, "cov.agora")
+	if err := ioutil.WriteFile(nm, []byte(coverageSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if nm, err = filepath.EvalSymlinks(nm); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two contexts record the same module
+	cov := runtime.NewCoverage()
+	for i := 0; i < 2; i++ {
+		ctx := runtime.NewCtx(new(runtime.FileResolver), new(compiler.Compiler))
+		ctx.Coverage = cov
+		m, err := ctx.Load(filepath.Join(dir, "cov"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fcs := cov.Files()
+	if len(fcs) != 1 {
+		t.Fatalf("expected coverage for 1 module, got %d", len(fcs))
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := cov.WriteProfile(buf, new(runtime.FileResolver)); err != nil {
+		t.Fatal(err)
+	}
+	if exp := nm + ":4.1,5.1 1 2\n"; !strings.Contains(buf.String(), exp) {
+		t.Errorf("expected profile to contain %q, got %q", exp, buf.String())
+	}
+}
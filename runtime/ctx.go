@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	"github.com/PuerkitoBio/agora/bytecode"
 )
@@ -13,6 +14,10 @@ type (
 	ModuleNotFoundError string
 	// Error raised when a cyclic dependency is detected
 	CyclicDependencyError string
+	// Error raised when no compiler is registered for a module's format
+	UnknownFormatError string
+	// Error raised when a module is not signed by a trusted key
+	UntrustedModuleError string
 )
 
 // Error interface implementation.
@@ -35,6 +40,26 @@ func NewCyclicDependencyError(id string) CyclicDependencyError {
 	return CyclicDependencyError(fmt.Sprintf("cyclic dependency: %s already being loaded", id))
 }
 
+// Error interface implementation.
+func (e UnknownFormatError) Error() string {
+	return string(e)
+}
+
+// Create a new UnknownFormatError.
+func NewUnknownFormatError(id, format string) UnknownFormatError {
+	return UnknownFormatError(fmt.Sprintf("no compiler for format '%s': %s", format, id))
+}
+
+// Error interface implementation.
+func (e UntrustedModuleError) Error() string {
+	return string(e)
+}
+
+// Create a new UntrustedModuleError, for the reason err.
+func NewUntrustedModuleError(id string, err error) UntrustedModuleError {
+	return UntrustedModuleError(fmt.Sprintf("untrusted module: %s: %s", id, err))
+}
+
 // The Compiler interface defines the required behaviour for a Compiler.
 type Compiler interface {
 	Compile(string, io.Reader) (*bytecode.File, error)
@@ -45,6 +70,7 @@ type Compiler interface {
 type frame struct {
 	f   Func
 	fvm *agoraFuncVM
+	pn  *profNode // the profiler's call tree node, if profiling
 }
 
 // A Ctx represents the execution context. It is self-contained, share-nothing
@@ -61,16 +87,38 @@ type Ctx struct {
 	Arithmetic Arithmetic     // The arithmetic processor
 	Comparer   Comparer       // The comparison processor
 	Resolver   ModuleResolver // The module loading resolver (match a module to a string literal)
-	Compiler   Compiler       // The source code compiler
+	Compiler   Compiler       // The default source code compiler
 	Debug      bool           // Debug mode outputs helpful messages
+	Profiler   *Profiler      // The profiler, if profiling is enabled
+	Coverage   *Coverage      // The coverage recorder, if coverage is enabled
+	Sandbox    *Sandbox       // The security policy, if sandboxed
+	Cache      *ModuleCache   // The compiled modules cache, may be shared by contexts
+
+	// The keys trusted to sign bytecode, if set only the bytecode modules signed
+	// by one of these keys are loaded (native modules are not affected).
+	TrustedKeys *bytecode.Keyring
+
+	BytecodeCache *BytecodeCache // The on-disk bytecode cache, if enabled
+
+	// The interval to check for changed modules, if watching. The check is done
+	// by Load and Call only, on the goroutine that uses the context: an idle
+	// context does not reload its modules until it is used again. To reload them
+	// in the background, call ReloadChanged periodically, e.g. on a time.Ticker,
+	// from the goroutine that uses the context.
+	Watch time.Duration
 
 	// Call stack
-	frames []*frame
+	frames []frame
 	frmsp  int
 
 	// Modules management
 	loadingMods map[string]bool // Modules currently being loaded
 	loadedMods  map[string]Module
+	sandboxMods map[string]Module          // Native modules as restricted by the sandbox
+	compilers   map[string]Compiler        // Compilers by format
+	importers   map[string]map[string]bool // Modules that imported a module
+	versions    map[string]string          // Versions of the sources, if watching
+	lastCheck   time.Time                  // Last check for changed modules
 	builtin     Object
 }
 
@@ -87,6 +135,8 @@ func NewCtx(resolver ModuleResolver, comp Compiler) *Ctx {
 		Compiler:    comp,
 		loadingMods: make(map[string]bool),
 		loadedMods:  make(map[string]Module),
+		importers:   make(map[string]map[string]bool),
+		versions:    make(map[string]string),
 	}
 	// Automatically add the built-in functions
 	b := new(builtinMod)
@@ -105,21 +155,59 @@ func NewCtx(resolver ModuleResolver, comp Compiler) *Ctx {
 // The sequence for loading, compiling, and bootstrapping execution is the
 // following:
 //
+// * If Watch is set, reload the changed modules, at most once per interval (see
+//   ReloadChanged).
 // * If id is empty string, return error.
+// * If id is a native module, return the Module, done. If a sandbox is set,
+//   return it as restricted by the sandbox's allow-list, or an error if it is
+//   not allowed.
+// * Get the canonical id of the module (see ImportResolver).
 // * If module is cached (ctx.loadedMods), return the Module, done.
 // * If module is not cached, call ModuleResolver.Resolve(id string) (io.Reader, error)
+//   with the canonical id
 // * If Resolve returns an error, return nil, error, done.
+// * If a compiled modules cache is set and holds an up-to-date compiled module,
+//   skip to the creation of the module.
 // * If file is already bytecode, just load it into memory using a decoder
 // * If decoder returns an error, return nil, error, done.
-// * Otherwise (if not bytecode) call Compiler.Compile(id string, r io.Reader) (*bytecode.File, error)
+// * If the context has TrustedKeys, the module must be bytecode signed by one of
+//   these keys, otherwise return nil, error, done.
+// * Otherwise (if not bytecode), if a bytecode cache is set and holds the up-to-date
+//   bytecode of the source, load it
+// * Otherwise call Compile(id string, r io.Reader) (*bytecode.File, error)
+//   on the compiler registered for the format of the module (see FormatReader), or on
+//   the default Compiler if there is none (and store it in the bytecode cache)
 // * If Compile returns an error, return nil, error, done.
-// * Create module from *bytecode.File
+// * Verify the bytecode (see bytecode.Verify), if it is invalid return nil, error,
+//   done.
+// * Create module from *bytecode.File (and store it in the compiled modules cache)
 // * Cache module and return, do NOT execute the module.
 //
 func (c *Ctx) Load(id string) (Module, error) {
+	c.checkChanges()
+	return c.load(id, "")
+}
+
+// Load the module identified by id, imported by the module identified by the
+// canonical identifier from, or by the host if it is empty.
+func (c *Ctx) load(id, from string) (Module, error) {
 	if id == "" {
 		return nil, NewModuleNotFoundError(id)
 	}
+	// Native modules are not resolved
+	if m, ok := c.loadedMods[id].(NativeModule); ok {
+		if c.Sandbox != nil {
+			return c.sandboxModule(m)
+		}
+		return m, nil
+	}
+	id, err := c.canonical(id, from)
+	if err != nil {
+		return nil, err
+	}
+	if from != "" {
+		c.addImporter(id, from)
+	}
 	// If already loaded, return from cache
 	if m, ok := c.loadedMods[id]; ok {
 		return m, nil
@@ -129,27 +217,161 @@ func (c *Ctx) Load(id string) (Module, error) {
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
+	defer func(r io.Reader) {
 		if rc, ok := r.(io.ReadCloser); ok {
 			rc.Close()
 		}
-	}()
+	}(r)
+	format := formatOf(r, id)
+	if c.Watch > 0 {
+		// Record the version of the source, to detect changes
+		var ver string
+		if _, ver, r, err = sourceVersion(id, r, false); err != nil {
+			return nil, err
+		}
+		c.versions[id] = ver
+	}
+	compile := func(id string, r io.Reader) (*compiledModule, error) {
+		return c.compile(id, format, r)
+	}
+	var cm *compiledModule
+	if c.Cache != nil {
+		comp := fmt.Sprintf("%s\x00%T", format, c.compilerFor(format))
+		cm, err = c.Cache.get(id, r, comp, compile, c.TrustedKeys != nil)
+	} else {
+		cm, err = compile(id, r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// A cached module may have been verified for a context that trusts other keys
+	if c.TrustedKeys != nil && !c.TrustedKeys.Trusts(cm.signer) {
+		return nil, NewUntrustedModuleError(id, bytecode.UntrustedKeyError(cm.signer))
+	}
+	mod := newAgoraModule(id, cm, c)
+	if c.Coverage != nil {
+		c.Coverage.addModule(mod)
+	}
+	// cache and return
+	c.loadedMods[id] = mod
+	return mod, nil
+}
+
+// Return the canonical identifier of the module identified by id, imported by
+// the module identified by the canonical identifier from.
+func (c *Ctx) canonical(id, from string) (string, error) {
+	if ir, ok := c.Resolver.(ImportResolver); ok {
+		return ir.Canonical(id, from)
+	}
+	return relativeID(id, from), nil
+}
+
+// Compile the source code in the specified format or decode the bytecode of the
+// module identified by id.
+func (c *Ctx) compile(id, format string, r io.Reader) (*compiledModule, error) {
 	// If already bytecode, just decode
-	var f *bytecode.File
+	var (
+		f   *bytecode.File
+		err error
+	)
 	if rs, ok := r.(io.ReadSeeker); ok && bytecode.IsBytecode(rs) {
 		dec := bytecode.NewDecoder(r)
 		f, err = dec.Decode()
+	} else if c.TrustedKeys != nil {
+		// Only signed bytecode can be trusted
+		return nil, NewUntrustedModuleError(id, bytecode.ErrUnsigned)
 	} else {
 		// Compile to bytecode
-		f, err = c.Compiler.Compile(id, r)
+		comp := c.compilerFor(format)
+		if comp == nil {
+			return nil, NewUnknownFormatError(id, format)
+		}
+		if c.BytecodeCache != nil {
+			f, err = c.BytecodeCache.get(id, format, r, comp)
+		} else {
+			f, err = comp.Compile(id, r)
+		}
 	}
 	if err != nil {
 		return nil, err
 	}
-	mod := newAgoraModule(f, c)
-	// cache and return
-	c.loadedMods[id] = mod
-	return mod, nil
+	// The bytecode may come from any toolchain, make sure it is trusted and safe
+	// to execute
+	if c.TrustedKeys != nil {
+		if err := c.TrustedKeys.Verify(f); err != nil {
+			return nil, NewUntrustedModuleError(id, err)
+		}
+	}
+	if err := bytecode.Verify(f); err != nil {
+		return nil, err
+	}
+	cm := newCompiledModule(f)
+	if c.TrustedKeys != nil {
+		cm.signer = f.Signature.KeyID
+	}
+	return cm, nil
+}
+
+// Call calls the function exported as fn by the module identified by id, with
+// the provided Go arguments converted to agora values using ToVal. The module is
+// loaded and run first if required, and must return an object with the function
+// as field. The function is called with the module's object as `this` value.
+//
+// It returns the natural Go representation of the function's return value (see
+// FromVal for empty interfaces), and any panic raised by the call as an error.
+// If the function is a coroutine that yields, the yielded value is returned and
+// the next Call resumes its execution. If the coroutine fails with an error, it
+// is reset so that the next Call starts a new execution.
+func (c *Ctx) Call(id string, fn string, args ...interface{}) (res interface{}, err error) {
+	m, err := c.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	v, err := m.Run()
+	if err != nil {
+		return nil, err
+	}
+	ob, ok := v.(Object)
+	if !ok {
+		return nil, NewTypeError(Type(v), "", "call")
+	}
+	f, ok := ob.Get(String(fn)).(Func)
+	if !ok {
+		return nil, NewNoSuchMethodError(fn)
+	}
+	defer func() {
+		if err != nil {
+			if afn, ok := f.(*agoraFuncVal); ok {
+				afn.reset()
+			}
+		}
+	}()
+	defer PanicToError(&err)
+	vals := make([]Val, len(args))
+	for i, arg := range args {
+		vals[i] = ToVal(c, arg)
+	}
+	return goValue(f.Call(ob, vals...)), nil
+}
+
+// RegisterCompiler registers the compiler to use for the modules in the
+// specified format, a file extension such as ".agoraa" (replacing any other
+// compiler for this format). The default Compiler is used for the modules in
+// a format that has no registered compiler.
+func (c *Ctx) RegisterCompiler(format string, comp Compiler) {
+	if c.compilers == nil {
+		c.compilers = make(map[string]Compiler)
+	}
+	c.compilers[format] = comp
+}
+
+// Return the compiler registered for the format, or the default Compiler if
+// there is none.
+func (c *Ctx) compilerFor(format string) Compiler {
+	if comp, ok := c.compilers[format]; ok {
+		return comp
+	}
+	return c.Compiler
 }
 
 // RegisterNativeModule adds the provided native module to the list of loaded and cached
@@ -157,6 +379,39 @@ func (c *Ctx) Load(id string) (Module, error) {
 func (c *Ctx) RegisterNativeModule(m NativeModule) {
 	m.SetCtx(c)
 	c.loadedMods[m.ID()] = m
+	delete(c.sandboxMods, m.ID())
+}
+
+// Return the native module as restricted by the sandbox, caching it so that
+// it is run only once.
+func (c *Ctx) sandboxModule(m NativeModule) (Module, error) {
+	if sm, ok := c.sandboxMods[m.ID()]; ok {
+		return sm, nil
+	}
+	sm, err := c.Sandbox.module(m)
+	if err != nil {
+		return nil, err
+	}
+	if c.sandboxMods == nil {
+		c.sandboxMods = make(map[string]Module)
+	}
+	c.sandboxMods[m.ID()] = sm
+	return sm, nil
+}
+
+// Return the canonical identifier of the module of the agora function that is
+// currently executing, or an empty string if no agora function is executing or
+// if it is a function compiled to Go, whose imports are resolved like the host's.
+func (c *Ctx) importer() string {
+	for i := c.frmsp - 1; i >= 0; i-- {
+		if fvm := c.frames[i].fvm; fvm != nil {
+			return fvm.proto.mod.id
+		}
+		if _, ok := c.frames[i].f.(*GoFunc); ok {
+			break
+		}
+	}
+	return ""
 }
 
 // Mark the specified module as currently executing
@@ -174,22 +429,43 @@ func (c *Ctx) popModule(id string) {
 
 // Push a function onto the frame stack.
 func (c *Ctx) pushFn(f Func, fvm *agoraFuncVM) {
+	frm := frame{f: f, fvm: fvm}
+	if c.Profiler != nil {
+		var caller *frame
+		if c.frmsp > 0 {
+			caller = &c.frames[c.frmsp-1]
+		}
+		frm.pn = c.Profiler.push(caller, f)
+	}
+	if fvm != nil {
+		fvm.pn = frm.pn
+	}
 	// Stack has to grow as needed
 	if c.frmsp == len(c.frames) {
 		if c.Debug && c.frmsp == cap(c.frames) {
 			fmt.Fprintf(c.Stdout, "DEBUG expanding frames of ctx, current size: %d\n", len(c.frames))
 		}
-		c.frames = append(c.frames, &frame{f, fvm})
+		c.frames = append(c.frames, frm)
 	} else {
-		c.frames[c.frmsp] = &frame{f, fvm}
+		c.frames[c.frmsp] = frm
 	}
 	c.frmsp++
 }
 
+// Replace the top function of the frame stack by the function called by a tail
+// call.
+func (c *Ctx) replaceFn(f Func, fvm *agoraFuncVM) {
+	c.popFn()
+	c.pushFn(f, fvm)
+}
+
 // Pop the top function from the frame stack.
 func (c *Ctx) popFn() {
+	if c.Profiler != nil {
+		c.Profiler.pop(&c.frames[c.frmsp-1])
+	}
 	c.frmsp--
-	c.frames[c.frmsp] = nil // free this reference for gc
+	c.frames[c.frmsp] = frame{} // free the references for gc
 }
 
 // IsRunning returns true if the specified function is currently executing.
@@ -202,43 +478,6 @@ func (c *Ctx) IsRunning(f Func) bool {
 	return false
 }
 
-// Get the variable identified by name, looking up the lexical scope stack and ultimately the
-// built-ins.
-func (c *Ctx) getVar(nm string, fvm *agoraFuncVM) (Val, bool) {
-	// First look in locals
-	if v, ok := fvm.vars[nm]; ok {
-		return v, true
-	}
-	// Then recursively in parent environments
-	for parent := fvm.val.env; parent != nil; parent = parent.parent {
-		if v, ok := parent.upvals[nm]; ok {
-			return v, true
-		}
-	}
-	// Finally, look if the identifier refers to a built-in function.
-	// This will return Nil if it doesn't match any built-in.
-	b := c.builtin.Get(String(nm))
-	return b, b != Nil
-}
-
-// Set the value of the variable identified by the provided name, looking up the
-// frame stack if necessary. Returns true if the variable was found.
-func (c *Ctx) setVar(nm string, v Val, fvm *agoraFuncVM) bool {
-	// First attempt to set as local var
-	if _, ok := fvm.vars[nm]; ok {
-		fvm.vars[nm] = v
-		return true
-	}
-	// Then recursively in parent environments
-	for parent := fvm.val.env; parent != nil; parent = parent.parent {
-		if _, ok := parent.upvals[nm]; ok {
-			parent.upvals[nm] = v
-			return true
-		}
-	}
-	return false
-}
-
 // Pretty-print the execution context, up to n number of frames.
 func (c *Ctx) dump(n int) {
 	if n < 0 {
@@ -0,0 +1,217 @@
+package runtime_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/agora/bytecode"
+	"github.com/PuerkitoBio/agora/compiler"
+	"github.com/PuerkitoBio/agora/runtime"
+)
+
+const callSrc = `x := {}
+x.Add = func(a, b) {
+	return a + b
+}
+x.Fail = func(msg) {
+	panic(msg)
+}
+x.Name = func() {
+	return this.prefix + "name"
+}
+x.prefix = "x."
+x.Count = func(n) {
+	for i := 0; i < n; i++ {
+		yield i
+	}
+	panic("done")
+}
+x.Pair = func(ob) {
+	return {first: ob.A, second: ob.B}
+}
+x.notAFunc = 1
+return x
+`
+
+func TestCall(t *testing.T) {
+	ctx := runtime.NewCtx(srcResolver{"call": callSrc, "num": "return 3"}, new(compiler.Compiler))
+	cases := []struct {
+		mod  string
+		fn   string
+		args []interface{}
+		exp  interface{}
+		err  string
+	}{
+		0:  {mod: "call", fn: "Add", args: []interface{}{1, 2.5}, exp: 3.5},
+		1:  {mod: "call", fn: "Add", args: []interface{}{"a", "b"}, exp: "ab"},
+		2:  {mod: "call", fn: "Fail", args: []interface{}{"oops"}, err: "oops"},
+		3:  {mod: "call", fn: "Name", exp: "x.name"},
+		4:  {mod: "call", fn: "Missing", err: "no such method: Missing"},
+		5:  {mod: "call", fn: "notAFunc", err: "no such method: notAFunc"},
+		6:  {mod: "none", fn: "Add", err: "module not found: none"},
+		7:  {mod: "num", fn: "Add", err: "type error: call not allowed with type number"},
+		8:  {mod: "call", fn: "Pair", args: []interface{}{struct{ A, B int }{1, 2}}, exp: map[string]interface{}{"first": 1.0, "second": 2.0}},
+		9:  {mod: "call", fn: "Count", args: []interface{}{2}, exp: 0.0},
+		10: {mod: "call", fn: "Count", exp: 1.0},
+		11: {mod: "call", fn: "Count", err: "done"},
+		12: {mod: "call", fn: "Count", args: []interface{}{1}, exp: 0.0}, // restarted after the error
+	}
+	for i, c := range cases {
+		res, err := ctx.Call(c.mod, c.fn, c.args...)
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("[%d] - expected error %q, got %v", i, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%d] - expected no error, got %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(res, c.exp) {
+			t.Errorf("[%d] - expected %v (%T), got %v (%T)", i, c.exp, c.exp, res, res)
+		}
+	}
+}
+
+func TestDecimalCtx(t *testing.T) {
+	ctx := runtime.NewCtx(srcResolver{"main": `total := 0
+	items := {}
+	items[0] = 0.1
+	items[1] = 0.2
+	items[2] = 19.99
+	for i := 0; i < len(items); i++ {
+		total += items[i]
+	}
+	big := decimal("12345678901234567890.5")
+	return string(total == 20.29) + ":" + string(total) + ":" + string(big + 0.5) + ":" + type(total)
+	`}, new(compiler.Compiler))
+	ctx.Arithmetic = runtime.DecimalArithmetic{}
+	ctx.Comparer = runtime.DecimalComparer{}
+	v, err := mustLoad(t, ctx, "main").Run()
+	if exp := "true:20.29:12345678901234567891:number"; err != nil || v.String() != exp {
+		t.Errorf("expected %s, got %v (%v)", exp, v, err)
+	}
+}
+
+func TestLoadVerify(t *testing.T) {
+	cases := []struct {
+		alter func(f *bytecode.File)
+		err   string
+	}{
+		0: {alter: func(f *bytecode.File) {}},
+		1: {
+			// Constant out of range
+			alter: func(f *bytecode.File) { f.Fns[0].Is[0] = bytecode.NewInstrBx(bytecode.OP_LOADK, 0, 9) },
+			err:   "instruction 0: LOADK 0 9: constant 9 out of range",
+		},
+		2: {
+			// Jump out of the function
+			alter: func(f *bytecode.File) { f.Fns[1].Is[1] = bytecode.NewInstrSBx(bytecode.OP_JMP, 0, 100) },
+			err:   "func 1 (add): instruction 1: JMP   0 100: jump to instruction 102 out of range",
+		},
+		3: {
+			// Invalid parent
+			alter: func(f *bytecode.File) { f.Fns[1].Header.ParentFnIx = 3 },
+			err:   "func 0 (verify): instruction 1: LOADF 1 1: function 1 is nested in function 3",
+		},
+		4: {
+			// Register out of range
+			alter: func(f *bytecode.File) { f.Fns[1].Header.StackSz = 1 },
+			err:   "func 1 (add): instruction 0: ADD   3 0 1: register 3 out of range (2 registers)",
+		},
+	}
+	src := "x := 1\nfunc add(a, b) {\nreturn a + b + x\n}\nreturn add(1, 2)"
+	for i, c := range cases {
+		f, err := new(compiler.Compiler).Compile("verify", strings.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.alter(f)
+		buf := bytes.NewBuffer(nil)
+		if err := bytecode.NewEncoder(buf).Encode(f); err != nil {
+			t.Fatal(err)
+		}
+		ctx := runtime.NewCtx(srcResolver{"verify": buf.String()}, new(compiler.Compiler))
+		m, err := ctx.Load("verify")
+		if c.err == "" {
+			if err != nil {
+				t.Errorf("[%d] - expected no error, got %s", i, err)
+			} else if v, err := m.Run(); err != nil || v.Int() != 4 {
+				t.Errorf("[%d] - expected 4, got %v (%v)", i, v, err)
+			}
+			continue
+		}
+		if _, ok := err.(*bytecode.VerifyError); !ok || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("[%d] - expected error %q, got %v", i, c.err, err)
+		}
+	}
+}
+
+func TestLoadTrustedKeys(t *testing.T) {
+	key := func(seed byte) ed25519.PrivateKey {
+		return ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+	}
+	priv1, priv2 := key(1), key(2)
+	pub1, pub2 := priv1.Public().(ed25519.PublicKey), priv2.Public().(ed25519.PublicKey)
+	encode := func(priv ed25519.PrivateKey) string {
+		f, err := new(compiler.Compiler).Compile("trust", strings.NewReader("return 42"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if priv != nil {
+			if err := bytecode.Sign(f, priv); err != nil {
+				t.Fatal(err)
+			}
+		}
+		buf := bytes.NewBuffer(nil)
+		if err := bytecode.NewEncoder(buf).Encode(f); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	signed1, signed2, unsigned := encode(priv1), encode(priv2), encode(nil)
+
+	cache := runtime.NewModuleCache()
+	cases := []struct {
+		src  string
+		keys []ed25519.PublicKey
+		err  string
+	}{
+		0: {src: signed1, keys: []ed25519.PublicKey{pub1}},
+		1: {src: signed1, keys: []ed25519.PublicKey{pub2, pub1}},
+		2: {src: signed1},
+		3: {src: unsigned},
+		4: {src: signed1, keys: []ed25519.PublicKey{pub2}, err: "untrusted module: trust: the bytecode is signed by an untrusted key: " + bytecode.KeyID(pub1)},
+		5: {src: signed2, keys: []ed25519.PublicKey{pub1}, err: "untrusted module: trust: the bytecode is signed by an untrusted key: " + bytecode.KeyID(pub2)},
+		6: {src: unsigned, keys: []ed25519.PublicKey{pub1}, err: "untrusted module: trust: the bytecode is not signed"},
+		7: {src: "return 42", keys: []ed25519.PublicKey{pub1}, err: "untrusted module: trust: the bytecode is not signed"},
+		8: {src: "return 42"},
+	}
+	// Run the cases without, then with a shared cache, where the modules
+	// verified for a keyring must not be trusted by the contexts with another
+	for _, mc := range []*runtime.ModuleCache{nil, cache} {
+		for i, c := range cases {
+			ctx := runtime.NewCtx(srcResolver{"trust": c.src}, new(compiler.Compiler))
+			ctx.Cache = mc
+			if c.keys != nil {
+				ctx.TrustedKeys = bytecode.NewKeyring(c.keys...)
+			}
+			m, err := ctx.Load("trust")
+			if c.err != "" {
+				if _, ok := err.(runtime.UntrustedModuleError); !ok || err.Error() != c.err {
+					t.Errorf("[%d] - expected error %q, got %v", i, c.err, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("[%d] - expected no error, got %s", i, err)
+			} else if v, err := m.Run(); err != nil || v.Int() != 42 {
+				t.Errorf("[%d] - expected 42, got %v (%v)", i, v, err)
+			}
+		}
+	}
+}
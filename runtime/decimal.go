@@ -0,0 +1,293 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+)
+
+var (
+	// Error raised by the decimal arithmetic on a division by zero.
+	ErrDivisionByZero = errors.New("division by zero")
+
+	// The largest integer that is exactly represented by a Number.
+	maxExactInt = new(big.Int).Lsh(big.NewInt(1), 53)
+)
+
+// The maximum number of decimal places used to represent a Decimal value that
+// has no finite decimal representation (e.g. 1/3) as a string.
+const decimalStringPrec = 20
+
+// Decimal is an arbitrary-precision number, backed by a big.Rat. It is
+// used by the DecimalArithmetic to represent the exact results of the
+// operations. Its type is "number", and it is immutable.
+//
+// Note that Decimal values are not comparable with ==, so two distinct Decimal
+// values that are equal are distinct keys of an object. The DecimalArithmetic
+// returns integral results as Number values, so that they can safely be used
+// as keys.
+type Decimal struct {
+	r *big.Rat
+}
+
+// NewDecimal returns a Decimal value holding a copy of r.
+func NewDecimal(r *big.Rat) Decimal {
+	return Decimal{new(big.Rat).Set(r)}
+}
+
+// ParseDecimal returns the Decimal value represented by the string s, which may
+// be a decimal number (e.g. "12.345" or "1.5e-3") or a fraction (e.g. "1/3").
+func ParseDecimal(s string) (Decimal, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return Decimal{}, fmt.Errorf("invalid decimal: %s", s)
+	}
+	return Decimal{r}, nil
+}
+
+// Return the value of the rational number: a Number if it is an integer that is
+// exactly represented by a float64, otherwise a Decimal. The rational number is
+// not copied.
+func decimalVal(r *big.Rat) Val {
+	if r.IsInt() && r.Num().CmpAbs(maxExactInt) <= 0 {
+		return Number(r.Num().Int64())
+	}
+	return Decimal{r}
+}
+
+// Dump pretty-prints the value for debugging purpose.
+func (d Decimal) Dump() string {
+	return fmt.Sprintf("%s (Decimal)", d.String())
+}
+
+// Int returns the integer part of the decimal value.
+func (d Decimal) Int() int64 {
+	return new(big.Int).Quo(d.r.Num(), d.r.Denom()).Int64()
+}
+
+// Float returns the nearest float value.
+func (d Decimal) Float() float64 {
+	f, _ := d.r.Float64()
+	return f
+}
+
+// String returns the exact decimal representation of the value if it has one,
+// otherwise its representation rounded to 20 decimal places.
+func (d Decimal) String() string {
+	prec, exact := decimalPlaces(d.r.Denom())
+	if exact {
+		return d.r.FloatString(prec)
+	}
+	return trimZeros(d.r.FloatString(decimalStringPrec))
+}
+
+// Bool returns true if the decimal value is non-zero, false otherwise.
+func (d Decimal) Bool() bool {
+	return d.r.Sign() != 0
+}
+
+// Native returns the Go native representation of the value, a copy of the
+// *big.Rat.
+func (d Decimal) Native() interface{} {
+	return new(big.Rat).Set(d.r)
+}
+
+// Rat returns a copy of the value as a *big.Rat.
+func (d Decimal) Rat() *big.Rat {
+	return new(big.Rat).Set(d.r)
+}
+
+// Return the number of decimal places of the fractions with the specified
+// denominator, and true if they have a finite decimal representation.
+func decimalPlaces(den *big.Int) (int, bool) {
+	d := new(big.Int).Set(den)
+	m := new(big.Int)
+	var n2, n5 int
+	for _, f := range []struct {
+		p int64
+		n *int
+	}{{2, &n2}, {5, &n5}} {
+		p := big.NewInt(f.p)
+		for {
+			q, r := new(big.Int).QuoRem(d, p, m)
+			if r.Sign() != 0 {
+				break
+			}
+			d = q
+			*f.n++
+		}
+	}
+	if n5 > n2 {
+		n2 = n5
+	}
+	return n2, d.Cmp(big.NewInt(1)) == 0
+}
+
+// Remove the trailing zeros of the decimal places of the number.
+func trimZeros(s string) string {
+	i := len(s)
+	for i > 0 && s[i-1] == '0' {
+		i--
+	}
+	if i > 0 && s[i-1] == '.' {
+		i--
+	}
+	return s[:i]
+}
+
+// A RatConverter is a value that can be converted exactly to a rational number.
+// Number, String and Decimal implement it.
+type RatConverter interface {
+	Rat() *big.Rat
+}
+
+// Rat returns the rational number matching the shortest decimal representation
+// of the float value, so that a literal such as 0.1 is exactly 1/10. It panics
+// if the value is not a finite number.
+func (f Number) Rat() *big.Rat {
+	r, ok := new(big.Rat).SetString(strconv.FormatFloat(float64(f), 'g', -1, 64))
+	if !ok {
+		panic(NewTypeError(f.String(), "", "decimal conversion"))
+	}
+	return r
+}
+
+// Rat converts the string representation of a decimal number or fraction to
+// a rational number. If the string doesn't hold a valid representation, it
+// panics.
+func (s String) Rat() *big.Rat {
+	d, err := ParseDecimal(string(s))
+	if err != nil {
+		panic(err)
+	}
+	return d.r
+}
+
+// ToRat converts the value to a rational number, using its Rat method if it
+// implements RatConverter, otherwise from its float value.
+func ToRat(v Val) *big.Rat {
+	if rc, ok := v.(RatConverter); ok {
+		return rc.Rat()
+	}
+	return Number(v.Float()).Rat()
+}
+
+// DecimalArithmetic is an Arithmetic implementation with arbitrary-precision
+// decimal numbers. The operations on two numbers are computed exactly, using
+// big.Rat. Number operands are converted using their shortest decimal
+// representation, so that the literals are exact (up to 17 significant digits,
+// use the decimal built-in function with a string for more). The integral results
+// are returned as Number values if they are exactly represented, the others as
+// Decimal values.
+//
+// The other operations are the same as the standard arithmetic.
+type DecimalArithmetic struct {
+	// The number of decimal places of the results of divisions, rounded half to
+	// even. If it is 0, the results are exact fractions (e.g. 1/3).
+	DivScale int
+}
+
+func (ar DecimalArithmetic) binaryOp(l, r Val, op string, allowStrings bool) Val {
+	if Type(l) != "number" || Type(r) != "number" {
+		return defaultArithmetic{}.binaryOp(l, r, op, allowStrings)
+	}
+	lr, rr := ToRat(l), ToRat(r)
+	res := new(big.Rat)
+	switch op {
+	case "add":
+		res.Add(lr, rr)
+	case "sub":
+		res.Sub(lr, rr)
+	case "mul":
+		res.Mul(lr, rr)
+	case "div":
+		if rr.Sign() == 0 {
+			panic(ErrDivisionByZero)
+		}
+		res.Quo(lr, rr)
+		if ar.DivScale > 0 {
+			res = roundRat(res, ar.DivScale)
+		}
+	case "mod":
+		// Truncated remainder, with the sign of the dividend, like Go's %
+		if rr.Sign() == 0 {
+			panic(ErrDivisionByZero)
+		}
+		res.Quo(lr, rr)
+		q := new(big.Int).Quo(res.Num(), res.Denom())
+		res.SetInt(q)
+		res.Sub(lr, res.Mul(res, rr))
+	}
+	return decimalVal(res)
+}
+
+func (ar DecimalArithmetic) Add(l, r Val) Val {
+	return ar.binaryOp(l, r, "add", true)
+}
+
+func (ar DecimalArithmetic) Sub(l, r Val) Val {
+	return ar.binaryOp(l, r, "sub", false)
+}
+
+func (ar DecimalArithmetic) Mul(l, r Val) Val {
+	return ar.binaryOp(l, r, "mul", false)
+}
+
+func (ar DecimalArithmetic) Div(l, r Val) Val {
+	return ar.binaryOp(l, r, "div", false)
+}
+
+func (ar DecimalArithmetic) Mod(l, r Val) Val {
+	return ar.binaryOp(l, r, "mod", false)
+}
+
+func (ar DecimalArithmetic) Unm(l Val) Val {
+	if Type(l) == "number" {
+		return decimalVal(new(big.Rat).Neg(ToRat(l)))
+	}
+	return defaultArithmetic{}.Unm(l)
+}
+
+// Return the rational number rounded half to even to the specified number of
+// decimal places.
+func roundRat(r *big.Rat, places int) *big.Rat {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(places)), nil)
+	num := new(big.Int).Mul(r.Num(), scale)
+	q, m := new(big.Int).QuoRem(num, r.Denom(), new(big.Int))
+	// Compare twice the remainder with the denominator
+	switch m.Abs(m).Lsh(m, 1).Cmp(r.Denom()) {
+	case 1:
+		q.Add(q, big.NewInt(int64(num.Sign())))
+	case 0:
+		if q.Bit(0) == 1 {
+			q.Add(q, big.NewInt(int64(num.Sign())))
+		}
+	}
+	return new(big.Rat).SetFrac(q, scale)
+}
+
+// DecimalComparer is a Comparer implementation that compares two numbers
+// exactly, using big.Rat, so that it is consistent with the DecimalArithmetic.
+// The other comparisons are the same as the standard comparer.
+type DecimalComparer struct{}
+
+func (dc DecimalComparer) Cmp(l, r Val) int {
+	if Type(l) == "number" && Type(r) == "number" {
+		// Avoid the conversion if both are numbers
+		ld, lok := l.(Decimal)
+		rd, rok := r.(Decimal)
+		if !lok && !rok {
+			return defaultComparer{}.Cmp(l, r)
+		}
+		lr, rr := ld.r, rd.r
+		if !lok {
+			lr = ToRat(l)
+		}
+		if !rok {
+			rr = ToRat(r)
+		}
+		return lr.Cmp(rr)
+	}
+	return defaultComparer{}.Cmp(l, r)
+}
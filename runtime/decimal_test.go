@@ -0,0 +1,110 @@
+package runtime
+
+import (
+	"math/big"
+	"testing"
+)
+
+func dec(s string) Decimal {
+	d, err := ParseDecimal(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func TestDecimalArithmetic(t *testing.T) {
+	ar := DecimalArithmetic{}
+	cases := []struct {
+		op  func(Val, Val) Val
+		l   Val
+		r   Val
+		exp string
+		typ string
+	}{
+		0:  {op: ar.Add, l: Number(0.1), r: Number(0.2), exp: "0.3", typ: "Decimal"},
+		1:  {op: ar.Add, l: Number(0.1), r: Number(0.9), exp: "1", typ: "Number"},
+		2:  {op: ar.Sub, l: dec("1.10"), r: Number(0.1), exp: "1", typ: "Number"},
+		3:  {op: ar.Mul, l: dec("19.99"), r: Number(3), exp: "59.97", typ: "Decimal"},
+		4:  {op: ar.Div, l: Number(1), r: Number(3), exp: "0.33333333333333333333", typ: "Decimal"},
+		5:  {op: ar.Mod, l: dec("7.5"), r: Number(2), exp: "1.5", typ: "Decimal"},
+		6:  {op: ar.Mod, l: Number(-7), r: Number(2), exp: "-1", typ: "Number"},
+		7:  {op: ar.Add, l: dec("12345678901234567890"), r: Number(1), exp: "12345678901234567891", typ: "Decimal"},
+		8:  {op: ar.Add, l: String("a"), r: String("b"), exp: "ab", typ: "String"},
+		9:  {op: ar.Mul, l: dec("1/3"), r: Number(3), exp: "1", typ: "Number"},
+		10: {op: DecimalArithmetic{DivScale: 2}.Div, l: Number(2), r: Number(3), exp: "0.67", typ: "Decimal"},
+		11: {op: DecimalArithmetic{DivScale: 1}.Div, l: Number(0.25), r: Number(1), exp: "0.2", typ: "Decimal"},
+		12: {op: DecimalArithmetic{DivScale: 1}.Div, l: Number(-0.35), r: Number(1), exp: "-0.4", typ: "Decimal"},
+	}
+	for i, c := range cases {
+		res := c.op(c.l, c.r)
+		if res.String() != c.exp {
+			t.Errorf("[%d] - expected %s, got %s", i, c.exp, res)
+		}
+		var typ string
+		switch res.(type) {
+		case Number:
+			typ = "Number"
+		case Decimal:
+			typ = "Decimal"
+		case String:
+			typ = "String"
+		}
+		if typ != c.typ {
+			t.Errorf("[%d] - expected type %s, got %s", i, c.typ, typ)
+		}
+	}
+	if v := ar.Unm(dec("0.5")); v.String() != "-0.5" {
+		t.Errorf("expected -0.5, got %s", v)
+	}
+	func() {
+		defer func() {
+			if e := recover(); e != ErrDivisionByZero {
+				t.Errorf("expected %v, got %v", ErrDivisionByZero, e)
+			}
+		}()
+		ar.Div(Number(1), dec("0"))
+	}()
+}
+
+func TestDecimalComparer(t *testing.T) {
+	cmp := DecimalComparer{}
+	cases := []struct {
+		l, r Val
+		exp  int
+	}{
+		0: {l: dec("0.1"), r: Number(0.1), exp: 0},
+		1: {l: dec("0.30000000000000001"), r: dec("0.3"), exp: 1},
+		2: {l: Number(1), r: dec("1.5"), exp: -1},
+		3: {l: Number(2), r: Number(1), exp: 1},
+		4: {l: dec("1"), r: String("1"), exp: -1},
+	}
+	for i, c := range cases {
+		if res := cmp.Cmp(c.l, c.r); res != c.exp {
+			t.Errorf("[%d] - expected %d, got %d", i, c.exp, res)
+		}
+	}
+}
+
+func TestDecimalConvert(t *testing.T) {
+	if v := ToVal(nil, big.NewRat(1, 4)); v.String() != "0.25" || Type(v) != "number" {
+		t.Errorf("expected the number 0.25, got %s (%s)", v, Type(v))
+	}
+	if v := ToVal(nil, big.NewInt(42)); v != Number(42) {
+		t.Errorf("expected Number 42, got %#v", v)
+	}
+	var r *big.Rat
+	if err := FromVal(dec("12.5"), &r); err != nil || r.Cmp(big.NewRat(25, 2)) != 0 {
+		t.Errorf("expected 25/2, got %v (%v)", r, err)
+	}
+	var i *big.Int
+	if err := FromVal(String("-7.9"), &i); err != nil || i.Int64() != -7 {
+		t.Errorf("expected -7, got %v (%v)", i, err)
+	}
+	if n := dec("-7.9").Int(); n != -7 {
+		t.Errorf("expected -7, got %d", n)
+	}
+	if _, ok := goValue(dec("0.5")).(*big.Rat); !ok {
+		t.Errorf("expected a *big.Rat")
+	}
+}
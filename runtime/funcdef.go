@@ -15,23 +15,73 @@ type Func interface {
 	Call(this Val, args ...Val) Val
 }
 
-// An agoraFuncDef represents an agora function's prototype.
+// A compiledFunc is the immutable compiled form of an agora function. It may
+// be shared by many execution contexts.
+type compiledFunc struct {
+	// Internal fields filled by the compiler
+	name      string
+	stackSz   int64
+	expArgs   int64
+	lineStart int64
+	lineEnd   int64
+	kTable    []Val
+	lTable    []string  // names of the local variables, by slot
+	uTable    []upvalue // the captured variables of the enclosing function
+	code      []bytecode.Instr
+	lines     []int64 // source line of each instruction, may be empty
+	usesArgs  bool    // the function refers to the `args` reserved identifier
+}
+
+// An upvalue describes a variable of the enclosing function captured by a
+// function, either a local variable (in a slot) or an upvalue of the enclosing
+// function.
+type upvalue struct {
+	name  string
+	local bool
+	ix    int64
+}
+
+// Get the source line of the instruction at index pc. If no line information is
+// available, the line start of the function is returned.
+func (a *compiledFunc) line(pc int) int64 {
+	if pc >= 0 && pc < len(a.lines) {
+		return a.lines[pc]
+	}
+	return a.lineStart
+}
+
+// Return the name of the variable of this function captured by a nested
+// function as the specified upvalue, for debugging purpose.
+func (a *compiledFunc) upvalueName(u bytecode.U) string {
+	if a != nil {
+		if u.Local && u.Ix >= 0 && u.Ix < int64(len(a.lTable)) {
+			return a.lTable[u.Ix]
+		} else if !u.Local && u.Ix >= 0 && u.Ix < int64(len(a.uTable)) {
+			return a.uTable[u.Ix].name
+		}
+	}
+	return "?"
+}
+
+// An agoraFuncDef represents an agora function's prototype, its compiled form
+// bound to a module of an execution context.
 type agoraFuncDef struct {
+	*compiledFunc
 	ctx *Ctx
 	mod *agoraModule
-	// Internal fields filled by the compiler
-	name    string
-	stackSz int64
-	expArgs int64
-	kTable  []Val
-	lTable  []string
-	code    []bytecode.Instr
+	ix  int            // the index of the function in its module
+	vms []*agoraFuncVM // the released instances, reused by the next calls
+	ics []inlineCache  // the inline caches of the field instructions, by pc
 }
 
-func newAgoraFuncDef(mod *agoraModule, c *Ctx) *agoraFuncDef {
+func newAgoraFuncDef(cf *compiledFunc, mod *agoraModule, ix int, c *Ctx) *agoraFuncDef {
 	return &agoraFuncDef{
-		ctx: c,
-		mod: mod,
+		cf,
+		c,
+		mod,
+		ix,
+		nil,
+		make([]inlineCache, len(cf.code)),
 	}
 }
 
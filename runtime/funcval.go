@@ -36,28 +36,29 @@ func (f *funcVal) Bool() bool {
 	return true
 }
 
-// The environment for a given func value. This is a linked list.
-type env struct {
-	upvals map[string]Val
-	parent *env
-}
-
 // An agoraFuncVal is a func's value, capturing its environment.
 type agoraFuncVal struct {
 	*funcVal
 	proto     *agoraFuncDef
-	env       *env
+	upvals    []*Val // the upvalue cells, shared with the enclosing function instance
 	coroState *agoraFuncVM
 }
 
 // Create a new function value from the specified function prototype,
-// with the given function instance (VM) as environment.
+// with the given function instance (VM) as environment. The upvalues are cells
+// pointing to the variable slots of the enclosing function instance, or its own
+// upvalue cells, so that the variables are shared.
 func newAgoraFuncVal(def *agoraFuncDef, vm *agoraFuncVM) *agoraFuncVal {
-	var e *env
-	if vm != nil {
-		e = &env{
-			vm.vars,
-			vm.val.env,
+	var upvals []*Val
+	if vm != nil && len(def.uTable) > 0 {
+		upvals = make([]*Val, len(def.uTable))
+		for i, u := range def.uTable {
+			if u.local {
+				upvals[i] = &vm.regs[u.ix]
+				vm.captured = true
+			} else {
+				upvals[i] = vm.val.upvals[u.ix]
+			}
 		}
 	}
 	return &agoraFuncVal{
@@ -66,7 +67,7 @@ func newAgoraFuncVal(def *agoraFuncDef, vm *agoraFuncVM) *agoraFuncVal {
 			def.name,
 		},
 		def,
-		e,
+		upvals,
 		nil,
 	}
 }
@@ -84,7 +85,23 @@ func (a *agoraFuncVal) Call(this Val, args ...Val) Val {
 	vm.this = this
 	a.ctx.pushFn(a, vm)
 	defer a.ctx.popFn()
-	return vm.run(args...)
+	v := vm.run(args...)
+	// Make the tail calls in the same frame. The vm that made the call is released
+	// once the called function has returned, as the arguments are its registers.
+	for vm.tail != nil {
+		prev := vm
+		vm = newFuncVM(prev.tail)
+		vm.this = prev.tailThis
+		a.ctx.replaceFn(prev.tail, vm)
+		v = vm.run(prev.tailArgs...)
+		prev.tail, prev.tailThis, prev.tailArgs = nil, nil, nil
+		prev.release()
+	}
+	// The vm can be reused, unless it is a suspended coroutine
+	if vm.val.coroState != vm {
+		vm.release()
+	}
+	return v
 }
 
 // Native returns the Go native representation of an agora function.
@@ -5,11 +5,9 @@ import (
 	"fmt"
 	"io"
 	"math"
-	"sort"
 	"strings"
 
 	"github.com/PuerkitoBio/agora/bytecode"
-	"github.com/PuerkitoBio/gocoro"
 )
 
 // An agoraFuncVM is a runnable instance of a function value. It holds the virtual machine
@@ -19,95 +17,105 @@ type agoraFuncVM struct {
 	val   *agoraFuncVal
 	proto *agoraFuncDef
 	debug bool
+	pn    *profNode // the profiler's call tree node, if profiling
 
-	// Stacks and counters
-	pc     int   // program counter
-	stack  []Val // function stack
-	sp     int
-	rstack []gocoro.Caller // range native coroutine stack
+	// Counters and stacks
+	pc     int         // program counter
+	rstack []rangeIter // range iterators stack
 	rsp    int
 
-	// Variables
-	vars map[string]Val
-	this Val
-	args Val
+	// Registers, the local variables by slot followed by the temporaries
+	regs     []Val
+	captured bool // the registers are captured by closures, they cannot be reused
+	this     Val
+	args     Val
+
+	// The tail call to make once run returns
+	tail     *agoraFuncVal
+	tailThis Val
+	tailArgs []Val
 }
 
-// Instantiate a runnable representation of the function prototype.
+// The maximum number of released instances kept by a function prototype for reuse.
+const maxPooledVMs = 64
+
+// Instantiate a runnable representation of the function prototype. An instance
+// released by a previous call of the same prototype is reused, if possible.
 func newFuncVM(fv *agoraFuncVal) *agoraFuncVM {
-	p := fv.proto
+	def := fv.proto
+	if n := len(def.vms); n > 0 {
+		vm := def.vms[n-1]
+		def.vms[n-1] = nil
+		def.vms = def.vms[:n-1]
+		vm.val = fv
+		vm.debug = def.ctx.Debug
+		vm.pc = 0
+		return vm
+	}
 	return &agoraFuncVM{
 		val:   fv,
-		proto: p,
-		debug: p.ctx.Debug,
-		stack: make([]Val, 0, p.stackSz),
-		vars:  make(map[string]Val, len(p.lTable)),
+		proto: def,
+		debug: def.ctx.Debug,
 	}
 }
 
-// Push a value onto the stack.
-func (f *agoraFuncVM) push(v Val) {
-	// Stack has to grow as needed, StackSz doesn't take into account the loops
-	if f.sp == len(f.stack) {
-		if f.debug && f.sp == cap(f.stack) {
-			fmt.Fprintf(f.proto.ctx.Stdout, "DEBUG expanding stack of func %s, current size: %d\n", f.val.name, len(f.stack))
-		}
-		f.stack = append(f.stack, v)
-	} else {
-		f.stack[f.sp] = v
+// Release the instance once its call is over, so that it can be reused by
+// the next call of the same prototype. The registers are kept, unless they
+// are captured by a closure.
+func (f *agoraFuncVM) release() {
+	def := f.proto
+	if len(def.vms) >= maxPooledVMs {
+		return
+	}
+	f.val, f.this, f.args = nil, nil, nil
+	if f.captured {
+		f.regs, f.captured = nil, false
 	}
-	f.sp++
+	def.vms = append(def.vms, f)
 }
 
-// Pop a value from the stack.
-func (f *agoraFuncVM) pop() Val {
-	f.sp--
-	v := f.stack[f.sp]
-	f.stack[f.sp] = Nil // free this reference for gc
-	return v
+// Get the value of a B or C operand, a register or a constant.
+func (f *agoraFuncVM) rk(x int) Val {
+	if bytecode.IsK(x) {
+		return f.proto.kTable[x&bytecode.MaxRK]
+	}
+	return f.regs[x]
 }
 
-// Get a value from *somewhere*, depending on the flag.
-func (f *agoraFuncVM) getVal(flg bytecode.Flag, ix uint64) Val {
-	switch flg {
-	case bytecode.FLG_K:
-		return f.proto.kTable[ix]
-	case bytecode.FLG_V:
-		// Fail if variable cannot be found
-		varNm := f.proto.kTable[ix].String()
-		v, ok := f.proto.ctx.getVar(varNm, f)
-		if !ok {
-			panic("variable not found: " + varNm)
-		}
-		return v
-	case bytecode.FLG_N:
-		return Nil
-	case bytecode.FLG_T:
-		return f.this
-	case bytecode.FLG_F:
-		return newAgoraFuncVal(f.proto.mod.fns[ix], f)
-	case bytecode.FLG_A:
-		return f.args
-	}
-	panic(fmt.Sprintf("invalid flag value %d", flg))
+// Get the value of the global variable named by the constant ix. Global variables
+// are the built-ins, fail if the variable cannot be found.
+func (f *agoraFuncVM) global(ix int) Val {
+	return f.proto.ctx.Builtin(f.proto.kTable[ix].String())
 }
 
-// Pretty-print an instruction.
+// Pretty-print the operands of an instruction that refer to constants, global
+// variables, upvalues or functions.
 func (f *agoraFuncVM) dumpInstrInfo(w io.Writer, i bytecode.Instr) {
-	switch i.Flag() {
-	case bytecode.FLG_K:
-		v := f.proto.kTable[i.Index()]
-		fmt.Fprintf(w, " ; %s", dumpVal(v))
-	case bytecode.FLG_V:
-		fmt.Fprintf(w, " ; var %s", f.proto.kTable[i.Index()])
-	case bytecode.FLG_N:
-		fmt.Fprintf(w, " ; %s", Nil.Dump())
-	case bytecode.FLG_T:
-		fmt.Fprint(w, " ; [this]")
-	case bytecode.FLG_F:
-		fmt.Fprintf(w, " ; [func %s]", f.proto.mod.fns[i.Index()].name)
-	case bytecode.FLG_A:
-		fmt.Fprint(w, " ; [args]")
+	var info []string
+	switch op := i.Opcode(); op {
+	case bytecode.OP_LOADK:
+		info = append(info, dumpVal(f.proto.kTable[i.Bx()]))
+	case bytecode.OP_GETG:
+		info = append(info, "global "+f.proto.kTable[i.Bx()].String())
+	case bytecode.OP_LOADF:
+		info = append(info, "[func "+f.proto.mod.fns[i.Bx()].name+"]")
+	case bytecode.OP_GETU:
+		info = append(info, "upvalue "+f.proto.uTable[i.B()].name)
+	case bytecode.OP_SETU:
+		info = append(info, "upvalue "+f.proto.uTable[i.A()].name)
+		fallthrough
+	default:
+		if op.Mode() != bytecode.ModeABC {
+			break
+		}
+		for _, x := range []int{i.B(), i.C()} {
+			if bytecode.IsK(x) {
+				info = append(info, dumpVal(f.rk(x)))
+			}
+		}
+	}
+	if len(info) > 0 {
+		fmt.Fprintf(w, " ; %s", strings.Join(info, ", "))
 	}
 }
 
@@ -128,36 +136,24 @@ func (f *agoraFuncVM) dump() string {
 	if f.args != nil {
 		fmt.Fprintf(buf, "    [args] = %s\n", dumpVal(f.args))
 	}
-	// Sort the vars for deterministic output
-	sortedVars := make([]string, len(f.vars))
-	j := 0
-	for k, _ := range f.vars {
-		sortedVars[j] = k
-		j++
-	}
-	sort.Strings(sortedVars)
-	for _, k := range sortedVars {
-		fmt.Fprintf(buf, "    %s = %s\n", k, dumpVal(f.vars[k]))
-	}
-	// Stack
-	fmt.Fprintf(buf, "\n  Stack:\n")
-	i := int(math.Max(0, float64(f.sp-5)))
-	for i <= f.sp {
-		if i == f.sp {
-			fmt.Fprint(buf, "sp->")
-		} else {
-			fmt.Fprint(buf, "    ")
+	for j, nm := range f.proto.lTable {
+		if j < len(f.regs) {
+			fmt.Fprintf(buf, "    %s = %s\n", nm, dumpVal(f.regs[j]))
 		}
-		v := Val(Nil)
-		if i < len(f.stack) {
-			v = f.stack[i]
+	}
+	for j, u := range f.proto.uTable {
+		if j < len(f.val.upvals) {
+			fmt.Fprintf(buf, "    ^%s = %s\n", u.name, dumpVal(*f.val.upvals[j]))
 		}
-		fmt.Fprintf(buf, "[%3d] %s\n", i, dumpVal(v))
-		i++
+	}
+	// Temporary registers
+	fmt.Fprintf(buf, "\n  Registers:\n")
+	for j := len(f.proto.lTable); j < len(f.regs); j++ {
+		fmt.Fprintf(buf, "    [%3d] %s\n", j, dumpVal(f.regs[j]))
 	}
 	// Instructions
 	fmt.Fprintf(buf, "\n  Instructions:\n")
-	i = int(math.Max(0, float64(f.pc-10)))
+	i := int(math.Max(0, float64(f.pc-10)))
 	for i <= f.pc+10 {
 		if i == f.pc {
 			fmt.Fprintf(buf, "pc->")
@@ -177,148 +173,144 @@ func (f *agoraFuncVM) dump() string {
 	return buf.String()
 }
 
-// Create the reserved identifier `args` value, as an Object.
-func (vm *agoraFuncVM) createArgsVal(args []Val) Val {
-	if len(args) == 0 {
-		return Nil
-	}
-	o := NewObject()
-	for i, v := range args {
-		o.Set(Number(i), v)
+// Create the registers all initialized to nil. The registers of a reused
+// instance are reset.
+func (vm *agoraFuncVM) createRegs() {
+	if int64(len(vm.regs)) != vm.proto.stackSz {
+		vm.regs = make([]Val, vm.proto.stackSz)
 	}
-	return o
-}
-
-// Create the local variables all initialized to nil
-func (vm *agoraFuncVM) createLocals() {
-	for _, s := range vm.proto.lTable {
-		vm.vars[s] = Nil
+	for i := range vm.regs {
+		vm.regs[i] = Nil
 	}
 }
 
+// Push the iterator of a new `for range` loop onto the range stack.
 func (vm *agoraFuncVM) pushRange(args ...Val) {
-	var coro gocoro.Caller
-	l := len(args)
-	switch t := Type(args[0]); t {
-	case "number":
-		start := int64(0)
-		max := args[0].Int()
-		inc := int64(1)
-		if l > 1 {
-			start = max
-			max = args[1].Int()
-		}
-		if l > 2 {
-			inc = args[2].Int()
-		}
-		coro = gocoro.New(func(y gocoro.Yielder, args ...interface{}) interface{} {
-			if inc >= 0 {
-				for i := start; i < max; i += inc {
-					y.Yield(Number(i))
-				}
-			} else {
-				for i := start; i > max; i += inc {
-					y.Yield(Number(i))
-				}
-			}
-			panic(gocoro.ErrEndOfCoro)
-		})
-
-	case "string":
-		src := args[0].String()
-		sep := ""
-		if len(args) > 1 && args[1].Bool() {
-			sep = args[1].String()
-		}
-		max := int64(-1)
-		if len(args) > 2 {
-			max = args[2].Int()
-		}
-		coro = gocoro.New(func(y gocoro.Yielder, args ...interface{}) interface{} {
-			if max == 0 {
-				panic(gocoro.ErrEndOfCoro)
-			}
-			if sep == "" {
-				cnt := int64(len(src))
-				if max >= 0 && max < cnt {
-					cnt = max
-				}
-				for i := int64(0); i < cnt; i++ {
-					y.Yield(String(src[i]))
-				}
-			} else {
-				cnt := int64(0)
-				for max < 0 || cnt < max {
-					splits := strings.SplitN(src, sep, 2)
-					if len(splits) == 0 {
-						break
-					}
-					y.Yield(String(splits[0]))
-					cnt++
-					if len(splits) == 1 {
-						break
-					}
-					src = splits[1]
-				}
-			}
-			panic(gocoro.ErrEndOfCoro)
-		})
-
-	case "object":
-		ob := args[0].(Object)
-		coro = gocoro.New(func(y gocoro.Yielder, args ...interface{}) interface{} {
-			ks := ob.Keys().(Object)
-			for i := int64(0); i < ks.Len().Int(); i++ {
-				val := NewObject()
-				key := ks.Get(Number(i))
-				val.Set(String("k"), key)
-				val.Set(String("v"), ob.Get(key))
-				y.Yield(val)
-			}
-			panic(gocoro.ErrEndOfCoro)
-		})
-
-	case "func":
-		fn := args[0].(Func)
-		if afn, ok := fn.(*agoraFuncVal); ok {
-			afn.reset()
-			coro = gocoro.New(func(y gocoro.Yielder, _ ...interface{}) interface{} {
-				for v := afn.Call(Nil, args[1:]...); afn.status() == "suspended"; v = afn.Call(Nil) {
-					y.Yield(v)
-				}
-				panic(gocoro.ErrEndOfCoro)
-			})
-		} else {
-			panic(NewTypeError("native func", "", "range"))
-		}
-
-	default:
-		panic(NewTypeError(t, "", "range"))
-	}
+	it := newRangeIter(args)
 	if vm.rsp == len(vm.rstack) {
 		if vm.debug && vm.rsp == cap(vm.rstack) {
 			fmt.Fprintf(vm.proto.ctx.Stdout, "DEBUG expanding range stack of func %s, current size: %d\n", vm.val.name, len(vm.rstack))
 		}
-		vm.rstack = append(vm.rstack, coro)
+		vm.rstack = append(vm.rstack, it)
 	} else {
-		vm.rstack[vm.rsp] = coro
+		vm.rstack[vm.rsp] = it
 	}
 	vm.rsp++
 }
 
+// Pop the iterator of the innermost `for range` loop from the range stack.
 func (vm *agoraFuncVM) popRange() {
 	vm.rsp--
-	coro := vm.rstack[vm.rsp]
 	vm.rstack[vm.rsp] = nil
-	if coro.Status() == gocoro.StSuspended {
-		coro.Cancel()
+}
+
+// Return the operands as numbers, if they are both numbers.
+func numbers(x, y Val) (Number, Number, bool) {
+	if nx, ok := x.(Number); ok {
+		if ny, ok := y.(Number); ok {
+			return nx, ny, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Apply the arithmetic operation on two numbers, as the default arithmetic does.
+func arithNumbers(op bytecode.Opcode, x, y Number) Val {
+	switch op {
+	case bytecode.OP_ADD:
+		return x + y
+	case bytecode.OP_SUB:
+		return x - y
+	case bytecode.OP_MUL:
+		return x * y
+	case bytecode.OP_DIV:
+		return x / y
+	}
+	return Number(x.Int() % y.Int())
+}
+
+// Apply the arithmetic operation on two values, using the arithmetic processor.
+func arithVals(arith Arithmetic, op bytecode.Opcode, x, y Val) Val {
+	switch op {
+	case bytecode.OP_ADD:
+		return arith.Add(x, y)
+	case bytecode.OP_SUB:
+		return arith.Sub(x, y)
+	case bytecode.OP_MUL:
+		return arith.Mul(x, y)
+	case bytecode.OP_DIV:
+		return arith.Div(x, y)
+	}
+	return arith.Mod(x, y)
+}
+
+// Return the result of the comparison operation, given the result of the
+// comparer.
+func cmpResult(op bytecode.Opcode, c int) Val {
+	switch op {
+	case bytecode.OP_EQ:
+		return Bool(c == 0)
+	case bytecode.OP_NEQ:
+		return Bool(c != 0)
+	case bytecode.OP_LT:
+		return Bool(c < 0)
+	case bytecode.OP_LTE:
+		return Bool(c <= 0)
+	case bytecode.OP_GT:
+		return Bool(c > 0)
+	}
+	return Bool(c >= 0)
+}
+
+// Get the field of the agora object identified by the B or C operand x. If it
+// is a constant, the inline cache of the instruction is used.
+func (f *agoraFuncVM) field(ob *object, x int) Val {
+	if bytecode.IsK(x) {
+		return ob.getK(f.proto.kTable[x&bytecode.MaxRK], &f.proto.ics[f.pc-1])
+	}
+	return ob.Get(f.regs[x])
+}
+
+// Set the field of the agora object identified by the B or C operand x. If it
+// is a constant, the inline cache of the instruction is used.
+func (f *agoraFuncVM) setField(ob *object, x int, v Val) {
+	if bytecode.IsK(x) {
+		ob.setK(f.proto.kTable[x&bytecode.MaxRK], v, &f.proto.ics[f.pc-1])
+	} else {
+		ob.Set(f.regs[x], v)
 	}
 }
 
+// Copy the arguments of a call from the registers. An agora function copies the
+// arguments it receives, so it can be called with the registers directly, but
+// other functions may keep them.
+func copyArgs(regs []Val) []Val {
+	args := make([]Val, len(regs))
+	copy(args, regs)
+	return args
+}
+
+// Return from the function with the call of fn. An agora function is called by
+// the caller of run once it returns, so that it runs in constant stack space,
+// and nil is returned. Other functions, and suspended coroutines which have
+// their own VM, are called directly and their value is returned.
+func (f *agoraFuncVM) tailCall(fn Val, this Val, args []Val) Val {
+	// This call is over, as with a return
+	f.val.coroState = nil
+	afn, ok := fn.(*agoraFuncVal)
+	if !ok {
+		return fn.(Func).Call(this, copyArgs(args)...)
+	} else if afn.coroState != nil {
+		return afn.Call(this, args...)
+	}
+	f.tail, f.tailThis, f.tailArgs = afn, this, args
+	return nil
+}
+
 // run executes the instructions of the function. This is the actual implementation
 // of the Virtual Machine.
 func (f *agoraFuncVM) run(args ...Val) Val {
-	// Register the defer to release all `for range` coroutines created
+	// Register the defer to release all `for range` iterators created
 	// by the VM and possibly still alive from a resume of this VM.
 	clearRange := true
 	defer func() {
@@ -329,228 +321,230 @@ func (f *agoraFuncVM) run(args ...Val) Val {
 		}
 	}()
 
-	// Keep reference to arithmetic and comparer
+	// Keep reference to arithmetic, comparer, profiler and coverage counters.
+	// Numbers are computed and compared directly if the default arithmetic
+	// and comparer are used.
 	arith := f.proto.ctx.Arithmetic
 	cmp := f.proto.ctx.Comparer
+	_, fastArith := arith.(defaultArithmetic)
+	_, fastCmp := cmp.(defaultComparer)
+	prof := f.proto.ctx.Profiler
+	var cov []int64
+	if f.proto.ctx.Coverage != nil {
+		cov = f.proto.ctx.Coverage.counts(f.proto)
+	}
 
 	// If the program counter is 0, this is an initial run, not a resume as
 	// a coroutine.
 	if f.pc == 0 {
-		// Create local variables
-		f.createLocals()
+		// Create the registers
+		f.createRegs()
 
-		// Expected args are defined in constant table spots 0 to ExpArgs - 1.
-		for j, l := int64(0), int64(len(args)); j < f.proto.expArgs; j++ {
-			if j < l {
-				f.vars[f.proto.kTable[j].String()] = args[j]
-			} else {
-				f.vars[f.proto.kTable[j].String()] = Nil
-			}
+		// Expected args are defined in local slots 0 to ExpArgs - 1.
+		for j, l := int64(0), int64(len(args)); j < f.proto.expArgs && j < l; j++ {
+			f.regs[j] = args[j]
+		}
+		// Keep the args array, if the function refers to it
+		if f.proto.usesArgs {
+			f.args = NewArgs(args)
 		}
-		// Keep the args array
-		f.args = f.createArgsVal(args)
 	} else {
-		// This is a resume for a coroutine, push the received arg (only one) on the stack
+		// This is a resume for a coroutine, store the received arg (only one) in
+		// the register of the yield instruction
 		var a0 Val = Nil
 		if len(args) > 0 {
 			a0 = args[0]
 		}
-		f.push(a0)
+		f.regs[f.proto.code[f.pc-1].A()] = a0
 	}
 
+	// Keep local references to the registers, constants and instructions
+	regs, ks, code := f.regs, f.proto.kTable, f.proto.code
+
 	// Execute the instructions
 	for {
 		// Get the instruction to process
-		i := f.proto.code[f.pc]
-		// Decode the instruction
-		op, flg, ix := i.Opcode(), i.Flag(), i.Index()
+		i := code[f.pc]
+		if prof != nil && f.pn != nil {
+			prof.instr(f.pn, f.pc)
+		}
+		if cov != nil {
+			cov[f.pc]++
+		}
 		// Increment the PC, if a jump requires a different PC delta, it will set it explicitly
 		f.pc++
-		switch op {
+		switch op := i.Opcode(); op {
 		case bytecode.OP_RET:
-			// End this function call, return the value on top of the stack and remove
-			// the vm if it was set on the value
+			// End this function call, return the value and remove the vm if it was
+			// set on the value
 			f.val.coroState = nil
-			return f.pop()
+			return f.rk(i.B())
 
 		case bytecode.OP_YLD:
-			// Yield n value(s), save the vm so it can be called back, and return
+			// Yield the value, save the vm so it can be called back, and return
 			f.val.coroState = f
-			clearRange = false // Keep active range coros, so that they can continue on a resume
-			return f.pop()
+			clearRange = false // Keep active range iterators, so that they can continue on a resume
+			return f.rk(i.B())
 
-		case bytecode.OP_PUSH:
-			f.push(f.getVal(flg, ix))
+		case bytecode.OP_MOVE:
+			regs[i.A()] = regs[i.B()]
 
-		case bytecode.OP_POP:
-			if nm, v := f.proto.kTable[ix].String(), f.pop(); !f.proto.ctx.setVar(nm, v, f) {
-				// Not found anywhere, panic
-				panic("unknown variable: " + nm)
-			}
-
-		case bytecode.OP_ADD:
-			y, x := f.pop(), f.pop()
-			f.push(arith.Add(x, y))
+		case bytecode.OP_LOADK:
+			regs[i.A()] = ks[i.Bx()]
 
-		case bytecode.OP_SUB:
-			y, x := f.pop(), f.pop()
-			f.push(arith.Sub(x, y))
+		case bytecode.OP_LOADN:
+			regs[i.A()] = Nil
 
-		case bytecode.OP_MUL:
-			y, x := f.pop(), f.pop()
-			f.push(arith.Mul(x, y))
+		case bytecode.OP_LOADT:
+			regs[i.A()] = f.this
 
-		case bytecode.OP_DIV:
-			y, x := f.pop(), f.pop()
-			f.push(arith.Div(x, y))
+		case bytecode.OP_LOADA:
+			regs[i.A()] = f.args
 
-		case bytecode.OP_MOD:
-			y, x := f.pop(), f.pop()
-			f.push(arith.Mod(x, y))
+		case bytecode.OP_LOADF:
+			regs[i.A()] = newAgoraFuncVal(f.proto.mod.fns[i.Bx()], f)
 
-		case bytecode.OP_NOT:
-			x := f.pop()
-			f.push(Bool(!x.Bool()))
+		case bytecode.OP_GETU:
+			regs[i.A()] = *f.val.upvals[i.B()]
 
-		case bytecode.OP_UNM:
-			x := f.pop()
-			f.push(arith.Unm(x))
+		case bytecode.OP_SETU:
+			*f.val.upvals[i.A()] = f.rk(i.B())
 
-		case bytecode.OP_EQ:
-			y, x := f.pop(), f.pop()
-			f.push(Bool(cmp.Cmp(x, y) == 0))
+		case bytecode.OP_GETG:
+			regs[i.A()] = f.global(i.Bx())
 
-		case bytecode.OP_NEQ:
-			y, x := f.pop(), f.pop()
-			f.push(Bool(cmp.Cmp(x, y) != 0))
-
-		case bytecode.OP_LT:
-			y, x := f.pop(), f.pop()
-			f.push(Bool(cmp.Cmp(x, y) < 0))
+		case bytecode.OP_ADD, bytecode.OP_SUB, bytecode.OP_MUL, bytecode.OP_DIV, bytecode.OP_MOD:
+			x, y := f.rk(i.B()), f.rk(i.C())
+			if nx, ny, ok := numbers(x, y); ok && fastArith {
+				regs[i.A()] = arithNumbers(op, nx, ny)
+			} else {
+				regs[i.A()] = arithVals(arith, op, x, y)
+			}
 
-		case bytecode.OP_LTE:
-			y, x := f.pop(), f.pop()
-			f.push(Bool(cmp.Cmp(x, y) <= 0))
+		case bytecode.OP_NOT:
+			regs[i.A()] = Bool(!f.rk(i.B()).Bool())
 
-		case bytecode.OP_GT:
-			y, x := f.pop(), f.pop()
-			f.push(Bool(cmp.Cmp(x, y) > 0))
+		case bytecode.OP_UNM:
+			regs[i.A()] = arith.Unm(f.rk(i.B()))
 
-		case bytecode.OP_GTE:
-			y, x := f.pop(), f.pop()
-			f.push(Bool(cmp.Cmp(x, y) >= 0))
+		case bytecode.OP_EQ, bytecode.OP_NEQ, bytecode.OP_LT, bytecode.OP_LTE, bytecode.OP_GT, bytecode.OP_GTE:
+			x, y := f.rk(i.B()), f.rk(i.C())
+			var c int
+			if nx, ny, ok := numbers(x, y); ok && fastCmp {
+				c = cmpFloats(float64(nx), float64(ny))
+			} else {
+				c = cmp.Cmp(x, y)
+			}
+			regs[i.A()] = cmpResult(op, c)
 
 		case bytecode.OP_TEST:
-			if !f.pop().Bool() {
-				// Do the jump over ix instructions
-				f.pc += int(ix)
+			if !regs[i.A()].Bool() {
+				// Do the jump over sBx instructions
+				f.pc += i.SBx()
 			}
 
 		case bytecode.OP_JMP:
-			if flg == bytecode.FLG_Jf {
-				f.pc += int(ix)
-			} else {
-				f.pc -= (int(ix) + 1) // +1 because pc is already on next instr
-			}
+			f.pc += i.SBx()
 
 		case bytecode.OP_NEW:
-			ob := NewObject()
-			for j := ix; j > 0; j-- {
-				key, val := f.pop(), f.pop()
-				ob.Set(key, val)
-			}
-			f.push(ob)
+			regs[i.A()] = NewObject()
 
 		case bytecode.OP_SFLD:
-			vr, k, vl := f.pop(), f.pop(), f.pop()
-			if ob, ok := vr.(Object); ok {
-				ob.Set(k, vl)
+			vr := regs[i.A()]
+			if ob, ok := vr.(*object); ok {
+				f.setField(ob, i.B(), f.rk(i.C()))
+			} else if ob, ok := vr.(Object); ok {
+				ob.Set(f.rk(i.B()), f.rk(i.C()))
 			} else {
 				panic(NewTypeError(Type(vr), "", "object"))
 			}
 
 		case bytecode.OP_GFLD:
-			vr, k := f.pop(), f.pop()
-			if ob, ok := vr.(Object); ok {
-				f.push(ob.Get(k))
+			vr := regs[i.B()]
+			if ob, ok := vr.(*object); ok {
+				regs[i.A()] = f.field(ob, i.C())
+			} else if ob, ok := vr.(Object); ok {
+				regs[i.A()] = ob.Get(f.rk(i.C()))
 			} else {
 				panic(NewTypeError(Type(vr), "", "object"))
 			}
 
 		case bytecode.OP_CFLD:
-			vr, k := f.pop(), f.pop()
-			// Pop the arguments in reverse order
-			args := make([]Val, ix)
-			for j := ix; j > 0; j-- {
-				args[j-1] = f.pop()
+			a, n := i.A(), i.C()
+			vr, k := regs[a], f.rk(i.B())
+			args := regs[a+1 : a+1+n]
+			// A method of an agora object is called directly
+			if ob, ok := vr.(*object); ok {
+				if fn, ok := f.field(ob, i.B()).(*agoraFuncVal); ok {
+					regs[a] = fn.Call(ob, args...)
+					break
+				}
 			}
 			if ob, ok := vr.(Object); ok {
-				// TODO : Do not push returned value if unused (grow stack for nothing). When multiple return values
-				// are added, add intelligence to know how many are used/discarded.
-				f.push(ob.callMethod(k, args...))
+				regs[a] = ob.CallMethod(k, copyArgs(args)...)
 			} else {
 				panic(NewTypeError(Type(vr), "", "object"))
 			}
 
 		case bytecode.OP_CALL:
-			// ix is the number of args
-			// Pop the function itself, ensure it is a function
-			x := f.pop()
-			fn, ok := x.(Func)
-			if !ok {
-				panic(NewTypeError(Type(x), "", "func"))
+			// The function is in register A, followed by B arguments
+			a, n := i.A(), i.B()
+			args := regs[a+1 : a+1+n]
+			// Call the function, and store the return value in the function's register
+			switch fn := regs[a].(type) {
+			case *agoraFuncVal:
+				regs[a] = fn.Call(nil, args...)
+			case Func:
+				regs[a] = fn.Call(nil, copyArgs(args)...)
+			default:
+				panic(NewTypeError(Type(regs[a]), "", "func"))
+			}
+
+		case bytecode.OP_TCALL:
+			a, n := i.A(), i.B()
+			if _, ok := regs[a].(Func); !ok {
+				panic(NewTypeError(Type(regs[a]), "", "func"))
 			}
-			// Pop the arguments in reverse order
-			args := make([]Val, ix)
-			for j := ix; j > 0; j-- {
-				args[j-1] = f.pop()
+			return f.tailCall(regs[a], nil, regs[a+1:a+1+n])
+
+		case bytecode.OP_TCFLD:
+			a, n := i.A(), i.C()
+			vr, k := regs[a], f.rk(i.B())
+			args := regs[a+1 : a+1+n]
+			// A method of an agora object is called as a tail call
+			if ob, ok := vr.(*object); ok {
+				if fn, ok := f.field(ob, i.B()).(*agoraFuncVal); ok {
+					return f.tailCall(fn, ob, args)
+				}
+			}
+			if ob, ok := vr.(Object); ok {
+				f.val.coroState = nil
+				return ob.CallMethod(k, copyArgs(args)...)
 			}
-			// Call the function, and store the return value on the stack
-			// TODO : Do not push returned value if unused (grow stack for nothing). When multiple return values
-			// are added, add intelligence to know how many are used/discarded.
-			f.push(fn.Call(nil, args...))
+			panic(NewTypeError(Type(vr), "", "object"))
 
 		case bytecode.OP_RNGS:
-			// Pop the arguments in reverse order
-			args := make([]Val, ix)
-			for j := ix; j > 0; j-- {
-				args[j-1] = f.pop()
-			}
-			// Create the range coroutine
-			f.pushRange(args...)
+			// The arguments are in registers A to A+B-1
+			a, n := i.A(), i.B()
+			// Create the range iterator
+			f.pushRange(copyArgs(regs[a : a+n])...)
 
 		case bytecode.OP_RNGP:
-			coro := f.rstack[f.rsp-1]
-			v, e := coro.Resume()
-			var vals []interface{}
-			if sl, ok := v.([]interface{}); ok {
-				vals = sl
+			if v, ok := f.rstack[f.rsp-1].next(); ok {
+				regs[i.A()] = v
 			} else {
-				vals = []interface{}{v}
-			}
-			// Push the values
-			if e == nil {
-				for j := uint64(0); j < ix; j++ {
-					if j < uint64(len(vals)) {
-						f.push(vals[j].(Val))
-					} else {
-						f.push(Nil)
-					}
-				}
-			} else if e != gocoro.ErrEndOfCoro {
-				panic(e)
+				// Jump to the end of the loop
+				f.pc += i.SBx()
 			}
-			// Push the condition
-			f.push(Bool(e == nil))
 
 		case bytecode.OP_RNGE:
-			// Release the range coroutine
+			// Release the range iterator
 			f.popRange()
 
 		case bytecode.OP_DUMP:
 			if f.debug {
-				// Dumps `ix` number of stack traces
-				f.proto.ctx.dump(int(ix))
+				// Dumps `Bx` number of stack traces
+				f.proto.ctx.dump(i.Bx())
 			}
 
 		default:
@@ -0,0 +1,163 @@
+package runtime
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/PuerkitoBio/agora/bytecode"
+)
+
+// This file holds the API used by the agora modules compiled ahead-of-time to Go
+// source code by the `agora gogen` command (see compiler.GoGen). The generated
+// code implements NativeModule, and executes the instructions of the functions
+// with calls to this API and to the Arithmetic and Comparer of the context.
+
+// GoFn represents the signature of the agora functions compiled to Go.
+type GoFn func(this Val, args ...Val) Val
+
+// NewGoFunc returns an agora function compiled to Go, initialized with the specified
+// context, name and function implementation.
+func NewGoFunc(ctx *Ctx, nm string, fn GoFn) *GoFunc {
+	return &GoFunc{
+		&funcVal{
+			ctx,
+			nm,
+		},
+		fn,
+	}
+}
+
+// A GoFunc represents an agora function compiled to Go. Unlike a NativeFunc, it
+// receives the `this` value.
+type GoFunc struct {
+	// Expose the default Func value's behaviour
+	*funcVal
+	// Internal fields
+	fn GoFn
+}
+
+// Native returns the Go native representation of the compiled function type.
+func (g *GoFunc) Native() interface{} {
+	return g
+}
+
+// Call executes the compiled function and returns its return value.
+func (g *GoFunc) Call(this Val, args ...Val) Val {
+	g.ctx.pushFn(g, nil)
+	defer g.ctx.popFn()
+	return g.fn(this, args...)
+}
+
+// Builtin returns the built-in value named nm, the global variables of the agora
+// programs. It panics if there is no such value.
+func (c *Ctx) Builtin(nm string) Val {
+	v := c.builtin.Get(String(nm))
+	if v == Nil {
+		panic("variable not found: " + nm)
+	}
+	return v
+}
+
+// CallFunc calls the function fn with the specified arguments, and returns its
+// return value. It panics if fn is not a function.
+func CallFunc(fn Val, args ...Val) Val {
+	f, ok := fn.(Func)
+	if !ok {
+		panic(NewTypeError(Type(fn), "", "func"))
+	}
+	return f.Call(nil, args...)
+}
+
+// CallMethod calls the method of the object v identified by the key k with the
+// specified arguments, and returns its return value. It panics if v is not an
+// object.
+func CallMethod(v, k Val, args ...Val) Val {
+	ob, ok := v.(Object)
+	if !ok {
+		panic(NewTypeError(Type(v), "", "object"))
+	}
+	return ob.CallMethod(k, args...)
+}
+
+// GetField returns the value of the field of the object v identified by the key k.
+// It panics if v is not an object.
+func GetField(v, k Val) Val {
+	ob, ok := v.(Object)
+	if !ok {
+		panic(NewTypeError(Type(v), "", "object"))
+	}
+	return ob.Get(k)
+}
+
+// SetField sets the value of the field of the object v identified by the key k.
+// It panics if v is not an object.
+func SetField(v, k, x Val) {
+	ob, ok := v.(Object)
+	if !ok {
+		panic(NewTypeError(Type(v), "", "object"))
+	}
+	ob.Set(k, x)
+}
+
+// NewArgs returns the value of the `args` reserved identifier for a function
+// called with the specified arguments: an array-like object, or nil if there
+// are no arguments.
+func NewArgs(args []Val) Val {
+	if len(args) == 0 {
+		return Nil
+	}
+	o := NewObject()
+	for i, v := range args {
+		o.Set(Number(i), v)
+	}
+	return o
+}
+
+// NewRange returns the iterator of a `for range` loop over the specified arguments,
+// the first one being the value to range over. The iterator returns the values of
+// the loop one at a time, and false once the loop is over.
+func NewRange(args ...Val) func() (Val, bool) {
+	return newRangeIter(args).next
+}
+
+// BytecodeFuncs are the functions of a bytecode file bound to an execution context,
+// run by the interpreter. The compiled modules use them for the coroutines, and
+// the functions nested in a coroutine.
+type BytecodeFuncs struct {
+	mod *agoraModule
+}
+
+// NewBytecodeFuncs decodes the bytecode of the module identified by id, and
+// returns its functions bound to the execution context.
+func NewBytecodeFuncs(ctx *Ctx, id string, b []byte) (*BytecodeFuncs, error) {
+	f, err := bytecode.NewDecoder(bytes.NewReader(b)).Decode()
+	if err != nil {
+		return nil, err
+	}
+	if err := bytecode.Verify(f); err != nil {
+		return nil, err
+	}
+	return &BytecodeFuncs{newAgoraModule(id, newCompiledModule(f), ctx)}, nil
+}
+
+// Func returns a new function value of the function at index ix in the bytecode
+// file, with the specified upvalue cells: the variables of the enclosing
+// functions that it captures, in the order of its upvalues.
+func (b *BytecodeFuncs) Func(ix int, upvals ...*Val) Func {
+	def := b.mod.fns[ix]
+	if len(upvals) != len(def.uTable) {
+		panic(fmt.Sprintf("expected %d upvalue(s) for function %s, got %d", len(def.uTable), def.name, len(upvals)))
+	}
+	if len(upvals) == 0 {
+		upvals = nil
+	}
+	return &agoraFuncVal{
+		&funcVal{
+			def.ctx,
+			def.name,
+		},
+		def,
+		upvals,
+		nil,
+	}
+}
@@ -2,9 +2,6 @@ package runtime
 
 import (
 	"fmt"
-	"io"
-	"os"
-	"path/filepath"
 
 	"github.com/PuerkitoBio/agora/bytecode"
 )
@@ -35,55 +32,101 @@ type NativeModule interface {
 	SetCtx(*Ctx)
 }
 
-// An agora module holds its ID, its function table, and the value it returned.
-type agoraModule struct {
-	id  string
-	fns []*agoraFuncDef
-	v   Val
+// A compiledModule is the immutable compiled form of an agora module, created
+// from its bytecode. It may be shared by many execution contexts.
+type compiledModule struct {
+	id     string
+	fns    []*compiledFunc
+	signer string // the id of the key that signed the bytecode, if verified
 }
 
-// Create a new agora module from the specified bytecode file and for the specified
-// execution context.
-func newAgoraModule(f *bytecode.File, c *Ctx) *agoraModule {
-	m := &agoraModule{
+// Create a new compiled module from the specified bytecode file.
+func newCompiledModule(f *bytecode.File) *compiledModule {
+	m := &compiledModule{
 		id: f.Name,
 	}
 	// Define all functions
-	m.fns = make([]*agoraFuncDef, len(f.Fns))
+	m.fns = make([]*compiledFunc, len(f.Fns))
 	for i, fn := range f.Fns {
-		af := newAgoraFuncDef(m, c)
-		af.name = fn.Header.Name
-		af.stackSz = fn.Header.StackSz
-		af.expArgs = fn.Header.ExpArgs
-		// TODO : Ignore LineStart and LineEnd at the moment, unused.
-		m.fns[i] = af
-		af.kTable = make([]Val, len(fn.Ks))
+		cf := &compiledFunc{
+			name:      fn.Header.Name,
+			stackSz:   fn.Header.StackSz,
+			expArgs:   fn.Header.ExpArgs,
+			lineStart: fn.Header.LineStart,
+			lineEnd:   fn.Header.LineEnd,
+		}
+		m.fns[i] = cf
+		cf.kTable = make([]Val, len(fn.Ks))
 		for j, k := range fn.Ks {
 			switch k.Type {
 			case bytecode.KtBoolean:
-				af.kTable[j] = Bool(k.Val.(int64) != 0)
+				cf.kTable[j] = Bool(k.Val.(int64) != 0)
 			case bytecode.KtInteger:
-				af.kTable[j] = Number(k.Val.(int64))
+				cf.kTable[j] = Number(k.Val.(int64))
 			case bytecode.KtFloat:
-				af.kTable[j] = Number(k.Val.(float64))
+				cf.kTable[j] = Number(k.Val.(float64))
 			case bytecode.KtString:
-				af.kTable[j] = String(k.Val.(string))
+				cf.kTable[j] = String(k.Val.(string))
 			default:
 				panic("invalid constant value type")
 			}
 		}
-		af.lTable = make([]string, len(fn.Ls))
+		cf.lTable = make([]string, len(fn.Ls))
 		for j, l := range fn.Ls {
-			af.lTable[j] = string(af.kTable[l].(String))
+			cf.lTable[j] = string(cf.kTable[l].(String))
+		}
+		// The locals are the first registers
+		if n := int64(len(fn.Ls)); cf.stackSz < n {
+			cf.stackSz = n
 		}
-		af.code = make([]bytecode.Instr, len(fn.Is))
+		if len(fn.Us) > 0 {
+			// The enclosing function is always defined before its nested functions
+			var parent *compiledFunc
+			if ix := fn.Header.ParentFnIx; ix >= 0 && ix < int64(i) {
+				parent = m.fns[ix]
+			}
+			cf.uTable = make([]upvalue, len(fn.Us))
+			for j, u := range fn.Us {
+				cf.uTable[j] = upvalue{parent.upvalueName(u), u.Local, u.Ix}
+			}
+		}
+		cf.code = make([]bytecode.Instr, len(fn.Is))
 		for j, ins := range fn.Is {
-			af.code[j] = ins
+			cf.code[j] = ins
+			// The `args` value is created only if the function refers to it
+			if ins.Opcode() == bytecode.OP_LOADA {
+				cf.usesArgs = true
+			}
+		}
+		if len(fn.Ns) > 0 {
+			cf.lines = make([]int64, len(fn.Ns))
+			copy(cf.lines, fn.Ns)
 		}
 	}
 	return m
 }
 
+// An agora module holds its ID, its function table, and the value it returned.
+// Its functions are the compiled functions bound to an execution context.
+type agoraModule struct {
+	id  string
+	fns []*agoraFuncDef
+	v   Val
+}
+
+// Create a new agora module identified by id from the specified compiled module
+// and for the specified execution context.
+func newAgoraModule(id string, cm *compiledModule, c *Ctx) *agoraModule {
+	m := &agoraModule{
+		id: id,
+	}
+	m.fns = make([]*agoraFuncDef, len(cm.fns))
+	for i, cf := range cm.fns {
+		m.fns[i] = newAgoraFuncDef(cf, m, i, c)
+	}
+	return m
+}
+
 // Run executes the module and returns its return value, or an error.
 func (m *agoraModule) Run(args ...Val) (v Val, err error) {
 	defer PanicToError(&err)
@@ -118,57 +161,3 @@ func PanicToError(err *error) {
 func (m *agoraModule) ID() string {
 	return m.id
 }
-
-// A ModuleResolver interface represents the required behaviour for the component
-// responsible for matching a module identifier to actual source code.
-// Various implementations can be provided, for example by loading modules
-// in a database, over http, compressed, secured and signed, etc.
-type ModuleResolver interface {
-	Resolve(string) (io.Reader, error)
-}
-
-// A FileResolver is a ModuleResolver that turns the module identifier into
-// a file path to find the matching source code.
-type FileResolver struct{}
-
-var (
-	extensions = [...]string{".agorac", ".agoraa", ".agora"}
-)
-
-// Resolve matches the provided identifier with a source file.
-//
-// If the identifier has no extension (which is recommended), Resolve looks
-// for files in the following order:
-//
-// 1- .agorac (compiled bytecode)
-// 2- .agoraa (agora assembly code)
-// 3- .agora  (agora source code)
-//
-// TODO : This doesn't work, the Ctx has a single compiler, that may
-// compile assembly or source, but not both. The Resolver should look
-// for compiled bytecode or the same source code as the initial Ctx.Load.
-func (f FileResolver) Resolve(id string) (io.Reader, error) {
-	var nm string
-	if filepath.IsAbs(id) {
-		nm = id
-	} else {
-		pwd, err := os.Getwd()
-		if err != nil {
-			return nil, err
-		}
-		nm = filepath.Join(pwd, id)
-	}
-	if filepath.Ext(nm) == "" {
-		for _, ext := range extensions {
-			if _, err := os.Stat(nm + ext); err != nil {
-				if !os.IsNotExist(err) {
-					return nil, err
-				}
-			} else {
-				nm += ext
-				break
-			}
-		}
-	}
-	return os.Open(nm)
-}
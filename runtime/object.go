@@ -23,50 +23,107 @@ func NewNoSuchMethodError(m string) NoSuchMethodError {
 // The Object interface represents an agora object, which is an associative array.
 // It can get and set keys, retrieve the length, the list of keys, and call methods
 // and meta-methods.
+//
+// The Object interface may be implemented outside the runtime package, to back
+// an object with a custom storage. The implementation must be comparable (i.e. a
+// pointer type), since objects may be used as keys. The DefaultCallMethod and
+// DefaultCallMetaMethod functions provide the standard method dispatch, based
+// on Get.
 type Object interface {
 	Val
-	Get(Val) Val
-	Set(Val, Val)
-	Len() Val
-	Keys() Val
-	callMethod(Val, ...Val) Val
-	callMetaMethod(string, ...Val) (Val, bool)
+	Get(Val) Val                               // Get a field value, Nil if it does not exist
+	Set(Val, Val)                              // Set a field value, or remove a field if value is Nil
+	Len() Val                                  // Get the length of the object
+	Keys() Val                                 // Get the keys of the object, as an array-like object
+	CallMethod(Val, ...Val) Val                // Call the method identified by the key
+	CallMetaMethod(string, ...Val) (Val, bool) // Call the meta-method if it exists
 }
 
-// An object is a map of values, an associative array.
+// DefaultCallMethod calls the method of o identified by nm with the provided
+// arguments, using o as `this` value. It panics if the field does not hold a
+// function. If the field does not exist and a meta-method named `__noSuchMethod`
+// is defined, it is called instead.
+func DefaultCallMethod(o Object, nm Val, args ...Val) Val {
+	v := o.Get(nm)
+	if v != Nil {
+		if f, ok := v.(Func); ok {
+			return f.Call(o, args...)
+		}
+		panic(NewNoSuchMethodError(nm.String()))
+	} else if v, ok := o.CallMetaMethod("__noSuchMethod", append([]Val{nm}, args...)...); ok {
+		// Method not found - call __noSuchMethod if it exists, otherwise panic
+		return v
+	}
+	panic(NewNoSuchMethodError(nm.String()))
+}
+
+// DefaultCallMetaMethod calls the meta-method of o identified by nm with the
+// provided arguments, using o as `this` value. It returns false if the field
+// does not exist or does not hold a function.
+func DefaultCallMetaMethod(o Object, nm string, args ...Val) (Val, bool) {
+	if f, ok := o.Get(String(nm)).(Func); ok {
+		return f.Call(o, args...), true
+	}
+	return nil, false
+}
+
+// An object is a map of values, an associative array. The fields with a string
+// key are stored by index in vals, as described by the shape of the object, so
+// that objects used as records are cheap to access. The other fields are stored
+// in the map.
 type object struct {
-	m map[Val]Val
+	m     map[Val]Val
+	shape *shape
+	vals  []Val
 }
 
 // NewObject returns a new instance of an object.
+//
+// The objects with string keys added in the same order share a shape, the
+// layout of their fields, so that the field accesses can be cached. The shapes
+// are shared by all the execution contexts of the process, and their number is
+// capped: when 16384 shapes have been created, a new set of shapes is started
+// for the new objects, and the previous ones are freed with the last objects
+// that use them. The objects whose shape was replaced store their new fields
+// in a map, which is slower to access but otherwise behaves the same.
 func NewObject() Object {
 	return &object{
-		make(map[Val]Val),
+		shape: rootShape(),
+	}
+}
+
+// Call fn for each field of the object, the ones of the shape first.
+func (o *object) each(fn func(k, v Val)) {
+	if o.shape != nil {
+		for i, k := range o.shape.keys {
+			fn(k, o.vals[i])
+		}
+	}
+	for k, v := range o.m {
+		fn(k, v)
 	}
 }
 
 // Dump pretty-prints the content of the object.
 func (o *object) Dump() string {
 	buf := bytes.NewBuffer(nil)
-	for k, v := range o.m {
+	o.each(func(k, v Val) {
 		buf.WriteString(fmt.Sprintf(" %s: %s, ", dumpVal(k), dumpVal(v)))
-	}
+	})
 	return fmt.Sprintf("{%s} (Object)", buf)
 }
 
-func (o *object) callMetaMethod(nm string, args ...Val) (Val, bool) {
-	if mm, ok := o.m[String(nm)]; ok {
-		if f, ok := mm.(Func); ok {
-			return f.Call(o, args...), true
-		}
-	}
-	return nil, false
+// CallMetaMethod calls the meta-method identified by nm with the provided
+// arguments, and returns its return value and true. If the meta-method does
+// not exist, it returns false.
+func (o *object) CallMetaMethod(nm string, args ...Val) (Val, bool) {
+	return DefaultCallMetaMethod(o, nm, args...)
 }
 
 // Int returns the integer value of the object. Such behaviour can be defined
 // if a `__int` method is available on the object.
 func (o *object) Int() int64 {
-	if v, ok := o.callMetaMethod("__int"); ok {
+	if v, ok := o.CallMetaMethod("__int"); ok {
 		return v.Int()
 	}
 	panic(NewTypeError(Type(o), "", "int"))
@@ -75,7 +132,7 @@ func (o *object) Int() int64 {
 // Float returns the float value of the object. Such behaviour can be defined
 // if a `__float` method is available on the object.
 func (o *object) Float() float64 {
-	if v, ok := o.callMetaMethod("__float"); ok {
+	if v, ok := o.CallMetaMethod("__float"); ok {
 		return v.Float()
 	}
 	panic(NewTypeError(Type(o), "", "float"))
@@ -84,7 +141,7 @@ func (o *object) Float() float64 {
 // String returns the string value of the object. Such behaviour can be overridden
 // if a `__string` method is available on the object.
 func (o *object) String() string {
-	if v, ok := o.callMetaMethod("__string"); ok {
+	if v, ok := o.CallMetaMethod("__string"); ok {
 		return v.String()
 	}
 	// Otherwise print the object's contents
@@ -107,7 +164,7 @@ func (o *object) String() string {
 // Bool returns the boolean value of the object. Such behaviour can be defined
 // if a `__bool` method is available on the object. Otherwise it returns true.
 func (o *object) Bool() bool {
-	if v, ok := o.callMetaMethod("__bool"); ok {
+	if v, ok := o.CallMetaMethod("__bool"); ok {
 		return v.Bool()
 	}
 	// If __bool is not defined, object returns true (since it is not nil)
@@ -117,20 +174,24 @@ func (o *object) Bool() bool {
 // Native returns the Go native value of the object. Such behaviour can be defined
 // if a `__native` method is available on the object.
 func (o *object) Native() interface{} {
-	if v, ok := o.callMetaMethod("__native"); ok {
+	if v, ok := o.CallMetaMethod("__native"); ok {
 		return v.Native()
 	}
-	// Defaults to returning the internal map
-	return o.m
+	// Defaults to returning a map of the fields
+	m := make(map[Val]Val, len(o.vals)+len(o.m))
+	o.each(func(k, v Val) {
+		m[k] = v
+	})
+	return m
 }
 
 // Get the length of the object. The behaviour can be overridden
 // if a `__len` method is available on the object.
 func (o *object) Len() Val {
-	if v, ok := o.callMetaMethod("__len"); ok {
+	if v, ok := o.CallMetaMethod("__len"); ok {
 		return v
 	}
-	return Number(len(o.m))
+	return Number(len(o.vals) + len(o.m))
 }
 
 // Get the keys of the object in an array-like object value,
@@ -138,21 +199,26 @@ func (o *object) Len() Val {
 // of the object's implementation to return coherent values for Len()
 // and Keys(). The list of keys is unordered.
 func (o *object) Keys() Val {
-	if v, ok := o.callMetaMethod("__keys"); ok {
+	if v, ok := o.CallMetaMethod("__keys"); ok {
 		return v
 	}
 	ob := NewObject()
 	i := 0
-	for k, _ := range o.m {
+	o.each(func(k, _ Val) {
 		ob.Set(Number(i), k)
 		i++
-	}
+	})
 	return ob
 }
 
 // Get returns the value of the field identified by key. It returns Nil
 // if the field does not exist.
 func (o *object) Get(key Val) Val {
+	if s, ok := key.(String); ok {
+		if ix, ok := o.shape.lookup(s); ok {
+			return o.vals[ix]
+		}
+	}
 	if v, ok := o.m[key]; ok {
 		return v
 	}
@@ -164,29 +230,97 @@ func (o *object) Get(key Val) Val {
 // an error is raised.
 func (o *object) Set(key Val, v Val) {
 	if v == Nil {
-		delete(o.m, key)
+		o.remove(key)
+		return
 	} else if key == Nil {
 		panic(NewTypeError(Type(key), "", "key"))
-	} else {
-		o.m[key] = v
 	}
+	if s, ok := key.(String); ok {
+		if ix, ok := o.shape.lookup(s); ok {
+			o.vals[ix] = v
+			return
+		}
+		// A new field is added to the shape, if possible
+		if _, ok := o.m[key]; !ok {
+			if ns := o.shape.add(s); ns != nil {
+				o.addVal(ns, v)
+				return
+			}
+		}
+	}
+	if o.m == nil {
+		o.m = make(map[Val]Val)
+	}
+	o.m[key] = v
 }
 
-// callMethod calls the method identified by nm with the provided arguments.
-// It panics if the field does not hold a function. If the field does not
-// exist and a method named `__noSuchMethod` is defined, it is called instead.
-func (o *object) callMethod(nm Val, args ...Val) Val {
-	v, ok := o.m[nm]
-	if ok {
-		if f, ok := v.(Func); ok {
-			return f.Call(o, args...)
-		} else {
-			panic(NewNoSuchMethodError(nm.String()))
+// Add the value of the field added by the shape s, the new shape of the object.
+func (o *object) addVal(s *shape, v Val) {
+	if o.vals == nil {
+		// Most records have a few fields, avoid growing from 1
+		o.vals = make([]Val, 0, 4)
+	}
+	o.shape = s
+	o.vals = append(o.vals, v)
+}
+
+// Remove the field identified by key. If it is a field of the shape, the
+// object is used as a dictionary, and all its fields are moved to the map.
+func (o *object) remove(key Val) {
+	if s, ok := key.(String); ok {
+		if _, ok := o.shape.lookup(s); ok {
+			if o.m == nil {
+				o.m = make(map[Val]Val, len(o.vals))
+			}
+			for i, k := range o.shape.keys {
+				o.m[k] = o.vals[i]
+			}
+			o.shape, o.vals = dictShape, nil
+		}
+	}
+	delete(o.m, key)
+}
+
+// Get the value of the field identified by the constant key of an instruction,
+// using the inline cache of the instruction.
+func (o *object) getK(key Val, ic *inlineCache) Val {
+	if o.shape == ic.shape && ic.shape != nil {
+		return o.vals[ic.ix]
+	}
+	if s, ok := key.(String); ok {
+		if ix, ok := o.shape.lookup(s); ok {
+			ic.shape, ic.ix = o.shape, ix
+			return o.vals[ix]
+		}
+	}
+	return o.Get(key)
+}
+
+// Set the value of the field identified by the constant key of an instruction,
+// using the inline cache of the instruction. The cache also records the field
+// added to the objects of the parent shape of the cached shape.
+func (o *object) setK(key Val, v Val, ic *inlineCache) {
+	if v != Nil && ic.shape != nil {
+		if o.shape == ic.shape {
+			o.vals[ic.ix] = v
+			return
+		}
+		if o.shape == ic.shape.parent && ic.ix == len(o.vals) && o.m == nil {
+			o.addVal(ic.shape, v)
+			return
+		}
+	}
+	o.Set(key, v)
+	if s, ok := key.(String); ok {
+		if ix, ok := o.shape.lookup(s); ok {
+			ic.shape, ic.ix = o.shape, ix
 		}
-	} else if v, ok := o.callMetaMethod("__noSuchMethod", append([]Val{nm}, args...)...); ok {
-		// Method not found - call __noSuchMethod if it exists, otherwise panic
-		return v
-	} else {
-		panic(NewNoSuchMethodError(nm.String()))
 	}
 }
+
+// CallMethod calls the method identified by nm with the provided arguments.
+// It panics if the field does not hold a function. If the field does not
+// exist and a method named `__noSuchMethod` is defined, it is called instead.
+func (o *object) CallMethod(nm Val, args ...Val) Val {
+	return DefaultCallMethod(o, nm, args...)
+}
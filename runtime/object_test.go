@@ -0,0 +1,174 @@
+package runtime_test
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/agora/compiler"
+	"github.com/PuerkitoBio/agora/runtime"
+)
+
+// A custom object implemented outside the runtime package, backed by a Go map
+// of strings, with a Go method.
+type mapObject struct {
+	m     map[string]string
+	calls int
+}
+
+func (o *mapObject) Get(k runtime.Val) runtime.Val {
+	if v, ok := o.m[k.String()]; ok {
+		return runtime.String(v)
+	}
+	return runtime.Nil
+}
+
+func (o *mapObject) Set(k, v runtime.Val) {
+	if v == runtime.Nil {
+		delete(o.m, k.String())
+	} else {
+		o.m[k.String()] = v.String()
+	}
+}
+
+func (o *mapObject) Len() runtime.Val {
+	return runtime.Number(len(o.m))
+}
+
+func (o *mapObject) Keys() runtime.Val {
+	keys := make([]string, 0, len(o.m))
+	for k := range o.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ob := runtime.NewObject()
+	for i, k := range keys {
+		ob.Set(runtime.Number(i), runtime.String(k))
+	}
+	return ob
+}
+
+func (o *mapObject) CallMethod(nm runtime.Val, args ...runtime.Val) runtime.Val {
+	if nm.String() == "Upper" {
+		o.calls++
+		return runtime.String(strings.ToUpper(o.Get(args[0]).String()))
+	}
+	return runtime.DefaultCallMethod(o, nm, args...)
+}
+
+func (o *mapObject) CallMetaMethod(nm string, args ...runtime.Val) (runtime.Val, bool) {
+	if nm == "__cmp" {
+		return runtime.Number(0), true
+	}
+	return runtime.DefaultCallMetaMethod(o, nm, args...)
+}
+
+func (o *mapObject) Int() int64          { return int64(len(o.m)) }
+func (o *mapObject) Float() float64      { return float64(len(o.m)) }
+func (o *mapObject) String() string      { return fmt.Sprint(o.m) }
+func (o *mapObject) Bool() bool          { return true }
+func (o *mapObject) Native() interface{} { return o.m }
+
+const customObjectSrc = `x := {}
+x.Run = func(ob) {
+	ob.b = "two"
+	ob["c"] = 3
+	ob.a = nil
+	s := ""
+	for kv := range ob {
+		s += kv.k + "=" + kv.v + ";"
+	}
+	return s + ob.Upper("b") + ";" + string(len(ob)) + ";" + keys(ob)[0] + ";" + type(ob) + ";" + string(ob == 1)
+}
+x.Missing = func(ob) {
+	return ob.Nope()
+}
+return x
+`
+
+func TestCustomObject(t *testing.T) {
+	ctx := runtime.NewCtx(srcResolver{"custom": customObjectSrc}, new(compiler.Compiler))
+	ob := &mapObject{m: map[string]string{"a": "one"}}
+	res, err := ctx.Call("custom", "Run", ob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "b=two;c=3;TWO;2;b;object;true"
+	if res != exp {
+		t.Errorf("expected %q, got %q", exp, res)
+	}
+	if ob.calls != 1 {
+		t.Errorf("expected 1 call to the Go method, got %d", ob.calls)
+	}
+	if _, ok := ob.m["a"]; ok {
+		t.Errorf("expected key a to be removed")
+	}
+	if _, err := ctx.Call("custom", "Missing", ob); err == nil || err.Error() != "no such method: Nope" {
+		t.Errorf("expected no such method error, got %v", err)
+	}
+}
+
+func TestObjectFields(t *testing.T) {
+	ob := runtime.NewObject()
+	ob.Set(runtime.String("a"), runtime.Number(1))
+	ob.Set(runtime.Number(0), runtime.String("zero"))
+	ob.Set(runtime.String("b"), runtime.Bool(true))
+	ob.Set(runtime.String("a"), runtime.Number(2))
+
+	cases := []struct {
+		set  runtime.Val
+		del  runtime.Val
+		exp  map[runtime.Val]runtime.Val
+		keys string
+	}{
+		0: {
+			exp:  map[runtime.Val]runtime.Val{runtime.String("a"): runtime.Number(2), runtime.Number(0): runtime.String("zero"), runtime.String("b"): runtime.Bool(true)},
+			keys: "0,a,b",
+		},
+		1: {
+			// Removing a field of a record turns it into a dictionary
+			del:  runtime.String("a"),
+			exp:  map[runtime.Val]runtime.Val{runtime.Number(0): runtime.String("zero"), runtime.String("b"): runtime.Bool(true)},
+			keys: "0,b",
+		},
+		2: {
+			set:  runtime.String("c"),
+			exp:  map[runtime.Val]runtime.Val{runtime.Number(0): runtime.String("zero"), runtime.String("b"): runtime.Bool(true), runtime.String("c"): runtime.Number(3)},
+			keys: "0,b,c",
+		},
+		3: {
+			del:  runtime.Number(0),
+			exp:  map[runtime.Val]runtime.Val{runtime.String("b"): runtime.Bool(true), runtime.String("c"): runtime.Number(3)},
+			keys: "b,c",
+		},
+	}
+	for i, c := range cases {
+		if c.set != nil {
+			ob.Set(c.set, runtime.Number(3))
+		}
+		if c.del != nil {
+			ob.Set(c.del, runtime.Nil)
+			if v := ob.Get(c.del); v != runtime.Nil {
+				t.Errorf("[%d] - expected %s to be removed, got %v", i, c.del, v)
+			}
+		}
+		for k, v := range c.exp {
+			if got := ob.Get(k); got != v {
+				t.Errorf("[%d] - expected %s to be %v, got %v", i, k, v, got)
+			}
+		}
+		if l := ob.Len().Int(); l != int64(len(c.exp)) {
+			t.Errorf("[%d] - expected length %d, got %d", i, len(c.exp), l)
+		}
+		keys := ob.Keys().(runtime.Object)
+		var ks []string
+		for j := int64(0); j < keys.Len().Int(); j++ {
+			ks = append(ks, keys.Get(runtime.Number(j)).String())
+		}
+		sort.Strings(ks)
+		if got := strings.Join(ks, ","); got != c.keys {
+			t.Errorf("[%d] - expected keys %s, got %s", i, c.keys, got)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package runtime
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// The rank of each type in the total order of the values, consistent with the
+// standard comparer.
+var typeRank = map[string]int{
+	"nil":    0,
+	"bool":   1,
+	"custom": 2,
+	"func":   3,
+	"number": 4,
+	"object": 5,
+	"string": 6,
+}
+
+// Equal returns true if the values are deeply equal: numbers, strings and
+// booleans are equal if the standard comparer says so (NaN is equal to itself),
+// funcs and custom values if they are the same value, and objects if they have
+// the same keys, whose values are deeply equal, or if their __cmp meta-method
+// returns 0. Cyclic objects are supported. See Ctx.Equal to use the comparer of
+// an execution context.
+func Equal(a, b Val) bool {
+	return newOrderer(defaultComparer{}).equal(a, b)
+}
+
+// Compare returns -1, 0 or 1 if a is lower than, deeply equal to (see Equal) or
+// greater than b, in a total order of all values. Values of different types are
+// ordered by type, in the order nil, bool, custom, func, number, object and
+// string. Numbers, strings and booleans are ordered by the standard comparer,
+// except NaN, which is equal to itself and lower than all other numbers.
+// Objects are ordered by their __cmp meta-method if they have one, otherwise by
+// their keys, then by the values of their keys, in the order of the keys.
+// Funcs and custom values are ordered by identity, which is consistent during
+// the execution of a program, but not across executions. See Ctx.Compare to
+// use the comparer of an execution context.
+func Compare(a, b Val) int {
+	return newOrderer(defaultComparer{}).compare(a, b)
+}
+
+// Equal is like the Equal function, but compares the numbers, strings and
+// booleans with the Comparer of the context, as the `equal` built-in does.
+func (c *Ctx) Equal(a, b Val) bool {
+	return newOrderer(c.Comparer).equal(a, b)
+}
+
+// Compare is like the Compare function, but orders the numbers, strings and
+// booleans with the Comparer of the context, as the `compare` built-in does.
+func (c *Ctx) Compare(a, b Val) int {
+	return newOrderer(c.Comparer).compare(a, b)
+}
+
+// An orderer compares values deeply, with cycle detection. The numbers,
+// strings and booleans are compared with its comparer.
+type orderer struct {
+	cmp  Comparer
+	seen map[[2]Val]bool
+}
+
+func newOrderer(cmp Comparer) *orderer {
+	return &orderer{cmp, make(map[[2]Val]bool)}
+}
+
+// Return true if the values are deeply equal.
+func (o *orderer) equal(a, b Val) bool {
+	if Type(a) != Type(b) {
+		return false
+	}
+	switch Type(a) {
+	case "nil":
+		return true
+	case "object":
+		ao, bo := a.(Object), b.(Object)
+		if sameVal(a, b) {
+			return true
+		}
+		if c, ok := metaCmp(ao, bo); ok {
+			return c == 0
+		}
+		// The pair is assumed equal while its fields are compared
+		if o.visited(a, b) {
+			return true
+		}
+		ak, bk := ao.Keys().(Object), bo.Keys().(Object)
+		l := ak.Len().Int()
+		if l != bk.Len().Int() {
+			return false
+		}
+		for i := int64(0); i < l; i++ {
+			k := ak.Get(Number(i))
+			bv := bo.Get(k)
+			if bv == Nil || !o.equal(ao.Get(k), bv) {
+				return false
+			}
+		}
+		return true
+	case "func", "custom":
+		return sameVal(a, b)
+	case "number":
+		if an, bn := isNaN(a), isNaN(b); an || bn {
+			return an && bn
+		}
+	}
+	return o.cmp.Cmp(a, b) == 0
+}
+
+// Return -1, 0 or 1 if a is lower than, equal to or greater than b.
+func (o *orderer) compare(a, b Val) int {
+	at, bt := Type(a), Type(b)
+	if at != bt {
+		return sign(int64(typeRank[at] - typeRank[bt]))
+	}
+	switch at {
+	case "nil":
+		return 0
+	case "object":
+		ao, bo := a.(Object), b.(Object)
+		if sameVal(a, b) {
+			return 0
+		}
+		if c, ok := metaCmp(ao, bo); ok {
+			return c
+		}
+		if o.visited(a, b) {
+			return 0
+		}
+		ak, bk := o.sortedKeys(ao), o.sortedKeys(bo)
+		for i := 0; i < len(ak) && i < len(bk); i++ {
+			if c := o.compare(ak[i], bk[i]); c != 0 {
+				return c
+			}
+			if c := o.compare(ao.Get(ak[i]), bo.Get(bk[i])); c != 0 {
+				return c
+			}
+		}
+		return sign(int64(len(ak) - len(bk)))
+	case "func", "custom":
+		return identityCmp(a, b)
+	case "number":
+		// The comparers do not order NaN, it is lower than all other numbers
+		if an, bn := isNaN(a), isNaN(b); an || bn {
+			if an && bn {
+				return 0
+			} else if an {
+				return -1
+			}
+			return 1
+		}
+	}
+	return sign(int64(o.cmp.Cmp(a, b)))
+}
+
+// Return true if the value is the NaN number.
+func isNaN(v Val) bool {
+	n, ok := v.(Number)
+	return ok && math.IsNaN(float64(n))
+}
+
+// Return true if the pair of values is being compared, and mark it as such.
+func (o *orderer) visited(a, b Val) bool {
+	if !reflect.TypeOf(a).Comparable() || !reflect.TypeOf(b).Comparable() {
+		return false
+	}
+	k := [2]Val{a, b}
+	if o.seen[k] {
+		return true
+	}
+	o.seen[k] = true
+	return false
+}
+
+// Return the keys of the object, sorted.
+func (o *orderer) sortedKeys(ob Object) []Val {
+	keys := ob.Keys().(Object)
+	vals := make([]Val, keys.Len().Int())
+	for i := range vals {
+		vals[i] = keys.Get(Number(i))
+	}
+	sort.SliceStable(vals, func(i, j int) bool {
+		return o.compare(vals[i], vals[j]) < 0
+	})
+	return vals
+}
+
+// Return the result of the __cmp meta-method of the left object, or of the right
+// object, and true, or false if none has this meta-method.
+func metaCmp(l, r Object) (int, bool) {
+	if v, ok := l.CallMetaMethod("__cmp", r, Bool(true)); ok {
+		return sign(v.Int()), true
+	}
+	if v, ok := r.CallMetaMethod("__cmp", l, Bool(false)); ok {
+		return sign(v.Int()), true
+	}
+	return 0, false
+}
+
+// Return true if both values are the same value.
+func sameVal(a, b Val) bool {
+	ta, tb := reflect.TypeOf(a), reflect.TypeOf(b)
+	if ta != tb {
+		return false
+	}
+	if !ta.Comparable() {
+		return reflect.DeepEqual(a, b)
+	}
+	return a == b
+}
+
+// Return -1, 0 or 1 to order the values by identity: by type, then by address
+// for pointers, or by their Go representation for other values.
+func identityCmp(a, b Val) int {
+	if sameVal(a, b) {
+		return 0
+	}
+	ta, tb := reflect.TypeOf(a).String(), reflect.TypeOf(b).String()
+	if ta != tb {
+		if ta < tb {
+			return -1
+		}
+		return 1
+	}
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.Kind() == reflect.Ptr {
+		if va.Pointer() < vb.Pointer() {
+			return -1
+		}
+		return 1
+	}
+	sa, sb := fmt.Sprintf("%#v", a), fmt.Sprintf("%#v", b)
+	if sa < sb {
+		return -1
+	} else if sa > sb {
+		return 1
+	}
+	return 0
+}
+
+// Return the sign of the integer.
+func sign(i int64) int {
+	if i < 0 {
+		return -1
+	} else if i > 0 {
+		return 1
+	}
+	return 0
+}
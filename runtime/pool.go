@@ -0,0 +1,49 @@
+package runtime
+
+// A Pool is a goroutine-safe pool of execution contexts forked from a snapshot.
+// It keeps up to a number of forked contexts ready to use, so that the cost of
+// forking is not paid when a context is requested.
+//
+// A context is not reused once it has been returned to the pool, since the
+// code it executed may have modified its state. It is discarded and replaced
+// by a new fork.
+type Pool struct {
+	snap *Snapshot
+	ctxs chan *Ctx
+}
+
+// NewPool creates a pool of execution contexts forked from the snapshot, with
+// size contexts forked in advance.
+func NewPool(s *Snapshot, size int) *Pool {
+	p := &Pool{
+		snap: s,
+		ctxs: make(chan *Ctx, size),
+	}
+	for i := 0; i < size; i++ {
+		p.ctxs <- s.Fork()
+	}
+	return p
+}
+
+// Get returns an execution context in the state of the snapshot, either a
+// context forked in advance or a new fork if none is available.
+func (p *Pool) Get() *Ctx {
+	select {
+	case c := <-p.ctxs:
+		return c
+	default:
+		return p.snap.Fork()
+	}
+}
+
+// Put returns a context that is no longer used to the pool. The context is
+// discarded, and replaced by a new fork if the pool is not full.
+func (p *Pool) Put(c *Ctx) {
+	if len(p.ctxs) == cap(p.ctxs) {
+		return
+	}
+	select {
+	case p.ctxs <- p.snap.Fork():
+	default:
+	}
+}
@@ -0,0 +1,256 @@
+package runtime
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// The sample values of the pprof profile, in this order.
+var pprofSampleTypes = [...][2]string{
+	{"instructions", "count"},
+	{"calls", "count"},
+	{"samples", "count"},
+	{"wall", "nanoseconds"},
+}
+
+// A pprofLoc identifies a pprof location, that is a line in a function.
+type pprofLoc struct {
+	fn   *profFunc
+	line int64
+}
+
+// A pprofBuilder builds the pprof representation of a profile.
+type pprofBuilder struct {
+	p       *Profiler
+	strs    []string
+	strIx   map[string]int64
+	fnIds   map[*profFunc]uint64
+	fns     []*profFunc
+	locIds  map[pprofLoc]uint64
+	locs    []pprofLoc
+	samples protobuf
+}
+
+// WritePprof writes the profile to w in the gzip-compressed protocol buffer
+// format used by pprof, so that it can be analyzed with `go tool pprof`.
+// Each sample records the instructions, calls, samples and sampled wall time
+// of a line of code for a given call stack, where recursive calls are folded
+// into the outermost call of the function. Native functions have no line
+// information.
+func (p *Profiler) WritePprof(w io.Writer) error {
+	b := &pprofBuilder{
+		p:      p,
+		strIx:  make(map[string]int64),
+		fnIds:  make(map[*profFunc]uint64),
+		locIds: make(map[pprofLoc]uint64),
+	}
+	b.str("")
+	rate := p.rate
+	if rate <= 0 {
+		rate = DefaultProfileRate
+	}
+
+	// Samples, aggregated by line for each node of the call tree
+	p.walk(func(n *profNode) {
+		stack := b.stack(n)
+		vals := make(map[int64][]int64)
+		var order []int64
+		add := func(l int64, ix int, v int64) {
+			vs, ok := vals[l]
+			if !ok {
+				vs = make([]int64, len(pprofSampleTypes))
+				vals[l] = vs
+				order = append(order, l)
+			}
+			vs[ix] += v
+		}
+		start := int64(0)
+		if n.fn.def != nil {
+			start = n.fn.def.lineStart
+		}
+		add(start, 1, n.calls)
+		for pc, s := range n.samples {
+			l := start
+			if n.fn.def != nil {
+				l = n.fn.def.line(pc)
+			}
+			if n.instrs != nil && n.instrs[pc] != 0 {
+				add(l, 0, n.instrs[pc])
+			}
+			if s != 0 {
+				add(l, 2, s)
+				add(l, 3, s*int64(rate))
+			}
+		}
+		for _, l := range order {
+			locs := append([]uint64{b.loc(n.fn, l)}, stack...)
+			vs := vals[l]
+			b.samples.msg(2, func(pb *protobuf) {
+				pb.uint64s(1, locs)
+				pb.int64s(2, vs)
+			})
+		}
+	})
+
+	var pb protobuf
+	for _, st := range pprofSampleTypes {
+		b.valueType(&pb, 1, st[0], st[1])
+	}
+	pb.buf = append(pb.buf, b.samples.buf...)
+	for i, l := range b.locs {
+		line := l.line
+		fnId := b.fnIds[l.fn]
+		pb.msg(4, func(lb *protobuf) {
+			lb.uint64(1, uint64(i+1))
+			lb.msg(4, func(ln *protobuf) {
+				ln.uint64(1, fnId)
+				ln.int64(2, line)
+			})
+		})
+	}
+	for i, pf := range b.fns {
+		name := b.str(pf.name)
+		var file, start int64
+		if pf.def != nil {
+			file = b.str(pf.def.mod.id)
+			start = pf.def.lineStart
+		}
+		pb.msg(5, func(fb *protobuf) {
+			fb.uint64(1, uint64(i+1))
+			fb.int64(2, name)
+			fb.int64(3, name)
+			fb.int64(4, file)
+			fb.int64(5, start)
+		})
+	}
+	// The period is the sampling interval, strings must be known before the table is written
+	pt, pu := b.str("wall"), b.str("nanoseconds")
+	for _, s := range b.strs {
+		pb.string(6, s)
+	}
+	pb.int64(9, p.begin.UnixNano())
+	pb.int64(10, int64(p.dur))
+	pb.msg(11, func(vb *protobuf) {
+		vb.int64(1, pt)
+		vb.int64(2, pu)
+	})
+	pb.int64(12, int64(rate))
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(pb.buf); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Get the index of s in the string table, adding it if needed.
+func (b *pprofBuilder) str(s string) int64 {
+	if ix, ok := b.strIx[s]; ok {
+		return ix
+	}
+	ix := int64(len(b.strs))
+	b.strs = append(b.strs, s)
+	b.strIx[s] = ix
+	return ix
+}
+
+// Get the id of the location of line l in function pf, adding it if needed.
+func (b *pprofBuilder) loc(pf *profFunc, l int64) uint64 {
+	if _, ok := b.fnIds[pf]; !ok {
+		b.fns = append(b.fns, pf)
+		b.fnIds[pf] = uint64(len(b.fns))
+	}
+	k := pprofLoc{pf, l}
+	if id, ok := b.locIds[k]; ok {
+		return id
+	}
+	b.locs = append(b.locs, k)
+	id := uint64(len(b.locs))
+	b.locIds[k] = id
+	return id
+}
+
+// Get the location ids of the callers of node n, innermost first. The location
+// of a caller is the line of its call instruction.
+func (b *pprofBuilder) stack(n *profNode) []uint64 {
+	var ids []uint64
+	for c := n; c.parent != nil && c.parent != b.p.root; c = c.parent {
+		pn := c.parent
+		l := int64(0)
+		if pn.fn.def != nil {
+			l = pn.fn.def.line(c.callPC)
+		}
+		ids = append(ids, b.loc(pn.fn, l))
+	}
+	return ids
+}
+
+func (b *pprofBuilder) valueType(pb *protobuf, field int, typ, unit string) {
+	t, u := b.str(typ), b.str(unit)
+	pb.msg(field, func(vb *protobuf) {
+		vb.int64(1, t)
+		vb.int64(2, u)
+	})
+}
+
+// A protobuf is a minimal protocol buffer encoder, sufficient to write
+// the pprof format.
+type protobuf struct {
+	buf []byte
+}
+
+func (pb *protobuf) varint(x uint64) {
+	for x >= 0x80 {
+		pb.buf = append(pb.buf, byte(x)|0x80)
+		x >>= 7
+	}
+	pb.buf = append(pb.buf, byte(x))
+}
+
+func (pb *protobuf) key(field, wire int) {
+	pb.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (pb *protobuf) uint64(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	pb.key(field, 0)
+	pb.varint(x)
+}
+
+func (pb *protobuf) int64(field int, x int64) {
+	pb.uint64(field, uint64(x))
+}
+
+func (pb *protobuf) uint64s(field int, xs []uint64) {
+	var sub protobuf
+	for _, x := range xs {
+		sub.varint(x)
+	}
+	pb.bytes(field, sub.buf)
+}
+
+func (pb *protobuf) int64s(field int, xs []int64) {
+	var sub protobuf
+	for _, x := range xs {
+		sub.varint(uint64(x))
+	}
+	pb.bytes(field, sub.buf)
+}
+
+func (pb *protobuf) string(field int, s string) {
+	pb.bytes(field, []byte(s))
+}
+
+func (pb *protobuf) bytes(field int, b []byte) {
+	pb.key(field, 2)
+	pb.varint(uint64(len(b)))
+	pb.buf = append(pb.buf, b...)
+}
+
+func (pb *protobuf) msg(field int, fn func(*protobuf)) {
+	var sub protobuf
+	fn(&sub)
+	pb.bytes(field, sub.buf)
+}
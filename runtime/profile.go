@@ -0,0 +1,368 @@
+package runtime
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultProfileRate is the default sampling interval of a Profiler.
+const DefaultProfileRate = time.Millisecond
+
+// A Profiler records the execution profile of the code run by an execution
+// context. It counts the calls of every function, agora or native, and the
+// instructions executed on each line, and measures the wall time spent in each
+// function. It also samples the currently executing line at a regular interval,
+// to estimate how the wall time is spread over the lines of code.
+//
+// To profile an execution context, set its Profiler field and call Start before
+// running the code, and Stop when done. The results should only be read once
+// the Profiler is stopped.
+type Profiler struct {
+	Rate time.Duration // The sampling interval, DefaultProfileRate if <= 0
+
+	root    *profNode
+	funcs   map[interface{}]*profFunc
+	order   []*profFunc
+	pending int64 // samples waiting to be attributed, updated atomically
+	rate    time.Duration
+	begin   time.Time
+	dur     time.Duration
+	running bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// A profFunc holds the function-level profile of a single function.
+type profFunc struct {
+	def   *agoraFuncDef // nil for native functions
+	name  string
+	calls int64
+	wall  time.Duration
+	depth int // number of active calls, so that recursion is only timed once
+	start time.Time
+}
+
+// A profKey identifies a callee in the call tree, by its function and the
+// instruction that called it.
+type profKey struct {
+	fn *profFunc
+	pc int
+}
+
+// A profNode is a node in the call tree. It holds the per-instruction counts
+// of a function when called from a specific call path. Recursive calls are
+// folded into the node of the outermost call of the function on the path.
+type profNode struct {
+	fn      *profFunc
+	parent  *profNode
+	callPC  int // pc of the call instruction in the parent, -1 if unknown
+	kids    map[profKey]*profNode
+	calls   int64
+	instrs  []int64 // executed instructions by pc, nil for native functions
+	samples []int64 // samples by pc, a single slot for native functions
+}
+
+// FuncStats holds the profiling statistics of a single function.
+type FuncStats struct {
+	Name    string        // The name of the function
+	File    string        // The module identifier, empty for native functions
+	Line    int64         // The starting line of the function, 0 if unknown
+	Native  bool          // Indicates if this is a native function
+	Calls   int64         // The number of calls
+	Instrs  int64         // The number of instructions executed
+	Samples int64         // The number of samples taken while in the function itself
+	Wall    time.Duration // The wall time spent in the function, callees included
+	Lines   []*LineStats  // The per-line statistics, sorted by line
+}
+
+// LineStats holds the profiling statistics of a single line of code.
+type LineStats struct {
+	Line    int64 // The line number
+	Instrs  int64 // The number of instructions executed
+	Samples int64 // The number of samples taken while on this line
+}
+
+// NewProfiler returns a new profiler using the default sampling rate.
+func NewProfiler() *Profiler {
+	p := &Profiler{
+		Rate: DefaultProfileRate,
+	}
+	p.reset()
+	return p
+}
+
+func (p *Profiler) reset() {
+	p.root = &profNode{callPC: -1, kids: make(map[profKey]*profNode)}
+	p.funcs = make(map[interface{}]*profFunc)
+	p.order = nil
+	p.dur = 0
+}
+
+// Start starts recording the profile. Starting an already running profiler
+// is a no-op, and starting a stopped profiler accumulates to its previous
+// results.
+func (p *Profiler) Start() {
+	if p.running {
+		return
+	}
+	if p.root == nil {
+		p.reset()
+	}
+	p.rate = p.Rate
+	if p.rate <= 0 {
+		p.rate = DefaultProfileRate
+	}
+	atomic.StoreInt64(&p.pending, 0)
+	p.begin = time.Now()
+	p.running = true
+	p.done = make(chan struct{})
+	p.wg.Add(1)
+	go p.tick(p.rate, p.done)
+}
+
+// Stop stops recording the profile.
+func (p *Profiler) Stop() {
+	if !p.running {
+		return
+	}
+	close(p.done)
+	p.wg.Wait()
+	p.running = false
+	p.dur += time.Since(p.begin)
+}
+
+// The sampling goroutine. It only signals that a sample is due, the sample is
+// taken by the execution context's goroutine.
+func (p *Profiler) tick(rate time.Duration, done <-chan struct{}) {
+	defer p.wg.Done()
+	t := time.NewTicker(rate)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			atomic.AddInt64(&p.pending, 1)
+		case <-done:
+			return
+		}
+	}
+}
+
+// Get the function profile of the specified function, creating it if needed.
+func (p *Profiler) funcOf(f Func) *profFunc {
+	var key interface{}
+	var def *agoraFuncDef
+	var name string
+	switch v := f.(type) {
+	case *agoraFuncVal:
+		key, def, name = v.proto, v.proto, v.proto.name
+		if name == "" {
+			name = "(anonymous)"
+		}
+	case *NativeFunc:
+		key, name = v.name, v.name
+	default:
+		name = Type(f)
+		key = name
+	}
+	pf, ok := p.funcs[key]
+	if !ok {
+		pf = &profFunc{def: def, name: name}
+		p.funcs[key] = pf
+		p.order = append(p.order, pf)
+	}
+	return pf
+}
+
+// Record the call of f by the caller frame. It returns the call tree node of
+// the call, or nil if the profiler is not running.
+func (p *Profiler) push(caller *frame, f Func) *profNode {
+	if !p.running {
+		return nil
+	}
+	parent, pc := p.root, -1
+	if caller != nil && caller.pn != nil {
+		parent = caller.pn
+		if caller.fvm != nil {
+			pc = caller.fvm.pc - 1
+		}
+	}
+	// Samples taken so far belong to the caller
+	p.sample(caller)
+
+	pf := p.funcOf(f)
+	n := parent.recursive(pf)
+	if n == nil {
+		n = parent.kids[profKey{pf, pc}]
+	}
+	if n == nil {
+		n = &profNode{
+			fn:     pf,
+			parent: parent,
+			callPC: pc,
+			kids:   make(map[profKey]*profNode),
+		}
+		if pf.def != nil {
+			n.instrs = make([]int64, len(pf.def.code))
+			n.samples = make([]int64, len(pf.def.code))
+		} else {
+			n.samples = make([]int64, 1)
+		}
+		parent.kids[profKey{pf, pc}] = n
+	}
+	n.calls++
+	pf.calls++
+	if pf.depth == 0 {
+		pf.start = time.Now()
+	}
+	pf.depth++
+	return n
+}
+
+// Return the node of pf on the call path ending at n, or nil if pf is not on
+// that path. A recursive call reuses this node, so that a path holds at most
+// one node per function and the call tree only grows with the distinct acyclic
+// call paths, not with the depth of the recursion.
+func (n *profNode) recursive(pf *profFunc) *profNode {
+	for ; n != nil; n = n.parent {
+		if n.fn == pf {
+			return n
+		}
+	}
+	return nil
+}
+
+// Record the return of the function executing in frm.
+func (p *Profiler) pop(frm *frame) {
+	if frm.pn == nil {
+		return
+	}
+	p.sample(frm)
+	pf := frm.pn.fn
+	pf.depth--
+	if pf.depth == 0 {
+		pf.wall += time.Since(pf.start)
+	}
+}
+
+// Record the execution of the instruction at pc. This is called by the VM
+// for each instruction.
+func (p *Profiler) instr(n *profNode, pc int) {
+	n.instrs[pc]++
+	if atomic.LoadInt64(&p.pending) != 0 {
+		n.samples[pc] += atomic.SwapInt64(&p.pending, 0)
+	}
+}
+
+// Attribute the pending samples to the current instruction of frm. If no
+// frame is executing, the samples are discarded.
+func (p *Profiler) sample(frm *frame) {
+	if atomic.LoadInt64(&p.pending) == 0 {
+		return
+	}
+	s := atomic.SwapInt64(&p.pending, 0)
+	if frm == nil || frm.pn == nil {
+		return
+	}
+	pc := 0
+	if frm.fvm != nil && frm.fvm.pc > 0 {
+		pc = frm.fvm.pc - 1
+	}
+	if pc < len(frm.pn.samples) {
+		frm.pn.samples[pc] += s
+	}
+}
+
+// Walk the call tree depth-first, calling fn for each node except the root.
+func (p *Profiler) walk(fn func(*profNode)) {
+	var visit func(*profNode)
+	visit = func(n *profNode) {
+		if n != p.root {
+			fn(n)
+		}
+		for _, k := range n.sortedKids() {
+			visit(k)
+		}
+	}
+	if p.root != nil {
+		visit(p.root)
+	}
+}
+
+// Return the children of the node in a deterministic order.
+func (n *profNode) sortedKids() []*profNode {
+	kids := make([]*profNode, 0, len(n.kids))
+	for _, k := range n.kids {
+		kids = append(kids, k)
+	}
+	sort.Sort(nodesByName(kids))
+	return kids
+}
+
+type nodesByName []*profNode
+
+func (s nodesByName) Len() int      { return len(s) }
+func (s nodesByName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s nodesByName) Less(i, j int) bool {
+	if s[i].fn.name != s[j].fn.name {
+		return s[i].fn.name < s[j].fn.name
+	}
+	return s[i].callPC < s[j].callPC
+}
+
+// Stats returns the statistics of all functions called while the profiler was
+// running, in order of first call.
+func (p *Profiler) Stats() []*FuncStats {
+	stats := make([]*FuncStats, len(p.order))
+	byFn := make(map[*profFunc]*FuncStats, len(p.order))
+	lines := make(map[*profFunc]map[int64]*LineStats, len(p.order))
+	for i, pf := range p.order {
+		st := &FuncStats{
+			Name:   pf.name,
+			Native: pf.def == nil,
+			Calls:  pf.calls,
+			Wall:   pf.wall,
+		}
+		if pf.def != nil {
+			st.File = pf.def.mod.id
+			st.Line = pf.def.lineStart
+		}
+		stats[i] = st
+		byFn[pf] = st
+		lines[pf] = make(map[int64]*LineStats)
+	}
+	p.walk(func(n *profNode) {
+		st := byFn[n.fn]
+		for pc, s := range n.samples {
+			st.Samples += s
+			if n.instrs != nil {
+				st.Instrs += n.instrs[pc]
+			}
+			if n.fn.def == nil {
+				continue
+			}
+			l := n.fn.def.line(pc)
+			ls, ok := lines[n.fn][l]
+			if !ok {
+				ls = &LineStats{Line: l}
+				lines[n.fn][l] = ls
+			}
+			ls.Instrs += n.instrs[pc]
+			ls.Samples += s
+		}
+	})
+	for pf, st := range byFn {
+		for _, ls := range lines[pf] {
+			st.Lines = append(st.Lines, ls)
+		}
+		sort.Sort(linesByNum(st.Lines))
+	}
+	return stats
+}
+
+type linesByNum []*LineStats
+
+func (s linesByNum) Len() int           { return len(s) }
+func (s linesByNum) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s linesByNum) Less(i, j int) bool { return s[i].Line < s[j].Line }
@@ -0,0 +1,162 @@
+package runtime_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/agora/compiler"
+	"github.com/PuerkitoBio/agora/runtime"
+)
+
+type srcResolver map[string]string
+
+func (s srcResolver) Resolve(id string) (io.Reader, error) {
+	if src, ok := s[id]; ok {
+		return strings.NewReader(src), nil
+	}
+	return nil, runtime.NewModuleNotFoundError(id)
+}
+
+const profileSrc = `func add(a, b) {
+	return a + b
+}
+s := 0
+for i := 0; i < 3; i++ {
+	s = add(s, len("ab"))
+}
+return s
+`
+
+func runProfiled(t *testing.T) *runtime.Profiler {
+	ctx := runtime.NewCtx(srcResolver{"prof": profileSrc}, new(compiler.Compiler))
+	ctx.Profiler = runtime.NewProfiler()
+	m, err := ctx.Load("prof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Profiler.Start()
+	v, err := m.Run()
+	ctx.Profiler.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Int() != 6 {
+		t.Errorf("expected result 6, got %s", v)
+	}
+	return ctx.Profiler
+}
+
+func TestProfilerStats(t *testing.T) {
+	p := runProfiled(t)
+	stats := make(map[string]*runtime.FuncStats)
+	for _, st := range p.Stats() {
+		stats[st.Name] = st
+	}
+	cases := []struct {
+		name   string
+		file   string
+		line   int64
+		native bool
+		calls  int64
+		lines  []int64
+	}{
+		0: {name: "prof", file: "prof", calls: 1, line: 1, lines: []int64{1, 4, 5, 6, 8}},
+		1: {name: "add", file: "prof", calls: 3, line: 1, lines: []int64{2}},
+		2: {name: "len", native: true, calls: 3},
+	}
+	for i, c := range cases {
+		st, ok := stats[c.name]
+		if !ok {
+			t.Errorf("[%d] - expected stats for %s", i, c.name)
+			continue
+		}
+		if st.File != c.file || st.Line != c.line || st.Native != c.native {
+			t.Errorf("[%d] - expected %s:%d (native: %v), got %s:%d (native: %v)", i, c.file, c.line, c.native, st.File, st.Line, st.Native)
+		}
+		if st.Calls != c.calls {
+			t.Errorf("[%d] - expected %d calls, got %d", i, c.calls, st.Calls)
+		}
+		if c.native && st.Instrs != 0 {
+			t.Errorf("[%d] - expected no instructions for a native function, got %d", i, st.Instrs)
+		}
+		if !c.native && st.Instrs == 0 {
+			t.Errorf("[%d] - expected instructions to be counted", i)
+		}
+		var got []int64
+		var sum int64
+		for _, ls := range st.Lines {
+			got = append(got, ls.Line)
+			sum += ls.Instrs
+		}
+		if fmt.Sprint(got) != fmt.Sprint(c.lines) {
+			t.Errorf("[%d] - expected lines %v, got %v", i, c.lines, got)
+		}
+		if sum != st.Instrs {
+			t.Errorf("[%d] - expected lines to sum up to %d instructions, got %d", i, st.Instrs, sum)
+		}
+	}
+}
+
+func TestProfilerPprof(t *testing.T) {
+	p := runProfiled(t)
+	buf := bytes.NewBuffer(nil)
+	if err := p.WritePprof(buf); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Read the top-level fields of the protocol buffer message
+	counts := make(map[uint64]int)
+	strs := make(map[string]bool)
+	for len(b) > 0 {
+		key, n := uvarint(b)
+		b = b[n:]
+		switch key & 7 {
+		case 0:
+			_, n = uvarint(b)
+			b = b[n:]
+		case 2:
+			l, n := uvarint(b)
+			if key>>3 == 6 {
+				strs[string(b[n:n+int(l)])] = true
+			}
+			b = b[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		counts[key>>3]++
+	}
+	// sample types, samples, locations, functions
+	for _, f := range []uint64{1, 2, 4, 5} {
+		if counts[f] == 0 {
+			t.Errorf("expected field %d to be present", f)
+		}
+	}
+	for _, s := range []string{"instructions", "calls", "wall", "nanoseconds", "prof", "add", "len"} {
+		if !strs[s] {
+			t.Errorf("expected string table to contain %q", s)
+		}
+	}
+}
+
+func uvarint(b []byte) (uint64, int) {
+	var x uint64
+	for i, c := range b {
+		x |= uint64(c&0x7f) << (7 * uint(i))
+		if c < 0x80 {
+			return x, i + 1
+		}
+	}
+	return 0, len(b)
+}
@@ -0,0 +1,72 @@
+package runtime
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/agora/compiler"
+)
+
+type treeResolver string
+
+func (r treeResolver) Resolve(id string) (io.Reader, error) {
+	return strings.NewReader(string(r)), nil
+}
+
+func TestProfilerRecursion(t *testing.T) {
+	const src = `func fib(n) {
+	if n < 2 {
+		return n
+	}
+	return fib(n-1) + fib(n-2)
+}
+o := {}
+func even(n) {
+	if n == 0 {
+		return 1
+	}
+	return o.odd(n-1)
+}
+func odd(n) {
+	if n == 0 {
+		return 0
+	}
+	return o.even(n-1)
+}
+o.even = even
+o.odd = odd
+return fib(18) + even(200)
+`
+	ctx := NewCtx(treeResolver(src), new(compiler.Compiler))
+	ctx.Profiler = NewProfiler()
+	m, err := ctx.Load("rec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Profiler.Start()
+	v, err := m.Run()
+	ctx.Profiler.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Int() != 2585 {
+		t.Errorf("expected result 2585, got %s", v)
+	}
+
+	// rec, fib, even, odd (from even) and even (from odd, folded)
+	nodes, calls := 0, make(map[string]int64)
+	ctx.Profiler.walk(func(n *profNode) {
+		nodes++
+		calls[n.fn.name] += n.calls
+	})
+	if nodes > 4 {
+		t.Errorf("expected at most 4 nodes, got %d", nodes)
+	}
+	exp := map[string]int64{"rec": 1, "fib": 8361, "even": 101, "odd": 100}
+	for nm, c := range exp {
+		if calls[nm] != c {
+			t.Errorf("expected %d calls of %s, got %d", c, nm, calls[nm])
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package runtime
+
+import (
+	"strings"
+)
+
+// A rangeIter is the state of a `for range` loop, held in the range stack of
+// the VM. It returns the values of the loop one at a time, and false once the
+// loop is over.
+type rangeIter interface {
+	next() (Val, bool)
+}
+
+// Create the iterator of a `for range` loop over the specified arguments, the
+// first one being the value to range over.
+func newRangeIter(args []Val) rangeIter {
+	l := len(args)
+	switch t := Type(args[0]); t {
+	case "number":
+		it := &numberRange{max: args[0].Int(), inc: 1}
+		if l > 1 {
+			it.i = it.max
+			it.max = args[1].Int()
+		}
+		if l > 2 {
+			it.inc = args[2].Int()
+		}
+		return it
+
+	case "string":
+		it := &stringRange{src: args[0].String(), max: -1}
+		if l > 1 && args[1].Bool() {
+			it.sep = args[1].String()
+		}
+		if l > 2 {
+			it.max = args[2].Int()
+		}
+		return it
+
+	case "object":
+		ob := args[0].(Object)
+		return &objectRange{ob: ob, keys: ob.Keys().(Object)}
+
+	case "func":
+		if fn, ok := args[0].(*agoraFuncVal); ok {
+			fn.reset()
+			return &funcRange{fn: fn, args: args[1:]}
+		}
+		panic(NewTypeError("native func", "", "range"))
+
+	default:
+		panic(NewTypeError(t, "", "range"))
+	}
+}
+
+// A numberRange loops from i up to, but not including, max, or down to max if
+// the increment is negative.
+type numberRange struct {
+	i, max, inc int64
+}
+
+func (r *numberRange) next() (Val, bool) {
+	if (r.inc >= 0 && r.i >= r.max) || (r.inc < 0 && r.i <= r.max) {
+		return nil, false
+	}
+	v := Number(r.i)
+	r.i += r.inc
+	return v, true
+}
+
+// A stringRange loops over each byte of the string, or over each part delimited
+// by the separator, up to a maximum of max values if it is not negative.
+type stringRange struct {
+	src  string
+	sep  string
+	max  int64
+	cnt  int64
+	done bool
+}
+
+func (r *stringRange) next() (Val, bool) {
+	if r.done || (r.max >= 0 && r.cnt >= r.max) {
+		return nil, false
+	}
+	if r.sep == "" {
+		if r.cnt >= int64(len(r.src)) {
+			return nil, false
+		}
+		r.cnt++
+		return String(r.src[r.cnt-1]), true
+	}
+	splits := strings.SplitN(r.src, r.sep, 2)
+	r.cnt++
+	if len(splits) == 1 {
+		r.done = true
+	} else {
+		r.src = splits[1]
+	}
+	return String(splits[0]), true
+}
+
+// An objectRange loops over the keys of the object, as returned when the loop
+// started, and returns an object with the key and the current value, as fields
+// "k" and "v".
+type objectRange struct {
+	ob   Object
+	keys Object
+	i    int64
+}
+
+func (r *objectRange) next() (Val, bool) {
+	if r.i >= r.keys.Len().Int() {
+		return nil, false
+	}
+	key := r.keys.Get(Number(r.i))
+	r.i++
+	val := NewObject()
+	val.Set(String("k"), key)
+	val.Set(String("v"), r.ob.Get(key))
+	return val, true
+}
+
+// A funcRange loops over the values yielded by the coroutine, called with the
+// arguments on the first iteration. The loop is over once the function returns,
+// its return value is ignored.
+type funcRange struct {
+	fn      *agoraFuncVal
+	args    []Val
+	started bool
+	done    bool
+}
+
+func (r *funcRange) next() (Val, bool) {
+	if r.done {
+		return nil, false
+	}
+	var v Val
+	if r.started {
+		v = r.fn.Call(Nil)
+	} else {
+		r.started = true
+		v = r.fn.Call(Nil, r.args...)
+	}
+	if r.fn.status() != "suspended" {
+		r.done = true
+		return nil, false
+	}
+	return v, true
+}
@@ -0,0 +1,177 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+var (
+	// Error returned when reloading a module while the context is executing code.
+	ErrReloadRunning = errors.New("cannot reload a module while the execution context is running")
+
+	// Error returned when reloading a native module.
+	ErrReloadNative = errors.New("cannot reload a native module")
+)
+
+// Reload recompiles the agora module identified by id, replaces it in the loaded
+// modules, and runs it. The modules that imported it, directly or not, are then
+// reloaded and run again too, so that they use the new value of the module
+// instead of the old one. Their state is lost, and the values that were
+// returned by the old modules are not updated: a host that holds them must get
+// them again, e.g. via Load and Run, or Call.
+//
+// The modules are run without arguments. If the module cannot be compiled or
+// fails to run, the old modules are restored and the error is returned.
+//
+// Reload cannot be called while the context is executing code. The module must
+// have been loaded.
+func (c *Ctx) Reload(id string) (err error) {
+	if c.frmsp > 0 || len(c.loadingMods) > 0 {
+		return ErrReloadRunning
+	}
+	if _, ok := c.loadedMods[id].(NativeModule); ok {
+		return ErrReloadNative
+	}
+	id, err = c.canonical(id, "")
+	if err != nil {
+		return err
+	}
+	if _, ok := c.loadedMods[id]; !ok {
+		return NewModuleNotFoundError(id)
+	}
+	ids := c.dependents(id)
+	old := make(map[string]Module, len(ids))
+	for _, id := range ids {
+		old[id] = c.loadedMods[id]
+		delete(c.loadedMods, id)
+	}
+	defer func() {
+		if err != nil {
+			for id, m := range old {
+				c.loadedMods[id] = m
+			}
+		}
+	}()
+	for _, id := range ids {
+		m, err := c.load(id, "")
+		if err != nil {
+			return err
+		}
+		// A dependent may have been run already by the import of another one
+		if _, err = m.Run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the module identified by the canonical id, followed by the modules that
+// imported it, directly or not, breadth-first.
+func (c *Ctx) dependents(id string) []string {
+	ids := []string{id}
+	seen := map[string]bool{id: true}
+	for i := 0; i < len(ids); i++ {
+		imps := make([]string, 0, len(c.importers[ids[i]]))
+		for imp := range c.importers[ids[i]] {
+			if _, ok := c.loadedMods[imp]; ok && !seen[imp] {
+				imps = append(imps, imp)
+			}
+		}
+		sort.Strings(imps)
+		for _, imp := range imps {
+			seen[imp] = true
+			ids = append(ids, imp)
+		}
+	}
+	return ids
+}
+
+// Record that the module identified by the canonical id was imported by the
+// module from.
+func (c *Ctx) addImporter(id, from string) {
+	m := c.importers[id]
+	if m == nil {
+		m = make(map[string]bool)
+		c.importers[id] = m
+	}
+	m[from] = true
+}
+
+// Changed returns the canonical identifiers of the agora modules whose source
+// changed since they were last loaded (including the ones that failed to compile),
+// sorted. The versions of the sources (modification time and size of a file, or
+// hash of the content) are recorded only if Watch is set when the modules are
+// loaded.
+func (c *Ctx) Changed() ([]string, error) {
+	var ids []string
+	for id, ver := range c.versions {
+		r, err := c.Resolver.Resolve(id)
+		if err != nil {
+			if _, ok := err.(ModuleNotFoundError); ok || isNotFound(err) {
+				// Removed, keep the loaded module
+				continue
+			}
+			return nil, err
+		}
+		_, nver, _, err := sourceVersion(id, r, false)
+		if rc, ok := r.(io.Closer); ok {
+			rc.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if nver != ver {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// ReloadChanged reloads the loaded agora modules whose source changed since they
+// were loaded (see Changed and Reload), and returns the identifiers of the
+// changed modules. It stops
+// at the first module that fails to reload, and returns the error. This module
+// is not reloaded again until its source changes again.
+func (c *Ctx) ReloadChanged() ([]string, error) {
+	ids, err := c.Changed()
+	if err != nil {
+		return nil, err
+	}
+	reloaded := make(map[string]bool, len(ids))
+	for i, id := range ids {
+		// Already reloaded as a dependent of a previous module, or not loaded (it
+		// failed to compile, it will be loaded again when imported)
+		if _, ok := c.loadedMods[id]; reloaded[id] || !ok {
+			continue
+		}
+		// On failure, the version of the new source has been recorded by the load,
+		// so that it is not retried until it changes again.
+		if err := c.Reload(id); err != nil {
+			return ids[:i], err
+		}
+		for _, dep := range c.dependents(id) {
+			reloaded[dep] = true
+		}
+	}
+	return ids, nil
+}
+
+// In watch mode, reload the changed modules if the interval has elapsed since
+// the last check. Errors are reported on Stderr, the old modules are kept.
+func (c *Ctx) checkChanges() {
+	if c.Watch <= 0 || c.frmsp > 0 || len(c.loadingMods) > 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(c.lastCheck) < c.Watch {
+		return
+	}
+	c.lastCheck = now
+	if _, err := c.ReloadChanged(); err != nil {
+		fmt.Fprintf(c.Stderr, "reload: %s\n", err)
+	}
+}
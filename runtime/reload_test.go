@@ -0,0 +1,114 @@
+package runtime_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/agora/compiler"
+	"github.com/PuerkitoBio/agora/runtime"
+)
+
+func reloadSrcs() srcResolver {
+	return srcResolver{
+		"lib": `return {v: 1}`,
+		"main": `lib := import("lib")
+		x := {}
+		x.Get = func() {
+			return lib.v
+		}
+		return x
+		`,
+		"other": `x := {n: 0}
+		x.Incr = func() {
+			this.n++
+			return this.n
+		}
+		return x
+		`,
+	}
+}
+
+func TestReload(t *testing.T) {
+	res := reloadSrcs()
+	ctx := runtime.NewCtx(res, new(compiler.Compiler))
+	ctx.RegisterNativeModule(new(sbMod))
+	call := func(id, fn string) interface{} {
+		v, err := ctx.Call(id, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	call("main", "Get")
+	call("other", "Incr")
+
+	cases := []struct {
+		id  string
+		lib string
+		err bool
+		exp float64
+	}{
+		0: {id: "lib", lib: `return {v: 2}`, exp: 2},
+		1: {id: "lib", lib: `return missing()`, err: true, exp: 2},
+		2: {id: "lib", lib: `return {v: 3}`, exp: 3},
+		3: {id: "main", lib: `return {v: 4}`, exp: 3}, // lib is not a dependent of main
+		4: {id: "unknown", err: true, exp: 3},
+	}
+	for i, c := range cases {
+		if c.lib != "" {
+			res["lib"] = c.lib
+		}
+		err := ctx.Reload(c.id)
+		if (err != nil) != c.err {
+			t.Errorf("[%d] - expected error %t, got %v", i, c.err, err)
+		}
+		if v := call("main", "Get"); v != c.exp {
+			t.Errorf("[%d] - expected %v, got %v", i, c.exp, v)
+		}
+	}
+	// Modules that do not depend on the reloaded module keep their state
+	if v := call("other", "Incr"); v != 2.0 {
+		t.Errorf("expected 2, got %v", v)
+	}
+	if err := ctx.Reload("sb"); err != runtime.ErrReloadNative {
+		t.Errorf("expected %v, got %v", runtime.ErrReloadNative, err)
+	}
+}
+
+func TestReloadWatch(t *testing.T) {
+	res := reloadSrcs()
+	ctx := runtime.NewCtx(res, new(compiler.Compiler))
+	buf := new(bytes.Buffer)
+	ctx.Stderr = buf
+	ctx.Watch = time.Nanosecond
+	if v, err := ctx.Call("main", "Get"); err != nil || v != 1.0 {
+		t.Fatalf("expected 1, got %v (%v)", v, err)
+	}
+	if ids, err := ctx.Changed(); err != nil || len(ids) != 0 {
+		t.Errorf("expected no changed module, got %v (%v)", ids, err)
+	}
+
+	res["lib"] = `return {v: 2}`
+	if ids, err := ctx.Changed(); err != nil || len(ids) != 1 || ids[0] != "lib" {
+		t.Errorf("expected lib to be changed, got %v (%v)", ids, err)
+	}
+	time.Sleep(time.Millisecond)
+	if v, err := ctx.Call("main", "Get"); err != nil || v != 2.0 {
+		t.Errorf("expected 2, got %v (%v)", v, err)
+	}
+
+	// On error, the old module is kept and the error is reported
+	res["lib"] = `return missing()`
+	time.Sleep(time.Millisecond)
+	if v, err := ctx.Call("main", "Get"); err != nil || v != 2.0 {
+		t.Errorf("expected 2, got %v (%v)", v, err)
+	}
+	if !strings.HasPrefix(buf.String(), "reload: ") {
+		t.Errorf("expected a reload error, got %q", buf.String())
+	}
+	if ids, err := ctx.Changed(); err != nil || len(ids) != 0 {
+		t.Errorf("expected no changed module, got %v (%v)", ids, err)
+	}
+}
@@ -0,0 +1,494 @@
+package runtime
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/PuerkitoBio/agora/bytecode"
+)
+
+// A ModuleResolver interface represents the required behaviour for the component
+// responsible for matching a module identifier to actual source code.
+// Various implementations can be provided, for example by loading modules
+// in a database, over http, compressed, secured and signed, etc.
+type ModuleResolver interface {
+	Resolve(string) (io.Reader, error)
+}
+
+// An ImportResolver is a ModuleResolver that resolves the module identifiers
+// relative to the importing module, and maps them to canonical identifiers, so
+// that a module is loaded only once even if it is imported using different
+// identifiers (e.g. "lib/util" and "./lib/util.agora").
+//
+// The execution context calls Canonical with the identifier of the module to
+// load and the canonical identifier of the importing module (empty if the module
+// is not imported by an agora module), and caches the module using the returned
+// canonical identifier, which is passed to Resolve.
+//
+// If the resolver is not an ImportResolver, the identifiers starting with "./"
+// or "../" are joined to the directory of the importing module's identifier, and
+// the result is the canonical identifier.
+type ImportResolver interface {
+	ModuleResolver
+	Canonical(id, from string) (string, error)
+}
+
+// IsRelative returns true if the module identifier is relative to the importing
+// module, i.e. if it starts with "./" or "../".
+func IsRelative(id string) bool {
+	id = filepath.ToSlash(id)
+	return strings.HasPrefix(id, "./") || strings.HasPrefix(id, "../")
+}
+
+// Return the module identifier joined to the directory of the importing module
+// if it is relative, using the slash-separated path rules.
+func relativeID(id, from string) string {
+	if from != "" && IsRelative(id) {
+		return path.Join(path.Dir(filepath.ToSlash(from)), filepath.ToSlash(id))
+	}
+	return id
+}
+
+// A FormatReader is an io.Reader that reports the format of the module's content,
+// as a file extension (e.g. ".agora"). The execution context uses the format to
+// select the compiler (see Ctx.RegisterCompiler). If the reader returned by a
+// resolver is not a FormatReader, the format is the extension of the reader's
+// file name if it has a Name method (e.g. *os.File), or of the module identifier.
+type FormatReader interface {
+	io.Reader
+	Format() string
+}
+
+// NewFormatReader returns a FormatReader that reads from r and reports the
+// specified format. It is also an io.ReadSeeker if r is one.
+func NewFormatReader(r io.Reader, format string) FormatReader {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		return &formatReadSeeker{rs, format}
+	}
+	return &formatReader{r, format}
+}
+
+type formatReader struct {
+	io.Reader
+	format string
+}
+
+func (f *formatReader) Format() string {
+	return f.format
+}
+
+type formatReadSeeker struct {
+	io.ReadSeeker
+	format string
+}
+
+func (f *formatReadSeeker) Format() string {
+	return f.format
+}
+
+// Return the format of the module's content read from r, for the module
+// identified by id.
+func formatOf(r io.Reader, id string) string {
+	if fr, ok := r.(FormatReader); ok {
+		return fr.Format()
+	}
+	if nr, ok := r.(interface {
+		Name() string
+	}); ok {
+		return filepath.Ext(nr.Name())
+	}
+	return path.Ext(filepath.ToSlash(id))
+}
+
+// The extensions looked for by default if the module identifier has none.
+var defaultExts = []string{".agorac", ".agoraa", ".agora"}
+
+// Return the extensions to look for, the default ones if exts is empty.
+func extsOrDefault(exts []string) []string {
+	if len(exts) == 0 {
+		return defaultExts
+	}
+	return exts
+}
+
+// A FileResolver is a ModuleResolver that turns the module identifier into
+// a file path to find the matching source code. It is an ImportResolver whose
+// canonical identifiers are absolute file paths, with symbolic links resolved.
+//
+// If the identifier has no extension (which is recommended), the files with
+// the extensions listed in Exts are looked for, in order. If Exts is empty, the
+// default order is:
+//
+// 1- .agorac (compiled bytecode)
+// 2- .agoraa (agora assembly code)
+// 3- .agora  (agora source code)
+//
+// The *os.File returned by Resolve reports the format of the module via its
+// file name's extension.
+type FileResolver struct {
+	Exts []string
+}
+
+// Resolve matches the provided identifier with a source file.
+func (f FileResolver) Resolve(id string) (io.Reader, error) {
+	var nm string
+	if filepath.IsAbs(id) {
+		nm = id
+	} else {
+		pwd, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		nm = filepath.Join(pwd, id)
+	}
+	return openFile(nm, f.Exts)
+}
+
+// Canonical returns the absolute path of the file matching the provided
+// identifier, relative to the current working directory, or to the directory
+// of the importing module if it starts with "./" or "../".
+func (f FileResolver) Canonical(id, from string) (string, error) {
+	nm := id
+	if IsRelative(id) && from != "" {
+		nm = filepath.Join(filepath.Dir(from), id)
+	}
+	return canonicalFile(nm, f.Exts)
+}
+
+// Return the name of the file, with the first of the extensions that exists if
+// it has none. It returns an error if the file does not exist.
+func findFile(nm string, exts []string) (string, error) {
+	if filepath.Ext(nm) == "" {
+		for _, ext := range extsOrDefault(exts) {
+			if _, err := os.Stat(nm + ext); err != nil {
+				if !os.IsNotExist(err) {
+					return "", err
+				}
+			} else {
+				return nm + ext, nil
+			}
+		}
+	}
+	if _, err := os.Stat(nm); err != nil {
+		return "", err
+	}
+	return nm, nil
+}
+
+// Return the canonical name of the file: its absolute path, with the extension
+// and symbolic links resolved.
+func canonicalFile(nm string, exts []string) (string, error) {
+	nm, err := findFile(nm, exts)
+	if err != nil {
+		return "", err
+	}
+	if nm, err = filepath.Abs(nm); err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(nm)
+}
+
+// Open the file with the specified name, looking for the extensions if it has
+// none.
+func openFile(nm string, exts []string) (io.Reader, error) {
+	nm, err := findFile(nm, exts)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(nm)
+}
+
+// An FSResolver is a ModuleResolver that finds the source code in a file system,
+// such as the virtual root of a Sandbox. The module identifier is a file name
+// relative to the root of the file system (see Sandbox.Path), and the same
+// extensions as for FileResolver are looked for if it has none.
+type FSResolver struct {
+	FS   fs.FS
+	Exts []string
+}
+
+// Resolve matches the provided identifier with a file in the file system. The
+// returned reader is a FormatReader.
+func (f FSResolver) Resolve(id string) (io.Reader, error) {
+	nm, err := f.find(fsPath(id))
+	if err != nil {
+		return nil, err
+	}
+	fl, err := f.FS.Open(nm)
+	if err != nil {
+		return nil, err
+	}
+	// The content is read in memory, the Ctx requires a ReadSeeker to detect
+	// bytecode.
+	defer fl.Close()
+	b, err := ioutil.ReadAll(fl)
+	if err != nil {
+		return nil, err
+	}
+	return NewFormatReader(bytes.NewReader(b), path.Ext(nm)), nil
+}
+
+// Canonical returns the path of the file matching the provided identifier in
+// the file system, relative to its root, or to the directory of the importing
+// module if it starts with "./" or "../".
+func (f FSResolver) Canonical(id, from string) (string, error) {
+	return f.find(fsPath(relativeID(id, from)))
+}
+
+// Return the path of the file in the file system, with the first of the known
+// extensions that exists if it has none. It returns an error if the file does
+// not exist.
+func (f FSResolver) find(nm string) (string, error) {
+	if path.Ext(nm) == "" {
+		for _, ext := range extsOrDefault(f.Exts) {
+			if _, err := fs.Stat(f.FS, nm+ext); err == nil {
+				return nm + ext, nil
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return "", err
+			}
+		}
+	}
+	if _, err := fs.Stat(f.FS, nm); err != nil {
+		return "", err
+	}
+	return nm, nil
+}
+
+// A PathResolver is a ModuleResolver that looks for the source code in a list
+// of directories, in order, like FileResolver does in the current working
+// directory. Absolute identifiers are resolved as is. It is an ImportResolver
+// whose canonical identifiers are absolute file paths, like FileResolver.
+type PathResolver struct {
+	Paths []string
+	Exts  []string
+}
+
+// NewPathResolver returns a PathResolver for the specified directories.
+func NewPathResolver(paths ...string) *PathResolver {
+	return &PathResolver{Paths: paths}
+}
+
+// NewEnvPathResolver returns a PathResolver for the directories listed in the
+// AGORA_PATH environment variable, separated by the OS-specific path list
+// separator (e.g. ':' on Unix).
+func NewEnvPathResolver() *PathResolver {
+	return NewPathResolver(filepath.SplitList(os.Getenv("AGORA_PATH"))...)
+}
+
+// Resolve matches the provided identifier with a source file in the first
+// directory that holds a matching file.
+func (p *PathResolver) Resolve(id string) (io.Reader, error) {
+	if filepath.IsAbs(id) {
+		return openFile(id, p.Exts)
+	}
+	for _, dir := range p.Paths {
+		r, err := openFile(filepath.Join(dir, id), p.Exts)
+		if err == nil {
+			return r, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, NewModuleNotFoundError(id)
+}
+
+// Canonical returns the absolute path of the file matching the provided
+// identifier in the first directory that holds a matching file, or relative
+// to the directory of the importing module if it starts with "./" or "../".
+func (p *PathResolver) Canonical(id, from string) (string, error) {
+	if filepath.IsAbs(id) {
+		return canonicalFile(id, p.Exts)
+	}
+	if IsRelative(id) && from != "" {
+		return canonicalFile(filepath.Join(filepath.Dir(from), id), p.Exts)
+	}
+	for _, dir := range p.Paths {
+		nm, err := canonicalFile(filepath.Join(dir, id), p.Exts)
+		if err == nil {
+			return nm, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return "", NewModuleNotFoundError(id)
+}
+
+// A ZipResolver is a ModuleResolver that finds the source code in a zip archive,
+// with the same rules as FSResolver.
+type ZipResolver struct {
+	FSResolver
+	c io.Closer
+}
+
+// NewZipResolver returns a ZipResolver that reads the zip archive from r, which
+// has the specified size.
+func NewZipResolver(r io.ReaderAt, size int64) (*ZipResolver, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return &ZipResolver{FSResolver{FS: zr}, nil}, nil
+}
+
+// OpenZipResolver returns a ZipResolver that reads the zip archive file with
+// the specified name. It should be closed when it is no longer used.
+func OpenZipResolver(nm string) (*ZipResolver, error) {
+	zr, err := zip.OpenReader(nm)
+	if err != nil {
+		return nil, err
+	}
+	return &ZipResolver{FSResolver{FS: zr}, zr}, nil
+}
+
+// Close closes the zip archive file, if it was opened by OpenZipResolver.
+func (z *ZipResolver) Close() error {
+	if z.c == nil {
+		return nil
+	}
+	return z.c.Close()
+}
+
+// A BundleResolver is a ModuleResolver that serves the modules packed in a bundle
+// (see bytecode.Bundle), so that a program made of many modules can be deployed
+// as a single file. It is an ImportResolver whose canonical identifiers are the
+// identifiers of the modules in the bundle (see BundleID).
+type BundleResolver struct {
+	Entry string // the identifier of the module that starts the program
+	mods  map[string][]byte
+}
+
+// NewBundleResolver returns a BundleResolver that serves the modules of the
+// bundle. The modules are encoded to bytecode once, and decoded by the execution
+// context when they are loaded, so that their signature can be verified.
+func NewBundleResolver(b *bytecode.Bundle) (*BundleResolver, error) {
+	br := &BundleResolver{Entry: b.Entry, mods: make(map[string][]byte, len(b.Mods))}
+	for _, m := range b.Mods {
+		buf := bytes.NewBuffer(nil)
+		if err := bytecode.NewEncoder(buf).Encode(m.File); err != nil {
+			return nil, err
+		}
+		br.mods[m.ID] = buf.Bytes()
+	}
+	return br, nil
+}
+
+// OpenBundleResolver returns a BundleResolver that serves the modules of the
+// bundle file with the specified name.
+func OpenBundleResolver(nm string) (*BundleResolver, error) {
+	f, err := os.Open(nm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := bytecode.NewDecoder(f).DecodeBundle()
+	if err != nil {
+		return nil, err
+	}
+	return NewBundleResolver(b)
+}
+
+// Resolve returns the bytecode of the module of the bundle identified by id.
+// The returned reader is a FormatReader, and reports the ".agorac" format.
+func (b *BundleResolver) Resolve(id string) (io.Reader, error) {
+	m, ok := b.mods[id]
+	if !ok {
+		return nil, NewModuleNotFoundError(id)
+	}
+	return NewFormatReader(bytes.NewReader(m), ".agorac"), nil
+}
+
+// Canonical returns the identifier in the bundle of the module identified by
+// id, imported by the module from.
+func (b *BundleResolver) Canonical(id, from string) (string, error) {
+	bid := BundleID(id, from)
+	if _, ok := b.mods[bid]; !ok {
+		return "", NewModuleNotFoundError(id)
+	}
+	return bid, nil
+}
+
+// BundleID returns the identifier in a bundle of the module identified by id,
+// imported by the module of the bundle identified by from (empty if the module
+// is not imported by an agora module). It is the slash-separated, cleaned path
+// of the module relative to the entry point's directory, without the agora
+// extensions (.agorac, .agoraa and .agora), e.g. "lib/util" for "./lib/util.agora"
+// imported by "main".
+func BundleID(id, from string) string {
+	id = path.Clean(relativeID(filepath.ToSlash(id), from))
+	for _, ext := range defaultExts {
+		if strings.HasSuffix(id, ext) {
+			return strings.TrimSuffix(id, ext)
+		}
+	}
+	return id
+}
+
+// A ChainResolver is a ModuleResolver that tries each resolver in order, until
+// one finds the module. It is an ImportResolver, the canonical identifier is
+// the one returned by the first resolver that finds the module.
+type ChainResolver []ModuleResolver
+
+// Resolve matches the provided identifier with the source code found by the
+// first resolver that finds the module. A resolver fails to find the module if
+// it returns a ModuleNotFoundError or an error matching fs.ErrNotExist, other
+// errors stop the resolution.
+func (c ChainResolver) Resolve(id string) (io.Reader, error) {
+	for _, r := range c {
+		rd, err := r.Resolve(id)
+		if err == nil {
+			return rd, nil
+		}
+		if !isNotFound(err) {
+			return nil, err
+		}
+	}
+	return nil, NewModuleNotFoundError(id)
+}
+
+// Canonical returns the canonical identifier of the module for the first
+// resolver that finds it. If a resolver is not an ImportResolver, the module
+// is resolved to check if it exists.
+func (c ChainResolver) Canonical(id, from string) (string, error) {
+	for _, r := range c {
+		var (
+			cid string
+			err error
+		)
+		if ir, ok := r.(ImportResolver); ok {
+			cid, err = ir.Canonical(id, from)
+		} else {
+			var rd io.Reader
+			cid = relativeID(id, from)
+			if rd, err = r.Resolve(cid); err == nil {
+				if rc, ok := rd.(io.Closer); ok {
+					rc.Close()
+				}
+			}
+		}
+		if err == nil {
+			return cid, nil
+		}
+		if !isNotFound(err) {
+			return "", err
+		}
+	}
+	return "", NewModuleNotFoundError(id)
+}
+
+// Return true if the error indicates that a module was not found.
+func isNotFound(err error) bool {
+	if _, ok := err.(ModuleNotFoundError); ok {
+		return true
+	}
+	return errors.Is(err, fs.ErrNotExist)
+}
@@ -0,0 +1,285 @@
+package runtime_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/PuerkitoBio/agora/bytecode"
+	"github.com/PuerkitoBio/agora/compiler"
+	"github.com/PuerkitoBio/agora/runtime"
+)
+
+// Return the content of the module resolved by r, or the error.
+func resolveString(r runtime.ModuleResolver, id string) (string, error) {
+	rd, err := r.Resolve(id)
+	if err != nil {
+		return "", err
+	}
+	if rc, ok := rd.(io.Closer); ok {
+		defer rc.Close()
+	}
+	b, err := ioutil.ReadAll(rd)
+	return string(b), err
+}
+
+func TestPathResolver(t *testing.T) {
+	dir1, err := ioutil.TempDir("", "agora-path1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir1)
+	dir2, err := ioutil.TempDir("", "agora-path2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir2)
+	files := map[string]string{
+		filepath.Join(dir1, "a.agora"):        "a1",
+		filepath.Join(dir2, "a.agora"):        "a2",
+		filepath.Join(dir2, "lib", "b.agora"): "b2",
+	}
+	for nm, src := range files {
+		os.MkdirAll(filepath.Dir(nm), 0755)
+		if err := ioutil.WriteFile(nm, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	os.Setenv("AGORA_PATH", dir1+string(os.PathListSeparator)+dir2)
+	defer os.Unsetenv("AGORA_PATH")
+	r := runtime.NewEnvPathResolver()
+	cases := []struct {
+		id  string
+		exp string
+	}{
+		0: {id: "a", exp: "a1"},
+		1: {id: "lib/b", exp: "b2"},
+		2: {id: "lib/b.agora", exp: "b2"},
+		3: {id: filepath.Join(dir2, "a"), exp: "a2"},
+		4: {id: "c"},
+	}
+	for i, c := range cases {
+		got, err := resolveString(r, c.id)
+		if c.exp == "" {
+			if _, ok := err.(runtime.ModuleNotFoundError); !ok {
+				t.Errorf("[%d] - expected module not found error, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%d] - expected no error, got %s", i, err)
+		} else if got != c.exp {
+			t.Errorf("[%d] - expected %s, got %s", i, c.exp, got)
+		}
+	}
+}
+
+func TestZipAndChainResolvers(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buf)
+	for nm, src := range map[string]string{"a.agora": "zip-a", "lib/b.agorac": "zip-b"} {
+		w, err := zw.Create(nm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, src)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := runtime.NewZipResolver(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	r := runtime.ChainResolver{
+		runtime.FSResolver{FS: fstest.MapFS{"a.agora": {Data: []byte("fs-a")}, "c.agora": {Data: []byte("fs-c")}}},
+		zr,
+		srcResolver{"d": "src-d"},
+	}
+	cases := []struct {
+		id  string
+		exp string
+	}{
+		0: {id: "a", exp: "fs-a"},
+		1: {id: "lib/b", exp: "zip-b"},
+		2: {id: "c", exp: "fs-c"},
+		3: {id: "d", exp: "src-d"},
+		4: {id: "e"},
+	}
+	for i, c := range cases {
+		got, err := resolveString(r, c.id)
+		if c.exp == "" {
+			if err == nil || err.Error() != "module not found: e" {
+				t.Errorf("[%d] - expected module not found error, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%d] - expected no error, got %s", i, err)
+		} else if got != c.exp {
+			t.Errorf("[%d] - expected %s, got %s", i, c.exp, got)
+		}
+	}
+}
+
+func TestRelativeImports(t *testing.T) {
+	files := map[string]string{
+		"main.agora": `a := import("lib/util")
+		b := import("./lib/util.agora")
+		c := import("lib/../lib/util")
+		return string(a == b && b == c) + ":" + a.name + ":" + a.helper + ":" + a.other`,
+		"lib/util.agora":   `return {name: "util", helper: import("./helper"), other: import("../other")}`,
+		"lib/helper.agora": `return "helper"`,
+		"other.agora":      `return "other"`,
+	}
+	exp := "true:util:helper:other"
+
+	// With an ImportResolver on a file system
+	fsys := fstest.MapFS{}
+	for nm, src := range files {
+		fsys[nm] = &fstest.MapFile{Data: []byte(src)}
+	}
+	ctx := runtime.NewCtx(runtime.FSResolver{FS: fsys}, new(compiler.Compiler))
+	if v, err := mustLoad(t, ctx, "main").Run(); err != nil || v.String() != exp {
+		t.Errorf("expected %s, got %v (%v)", exp, v, err)
+	}
+
+	// With a FileResolver, from another working directory
+	dir, err := ioutil.TempDir("", "agora-relative")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for nm, src := range files {
+		fn := filepath.Join(dir, filepath.FromSlash(nm))
+		os.MkdirAll(filepath.Dir(fn), 0755)
+		if err := ioutil.WriteFile(fn, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx = runtime.NewCtx(runtime.ChainResolver{runtime.NewPathResolver(dir)}, new(compiler.Compiler))
+	if v, err := mustLoad(t, ctx, "main").Run(); err != nil || v.String() != exp {
+		t.Errorf("expected %s, got %v (%v)", exp, v, err)
+	}
+
+	// With a plain resolver, the identifiers are joined
+	ctx = runtime.NewCtx(srcResolver{
+		"main":       `return import("lib/util")`,
+		"lib/util":   `return import("./helper") + import("../other")`,
+		"lib/helper": `return "helper"`,
+		"other":      `return "other"`,
+	}, new(compiler.Compiler))
+	if v, err := mustLoad(t, ctx, "main").Run(); err != nil || v.String() != "helperother" {
+		t.Errorf("expected helperother, got %v (%v)", v, err)
+	}
+}
+
+func TestBundleResolver(t *testing.T) {
+	files := map[string]string{
+		"main": `a := import("lib/util")
+		b := import("./lib/util.agora")
+		return string(a == b) + ":" + a.name + ":" + a.helper + ":" + a.other`,
+		"lib/util":   `return {name: "util", helper: import("./helper"), other: import("../other")}`,
+		"lib/helper": `return "helper"`,
+		"other":      `return "other"`,
+	}
+	b := &bytecode.Bundle{Entry: "main"}
+	for id, src := range files {
+		f, err := new(compiler.Compiler).Compile(id, strings.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Mods = append(b.Mods, &bytecode.BundleMod{ID: id, File: f})
+	}
+	br, err := runtime.NewBundleResolver(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No compiler, the modules of the bundle are bytecode
+	ctx := runtime.NewCtx(br, nil)
+	exp := "true:util:helper:other"
+	if v, err := mustLoad(t, ctx, br.Entry).Run(); err != nil || v.String() != exp {
+		t.Errorf("expected %s, got %v (%v)", exp, v, err)
+	}
+	if _, err := ctx.Load("lib/missing"); err == nil || err.Error() != "module not found: lib/missing" {
+		t.Errorf("expected module not found error, got %v", err)
+	}
+
+	cases := []struct {
+		id, from, exp string
+	}{
+		0: {id: "main", exp: "main"},
+		1: {id: "main.agora", exp: "main"},
+		2: {id: "./lib/util.agorac", from: "main", exp: "lib/util"},
+		3: {id: "lib/util", from: "a/b", exp: "lib/util"},
+		4: {id: "../c", from: "a/b", exp: "c"},
+		5: {id: "./d.txt", from: "a/b", exp: "a/d.txt"},
+		6: {id: "lib//../x", exp: "x"},
+	}
+	for i, c := range cases {
+		if got := runtime.BundleID(c.id, c.from); got != c.exp {
+			t.Errorf("[%d] - expected %s, got %s", i, c.exp, got)
+		}
+	}
+}
+
+// A compiler for a tiny language whose modules return their content, in
+// upper case.
+type upperCompiler struct{}
+
+func (u upperCompiler) Compile(id string, r io.Reader) (*bytecode.File, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	src := fmt.Sprintf("return %q", strings.ToUpper(strings.TrimSpace(string(b))))
+	return new(compiler.Compiler).Compile(id, strings.NewReader(src))
+}
+
+func TestCompilersByFormat(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.agora": {Data: []byte(`return import("helper") + import("./dsl") + import("text.txt")`)},
+		"helper.agoraa": {Data: []byte(`[f]
+helper
+1
+0
+0
+1
+1
+[k]
+sasm
+[l]
+[i]
+RET 0 K0 0
+[n]
+1
+`)},
+		"dsl.upper": {Data: []byte("dsl")},
+		"text.txt":  {Data: []byte(`return "txt"`)},
+	}
+	res := runtime.FSResolver{FS: fsys, Exts: []string{".agoraa", ".agora", ".upper"}}
+	ctx := runtime.NewCtx(res, new(compiler.Compiler))
+	ctx.RegisterCompiler(".agoraa", new(compiler.Asm))
+	ctx.RegisterCompiler(".upper", upperCompiler{})
+	if v, err := mustLoad(t, ctx, "main").Run(); err != nil || v.String() != "asmDSLtxt" {
+		t.Errorf("expected asmDSLtxt, got %v (%v)", v, err)
+	}
+
+	// Without a default compiler, an unknown format is an error
+	ctx = runtime.NewCtx(res, nil)
+	ctx.RegisterCompiler(".agora", new(compiler.Compiler))
+	_, err := ctx.Load("text.txt")
+	if _, ok := err.(runtime.UnknownFormatError); !ok {
+		t.Errorf("expected an unknown format error, got %v", err)
+	}
+}
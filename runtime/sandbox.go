@@ -0,0 +1,201 @@
+package runtime
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type (
+	// Error raised when an operation is denied by the sandbox policy
+	SandboxError string
+
+	// Error raised to terminate the execution, e.g. by the stdlib's os.Exit. It
+	// holds the exit status code.
+	ExitError int
+)
+
+// Error interface implementation.
+func (e SandboxError) Error() string {
+	return string(e)
+}
+
+// Create a new SandboxError.
+func NewSandboxError(op string) SandboxError {
+	return SandboxError(fmt.Sprintf("sandbox: %s not allowed", op))
+}
+
+// Error interface implementation.
+func (e ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// A Sandbox is a security policy that restricts what the code executed in an
+// execution context can do. It is set on the Ctx.Sandbox field, before any
+// module is loaded.
+//
+// Native modules are loaded only if they are listed in the allow-list, and only
+// the allowed fields of the value they return are visible. The stdlib's file
+// operations are confined to the virtual root FS.
+//
+// The Ctx's Resolver is not restricted by the sandbox, it is the host's
+// responsibility to use a resolver that only exposes the trusted or sandboxed
+// source code, such as an FSResolver on the same FS.
+type Sandbox struct {
+	// Modules is the allow-list of native modules, by module ID. If the list of
+	// names for a module is empty, all its fields are allowed, otherwise only
+	// the listed fields are allowed (e.g. "ReadFile" for the os module).
+	Modules map[string][]string
+
+	// FS is the virtual root of the file operations. File names are cleaned
+	// and made relative to this root (see Path). If it is nil, file operations
+	// are denied. Operations that modify the file system require FS to implement
+	// WriteFS.
+	FS fs.FS
+}
+
+// NewSandbox creates a sandbox policy with the allow-list of native modules
+// and fields specified as IDs ("os") or as dotted names ("os.ReadFile"), and
+// the provided virtual root.
+func NewSandbox(root fs.FS, allow ...string) *Sandbox {
+	s := &Sandbox{
+		Modules: make(map[string][]string, len(allow)),
+		FS:      root,
+	}
+	for _, a := range allow {
+		id, fld := a, ""
+		if ix := strings.Index(a, "."); ix >= 0 {
+			id, fld = a[:ix], a[ix+1:]
+		}
+		nms, ok := s.Modules[id]
+		if fld == "" {
+			// Whole module
+			s.Modules[id] = nil
+		} else if !ok || nms != nil {
+			s.Modules[id] = append(nms, fld)
+		}
+	}
+	return s
+}
+
+// Path returns the name of the file in the virtual root that matches the
+// provided file name. Relative and absolute names are both resolved from the
+// root, and the name cannot go up past the root.
+func (s *Sandbox) Path(name string) string {
+	return fsPath(name)
+}
+
+// Return the slash-separated path within an fs.FS for the provided file name.
+func fsPath(name string) string {
+	p := path.Clean("/" + filepath.ToSlash(name))
+	if p == "/" {
+		return "."
+	}
+	return p[1:]
+}
+
+// Return the native module with its value restricted to the allowed fields, or
+// an error if the module is not allowed.
+func (s *Sandbox) module(m NativeModule) (Module, error) {
+	nms, ok := s.Modules[m.ID()]
+	if !ok {
+		return nil, NewSandboxError("module " + m.ID())
+	}
+	if len(nms) == 0 {
+		return m, nil
+	}
+	return &sandboxedModule{m, nms, nil}, nil
+}
+
+// A sandboxedModule wraps a native module to expose only the allowed fields.
+type sandboxedModule struct {
+	NativeModule
+	allowed []string
+	v       Val
+}
+
+// Run executes the native module and returns a copy of its object holding only
+// the allowed fields.
+func (s *sandboxedModule) Run(args ...Val) (Val, error) {
+	if s.v == nil {
+		v, err := s.NativeModule.Run(args...)
+		if err != nil {
+			return nil, err
+		}
+		src, ok := v.(Object)
+		if !ok {
+			return v, nil
+		}
+		ob := NewObject()
+		for _, nm := range s.allowed {
+			ob.Set(String(nm), src.Get(String(nm)))
+		}
+		s.v = ob
+	}
+	return s.v, nil
+}
+
+// The WriteFS interface is implemented by a file system that supports the
+// operations that modify the files, in addition to fs.FS. File names follow the
+// same rules as for fs.FS.
+type WriteFS interface {
+	fs.FS
+	OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error)
+	MkdirAll(name string, perm fs.FileMode) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldname, newname string) error
+}
+
+// A DirFS is a WriteFS rooted at a directory of the host file system. It cannot
+// access files outside this directory, even through symbolic links.
+type DirFS struct {
+	fs.FS
+	root *os.Root
+}
+
+// OpenDirFS returns a DirFS for the specified directory.
+func OpenDirFS(dir string) (*DirFS, error) {
+	r, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &DirFS{r.FS(), r}, nil
+}
+
+// OpenFile opens the named file with the specified flag and permissions, as os.OpenFile.
+func (d *DirFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	f, err := d.root.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// MkdirAll creates the named directory along with any missing parent.
+func (d *DirFS) MkdirAll(name string, perm fs.FileMode) error {
+	return d.root.MkdirAll(name, perm)
+}
+
+// Remove removes the named file or empty directory.
+func (d *DirFS) Remove(name string) error {
+	return d.root.Remove(name)
+}
+
+// RemoveAll removes the named file or directory and any children it contains.
+func (d *DirFS) RemoveAll(name string) error {
+	return d.root.RemoveAll(name)
+}
+
+// Rename renames the oldname file to newname.
+func (d *DirFS) Rename(oldname, newname string) error {
+	return d.root.Rename(oldname, newname)
+}
+
+// Close releases the directory.
+func (d *DirFS) Close() error {
+	return d.root.Close()
+}
@@ -0,0 +1,115 @@
+package runtime_test
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/PuerkitoBio/agora/compiler"
+	"github.com/PuerkitoBio/agora/runtime"
+)
+
+// A native module exposing two functions.
+type sbMod struct {
+	ctx *runtime.Ctx
+	ob  runtime.Object
+}
+
+func (m *sbMod) ID() string {
+	return "sb"
+}
+
+func (m *sbMod) SetCtx(c *runtime.Ctx) {
+	m.ctx = c
+}
+
+func (m *sbMod) Run(_ ...runtime.Val) (runtime.Val, error) {
+	if m.ob == nil {
+		m.ob = runtime.NewObject()
+		m.ob.Set(runtime.String("Safe"), runtime.NewNativeFunc(m.ctx, "sb.Safe", func(args ...runtime.Val) runtime.Val {
+			return runtime.String("safe")
+		}))
+		m.ob.Set(runtime.String("Unsafe"), runtime.NewNativeFunc(m.ctx, "sb.Unsafe", func(args ...runtime.Val) runtime.Val {
+			return runtime.String("unsafe")
+		}))
+	}
+	return m.ob, nil
+}
+
+func TestSandboxModules(t *testing.T) {
+	cases := []struct {
+		allow []string
+		src   string
+		exp   string
+		err   string
+	}{
+		0: {allow: nil, src: `return import("sb").Safe()`, err: "sandbox: module sb not allowed"},
+		1: {allow: []string{"sb"}, src: `return import("sb").Unsafe()`, exp: "unsafe"},
+		2: {allow: []string{"sb.Safe"}, src: `return import("sb").Safe()`, exp: "safe"},
+		3: {allow: []string{"sb.Safe"}, src: `return import("sb").Unsafe`, exp: "nil"},
+		4: {allow: []string{"sb.Safe", "sb"}, src: `return import("sb").Unsafe()`, exp: "unsafe"},
+		5: {allow: []string{"sb.Safe"}, src: `return import("../sub/lib")`, exp: "lib"}, // confined to the root
+	}
+	for i, c := range cases {
+		ctx := runtime.NewCtx(runtime.FSResolver{FS: fstest.MapFS{
+			"main.agora":    {Data: []byte(c.src)},
+			"sub/lib.agora": {Data: []byte(`return "lib"`)},
+		}}, new(compiler.Compiler))
+		ctx.RegisterNativeModule(new(sbMod))
+		ctx.Sandbox = runtime.NewSandbox(nil, c.allow...)
+		m, err := ctx.Load("main")
+		if err != nil {
+			t.Errorf("[%d] - %s", i, err)
+			continue
+		}
+		v, err := m.Run()
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("[%d] - expected error %q, got %v", i, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%d] - expected no error, got %s", i, err)
+		} else if v.String() != c.exp {
+			t.Errorf("[%d] - expected %s, got %s", i, c.exp, v)
+		}
+	}
+}
+
+func TestExitNotRecoverable(t *testing.T) {
+	ctx := runtime.NewCtx(srcResolver{"main": `
+	exit := import("exit")
+	recover(func() {
+		exit(3)
+	})
+	return 1
+	`}, new(compiler.Compiler))
+	ctx.RegisterNativeModule(new(exitMod))
+	m, err := ctx.Load("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.Run()
+	if code, ok := err.(runtime.ExitError); !ok || code != 3 {
+		t.Errorf("expected exit status 3, got %v", err)
+	}
+}
+
+// A native module whose value is a function that terminates the execution.
+type exitMod struct {
+	ctx *runtime.Ctx
+}
+
+func (m *exitMod) ID() string {
+	return "exit"
+}
+
+func (m *exitMod) SetCtx(c *runtime.Ctx) {
+	m.ctx = c
+}
+
+func (m *exitMod) Run(_ ...runtime.Val) (runtime.Val, error) {
+	return runtime.NewNativeFunc(m.ctx, "exit", func(args ...runtime.Val) runtime.Val {
+		panic(runtime.ExitError(args[0].Int()))
+	}), nil
+}
@@ -0,0 +1,181 @@
+package runtime
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// The maximum number of fields of a shape. The fields added to an object
+	// beyond this number are stored in its map.
+	maxShapeFields = 64
+
+	// The maximum number of shapes of a shapes tree (see NewObject). Once
+	// reached, a new tree is started for the new objects.
+	maxShapes = 1 << 14
+)
+
+var (
+	// The current shapes tree, the shapes of the new objects.
+	shapes = func() *atomic.Pointer[shapeTree] {
+		p := new(atomic.Pointer[shapeTree])
+		p.Store(newShapeTree())
+		return p
+	}()
+
+	// The shape of the objects used as dictionaries, whose fields are all stored
+	// in their map.
+	dictShape = newShape(nil, "")
+)
+
+// A shapeTree is the tree of the shapes created from the shape of the objects
+// without fields, its root. The tree is replaced by a new one when it holds
+// maxShapes shapes, so that the shapes created by a program, e.g. by scripts
+// that use objects as dictionaries, do not grow without bounds.
+//
+// The shapes only link to their parent, the transitions from a shape to its
+// children are stored in the tree. They are dropped when the tree is replaced,
+// so that the shapes of a replaced tree are garbage-collected with the last
+// objects that use them.
+type shapeTree struct {
+	root  *shape
+	next  atomic.Pointer[sync.Map] // the shapes by transition, nil once replaced
+	count int64                    // the number of shapes of the tree, without its root
+}
+
+// A transition identifies the shape of the objects of shape s once the key k
+// is added.
+type transition struct {
+	s *shape
+	k String
+}
+
+// Create a new, empty shapes tree.
+func newShapeTree() *shapeTree {
+	t := new(shapeTree)
+	t.root = newShape(nil, "")
+	t.root.tree = t
+	t.next.Store(new(sync.Map))
+	return t
+}
+
+// Return the shape of the objects without fields, the root of the current tree.
+func rootShape() *shape {
+	return shapes.Load().root
+}
+
+// The number of keys indexed by a shapeIndex.
+const shapeBlock = 8
+
+// A shape is the layout of the fields of an object used as a record: the string
+// keys of its fields, in the order they were added. The objects with the same
+// keys added in the same order share the same shape, so that the index of a
+// field can be cached by the instructions that access it (see inlineCache).
+//
+// The shapes are shared by all execution contexts and are immutable. A shape
+// shares the array of its keys with its parent when it is the first child to
+// extend it, and the keys are indexed by blocks of shapeBlock keys shared with
+// the descendants, so that a chain of shapes takes memory in proportion to its
+// number of keys. The keys after the last block are looked up by a linear scan.
+type shape struct {
+	parent *shape
+	tree   *shapeTree
+	keys   []String
+	block  *shapeIndex // the index of the last full block of keys, if any
+	shared int32       // set once a child shares the array of keys
+}
+
+// A shapeIndex holds the indices of a block of shapeBlock keys of a shape, and
+// links to the index of the previous block.
+type shapeIndex struct {
+	index map[String]int
+	prev  *shapeIndex
+}
+
+// Create a new shape with the fields of the parent shape followed by the key.
+func newShape(parent *shape, k String) *shape {
+	s := &shape{parent: parent}
+	if parent == nil {
+		return s
+	}
+	s.tree = parent.tree
+	n := len(parent.keys)
+	if atomic.CompareAndSwapInt32(&parent.shared, 0, 1) {
+		// The first child appends to the array of the parent: the keys after n
+		// are only seen by the descendants of this child.
+		s.keys = append(parent.keys, k)
+	} else {
+		s.keys = append(parent.keys[:n:n], k)
+	}
+	s.block = parent.block
+	if (n+1)%shapeBlock == 0 {
+		ix := &shapeIndex{index: make(map[String]int, shapeBlock), prev: s.block}
+		for i := n + 1 - shapeBlock; i <= n; i++ {
+			ix.index[s.keys[i]] = i
+		}
+		s.block = ix
+	}
+	return s
+}
+
+// Get the index of the field identified by k, if it is part of the shape.
+func (s *shape) lookup(k String) (int, bool) {
+	if s == nil {
+		return 0, false
+	}
+	for i := len(s.keys) - 1; i >= len(s.keys)-len(s.keys)%shapeBlock; i-- {
+		if s.keys[i] == k {
+			return i, true
+		}
+	}
+	for b := s.block; b != nil; b = b.prev {
+		if ix, ok := b.index[k]; ok {
+			return ix, true
+		}
+	}
+	return 0, false
+}
+
+// Get the shape of the objects of this shape once the key k is added. It
+// returns nil if the field cannot be added to the shape, it must be stored
+// in the map of the object.
+func (s *shape) add(k String) *shape {
+	if s == nil || (s.parent == nil && s != dictShape) {
+		// The objects without fields use the current tree
+		s = rootShape()
+	}
+	if s == dictShape || len(s.keys) >= maxShapeFields {
+		return nil
+	}
+	t := s.tree
+	next := t.next.Load()
+	if next == nil {
+		// The tree was replaced, no new shape is added to it
+		return nil
+	}
+	tr := transition{s, k}
+	if n, ok := next.Load(tr); ok {
+		return n.(*shape)
+	}
+	if atomic.AddInt64(&t.count, 1) > maxShapes {
+		// Start a new tree for the new objects, and drop the transitions of
+		// this one
+		if shapes.CompareAndSwap(t, newShapeTree()) {
+			t.next.Store(nil)
+		}
+		return nil
+	}
+	n, loaded := next.LoadOrStore(tr, newShape(s, k))
+	if loaded {
+		atomic.AddInt64(&t.count, -1)
+	}
+	return n.(*shape)
+}
+
+// An inlineCache is the cache of an instruction that accesses the field of an
+// object identified by a constant key: the shape of the last object accessed
+// that had this field, and the index of the field in this shape.
+type inlineCache struct {
+	shape *shape
+	ix    int
+}
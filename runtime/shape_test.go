@@ -0,0 +1,113 @@
+package runtime
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestShapeTreeReset(t *testing.T) {
+	old, empty := NewObject().(*object), NewObject().(*object)
+	old.Set(String("a"), Number(1))
+	t0 := shapes.Load()
+	if old.shape.tree != t0 {
+		t.Fatal("expected the shape in the current tree")
+	}
+
+	// Add distinct fields until the tree is replaced
+	for i := 0; shapes.Load() == t0; i++ {
+		if i > maxShapes {
+			t.Fatalf("expected the tree to be replaced after %d shapes", maxShapes)
+		}
+		NewObject().Set(String(fmt.Sprintf("reset%d", i)), Number(i))
+	}
+
+	// The transitions of the replaced tree are dropped, so that its shapes are
+	// only referenced by its objects
+	if t0.next.Load() != nil {
+		t.Errorf("expected the transitions of the replaced tree to be dropped")
+	}
+
+	// The objects of the replaced tree still work, the fields that would need a
+	// new shape are in the map
+	old.Set(String("after-reset"), Number(2))
+	if old.Get(String("a")) != Number(1) || old.Get(String("after-reset")) != Number(2) || old.m == nil {
+		t.Errorf("expected a=1 and after-reset=2 in the map, got %s", old.Dump())
+	}
+	// The new objects, and the ones without fields, use the new tree
+	for i, o := range []*object{NewObject().(*object), empty} {
+		o.Set(String("a"), Number(3))
+		if o.shape.tree != shapes.Load() || o.m != nil || o.Get(String("a")) != Number(3) {
+			t.Errorf("[%d] - expected the field in the shape of the new tree", i)
+		}
+	}
+}
+
+func TestShapeConcurrentAdd(t *testing.T) {
+	objs := make([]*object, 8)
+	var wg sync.WaitGroup
+	for i := range objs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			o := NewObject().(*object)
+			o.Set(String("concurrent"), Number(i))
+			o.Set(String("add"), Number(i))
+			objs[i] = o
+		}(i)
+	}
+	wg.Wait()
+	for i, o := range objs {
+		if o.shape != objs[0].shape || o.m != nil {
+			t.Errorf("[%d] - expected the same shape for all the objects", i)
+		}
+	}
+}
+
+func TestShapeKeys(t *testing.T) {
+	// Two objects that share their first 20 keys, then differ
+	a, b := NewObject().(*object), NewObject().(*object)
+	for i := 0; i < 20; i++ {
+		k := String(fmt.Sprintf("keys%d", i))
+		a.Set(k, Number(i))
+		b.Set(k, Number(i))
+	}
+	a.Set(String("keysa"), Number(-1))
+	b.Set(String("keysb"), Number(-2))
+	for i := 0; i < 3; i++ {
+		b.Set(String(fmt.Sprintf("keysb%d", i)), Number(i))
+	}
+	if a.shape.parent != b.shape.parent.parent.parent.parent {
+		t.Fatal("expected the objects to share the shape of the first keys")
+	}
+	// The keys of the chain of shapes share the same array
+	if p := a.shape.parent; &p.keys[0] != &p.parent.keys[0] {
+		t.Errorf("expected the keys to be shared with the parent shape")
+	}
+	cases := []struct {
+		o   *object
+		k   string
+		ix  int
+		has bool
+	}{
+		0: {o: a, k: "keys0", ix: 0, has: true},
+		1: {o: a, k: "keys7", ix: 7, has: true},
+		2: {o: a, k: "keys8", ix: 8, has: true},
+		3: {o: a, k: "keys19", ix: 19, has: true},
+		4: {o: a, k: "keysa", ix: 20, has: true},
+		5: {o: a, k: "keysb", has: false},
+		6: {o: b, k: "keysb", ix: 20, has: true},
+		7: {o: b, k: "keysb2", ix: 23, has: true},
+		8: {o: b, k: "keysa", has: false},
+		9: {o: b, k: "keys15", ix: 15, has: true},
+	}
+	for i, c := range cases {
+		ix, ok := c.o.shape.lookup(String(c.k))
+		if ok != c.has || (ok && ix != c.ix) {
+			t.Errorf("[%d] - expected %s at %d (%v), got %d (%v)", i, c.k, c.ix, c.has, ix, ok)
+		}
+	}
+	if a.Get(String("keysa")) != Number(-1) || b.Get(String("keysb2")) != Number(2) {
+		t.Errorf("expected the fields to be found, got %s and %s", a.Dump(), b.Dump())
+	}
+}
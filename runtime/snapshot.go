@@ -0,0 +1,290 @@
+package runtime
+
+import (
+	"errors"
+	"reflect"
+)
+
+var (
+	// Error returned when taking a snapshot of a context that is executing code.
+	ErrSnapshotRunning = errors.New("cannot snapshot a running execution context")
+
+	// Error returned when taking a snapshot of a context that holds a suspended
+	// coroutine, whose execution state cannot be copied.
+	ErrSnapshotCoroutine = errors.New("cannot snapshot a suspended coroutine")
+)
+
+// A ForkableModule is a NativeModule that controls how it is copied in a forked
+// execution context. Fork returns a new instance of the module that shares no
+// mutable state with the original. The context of the new instance is set via
+// SetCtx.
+type ForkableModule interface {
+	NativeModule
+	Fork() NativeModule
+}
+
+// A Snapshot is a frozen copy of an initialized execution context, with its
+// registered native modules and its loaded agora modules, along with the values
+// returned by the modules that have been run. It is used to create new execution
+// contexts in this state cheaply, via Fork.
+//
+// A Snapshot is immutable, and Fork is safe for concurrent use.
+type Snapshot struct {
+	ctx *Ctx
+}
+
+// Snapshot returns a snapshot of the current state of the execution context. It
+// cannot be called while the context is executing code, and fails if a value
+// reachable from a module is a suspended coroutine.
+//
+// The values are deep-copied, so that the snapshot and its forks share no mutable
+// state with the context, with the following exceptions:
+//
+// * Native modules are copied using their Fork method if they implement
+//   ForkableModule, otherwise as new zero values of the same type. The values
+//   returned by the native modules are expected to be the same on each Run,
+//   and the values reachable from a module that come from a native module are
+//   mapped to the matching value of the copy.
+// * The built-in functions are mapped to the built-ins of the new context.
+// * Other native functions, e.g. the ones created by ToVal or NewNativeFunc, or
+//   returned by a call to a native function, are not rebound: the copy runs the
+//   same Go closure, so it still uses the state it captured, such as the source
+//   context's Stdout or its native modules. Such functions should not capture
+//   context state if the context is meant to be forked.
+// * Custom implementations of the Object and Func interfaces are shared.
+//
+// The Profiler and Coverage fields are not copied.
+func (c *Ctx) Snapshot() (s *Snapshot, err error) {
+	if c.frmsp > 0 || len(c.loadingMods) > 0 {
+		return nil, ErrSnapshotRunning
+	}
+	defer PanicToError(&err)
+	return &Snapshot{newCloner(c).ctx}, nil
+}
+
+// Fork returns a new execution context in the state of the snapshot. The
+// returned context shares no mutable state with the snapshot or other forks.
+func (s *Snapshot) Fork() *Ctx {
+	return newCloner(s.ctx).ctx
+}
+
+// A cloner deep-copies an execution context into a new one.
+type cloner struct {
+	ctx  *Ctx
+	seen map[interface{}]interface{}
+}
+
+// Create a cloner with a new context copied from the source context.
+func newCloner(src *Ctx) *cloner {
+	c := &cloner{
+		ctx:  NewCtx(src.Resolver, src.Compiler),
+		seen: make(map[interface{}]interface{}),
+	}
+	c.ctx.Stdout = src.Stdout
+	c.ctx.Stdin = src.Stdin
+	c.ctx.Stderr = src.Stderr
+	c.ctx.Arithmetic = src.Arithmetic
+	c.ctx.Comparer = src.Comparer
+	c.ctx.Debug = src.Debug
+	c.ctx.Sandbox = src.Sandbox
+	c.ctx.Cache = src.Cache
+	c.ctx.BytecodeCache = src.BytecodeCache
+	c.ctx.TrustedKeys = src.TrustedKeys
+	c.ctx.Watch = src.Watch
+	for id, imps := range src.importers {
+		for imp := range imps {
+			c.ctx.addImporter(id, imp)
+		}
+	}
+	for id, ver := range src.versions {
+		c.ctx.versions[id] = ver
+	}
+	for format, comp := range src.compilers {
+		c.ctx.RegisterCompiler(format, comp)
+	}
+
+	// Map the built-in functions
+	c.mapFields(src.builtin, c.ctx.builtin)
+	// Copy the native modules first, so that their values are mapped when copying
+	// the values of the agora modules.
+	for _, m := range src.loadedMods {
+		if nm, ok := m.(NativeModule); ok {
+			c.ctx.RegisterNativeModule(c.nativeModule(nm))
+		}
+	}
+	for id, m := range src.sandboxMods {
+		if sm, ok := m.(*sandboxedModule); ok && sm.v != nil {
+			nm, err := c.ctx.sandboxModule(c.ctx.loadedMods[id].(NativeModule))
+			if err != nil {
+				panic(err)
+			}
+			v, err := nm.Run()
+			if err != nil {
+				panic(err)
+			}
+			c.mapFields(sm.v, v)
+		}
+	}
+	for id, m := range src.loadedMods {
+		if am, ok := m.(*agoraModule); ok {
+			c.ctx.loadedMods[id] = c.module(am)
+		}
+	}
+	return c
+}
+
+// Return a copy of the native module for the new context, and map the values
+// of the source module to the values of the copy.
+func (c *cloner) nativeModule(m NativeModule) NativeModule {
+	var nm NativeModule
+	if fm, ok := m.(ForkableModule); ok {
+		nm = fm.Fork()
+	} else {
+		t := reflect.TypeOf(m)
+		if t.Kind() == reflect.Ptr {
+			nm = reflect.New(t.Elem()).Interface().(NativeModule)
+		} else {
+			nm = reflect.Zero(t).Interface().(NativeModule)
+		}
+	}
+	nm.SetCtx(c.ctx)
+	src, err := m.Run()
+	if err != nil {
+		panic(err)
+	}
+	dst, err := nm.Run()
+	if err != nil {
+		panic(err)
+	}
+	c.mapFields(src, dst)
+	return nm
+}
+
+// Map the source value to the destination value, and if both are objects, map
+// the values of their fields.
+func (c *cloner) mapFields(src, dst Val) {
+	c.seen[src] = dst
+	so, ok1 := src.(Object)
+	do, ok2 := dst.(Object)
+	if !ok1 || !ok2 {
+		return
+	}
+	keys := so.Keys().(Object)
+	for i := int64(0); i < keys.Len().Int(); i++ {
+		k := keys.Get(Number(i))
+		if v := so.Get(k); isCloneable(v) {
+			if _, ok := c.seen[v]; !ok {
+				c.seen[v] = do.Get(k)
+			}
+		}
+	}
+}
+
+// Return true if the value is a reference value that must be mapped.
+func isCloneable(v Val) bool {
+	switch v.(type) {
+	case Object, Func:
+		return true
+	}
+	return false
+}
+
+// Return a copy of the agora module.
+func (c *cloner) module(m *agoraModule) *agoraModule {
+	if v, ok := c.seen[m]; ok {
+		return v.(*agoraModule)
+	}
+	nm := &agoraModule{id: m.id}
+	c.seen[m] = nm
+	nm.fns = make([]*agoraFuncDef, len(m.fns))
+	for i, fn := range m.fns {
+		nm.fns[i] = c.funcDef(fn)
+	}
+	if m.v != nil {
+		nm.v = c.val(m.v)
+	}
+	return nm
+}
+
+// Return a copy of the function prototype, bound to the new context. The
+// constants and the code are immutable and shared.
+func (c *cloner) funcDef(def *agoraFuncDef) *agoraFuncDef {
+	if v, ok := c.seen[def]; ok {
+		return v.(*agoraFuncDef)
+	}
+	nd := new(agoraFuncDef)
+	*nd = *def
+	nd.ctx = c.ctx
+	nd.vms = nil // the released VMs belong to the original context
+	nd.ics = make([]inlineCache, len(def.code))
+	c.seen[def] = nd
+	nd.mod = c.module(def.mod)
+	return nd
+}
+
+// Return a deep copy of the value.
+func (c *cloner) val(v Val) Val {
+	if !isCloneable(v) {
+		return v
+	}
+	if nv, ok := c.seen[v]; ok {
+		return nv.(Val)
+	}
+	switch v := v.(type) {
+	case *object:
+		nob := &object{shape: v.shape}
+		c.seen[v] = nob
+		if v.vals != nil {
+			nob.vals = make([]Val, len(v.vals))
+			for i, fv := range v.vals {
+				nob.vals[i] = c.val(fv)
+			}
+		}
+		if v.m != nil {
+			nob.m = make(map[Val]Val, len(v.m))
+			for k, fv := range v.m {
+				nob.m[c.val(k)] = c.val(fv)
+			}
+		}
+		return nob
+	case *agoraFuncVal:
+		if v.coroState != nil {
+			panic(ErrSnapshotCoroutine)
+		}
+		nf := &agoraFuncVal{
+			&funcVal{c.ctx, v.name},
+			nil,
+			nil,
+			nil,
+		}
+		c.seen[v] = nf
+		nf.proto = c.funcDef(v.proto)
+		if v.upvals != nil {
+			nf.upvals = make([]*Val, len(v.upvals))
+			for i, u := range v.upvals {
+				nf.upvals[i] = c.cell(u)
+			}
+		}
+		return nf
+	case *NativeFunc:
+		// Not a function of a native module (see Snapshot), the Go closure is
+		// shared
+		nf := &NativeFunc{&funcVal{c.ctx, v.name}, v.fn}
+		c.seen[v] = nf
+		return nf
+	}
+	// Custom implementations are shared
+	return v
+}
+
+// Return a deep copy of the upvalue cell. Distinct closures may share the same
+// cells, if they capture the same variable of the same function instance.
+func (c *cloner) cell(u *Val) *Val {
+	if v, ok := c.seen[u]; ok {
+		return v.(*Val)
+	}
+	nu := new(Val)
+	c.seen[u] = nu
+	*nu = c.val(*u)
+	return nu
+}
@@ -0,0 +1,141 @@
+package runtime_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/PuerkitoBio/agora/compiler"
+	"github.com/PuerkitoBio/agora/runtime"
+)
+
+var snapshotSrcs = srcResolver{
+	"counter": `x := {n: 0}
+	count := 0
+	x.Incr = func() {
+		count++
+		this.n = count
+		return count
+	}
+	x.Count = func() {
+		return count
+	}
+	return x
+	`,
+	"main": `c := import("counter")
+	sb := import("sb")
+	x := {}
+	x.Incr = func() {
+		return c.Incr()
+	}
+	x.N = func() {
+		return c.n
+	}
+	x.Safe = sb.Safe
+	x.Coro = func() {
+		yield 1
+		yield 2
+	}
+	return x
+	`,
+}
+
+func TestSnapshotFork(t *testing.T) {
+	ctx := runtime.NewCtx(snapshotSrcs, new(compiler.Compiler))
+	ctx.RegisterNativeModule(new(sbMod))
+	if _, err := ctx.Call("main", "Incr"); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := ctx.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1, f2 := snap.Fork(), snap.Fork()
+
+	// Incrementing in a fork does not affect the others
+	for i := 0; i < 3; i++ {
+		if _, err := f1.Call("main", "Incr"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := []struct {
+		ctx *runtime.Ctx
+		exp float64
+	}{
+		0: {ctx: ctx, exp: 1},
+		1: {ctx: f1, exp: 4},
+		2: {ctx: f2, exp: 1},
+	}
+	for i, c := range cases {
+		// The closure and the object share the same state within a context
+		cnt, err := c.ctx.Call("counter", "Count")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := c.ctx.Call("main", "N")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cnt != c.exp || n != c.exp {
+			t.Errorf("[%d] - expected count %v, got %v and %v", i, c.exp, cnt, n)
+		}
+	}
+
+	// Native modules are forked too
+	if res, err := f2.Call("main", "Safe"); err != nil || res != "safe" {
+		t.Errorf("expected 'safe', got %v (%v)", res, err)
+	}
+	m, err := f2.Load("sb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sbv, _ := m.Run()
+	mainv, _ := mustLoad(t, f2, "main").Run()
+	if sbv.(runtime.Object).Get(runtime.String("Safe")) != mainv.(runtime.Object).Get(runtime.String("Safe")) {
+		t.Errorf("expected the native function to be mapped to the forked native module")
+	}
+
+	// Cannot snapshot a suspended coroutine
+	if _, err := ctx.Call("main", "Coro"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.Snapshot(); err != runtime.ErrSnapshotCoroutine {
+		t.Errorf("expected %v, got %v", runtime.ErrSnapshotCoroutine, err)
+	}
+}
+
+func mustLoad(t *testing.T, ctx *runtime.Ctx, id string) runtime.Module {
+	m, err := ctx.Load(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestPool(t *testing.T) {
+	ctx := runtime.NewCtx(snapshotSrcs, new(compiler.Compiler))
+	ctx.RegisterNativeModule(new(sbMod))
+	// The functions are called before the snapshot, so that their prototypes
+	// hold released VMs
+	if _, err := ctx.Call("main", "Incr"); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := ctx.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := runtime.NewPool(snap, 2)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := p.Get()
+			defer p.Put(c)
+			// Each context starts from the snapshot's state
+			if res, err := c.Call("main", "Incr"); err != nil || res != 2.0 {
+				t.Errorf("[%d] - expected 2, got %v (%v)", i, res, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -2,12 +2,16 @@ package stdlib
 
 import (
 	"path/filepath"
+	"strings"
 
 	"github.com/PuerkitoBio/agora/runtime"
 )
 
 // The filepath module, as documented in
 // https://github.com/PuerkitoBio/agora/wiki/Standard-library
+//
+// If the execution context is sandboxed, Abs returns the absolute path in the
+// sandbox's virtual root.
 type FilepathMod struct {
 	ctx *runtime.Ctx
 	ob  runtime.Object
@@ -38,6 +42,9 @@ func (fp *FilepathMod) SetCtx(c *runtime.Ctx) {
 
 func (fp *FilepathMod) filepath_Abs(args ...runtime.Val) runtime.Val {
 	runtime.ExpectAtLeastNArgs(1, args)
+	if sb := sandboxOf(fp.ctx); sb != nil {
+		return runtime.String("/" + strings.TrimPrefix(sb.Path(args[0].String()), "."))
+	}
 	s, e := filepath.Abs(args[0].String())
 	if e != nil {
 		panic(e)
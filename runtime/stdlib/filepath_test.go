@@ -21,6 +21,14 @@ func TestFilepathAbs(t *testing.T) {
 	if ret.String() != exp {
 		t.Errorf("expected '%s', got '%s'", exp, ret.String())
 	}
+	// Abs in a sandbox is in the virtual root
+	ctx.Sandbox = runtime.NewSandbox(nil)
+	for _, c := range [...]struct{ src, exp string }{{".", "/"}, {"./testdata", "/testdata"}, {"../a/../b", "/b"}} {
+		if ret := fm.filepath_Abs(runtime.String(c.src)); ret.String() != c.exp {
+			t.Errorf("expected '%s', got '%s'", c.exp, ret.String())
+		}
+	}
+	ctx.Sandbox = nil
 	// IsAbs
 	{
 		exp := filepath.IsAbs(p)
@@ -2,6 +2,9 @@ package stdlib
 
 import (
 	"bufio"
+	"errors"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -11,25 +14,40 @@ import (
 
 // The os module, as documented in
 // https://github.com/PuerkitoBio/agora/wiki/Standard-library
+//
+// Exit does not terminate the process, in any execution context: it raises a
+// runtime.ExitError holding the exit status, that cannot be caught by the
+// built-in recover and is returned as error by Module.Run, so that the host
+// decides what to do with it (e.g. call os.Exit, as the agora tool does).
+//
+// If the execution context is sandboxed, the file operations are confined to
+// the sandbox's virtual root, Exec is denied and Getwd returns the root ("/").
 type OsMod struct {
 	ctx *runtime.Ctx
 	ob  runtime.Object
 }
 
+var (
+	// Error raised when writing to a file that does not support it.
+	ErrNotWritable = errors.New("file is not writable")
+	// Error raised when seeking in a file that does not support it.
+	ErrNotSeekable = errors.New("file is not seekable")
+)
+
 type file struct {
 	runtime.Object
-	f *os.File
+	f fs.File
 	s *bufio.Scanner
 }
 
-func (o *OsMod) newFile(f *os.File) *file {
+func (o *OsMod) newFile(nm string, f fs.File) *file {
 	ob := runtime.NewObject()
 	of := &file{
 		ob,
 		f,
 		nil,
 	}
-	ob.Set(runtime.String("Name"), runtime.String(f.Name()))
+	ob.Set(runtime.String("Name"), runtime.String(nm))
 	ob.Set(runtime.String("Close"), runtime.NewNativeFunc(o.ctx, "os.File.Close", of.closeFile))
 	ob.Set(runtime.String("ReadLine"), runtime.NewNativeFunc(o.ctx, "os.File.ReadLine", of.readLine))
 	ob.Set(runtime.String("Seek"), runtime.NewNativeFunc(o.ctx, "os.File.Seek", of.seek))
@@ -68,7 +86,11 @@ func (of *file) seek(args ...runtime.Val) runtime.Val {
 	if len(args) > 1 {
 		rel = int(args[1].Int())
 	}
-	n, e := of.f.Seek(off, rel)
+	sk, ok := of.f.(io.Seeker)
+	if !ok {
+		panic(ErrNotSeekable)
+	}
+	n, e := sk.Seek(off, rel)
 	if e != nil {
 		panic(e)
 	}
@@ -76,9 +98,13 @@ func (of *file) seek(args ...runtime.Val) runtime.Val {
 }
 
 func (of *file) write(args ...runtime.Val) runtime.Val {
+	w, ok := of.f.(io.Writer)
+	if !ok {
+		panic(ErrNotWritable)
+	}
 	n := 0
 	for _, v := range args {
-		m, e := of.f.WriteString(v.String())
+		m, e := io.WriteString(w, v.String())
 		if e != nil {
 			panic(e)
 		}
@@ -89,7 +115,7 @@ func (of *file) write(args ...runtime.Val) runtime.Val {
 
 func (of *file) writeLine(args ...runtime.Val) runtime.Val {
 	n := of.write(args...)
-	m, e := of.f.WriteString("\n")
+	m, e := io.WriteString(of.f.(io.Writer), "\n")
 	if e != nil {
 		panic(e)
 	}
@@ -105,7 +131,11 @@ func (o *OsMod) Run(_ ...runtime.Val) (v runtime.Val, err error) {
 	if o.ob == nil {
 		// Prepare the object
 		o.ob = runtime.NewObject()
-		o.ob.Set(runtime.String("TempDir"), runtime.String(os.TempDir()))
+		tmp := os.TempDir()
+		if sandboxOf(o.ctx) != nil {
+			tmp = "/"
+		}
+		o.ob.Set(runtime.String("TempDir"), runtime.String(tmp))
 		o.ob.Set(runtime.String("PathSeparator"), runtime.String(os.PathSeparator))
 		o.ob.Set(runtime.String("PathListSeparator"), runtime.String(os.PathListSeparator))
 		o.ob.Set(runtime.String("DevNull"), runtime.String(os.DevNull))
@@ -131,11 +161,13 @@ func (o *OsMod) SetCtx(ctx *runtime.Ctx) {
 }
 
 func (o *OsMod) os_Exit(args ...runtime.Val) runtime.Val {
-	if len(args) == 0 {
-		os.Exit(0)
+	code := 0
+	if len(args) > 0 {
+		code = int(args[0].Int())
 	}
-	os.Exit(int(args[0].Int()))
-	return runtime.Nil
+	// Do not kill the host process, unwind the stack up to the host, which
+	// decides what to do with the exit status.
+	panic(runtime.ExitError(code))
 }
 
 func (o *OsMod) os_Getenv(args ...runtime.Val) runtime.Val {
@@ -144,6 +176,9 @@ func (o *OsMod) os_Getenv(args ...runtime.Val) runtime.Val {
 }
 
 func (o *OsMod) os_Getwd(args ...runtime.Val) runtime.Val {
+	if sandboxOf(o.ctx) != nil {
+		return runtime.String("/")
+	}
 	pwd, err := os.Getwd()
 	if err != nil {
 		panic(err)
@@ -153,6 +188,9 @@ func (o *OsMod) os_Getwd(args ...runtime.Val) runtime.Val {
 
 func (o *OsMod) os_Exec(args ...runtime.Val) runtime.Val {
 	runtime.ExpectAtLeastNArgs(1, args)
+	if sandboxOf(o.ctx) != nil {
+		panic(runtime.NewSandboxError("os.Exec"))
+	}
 	c := exec.Command(args[0].String(), toString(args[1:])...)
 	b, e := c.CombinedOutput()
 	if e != nil {
@@ -173,8 +211,15 @@ func (o *OsMod) os_Mkdir(args ...runtime.Val) runtime.Val {
 		args = args[:len(args)-1]
 	}
 	// Use the mkdir-all version, to create all missing dirs as required
+	mkdir := os.MkdirAll
+	if sb := sandboxOf(o.ctx); sb != nil {
+		wfs := writeFS(sb)
+		mkdir = func(nm string, perm os.FileMode) error {
+			return wfs.MkdirAll(sb.Path(nm), perm)
+		}
+	}
 	for _, v := range args {
-		if e := os.MkdirAll(v.String(), perm); e != nil {
+		if e := mkdir(v.String(), perm); e != nil {
 			panic(e)
 		}
 	}
@@ -191,7 +236,15 @@ func createFileInfo(fi os.FileInfo) runtime.Val {
 
 func (o *OsMod) os_ReadDir(args ...runtime.Val) runtime.Val {
 	runtime.ExpectAtLeastNArgs(1, args)
-	fis, e := ioutil.ReadDir(args[0].String())
+	var (
+		fis []os.FileInfo
+		e   error
+	)
+	if sb := sandboxOf(o.ctx); sb != nil {
+		fis, e = readDirFS(rootFS(sb), sb.Path(args[0].String()))
+	} else {
+		fis, e = ioutil.ReadDir(args[0].String())
+	}
 	if e != nil {
 		panic(e)
 	}
@@ -203,8 +256,15 @@ func (o *OsMod) os_ReadDir(args ...runtime.Val) runtime.Val {
 }
 
 func (o *OsMod) os_Remove(args ...runtime.Val) runtime.Val {
+	remove := os.Remove
+	if sb := sandboxOf(o.ctx); sb != nil {
+		wfs := writeFS(sb)
+		remove = func(nm string) error {
+			return wfs.Remove(sb.Path(nm))
+		}
+	}
 	for _, v := range args {
-		if e := os.Remove(v.String()); e != nil {
+		if e := remove(v.String()); e != nil {
 			panic(e)
 		}
 	}
@@ -212,8 +272,15 @@ func (o *OsMod) os_Remove(args ...runtime.Val) runtime.Val {
 }
 
 func (o *OsMod) os_RemoveAll(args ...runtime.Val) runtime.Val {
+	removeAll := os.RemoveAll
+	if sb := sandboxOf(o.ctx); sb != nil {
+		wfs := writeFS(sb)
+		removeAll = func(nm string) error {
+			return wfs.RemoveAll(sb.Path(nm))
+		}
+	}
 	for _, v := range args {
-		if e := os.RemoveAll(v.String()); e != nil {
+		if e := removeAll(v.String()); e != nil {
 			panic(e)
 		}
 	}
@@ -222,7 +289,14 @@ func (o *OsMod) os_RemoveAll(args ...runtime.Val) runtime.Val {
 
 func (o *OsMod) os_Rename(args ...runtime.Val) runtime.Val {
 	runtime.ExpectAtLeastNArgs(2, args)
-	if e := os.Rename(args[0].String(), args[1].String()); e != nil {
+	rename := os.Rename
+	if sb := sandboxOf(o.ctx); sb != nil {
+		wfs := writeFS(sb)
+		rename = func(from, to string) error {
+			return wfs.Rename(sb.Path(from), sb.Path(to))
+		}
+	}
+	if e := rename(args[0].String(), args[1].String()); e != nil {
 		panic(e)
 	}
 	return runtime.Nil
@@ -230,7 +304,14 @@ func (o *OsMod) os_Rename(args ...runtime.Val) runtime.Val {
 
 func (o *OsMod) os_ReadFile(args ...runtime.Val) runtime.Val {
 	runtime.ExpectAtLeastNArgs(1, args)
-	b, e := ioutil.ReadFile(args[0].String())
+	readFile := ioutil.ReadFile
+	if sb := sandboxOf(o.ctx); sb != nil {
+		root := rootFS(sb)
+		readFile = func(nm string) ([]byte, error) {
+			return fs.ReadFile(root, sb.Path(nm))
+		}
+	}
+	b, e := readFile(args[0].String())
 	if e != nil {
 		panic(e)
 	}
@@ -239,14 +320,15 @@ func (o *OsMod) os_ReadFile(args ...runtime.Val) runtime.Val {
 
 func (o *OsMod) os_WriteFile(args ...runtime.Val) runtime.Val {
 	runtime.ExpectAtLeastNArgs(1, args)
-	f, e := os.Create(args[0].String())
-	if e != nil {
-		panic(e)
-	}
+	f := o.openFile(args[0].String(), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	defer f.Close()
+	w, ok := f.(io.Writer)
+	if !ok {
+		panic(ErrNotWritable)
+	}
 	n := 0
 	for _, v := range args[1:] {
-		m, e := f.WriteString(v.String())
+		m, e := io.WriteString(w, v.String())
 		if e != nil {
 			panic(e)
 		}
@@ -296,11 +378,71 @@ func (o *OsMod) os_Open(args ...runtime.Val) runtime.Val {
 	default:
 		panic("invalid file flag mode: " + flg)
 	}
-	f, e := os.OpenFile(nm, flgi, 0666)
+	return o.newFile(nm, o.openFile(nm, flgi, 0666))
+}
+
+// Open the named file with the specified flag and permissions, in the virtual
+// root if the execution context is sandboxed. It panics if the file cannot be
+// opened.
+func (o *OsMod) openFile(nm string, flg int, perm os.FileMode) fs.File {
+	var (
+		f fs.File
+		e error
+	)
+	if sb := sandboxOf(o.ctx); sb == nil {
+		f, e = os.OpenFile(nm, flg, perm)
+	} else if flg == os.O_RDONLY {
+		// Read-only access is allowed on any file system
+		f, e = rootFS(sb).Open(sb.Path(nm))
+	} else {
+		f, e = writeFS(sb).OpenFile(sb.Path(nm), flg, perm)
+	}
 	if e != nil {
 		panic(e)
 	}
-	return o.newFile(f)
+	return f
+}
+
+// Return the sandbox of the execution context, or nil if it is not sandboxed.
+func sandboxOf(ctx *runtime.Ctx) *runtime.Sandbox {
+	if ctx == nil {
+		return nil
+	}
+	return ctx.Sandbox
+}
+
+// Return the virtual root of the sandbox. It panics if the sandbox denies
+// access to the file system.
+func rootFS(sb *runtime.Sandbox) fs.FS {
+	if sb.FS == nil {
+		panic(runtime.NewSandboxError("file system access"))
+	}
+	return sb.FS
+}
+
+// Return the virtual root of the sandbox as a writable file system. It panics
+// if the sandbox denies modifications to the file system.
+func writeFS(sb *runtime.Sandbox) runtime.WriteFS {
+	wfs, ok := rootFS(sb).(runtime.WriteFS)
+	if !ok {
+		panic(runtime.NewSandboxError("file system modification"))
+	}
+	return wfs
+}
+
+// Read the directory in the file system, sorted by file name like ioutil.ReadDir.
+func readDirFS(fsys fs.FS, nm string) ([]os.FileInfo, error) {
+	des, e := fs.ReadDir(fsys, nm)
+	if e != nil {
+		return nil, e
+	}
+	fis := make([]os.FileInfo, len(des))
+	for i, de := range des {
+		if fis[i], e = de.Info(); e != nil {
+			return nil, e
+		}
+	}
+	return fis, nil
 }
 
 func toString(args []runtime.Val) []string {
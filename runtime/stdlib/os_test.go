@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"testing/fstest"
 
 	"github.com/PuerkitoBio/agora/runtime"
 )
@@ -257,3 +258,109 @@ func TestOsMkRemRenReadDir(t *testing.T) {
 		t.Errorf("expected d2 to be deleted, got %s", e)
 	}
 }
+
+func TestOsExit(t *testing.T) {
+	ctx := runtime.NewCtx(nil, nil)
+	om := new(OsMod)
+	om.SetCtx(ctx)
+	defer func() {
+		if e := recover(); e != runtime.ExitError(2) {
+			t.Errorf("expected exit status 2, got %v", e)
+		}
+	}()
+	om.os_Exit(runtime.Number(2))
+}
+
+// Return the error raised by the call to fn, or nil.
+func raised(fn func()) (err error) {
+	defer runtime.PanicToError(&err)
+	fn()
+	return nil
+}
+
+func TestOsSandboxReadOnly(t *testing.T) {
+	ctx := runtime.NewCtx(nil, nil)
+	ctx.Sandbox = runtime.NewSandbox(fstest.MapFS{
+		"a.txt":   {Data: []byte("root")},
+		"d/b.txt": {Data: []byte("line1\nline2")},
+	})
+	om := new(OsMod)
+	om.SetCtx(ctx)
+	if ret := om.os_ReadFile(runtime.String("/a.txt")); ret.String() != "root" {
+		t.Errorf("expected 'root', got '%s'", ret)
+	}
+	// Cannot go up past the root
+	if ret := om.os_ReadFile(runtime.String("../../a.txt")); ret.String() != "root" {
+		t.Errorf("expected 'root', got '%s'", ret)
+	}
+	fl := om.os_Open(runtime.String("d/b.txt")).(*file)
+	if ret := fl.readLine(); ret.String() != "line1" {
+		t.Errorf("expected 'line1', got '%s'", ret)
+	}
+	fl.closeFile()
+	ob := om.os_ReadDir(runtime.String("d")).(runtime.Object)
+	if nm := ob.Get(runtime.Number(0)).(runtime.Object).Get(runtime.String("Name")); nm.String() != "b.txt" {
+		t.Errorf("expected 'b.txt', got '%s'", nm)
+	}
+	if ret := om.os_Getwd(); ret.String() != "/" {
+		t.Errorf("expected '/', got '%s'", ret)
+	}
+
+	denied := []func(){
+		func() { om.os_WriteFile(runtime.String("a.txt"), runtime.String("x")) },
+		func() { om.os_Mkdir(runtime.String("e")) },
+		func() { om.os_Remove(runtime.String("a.txt")) },
+		func() { om.os_Rename(runtime.String("a.txt"), runtime.String("c.txt")) },
+		func() { om.os_Exec(runtime.String("echo")) },
+	}
+	for i, fn := range denied {
+		if _, ok := raised(fn).(runtime.SandboxError); !ok {
+			t.Errorf("[%d] - expected a sandbox error", i)
+		}
+	}
+
+	// Without a virtual root, file operations are denied
+	ctx.Sandbox = runtime.NewSandbox(nil)
+	if _, ok := raised(func() { om.os_ReadFile(runtime.String("a.txt")) }).(runtime.SandboxError); !ok {
+		t.Errorf("expected a sandbox error")
+	}
+}
+
+func TestOsSandboxDirFS(t *testing.T) {
+	dir, e := ioutil.TempDir("", "agora-sandbox")
+	if e != nil {
+		panic(e)
+	}
+	defer os.RemoveAll(dir)
+	root, e := runtime.OpenDirFS(dir)
+	if e != nil {
+		panic(e)
+	}
+	defer root.Close()
+	ctx := runtime.NewCtx(nil, nil)
+	ctx.Sandbox = runtime.NewSandbox(root)
+	om := new(OsMod)
+	om.SetCtx(ctx)
+
+	om.os_Mkdir(runtime.String("/d1/d2"))
+	om.os_WriteFile(runtime.String("../../d1/d2/f.txt"), runtime.String("hi"))
+	b, e := ioutil.ReadFile(filepath.Join(dir, "d1", "d2", "f.txt"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if string(b) != "hi" {
+		t.Errorf("expected 'hi', got '%s'", b)
+	}
+	fl := om.os_Open(runtime.String("d1/d2/f.txt"), runtime.String("a+")).(*file)
+	fl.writeLine(runtime.String("!"))
+	fl.closeFile()
+	if ret := om.os_ReadFile(runtime.String("d1/d2/f.txt")); ret.String() != "hi!\n" {
+		t.Errorf("expected 'hi!\\n', got '%s'", ret)
+	}
+	om.os_Rename(runtime.String("d1/d2/f.txt"), runtime.String("g.txt"))
+	om.os_Remove(runtime.String("g.txt"))
+	om.os_RemoveAll(runtime.String("d1"))
+	if fis, e := ioutil.ReadDir(dir); e != nil || len(fis) != 0 {
+		t.Errorf("expected an empty directory, got %v (%v)", fis, e)
+	}
+}
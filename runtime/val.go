@@ -70,14 +70,14 @@ func (ar defaultArithmetic) binaryOp(l, r Val, op string, allowStrings bool) Val
 	} else if lt == "object" {
 		// If left operand is an object with a meta-method
 		lo := l.(Object)
-		if v, ok := lo.callMetaMethod(mm, r, Bool(true)); ok {
+		if v, ok := lo.CallMetaMethod(mm, r, Bool(true)); ok {
 			return v
 		}
 	}
 	// Last chance: if right operand is an object with a meta-method
 	if rt == "object" {
 		ro := r.(Object)
-		if v, ok := ro.callMetaMethod(mm, l, Bool(false)); ok {
+		if v, ok := ro.CallMetaMethod(mm, l, Bool(false)); ok {
 			return v
 		}
 	}
@@ -110,7 +110,7 @@ func (ar defaultArithmetic) Unm(l Val) Val {
 		return Number(-l.Float())
 	} else if lt == "object" {
 		lo := l.(Object)
-		if v, ok := lo.callMetaMethod("__unm"); ok {
+		if v, ok := lo.CallMetaMethod("__unm"); ok {
 			return v
 		}
 	}
@@ -197,14 +197,7 @@ func (dc defaultComparer) Cmp(l, r Val) int {
 		case "nil":
 			return 0
 		case "number":
-			lf, rf := l.Float(), r.Float()
-			if lf == rf {
-				return 0
-			} else if lf < rf {
-				return -1
-			} else {
-				return 1
-			}
+			return cmpFloats(l.Float(), r.Float())
 		case "string":
 			ls, rs := l.String(), r.String()
 			if ls == rs {
@@ -224,35 +217,22 @@ func (dc defaultComparer) Cmp(l, r Val) int {
 				return -1
 			}
 		case "func":
-			lf, rf := l.Native(), r.Native()
-			if lf == rf {
-				return 0
-			} else {
-				// "greater" or "lower" has no sense for funcs, return -1
-				return -1
-			}
+			// "greater" or "lower" has no sense for funcs, use a consistent order
+			return identityCmp(l, r)
 		case "object":
 			// If left has meta method, use left, otherwise right, else compare
 			lo, ro := l.(Object), r.(Object)
-			if v, ok := lo.callMetaMethod("__cmp", r, Bool(true)); ok {
+			if v, ok := lo.CallMetaMethod("__cmp", r, Bool(true)); ok {
 				return int(v.Int())
 			}
-			if v, ok := ro.callMetaMethod("__cmp", l, Bool(false)); ok {
+			if v, ok := ro.CallMetaMethod("__cmp", l, Bool(false)); ok {
 				return int(v.Int())
 			}
-			if lo == ro {
-				return 0
-			} else {
-				// "greater" or "lower" has no sense for objects, return -1
-				return -1
-			}
+			// "greater" or "lower" has no sense for objects, use a consistent order
+			return identityCmp(l, r)
 		case "custom":
-			if l == r {
-				return 0
-			} else {
-				// "greater" or "lower" has no sense for custom vals, return -1
-				return -1
-			}
+			// "greater" or "lower" has no sense for custom vals, use a consistent order
+			return identityCmp(l, r)
 		default:
 			panic(NewTypeError(lt, "", "cmp"))
 		}
@@ -273,11 +253,12 @@ func (dc defaultComparer) Cmp(l, r Val) int {
 			otherv = l
 		}
 		if o != nil {
-			if v, ok := o.callMetaMethod("__cmp", otherv, Bool(isLeft)); ok {
+			if v, ok := o.CallMetaMethod("__cmp", otherv, Bool(isLeft)); ok {
 				return int(v.Int())
 			}
 		}
-		// Else, return arbitrary but constant result
+		// Else, return arbitrary but constant result, the types are ordered nil,
+		// bool, custom, func, number, object, string.
 		return uneqMatrix[lt][rt]
 	}
 }
@@ -290,7 +271,7 @@ type Dumper interface {
 
 // Val is the representation of a value, any value, in the language.
 // The supported value types are the following:
-// * Number (float64)
+// * Number (float64, or Decimal for arbitrary-precision numbers)
 // * String
 // * Bool (bool)
 // * Nil (null)
@@ -313,7 +294,7 @@ func Type(v Val) string {
 	switch v.(type) {
 	case String:
 		return "string"
-	case Number:
+	case Number, Decimal:
 		return "number"
 	case Bool:
 		return "bool"
@@ -330,6 +311,16 @@ func Type(v Val) string {
 	}
 }
 
+// Compare two numbers, as the default comparer does.
+func cmpFloats(lf, rf float64) int {
+	if lf == rf {
+		return 0
+	} else if lf < rf {
+		return -1
+	}
+	return 1
+}
+
 // Helper function to pretty-print a value for debugging purpose.
 func dumpVal(v Val) string {
 	if dmp, ok := v.(Dumper); ok {